@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// AccessLogEntry describes a served request for an AccessLogger.
+type AccessLogEntry struct {
+	Time time.Time
+	// URI is the unmodified request target, as sent by the client
+	URI    string
+	Method string
+	Path   string
+	// Pattern is the pattern of the route that served the request, including group prefixes
+	Pattern   string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	RequestID string
+	IP        string
+	UserAgent string
+	Referer   string
+	// Slow is set when Duration is over Options.SlowRequestThreshold
+	Slow bool
+	// TraceID and SpanID come from the traceparent or B3 headers, see TraceFromContext
+	TraceID string
+	SpanID  string
+	// RequestBody is the start of the request body of failed requests, see Options.LogBodyOnError
+	RequestBody string
+}
+
+// AccessLogger writes the LogRequests line of every request that isn't skipped.
+type AccessLogger interface {
+	LogAccess(e AccessLogEntry)
+}
+
+// AccessLogFormat selects a built-in AccessLogger.
+type AccessLogFormat string
+
+const (
+	// AccessLogSlog logs through the server logger, see Options.RequestLogFields.
+	AccessLogSlog AccessLogFormat = ""
+	// AccessLogCombined writes the Apache combined log format, see CombinedFormat.
+	AccessLogCombined AccessLogFormat = "combined"
+	// AccessLogJSON writes one JSON object per request, see JSONFormat.
+	AccessLogJSON AccessLogFormat = "json"
+)
+
+// AccessLogOptions configures the request log. Setting Options.AccessLog turns on LogRequests.
+type AccessLogOptions struct {
+	Format AccessLogFormat
+	// Output is where the combined and JSON formats are written. Defaults to stdout.
+	Output io.Writer
+	// Logger replaces the built-in formats.
+	Logger AccessLogger
+}
+
+// accessLogger returns the AccessLogger opts selects, falling back to the server logger.
+func (s *Server) accessLogger(opts *AccessLogOptions) AccessLogger {
+	if opts == nil {
+		return slogAccessLogger{s}
+	}
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.Output != nil {
+		out = opts.Output
+	}
+
+	switch opts.Format {
+	case AccessLogCombined:
+		return NewCombinedFormat(out)
+	case AccessLogJSON:
+		return NewJSONFormat(out)
+	default:
+		return slogAccessLogger{s}
+	}
+}
+
+// accessLogEntry collects the access log details of r once it has been served through rw.
+func accessLogEntry(rw *ResponseWriter, r *http.Request, start time.Time) AccessLogEntry {
+	ip, pattern, body := remoteIP(r.RemoteAddr), "", ""
+	var trace TraceContext
+	if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+		if info.clientIP != "" {
+			ip = info.clientIP
+		}
+		pattern, trace = info.pattern, info.trace
+		if info.body != nil {
+			body = info.body.String()
+		}
+	}
+
+	return AccessLogEntry{
+		Time:      start,
+		URI:       r.RequestURI,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Pattern:   pattern,
+		Proto:     r.Proto,
+		Status:    rw.statusCode,
+		Bytes:     rw.bytes,
+		Duration:  time.Since(start),
+		RequestID: rw.Header().Get(RequestIDHeaderKey),
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+
+		TraceID:     trace.TraceID,
+		SpanID:      trace.SpanID,
+		RequestBody: body,
+	}
+}
+
+// slogAccessLogger is the default AccessLogger. It logs a record with the request URI as
+// message through Options.RequestLogger, or the server logger, at the level requestLogLevel picks.
+type slogAccessLogger struct {
+	s *Server
+}
+
+func (l slogAccessLogger) LogAccess(e AccessLogEntry) {
+	attrs := []any{"method", e.Method, "path", e.Path, "status", e.Status, "duration", e.Duration}
+	attrs = append(attrs, l.s.requestLogFields(e)...)
+	if e.TraceID != "" {
+		attrs = append(attrs, "trace_id", e.TraceID, "span_id", e.SpanID)
+	}
+	if e.RequestBody != "" {
+		attrs = append(attrs, "body", e.RequestBody)
+	}
+	if e.Slow {
+		attrs = append(attrs, "slow", true)
+	}
+
+	logger := l.s.reqLogger
+	if logger == nil {
+		logger = l.s.logger()
+	}
+	logger.Log(context.Background(), l.s.requestLogLevel(e), e.URI, attrs...)
+}
+
+// requestLogLevel returns the level of the request log line of e: Options.RequestLogLevel,
+// raised to Warn for slow requests and, with Options.RequestLogLevelByStatus, by status class.
+func (s *Server) requestLogLevel(e AccessLogEntry) slog.Level {
+	level := s.reqLogLevel
+	if s.levelByCode {
+		switch {
+		case e.Status >= http.StatusInternalServerError:
+			level = max(level, slog.LevelError)
+		case e.Status >= http.StatusBadRequest:
+			level = max(level, slog.LevelWarn)
+		}
+	}
+	if e.Slow {
+		level = max(level, slog.LevelWarn)
+	}
+	return level
+}
+
+// accessLogBufs holds the line buffers of CombinedFormat and JSONFormat.
+var accessLogBufs = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// lineWriter writes whole lines to w, one Write call per line.
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lineWriter) writeLine(format func(b []byte) []byte) {
+	bp := accessLogBufs.Get().(*[]byte)
+	b := format((*bp)[:0])
+
+	lw.mu.Lock()
+	lw.w.Write(b)
+	lw.mu.Unlock()
+
+	*bp = b
+	accessLogBufs.Put(bp)
+}
+
+// CombinedFormat is an AccessLogger writing the Apache combined log format:
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0"
+type CombinedFormat struct {
+	lw lineWriter
+}
+
+// NewCombinedFormat returns a CombinedFormat writing to w.
+func NewCombinedFormat(w io.Writer) *CombinedFormat {
+	return &CombinedFormat{lw: lineWriter{w: w}}
+}
+
+func (f *CombinedFormat) LogAccess(e AccessLogEntry) {
+	f.lw.writeLine(func(b []byte) []byte {
+		b = appendOrDash(b, e.IP)
+		b = append(b, " - - ["...)
+		b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+		b = append(b, `] "`...)
+		b = appendApacheEscaped(b, e.Method)
+		b = append(b, ' ')
+		b = appendApacheEscaped(b, e.URI)
+		b = append(b, ' ')
+		b = appendApacheEscaped(b, e.Proto)
+		b = append(b, `" `...)
+		b = strconv.AppendInt(b, int64(e.Status), 10)
+		b = append(b, ' ')
+		if e.Bytes > 0 {
+			b = strconv.AppendInt(b, e.Bytes, 10)
+		} else {
+			b = append(b, '-')
+		}
+		b = append(b, ` "`...)
+		b = appendApacheEscaped(b, orDash(e.Referer))
+		b = append(b, `" "`...)
+		b = appendApacheEscaped(b, orDash(e.UserAgent))
+		return append(b, "\"\n"...)
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func appendOrDash(b []byte, s string) []byte {
+	return append(b, orDash(s)...)
+}
+
+// appendApacheEscaped escapes quotes, backslashes and non-printable bytes the way Apache does.
+func appendApacheEscaped(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// JSONFormat is an AccessLogger writing one compact JSON object per request, independent of
+// the application log handler. Empty pattern, request ID, user agent, referer, trace IDs and
+// body are left out.
+type JSONFormat struct {
+	lw lineWriter
+}
+
+// NewJSONFormat returns a JSONFormat writing to w.
+func NewJSONFormat(w io.Writer) *JSONFormat {
+	return &JSONFormat{lw: lineWriter{w: w}}
+}
+
+func (f *JSONFormat) LogAccess(e AccessLogEntry) {
+	f.lw.writeLine(func(b []byte) []byte {
+		b = append(b, `{"time":"`...)
+		b = e.Time.AppendFormat(b, time.RFC3339Nano)
+		b = append(b, `","method":`...)
+		b = appendJSONString(b, e.Method)
+		b = append(b, `,"uri":`...)
+		b = appendJSONString(b, e.URI)
+		b = append(b, `,"path":`...)
+		b = appendJSONString(b, e.Path)
+		b = append(b, `,"proto":`...)
+		b = appendJSONString(b, e.Proto)
+		b = append(b, `,"status":`...)
+		b = strconv.AppendInt(b, int64(e.Status), 10)
+		b = append(b, `,"bytes":`...)
+		b = strconv.AppendInt(b, e.Bytes, 10)
+		b = append(b, `,"duration":`...)
+		b = strconv.AppendInt(b, int64(e.Duration), 10)
+		b = append(b, `,"ip":`...)
+		b = appendJSONString(b, e.IP)
+		for _, kv := range [...]struct{ key, val string }{
+			{`,"pattern":`, e.Pattern},
+			{`,"reqID":`, e.RequestID},
+			{`,"userAgent":`, e.UserAgent},
+			{`,"referer":`, e.Referer},
+			{`,"trace_id":`, e.TraceID},
+			{`,"span_id":`, e.SpanID},
+			{`,"body":`, e.RequestBody},
+		} {
+			if kv.val != "" {
+				b = append(b, kv.key...)
+				b = appendJSONString(b, kv.val)
+			}
+		}
+		if e.Slow {
+			b = append(b, `,"slow":true`...)
+		}
+		return append(b, "}\n"...)
+	})
+}
+
+// appendJSONString appends s as a JSON string. Invalid UTF-8 is replaced with U+FFFD.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `�`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAccessLogEntry = AccessLogEntry{
+	Time:      time.Date(2025, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+	URI:       `/search?q="go"`,
+	Method:    http.MethodGet,
+	Path:      "/search",
+	Proto:     "HTTP/1.1",
+	Status:    http.StatusOK,
+	Bytes:     2326,
+	Duration:  1500 * time.Microsecond,
+	RequestID: "req-1",
+	IP:        "203.0.113.9",
+	UserAgent: "Mozilla/5.0 \x01",
+}
+
+func TestCombinedFormat(t *testing.T) {
+	out := new(bytes.Buffer)
+	NewCombinedFormat(out).LogAccess(testAccessLogEntry)
+
+	assert.Equal(t,
+		`203.0.113.9 - - [10/Oct/2025:13:55:36 -0700] "GET /search?q=\"go\" HTTP/1.1" 200 2326 "-" "Mozilla/5.0 \x01"`+"\n",
+		out.String())
+}
+
+func TestJSONFormat(t *testing.T) {
+	out := new(bytes.Buffer)
+	NewJSONFormat(out).LogAccess(testAccessLogEntry)
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+	assert.Equal(t, map[string]any{
+		"time":      "2025-10-10T13:55:36-07:00",
+		"method":    "GET",
+		"uri":       `/search?q="go"`,
+		"path":      "/search",
+		"proto":     "HTTP/1.1",
+		"status":    float64(200),
+		"bytes":     float64(2326),
+		"duration":  float64(1500000),
+		"ip":        "203.0.113.9",
+		"reqID":     "req-1",
+		"userAgent": "Mozilla/5.0 \x01",
+	}, entry)
+
+	assert.Equal(t, `"a\u0009\"\\ü�"`, string(appendJSONString(nil, "a\t\"\\ü\xff")))
+}
+
+func TestAccessLogFormatsDontAllocate(t *testing.T) {
+	for name, l := range map[string]AccessLogger{
+		"combined": NewCombinedFormat(io.Discard),
+		"json":     NewJSONFormat(io.Discard),
+	} {
+		l.LogAccess(testAccessLogEntry)
+		allocs := testing.AllocsPerRun(100, func() { l.LogAccess(testAccessLogEntry) })
+		assert.Zero(t, allocs, name)
+	}
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	out := new(bytes.Buffer)
+	srv, err := Init(Options{AccessLog: &AccessLogOptions{Format: AccessLogCombined, Output: out}})
+	require.NoError(t, err)
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "hello")
+	})
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	req, _ := http.NewRequest(http.MethodGet, tSrv.URL+"/hello", nil)
+	req.Header.Set("User-Agent", "probe/1.0")
+	resp, err := tSrv.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	tSrv.Close()
+
+	assert.Regexp(t, `^127\.0\.0\.1 - - \[[^\]]+\] "GET /hello HTTP/1\.1" 200 5 "-" "probe/1\.0"\n$`, out.String())
+}
+
+func BenchmarkCombinedFormat(b *testing.B) {
+	l := NewCombinedFormat(io.Discard)
+	b.ReportAllocs()
+	for b.Loop() {
+		l.LogAccess(testAccessLogEntry)
+	}
+}
+
+func BenchmarkJSONFormat(b *testing.B) {
+	l := NewJSONFormat(io.Discard)
+	b.ReportAllocs()
+	for b.Loop() {
+		l.LogAccess(testAccessLogEntry)
+	}
+}
+
+// recordHandler keeps the records it handles.
+type recordHandler struct {
+	level   slog.Level
+	records *[]slog.Record
+}
+
+func (h recordHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= h.level }
+func (h recordHandler) WithAttrs([]slog.Attr) slog.Handler               { return h }
+func (h recordHandler) WithGroup(string) slog.Handler                    { return h }
+
+func (h recordHandler) Handle(_ context.Context, r slog.Record) error {
+	*h.records = append(*h.records, r)
+	return nil
+}
+
+func TestServer_RequestLogLevel(t *testing.T) {
+	statusHandler := func(ctx Context) error {
+		code, _ := strconv.Atoi(ctx.Param("code"))
+		return ctx.Status(code)
+	}
+	serve := func(t *testing.T, opts Options, codes ...int) []slog.Record {
+		var records []slog.Record
+		opts.LogRequests = true
+		if opts.RequestLogger == nil {
+			opts.RequestLogger = slog.New(recordHandler{level: slog.LevelDebug, records: &records})
+		}
+		srv, err := Init(opts)
+		require.NoError(t, err)
+		srv.HandleFunc("/status", statusHandler)
+		require.NoError(t, srv.Route())
+
+		for _, code := range codes {
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status?code="+strconv.Itoa(code), nil))
+			require.Equal(t, code, rec.Code)
+		}
+		return records
+	}
+	levels := func(records []slog.Record) []slog.Level {
+		var levels []slog.Level
+		for _, r := range records {
+			levels = append(levels, r.Level)
+		}
+		return levels
+	}
+
+	t.Run("default", func(t *testing.T) {
+		records := serve(t, Options{}, 200, 404, 500)
+		assert.Equal(t, []slog.Level{slog.LevelInfo, slog.LevelInfo, slog.LevelInfo}, levels(records))
+	})
+
+	t.Run("by status", func(t *testing.T) {
+		records := serve(t, Options{RequestLogLevelByStatus: true}, 200, 302, 404, 500, 503)
+		assert.Equal(t, []slog.Level{slog.LevelInfo, slog.LevelInfo, slog.LevelWarn, slog.LevelError, slog.LevelError}, levels(records))
+	})
+
+	t.Run("custom level", func(t *testing.T) {
+		records := serve(t, Options{RequestLogLevel: slog.LevelDebug, RequestLogLevelByStatus: true}, 200, 400, 500)
+		assert.Equal(t, []slog.Level{slog.LevelDebug, slog.LevelWarn, slog.LevelError}, levels(records))
+	})
+
+	t.Run("dedicated logger", func(t *testing.T) {
+		var appRecords, accessRecords []slog.Record
+		records := serve(t, Options{
+			Log:             slog.New(recordHandler{level: slog.LevelWarn, records: &appRecords}),
+			RequestLogger:   slog.New(recordHandler{level: slog.LevelInfo, records: &accessRecords}),
+			RequestLogLevel: slog.LevelInfo,
+		}, 200, 404)
+		assert.Empty(t, records)
+		assert.Empty(t, appRecords, "the app logger is at Warn")
+		assert.Equal(t, []slog.Level{slog.LevelInfo, slog.LevelInfo}, levels(accessRecords))
+	})
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultPublicPrefix is the URL path the Public directory is served under.
+const DefaultPublicPrefix = "/public"
+
+// AssetManifest is the bundler manifest the asset template function reads from the Public
+// directory. It maps logical paths to hashed file names, either directly
+// ({"app.css": "app.3f2a1b.css"}) or in a "file" field as Vite writes it.
+const AssetManifest = "manifest.json"
+
+// assets maps the logical paths of the public files to versioned URLs for the asset template
+// function: the hashed file name from AssetManifest when it lists the path, otherwise the path
+// with ?v= and a hash of the file content. Files that can't be found are cached as their path.
+type assets struct {
+	prefix string
+	// debug reads the manifest and hashes the files on every call
+	debug bool
+	srv   *Server
+
+	// mu guards the maps only, the files are read without it
+	mu       sync.Mutex
+	manifest map[string]string
+	urls     map[string]string
+}
+
+func newAssets(srv *Server, prefix string, debug bool) *assets {
+	return &assets{prefix: prefix, debug: debug, srv: srv, urls: make(map[string]string)}
+}
+
+// url returns the versioned URL of the public file at p, which may start with the public
+// prefix. p is returned unchanged, and a warning logged once, when the file can't be found.
+func (a *assets) url(p string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(p, a.prefix+"/"), "/")
+	fsys := os.DirFS(a.srv.publicDir())
+	if a.debug {
+		return a.resolve(fsys, p, name, a.readManifest(fsys))
+	}
+
+	a.mu.Lock()
+	u, ok := a.urls[name]
+	manifest := a.manifest
+	a.mu.Unlock()
+	if ok {
+		return u
+	}
+
+	if manifest == nil {
+		manifest = a.readManifest(fsys)
+		a.mu.Lock()
+		if a.manifest == nil {
+			a.manifest = manifest
+		}
+		manifest = a.manifest
+		a.mu.Unlock()
+	}
+
+	u = a.resolve(fsys, p, name, manifest)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cached, ok := a.urls[name]; ok {
+		return cached
+	}
+	a.urls[name] = u
+	return u
+}
+
+// readManifest reads AssetManifest, logging a warning when it can't be read.
+func (a *assets) readManifest(fsys fs.FS) map[string]string {
+	manifest, err := readAssetManifest(fsys)
+	if err != nil {
+		a.srv.logger().Warn("asset manifest", "err", err)
+	}
+	return manifest
+}
+
+// resolve returns the versioned URL of the public file name, or p when it can't be found.
+func (a *assets) resolve(fsys fs.FS, p, name string, manifest map[string]string) string {
+	if file, ok := manifest[name]; ok {
+		return a.prefix + "/" + strings.TrimPrefix(file, "/")
+	}
+	sum, err := hashFile(fsys, name)
+	if err != nil {
+		a.srv.logger().Warn("asset not found", "path", p, "err", err)
+		return p
+	}
+	return a.prefix + "/" + name + "?v=" + sum
+}
+
+// readAssetManifest reads AssetManifest from fsys. A missing manifest is an empty one.
+func readAssetManifest(fsys fs.FS) (map[string]string, error) {
+	manifest := make(map[string]string)
+	data, err := fs.ReadFile(fsys, AssetManifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return manifest, err
+	}
+	for name, raw := range entries {
+		var file string
+		if json.Unmarshal(raw, &file) != nil {
+			var entry struct {
+				File string `json:"file"`
+			}
+			if json.Unmarshal(raw, &entry) != nil || entry.File == "" {
+				continue
+			}
+			file = entry.File
+		}
+		manifest[strings.TrimPrefix(name, "/")] = file
+	}
+	return manifest, nil
+}
+
+// hashFile returns the first 12 hex digits of the SHA-256 of the file at name.
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(path.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// AssetURL returns the versioned URL of the public file at p, as the asset template function
+// does, or p unchanged when the file can't be found.
+func (s *Server) AssetURL(p string) string {
+	return s.assets.url(p)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_AssetFunc(t *testing.T) {
+	public := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(public, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(public, name), []byte(content), 0o644))
+	}
+	write("css/app.css", "body{}")
+	write(AssetManifest, `{"app.js": "app.3f2a1b.js", "src/main.ts": {"file": "assets/main.9c8d.js"}}`)
+	sum := sha256.Sum256([]byte("body{}"))
+	version := hex.EncodeToString(sum[:])[:12]
+
+	newServer := func(debug bool) (*Server, *bytes.Buffer) {
+		var logs bytes.Buffer
+		tmpl, err := InitTemplates(TemplateOptions{Debug: debug, FS: fstest.MapFS{
+			"page.tmpl": {Data: []byte(`{{asset "css/app.css"}}|{{asset "/static/app.js"}}|{{asset "src/main.ts"}}|{{asset "missing.css"}}`)},
+		}})
+		require.NoError(t, err)
+		srv, err := Init(Options{
+			Public:       public,
+			PublicPrefix: "/static/",
+			Templates:    tmpl,
+			Log:          slog.New(slog.NewTextHandler(&logs, nil)),
+		})
+		require.NoError(t, err)
+		srv.HandleFunc("GET /page", func(ctx Context) error {
+			return ctx.Render(http.StatusOK, RenderOpt{Template: "page"})
+		})
+		require.NoError(t, srv.Route())
+		return srv, &logs
+	}
+	render := func(srv *Server) string {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	srv, logs := newServer(false)
+	assert.Equal(t, "/static/css/app.css?v="+version+"|/static/app.3f2a1b.js|/static/assets/main.9c8d.js|missing.css", render(srv))
+	assert.Contains(t, logs.String(), "asset not found")
+	assert.Contains(t, logs.String(), "path=missing.css")
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/static/css/app.css", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "body{}", rec.Body.String())
+
+	write("css/app.css", "body{color:red}")
+	logs.Reset()
+	assert.True(t, strings.HasPrefix(render(srv), "/static/css/app.css?v="+version+"|"), "cached")
+	assert.NotContains(t, logs.String(), "asset not found", "the missing file is cached too")
+	assert.Equal(t, "/static/app.3f2a1b.js", srv.AssetURL("app.js"))
+
+	debugSrv, _ := newServer(true)
+	sum = sha256.Sum256([]byte("body{color:red}"))
+	assert.True(t, strings.HasPrefix(render(debugSrv), "/static/css/app.css?v="+hex.EncodeToString(sum[:])[:12]+"|"))
+	write("css/app.css", "body{color:blue}")
+	sum = sha256.Sum256([]byte("body{color:blue}"))
+	assert.True(t, strings.HasPrefix(render(debugSrv), "/static/css/app.css?v="+hex.EncodeToString(sum[:])[:12]+"|"), "not cached in Debug")
+}
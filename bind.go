@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrBindTarget = errors.New("bind target must be a non-nil pointer to a struct")
+
+// ErrUnknownField is wrapped by the error strict JSON binding returns for a field the target doesn't have.
+var ErrUnknownField = errors.New("unknown field")
+
+// BindError reports a value that couldn't be converted to its field's type.
+type BindError struct {
+	Field string
+	Err   error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("bind %s: %v", e.Field, e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// decodeJSON decodes the JSON document in body into dst. In strict mode fields of the document
+// that dst doesn't have are rejected. Malformed or unexpected input is a 400 HTTPError, wrapping
+// a BindError when the problem is tied to a field.
+func decodeJSON(body io.Reader, dst any, strict bool) error {
+	dec := json.NewDecoder(body)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(dst)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var invalidErr *json.InvalidUnmarshalError
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &invalidErr):
+		return ErrBindTarget
+	case errors.As(err, &maxErr):
+		return NewHTTPError(http.StatusRequestEntityTooLarge, err)
+	case errors.As(err, &typeErr):
+		return NewHTTPError(http.StatusBadRequest, &BindError{Field: typeErr.Field, Err: err},
+			fmt.Sprintf("invalid value for field %q", typeErr.Field))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return NewHTTPError(http.StatusBadRequest, &BindError{Field: field, Err: fmt.Errorf("%w: %w", ErrUnknownField, err)},
+			fmt.Sprintf("unknown field %q", field))
+	case errors.Is(err, io.EOF):
+		return NewHTTPError(http.StatusBadRequest, err, "empty request body")
+	default:
+		return NewHTTPError(http.StatusBadRequest, err, "invalid JSON")
+	}
+}
+
+// parseForm parses the body of r as a form, keeping up to maxMemory bytes of multipart file
+// parts in memory and spilling the rest to temporary files. Malformed forms are a 400 HTTPError.
+func parseForm(r *http.Request, maxMemory int64) error {
+	if r.Form != nil && (r.MultipartForm != nil || !isMultipart(r)) {
+		return nil
+	}
+
+	var err error
+	if isMultipart(r) {
+		err = r.ParseMultipartForm(maxMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err == nil {
+		return nil
+	}
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return NewHTTPError(http.StatusRequestEntityTooLarge, err)
+	}
+	return NewHTTPError(http.StatusBadRequest, err, "invalid form")
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	return mediaType == "multipart/form-data"
+}
+
+// bindValues copies values into the fields of the struct dst points to. Fields are matched by the
+// given struct tag, falling back to the field name. A tag of "-" skips the field.
+// Slice fields collect every value for a key; with the "comma" tag option
+// (e.g. `query:"tag,comma"`) each value is also split on commas.
+func bindValues(values url.Values, tag string, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrBindTarget
+	}
+
+	return bindStruct(values, tag, rv.Elem())
+}
+
+func bindStruct(values url.Values, tag string, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		fv := rv.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := bindStruct(values, tag, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		vals, ok := values[name]
+		if !ok || len(vals) == 0 {
+			continue
+		}
+
+		if fv.Kind() != reflect.Slice {
+			if err := setValue(fv, vals[0]); err != nil {
+				return &BindError{Field: name, Err: err}
+			}
+			continue
+		}
+
+		if hasTagOption(opts, "comma") {
+			var split []string
+			for _, v := range vals {
+				split = append(split, strings.Split(v, ",")...)
+			}
+			vals = split
+		}
+
+		slice := reflect.MakeSlice(fv.Type(), 0, len(vals))
+		for _, v := range vals {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := setValue(elem, strings.TrimSpace(v)); err != nil {
+				return &BindError{Field: name, Err: err}
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		fv.Set(slice)
+	}
+
+	return nil
+}
+
+func hasTagOption(opts string, option string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+
+	return nil
+}
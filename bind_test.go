@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFilter struct {
+	Tags    []string `query:"tag"`
+	IDs     []int    `query:"id,comma"`
+	Sizes   []string `query:"size"`
+	Page    int      `query:"page"`
+	Active  bool     `query:"active"`
+	Ignored string   `query:"-"`
+}
+
+func TestBindValues(t *testing.T) {
+	t.Run("repeated keys", func(t *testing.T) {
+		values, err := url.ParseQuery("tag=a&tag=b&tag=c&page=2&active=true&Ignored=x")
+		require.NoError(t, err)
+
+		var f testFilter
+		require.NoError(t, bindValues(values, "query", &f))
+		assert.Equal(t, []string{"a", "b", "c"}, f.Tags)
+		assert.Equal(t, 2, f.Page)
+		assert.True(t, f.Active)
+		assert.Empty(t, f.Ignored)
+	})
+
+	t.Run("comma separated values", func(t *testing.T) {
+		values, err := url.ParseQuery("id=1,2&id=3&size=s,m")
+		require.NoError(t, err)
+
+		var f testFilter
+		require.NoError(t, bindValues(values, "query", &f))
+		assert.Equal(t, []int{1, 2, 3}, f.IDs)
+		// without the comma option values are kept as sent
+		assert.Equal(t, []string{"s,m"}, f.Sizes)
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		values, err := url.ParseQuery("id=1,x")
+		require.NoError(t, err)
+
+		var f testFilter
+		assert.Error(t, bindValues(values, "query", &f))
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		var f testFilter
+		assert.ErrorIs(t, bindValues(url.Values{}, "query", f), ErrBindTarget)
+	})
+}
+
+type testItem struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	const extra = `{"name":"widget","count":2,"colour":"red"}`
+
+	t.Run("lenient ignores unknown fields", func(t *testing.T) {
+		var item testItem
+		require.NoError(t, decodeJSON(strings.NewReader(extra), &item, false))
+		assert.Equal(t, testItem{Name: "widget", Count: 2}, item)
+	})
+
+	t.Run("strict rejects unknown fields", func(t *testing.T) {
+		var item testItem
+		err := decodeJSON(strings.NewReader(extra), &item, true)
+
+		var httpErr *HTTPError
+		require.ErrorAs(t, err, &httpErr)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+		assert.Equal(t, `unknown field "colour"`, httpErr.Message)
+		assert.ErrorIs(t, err, ErrUnknownField)
+
+		var bindErr *BindError
+		require.ErrorAs(t, err, &bindErr)
+		assert.Equal(t, "colour", bindErr.Field)
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		var item testItem
+		for body, msg := range map[string]string{
+			``:                 "empty request body",
+			`{"name":`:         "invalid JSON",
+			`{"count":"many"}`: `invalid value for field "count"`,
+		} {
+			var httpErr *HTTPError
+			require.ErrorAs(t, decodeJSON(strings.NewReader(body), &item, true), &httpErr, body)
+			assert.Equal(t, http.StatusBadRequest, httpErr.Code, body)
+			assert.Equal(t, msg, httpErr.Message, body)
+		}
+
+		assert.ErrorIs(t, decodeJSON(strings.NewReader(`{}`), item, false), ErrBindTarget)
+	})
+}
+
+func TestContext_MultipartForm(t *testing.T) {
+	upload := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("title", "report"))
+	require.NoError(t, mw.WriteField("pages", "12"))
+	fw, err := mw.CreateFormFile("file", "report.bin")
+	require.NoError(t, err)
+	_, err = fw.Write(upload)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	srv, err := Init(Options{MaxMultipartMemory: 1024})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /upload", func(ctx Context) error {
+		var form struct {
+			Title string `form:"title"`
+			Pages int    `form:"pages"`
+		}
+		require.NoError(t, ctx.BindForm(&form))
+		assert.Equal(t, "report", form.Title)
+		assert.Equal(t, 12, form.Pages)
+		assert.Equal(t, "report", ctx.Param("title"))
+
+		f, hdr, err := ctx.FormFile("file")
+		require.NoError(t, err)
+		defer f.Close()
+		_, spilled := f.(*os.File)
+		assert.True(t, spilled, "parts over MaxMultipartMemory are kept in temporary files")
+		assert.EqualValues(t, len(upload), hdr.Size)
+		got, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, upload, got)
+
+		ctx.Request().MultipartForm.RemoveAll()
+		return ctx.String(http.StatusOK, "ok")
+	})
+	require.NoError(t, srv.Route())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set(HeaderContentType, mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("--broken"))
+	req.Header.Set(HeaderContentType, "multipart/form-data; boundary=x")
+	var httpErr *HTTPError
+	require.ErrorAs(t, parseForm(req, 1024), &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+}
+
+func TestHandle2(t *testing.T) {
+	type createItem struct {
+		Name  string `json:"name" form:"name"`
+		Count int    `json:"count" form:"count"`
+	}
+	type listItems struct {
+		Page int `query:"page"`
+	}
+
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /items", Handle2(func(ctx Context, in createItem) (testItem, error) {
+		if in.Name == "" {
+			return testItem{}, NewHTTPError(http.StatusUnprocessableEntity, nil, "name is required")
+		}
+		return testItem{Name: in.Name, Count: in.Count * 2}, nil
+	}))
+	srv.Group("/api", "", func(srv *Server) {
+		srv.HandleFunc("GET /items", Handle2(func(ctx Context, in listItems) ([]string, error) {
+			return []string{fmt.Sprint("page ", in.Page)}, nil
+		}))
+		srv.HandleFunc("GET /ping", Handle2(func(ctx Context, _ struct{}) (string, error) {
+			return "pong", nil
+		}))
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(body))
+		req.Header.Set(HeaderContentType, contentType)
+		return serve(req)
+	}
+
+	rec := post(ContentTypeJSON, `{"name":"widget","count":2}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeJSON, rec.Header().Get(HeaderContentType))
+	assert.JSONEq(t, `{"Status":200,"Data":{"name":"widget","count":4},"ErrorType":"","Error":null}`, rec.Body.String())
+
+	rec = post("application/x-www-form-urlencoded", "name=gadget&count=3")
+	assert.JSONEq(t, `{"Status":200,"Data":{"name":"gadget","count":6},"ErrorType":"","Error":null}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, post(ContentTypeJSON, `{"count":"many"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/x-www-form-urlencoded", "count=many").Code)
+	rec = post(ContentTypeJSON, `{"count":1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, "name is required\n", rec.Body.String())
+
+	rec = serve(httptest.NewRequest(http.MethodGet, "/api/items?page=3", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"Status":200,"Data":["page 3"],"ErrorType":"","Error":null}`, rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, serve(httptest.NewRequest(http.MethodGet, "/api/items?page=x", nil)).Code)
+
+	rec = serve(httptest.NewRequest(http.MethodGet, "/api/ping", nil))
+	assert.JSONEq(t, `{"Status":200,"Data":"pong","ErrorType":"","Error":null}`, rec.Body.String())
+}
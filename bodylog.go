@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultBodyLogMaxBytes is how much of a request body Options.LogBodyOnError keeps by default.
+const DefaultBodyLogMaxBytes = 2048
+
+// DefaultBodyLogContentTypes are the request content types Options.LogBodyOnError captures by default.
+var DefaultBodyLogContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "text/plain"}
+
+// DefaultBodyLogRedactKeys are the JSON keys and form fields whose values are hidden by default.
+var DefaultBodyLogRedactKeys = []string{
+	"password", "secret", "token", "access_token", "refresh_token", "api_key", "apikey",
+}
+
+// BodyLogOptions configures Options.LogBodyOnError.
+type BodyLogOptions struct {
+	// MaxBytes caps the bytes kept of each body. Defaults to DefaultBodyLogMaxBytes.
+	MaxBytes int
+	// ContentTypes lists the media types that are captured, "text/*" matches every text type.
+	// Defaults to DefaultBodyLogContentTypes.
+	ContentTypes []string
+	// RedactKeys lists the JSON object keys, at any depth, and form fields whose values are
+	// replaced. Keys are matched case-insensitively. Defaults to DefaultBodyLogRedactKeys.
+	RedactKeys []string
+}
+
+// bodyLog captures request bodies so they can be logged when the request fails.
+type bodyLog struct {
+	max          int
+	contentTypes []string
+	redact       map[string]bool
+}
+
+func newBodyLog(opts *BodyLogOptions) *bodyLog {
+	if opts == nil {
+		return nil
+	}
+
+	l := &bodyLog{max: opts.MaxBytes, contentTypes: opts.ContentTypes}
+	if l.max <= 0 {
+		l.max = DefaultBodyLogMaxBytes
+	}
+	if l.contentTypes == nil {
+		l.contentTypes = DefaultBodyLogContentTypes
+	}
+
+	keys := opts.RedactKeys
+	if keys == nil {
+		keys = DefaultBodyLogRedactKeys
+	}
+	l.redact = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		l.redact[strings.ToLower(k)] = true
+	}
+	return l
+}
+
+// capture buffers the start of the body of r in its requestInfo, when its content type is
+// allowed. The handler still reads the whole body.
+func (l *bodyLog) capture(r *http.Request) {
+	info, ok := FromContext(r.Context(), requestInfoKey)
+	if !ok {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	if err != nil || !l.allowed(mediaType) {
+		return
+	}
+
+	prefix, truncated, err := peekBody(r, l.max)
+	if err != nil {
+		requestLogger(r).Warn("request body log: reading body", "err", err)
+	}
+	if len(prefix) > 0 {
+		info.body = &capturedBody{log: l, mediaType: mediaType, data: prefix, truncated: truncated}
+	}
+}
+
+func (l *bodyLog) allowed(mediaType string) bool {
+	for _, ct := range l.contentTypes {
+		ct = strings.ToLower(ct)
+		if ct == mediaType || strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, ct[:len(ct)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// capturedBody is the start of a request body kept by Options.LogBodyOnError.
+type capturedBody struct {
+	log       *bodyLog
+	mediaType string
+	data      []byte
+	truncated bool
+}
+
+// String returns the body for the log, with the values of redacted keys replaced. JSON that
+// can't be parsed, usually because it was truncated, is kept up to the first error.
+func (b *capturedBody) String() string {
+	var s string
+	switch {
+	case b.mediaType == ContentTypeJSON || strings.HasSuffix(b.mediaType, "+json"):
+		var complete bool
+		s, complete = redactJSON(b.data, b.log.redact)
+		if !complete && !b.truncated {
+			s += "…(invalid JSON)"
+		}
+	case b.mediaType == "application/x-www-form-urlencoded":
+		s = redactForm(string(b.data), b.log.redact)
+	default:
+		s = string(b.data)
+	}
+
+	if b.truncated {
+		s += "…(truncated)"
+	}
+	return s
+}
+
+func (b *capturedBody) LogValue() slog.Value {
+	return slog.StringValue(b.String())
+}
+
+// requestBodyAttrs returns the captured body of r as log attributes, if it has one.
+func requestBodyAttrs(r *http.Request) []any {
+	if info, ok := FromContext(r.Context(), requestInfoKey); ok && info.body != nil {
+		return []any{"body", info.body}
+	}
+	return nil
+}
+
+// redactedValue replaces the values of redacted keys.
+const redactedValue = "[REDACTED]"
+
+// redactJSON re-encodes the JSON in b compactly, replacing the values of keys in redact. It stops
+// at the first syntax error, or the end of a truncated document, and reports whether it got to
+// the end of b.
+func redactJSON(b []byte, redact map[string]bool) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	type container struct {
+		object bool
+		// n counts the keys and values written so far
+		n int
+	}
+	var (
+		out       []byte
+		stack     []container
+		redactVal bool
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return string(out), true
+		}
+		if err != nil {
+			return string(out), false
+		}
+
+		isKey := false
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+		} else if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			isKey = top.object && top.n%2 == 0
+			switch {
+			case top.object && !isKey:
+				out = append(out, ':')
+			case top.n > 0:
+				out = append(out, ',')
+			}
+			top.n++
+		} else if len(out) > 0 {
+			out = append(out, ' ')
+		}
+
+		if redactVal && !isKey {
+			redactVal = false
+			out = appendJSONString(out, redactedValue)
+			if delim, ok := tok.(json.Delim); ok && (delim == '{' || delim == '[') {
+				if !skipJSONValue(dec) {
+					return string(out), false
+				}
+			}
+			continue
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			out = append(out, byte(v))
+			if v == '{' || v == '[' {
+				stack = append(stack, container{object: v == '{'})
+			}
+		case string:
+			out = appendJSONString(out, v)
+			redactVal = isKey && redact[strings.ToLower(v)]
+		case json.Number:
+			out = append(out, v...)
+		case bool:
+			if v {
+				out = append(out, "true"...)
+			} else {
+				out = append(out, "false"...)
+			}
+		case nil:
+			out = append(out, "null"...)
+		}
+	}
+}
+
+// skipJSONValue reads the tokens of the object or array whose opening delimiter was just read.
+func skipJSONValue(dec *json.Decoder) bool {
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return true
+}
+
+// redactForm replaces the values of the fields in redact in a urlencoded form, leaving the
+// rest as sent.
+func redactForm(form string, redact map[string]bool) string {
+	pairs := strings.Split(form, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil && redact[strings.ToLower(name)] {
+			pairs[i] = key + "=" + redactedValue
+		}
+	}
+	return strings.Join(pairs, "&")
+}
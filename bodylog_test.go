@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_LogBodyOnError(t *testing.T) {
+	accessLog, errorLog := new(bytes.Buffer), new(bytes.Buffer)
+	srv, err := Init(Options{
+		AccessLog:      &AccessLogOptions{Format: AccessLogJSON, Output: accessLog},
+		LogBodyOnError: &BodyLogOptions{MaxBytes: 48},
+	})
+	require.NoError(t, err)
+	srv.SetLogger(slog.New(slog.NewJSONHandler(errorLog, nil)))
+
+	srv.HandleFunc("POST /users", func(ctx Context) error {
+		var user struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := ctx.BindJSON(&user); err != nil {
+			return err
+		}
+		if user.Name == "" {
+			return NewHTTPError(http.StatusUnprocessableEntity, nil, "name is required")
+		}
+		return ctx.String(http.StatusCreated, user.Name)
+	})
+	srv.HandleFunc("POST /import", func(ctx Context) error {
+		return ctx.String(http.StatusBadRequest, "bad csv")
+	})
+	require.NoError(t, srv.Route())
+
+	post := func(path, contentType, body string) int {
+		accessLog.Reset()
+		errorLog.Reset()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(HeaderContentType, contentType)
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	logged := func(buf *bytes.Buffer) map[string]any {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line), buf.String())
+		return line
+	}
+
+	t.Run("success", func(t *testing.T) {
+		require.Equal(t, http.StatusCreated, post("/users", ContentTypeJSON, `{"name":"ada","password":"hunter2"}`))
+		assert.NotContains(t, logged(accessLog), "body")
+		assert.Empty(t, errorLog.String())
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		require.Equal(t, http.StatusUnprocessableEntity, post("/users", ContentTypeJSON, `{"name": "", "password": "hunter2"}`))
+		want := `{"name":"","password":"[REDACTED]"}`
+		assert.Equal(t, want, logged(accessLog)["body"])
+		assert.Equal(t, want, logged(errorLog)["body"])
+		assert.NotContains(t, accessLog.String()+errorLog.String(), "hunter2")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		body := `{"password":"hunter2","name":"` + strings.Repeat("a", 64) + `"}`
+		require.Equal(t, http.StatusCreated, post("/users", "application/json; charset=utf-8", body))
+		assert.NotContains(t, logged(accessLog), "body", "successful requests aren't logged")
+
+		require.Equal(t, http.StatusBadRequest, post("/users", ContentTypeJSON, `{"password":"hunter2","bio":"`+strings.Repeat("a", 64)))
+		assert.Equal(t, `{"password":"[REDACTED]","bio"…(truncated)`, logged(accessLog)["body"])
+	})
+
+	t.Run("status only", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post("/import", "text/plain", "a,b\n1,2"))
+		assert.Equal(t, "a,b\n1,2", logged(accessLog)["body"])
+	})
+
+	t.Run("content type not allowed", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post("/import", "text/csv", "a,b\n1,2"))
+		assert.NotContains(t, logged(accessLog), "body")
+	})
+
+	t.Run("form", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post("/import", "application/x-www-form-urlencoded", "user=ada&Password=hunter2"))
+		assert.Equal(t, "user=ada&Password=[REDACTED]", logged(accessLog)["body"])
+	})
+}
+
+func TestRedactJSON(t *testing.T) {
+	redact := map[string]bool{"password": true, "token": true}
+	tests := []struct {
+		in       string
+		want     string
+		complete bool
+	}{
+		{`{"a": [1, true, null, {"b": "c"}]}`, `{"a":[1,true,null,{"b":"c"}]}`, true},
+		{`{"user": {"Password": "x"}, "token": {"id": [1, 2]}, "n": 2}`, `{"user":{"Password":"[REDACTED]"},"token":"[REDACTED]","n":2}`, true},
+		{`[{"password": "x"}, "password"]`, `[{"password":"[REDACTED]"},"password"]`, true},
+		{`{"name": "ada", "password": "hun`, `{"name":"ada","password"`, false},
+		{`{"name": ada}`, `{"name"`, false},
+	}
+	for _, tt := range tests {
+		got, complete := redactJSON([]byte(tt.in), redact)
+		assert.Equal(t, tt.want, got, tt.in)
+		assert.Equal(t, tt.complete, complete, tt.in)
+	}
+}
@@ -1,12 +1,81 @@
 package server
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 )
 
 type Middleware func(http.Handler) http.Handler
 type Chain []Middleware
 
+// CtxMiddleware is a middleware written against Context. Errors it returns are handled
+// the same way as errors returned from a HandlerFunc.
+type CtxMiddleware func(next HandlerFunc) HandlerFunc
+
+// Middleware converts m to a Middleware so it can be used anywhere a Middleware is accepted.
+func (m CtxMiddleware) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		h, ok := next.(HandlerFunc)
+		if !ok {
+			h = func(ctx Context) error {
+				next.ServeHTTP(ctx.Response(), ctx.Request())
+				return nil
+			}
+		}
+
+		return m(h)
+	}
+}
+
+// CtxMiddlewareFunc is a CtxMiddleware written as a single function, like a HandlerFunc that is
+// also given the next handler. Returning without calling next ends the request, e.g. with
+// ctx.Error(http.StatusUnauthorized, err).
+type CtxMiddlewareFunc func(ctx Context, next HandlerFunc) error
+
+// CtxMiddleware converts f to a CtxMiddleware, e.g. for UseCtx or WithCtxMiddleware.
+func (f CtxMiddlewareFunc) CtxMiddleware() CtxMiddleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			return f(ctx, next)
+		}
+	}
+}
+
+// Middleware converts f to a Middleware.
+func (f CtxMiddlewareFunc) Middleware() Middleware {
+	return f.CtxMiddleware().Middleware()
+}
+
+// ToCtxMiddleware converts a Middleware to a CtxMiddleware.
+func ToCtxMiddleware(m Middleware) CtxMiddleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			var err error
+			h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCtx := NewContext(w, r)
+				if nextCtx == nil {
+					err = errors.New("failed to create context")
+					return
+				}
+				err = next(nextCtx)
+			}))
+
+			h.ServeHTTP(ctx.Response(), ctx.Request())
+			return err
+		}
+	}
+}
+
+// CtxChain converts CtxMiddleware to a Chain.
+func CtxChain(middleware ...CtxMiddleware) Chain {
+	c := make(Chain, len(middleware))
+	for i, m := range middleware {
+		c[i] = m.Middleware()
+	}
+	return c
+}
+
 func (c Chain) ThenFunc(h http.HandlerFunc) http.Handler {
 	return c.Then(h)
 }
@@ -17,3 +86,66 @@ func (c Chain) Then(h http.Handler) http.Handler {
 	}
 	return h
 }
+
+// Skipper reports whether a middleware should be bypassed for the request.
+type Skipper func(r *http.Request) bool
+
+// Skip returns a middleware that runs m unless skip returns true for the request. When skipped,
+// the request goes straight to the next handler so the rest of the chain still runs in order.
+func Skip(m Middleware, skip Skipper) Middleware {
+	if skip == nil {
+		return m
+	}
+
+	return func(next http.Handler) http.Handler {
+		wrapped := m(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SkipPaths returns a Skipper matching requests whose path is exactly one of paths.
+func SkipPaths(paths ...string) Skipper {
+	return func(r *http.Request) bool {
+		for _, p := range paths {
+			if r.URL.Path == p {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipPathPrefixes returns a Skipper matching requests whose path starts with one of prefixes.
+func SkipPathPrefixes(prefixes ...string) Skipper {
+	return func(r *http.Request) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(r.URL.Path, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ForMethods returns a middleware that runs mw, in order, only for requests whose method is one
+// of methods. Other requests go straight to the next handler. Methods are matched
+// case-insensitively; list HEAD explicitly to cover it along with GET.
+func ForMethods(methods []string, mw ...Middleware) Middleware {
+	set := make(map[string]struct{}, len(methods))
+	for _, m := range methods {
+		set[strings.ToUpper(m)] = struct{}{}
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return Chain(mw).Then(next)
+	}, func(r *http.Request) bool {
+		_, ok := set[r.Method]
+		return !ok
+	})
+}
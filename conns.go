@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnStats are the connection counters of the main listener, kept with
+// Options.TrackConnections. New, Active and Idle are the connections currently in that state,
+// Hijacked and Closed count the connections that reached it.
+type ConnStats struct {
+	New      int64  `json:"new"`
+	Active   int64  `json:"active"`
+	Idle     int64  `json:"idle"`
+	Hijacked uint64 `json:"hijacked"`
+	Closed   uint64 `json:"closed"`
+}
+
+// connTracker keeps the state of the open connections for the ConnStats gauges.
+type connTracker struct {
+	// state maps each open net.Conn to its *atomic.Int32 http.ConnState
+	state sync.Map
+
+	// gauges is indexed by http.ConnState: StateNew, StateActive and StateIdle
+	gauges   [3]atomic.Int64
+	hijacked atomic.Uint64
+	closed   atomic.Uint64
+
+	// logStates logs every transition at debug level
+	logStates bool
+	srv       *Server
+}
+
+func newConnTracker(srv *Server, logStates bool) *connTracker {
+	return &connTracker{srv: srv, logStates: logStates}
+}
+
+// connState is an http.Server.ConnState callback. Moving a connection between active and idle
+// swaps its state in place, so it takes no lock and allocates nothing.
+func (ct *connTracker) connState(c net.Conn, state http.ConnState) {
+	prev, known := http.ConnState(0), false
+	switch state {
+	case http.StateNew:
+		cur := new(atomic.Int32)
+		cur.Store(int32(state))
+		ct.state.Store(c, cur)
+	case http.StateHijacked, http.StateClosed:
+		if cur, ok := ct.state.LoadAndDelete(c); ok {
+			prev, known = http.ConnState(cur.(*atomic.Int32).Load()), true
+		}
+	default:
+		if cur, ok := ct.state.Load(c); ok {
+			prev, known = http.ConnState(cur.(*atomic.Int32).Swap(int32(state))), true
+		}
+	}
+
+	if known {
+		ct.gauges[prev].Add(-1)
+	}
+	switch state {
+	case http.StateNew:
+		ct.gauges[state].Add(1)
+	case http.StateActive, http.StateIdle:
+		if known {
+			ct.gauges[state].Add(1)
+		}
+	case http.StateHijacked:
+		ct.hijacked.Add(1)
+	case http.StateClosed:
+		ct.closed.Add(1)
+	}
+
+	if ct.logStates {
+		ct.srv.logger().Debug("connection state", "state", state.String(), "remote", c.RemoteAddr().String())
+	}
+}
+
+func (ct *connTracker) snapshot() ConnStats {
+	return ConnStats{
+		New:      ct.gauges[http.StateNew].Load(),
+		Active:   ct.gauges[http.StateActive].Load(),
+		Idle:     ct.gauges[http.StateIdle].Load(),
+		Hijacked: ct.hijacked.Load(),
+		Closed:   ct.closed.Load(),
+	}
+}
+
+// connState returns the HTTPServer.ConnState callback counting the connections when
+// TrackConnections is set and calling next, if any.
+func (s *Server) connState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	switch {
+	case s.conns == nil:
+		return next
+	case next == nil:
+		return s.conns.connState
+	}
+	return func(c net.Conn, state http.ConnState) {
+		s.conns.connState(c, state)
+		next(c, state)
+	}
+}
@@ -1,10 +1,20 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 )
@@ -13,20 +23,119 @@ var _ Context = &HandlerContext{}
 
 type Context interface {
 	Context() context.Context
+	// Detach returns a context for work that outlives the request, see HandlerContext.Detach.
+	Detach(keys ...any) context.Context
 	ContextGet(key any, defa ...any) any
 	ContextSet(key any, val any) *http.Request
 	Request() *http.Request
 	Response() http.ResponseWriter
+	// Header returns the response headers.
+	Header() http.Header
+	// SetHeader sets a response header and returns the context for chaining.
+	SetHeader(key, value string) Context
+	// WithHeaders sets each of headers on the response and returns the context for chaining.
+	WithHeaders(headers map[string]string) Context
 	JSON(status int, data JSONResponse) error
+	// StreamArray writes a JSON array incrementally. fn calls write once per element; each
+	// element is flushed to the client as it is written.
+	StreamArray(status int, fn func(write func(v any) error) error) error
 	Redirect(url string) error
+	// FlashRedirect stores msg in the session under flashKey and redirects to url. With
+	// Options.RenderFlashes the next Render adds it to the template data.
+	// htmx requests are redirected with the HX-Redirect header.
+	FlashRedirect(url, flashKey, msg string) error
+	// IsHTMX reports whether the request was made by htmx (HX-Request: true).
+	IsHTMX() bool
+	// HXTarget returns the id of the element targeted by an htmx request (HX-Target).
+	HXTarget() string
+	// HXTrigger returns the id of the element that triggered an htmx request (HX-Trigger).
+	HXTrigger() string
+	// HXCurrentURL returns the browser URL when an htmx request was made (HX-Current-URL).
+	HXCurrentURL() string
+	// Render renders an html template with the given status code
+	Render(status int, opt RenderOpt) error
+	// ViewData returns the view data of the request, added to the data of every Render.
+	ViewData() ViewData
+	// RenderMarkdown renders markdown as HTML in a page template, see HandlerContext.RenderMarkdown.
+	RenderMarkdown(status int, opt MarkdownOpt) error
+	// RenderHX is Render setting the HX-Retarget and HX-Reswap headers of htmx requests.
+	RenderHX(status int, opt RenderOpt, retarget, reswap string) error
+	// RenderAuto renders fragment for htmx requests and full for the others and boosted links.
+	RenderAuto(status int, fragment, full RenderOpt) error
+	// RenderOOB renders main and, for htmx requests, the out of band fragments oob.
+	RenderOOB(status int, main RenderOpt, oob ...OOBFragment) error
+	// Error renders the error template for code. It falls back to a plain text response
+	// when there is no template for the code.
+	Error(code int, err error) error
 	String(code int, out string) error
 	// Status sets the response status code
 	Status(code int) error
 	Log() *slog.Logger
 	Session() *SessionHelper
+	// SetSignedCookie sets cookie with its value signed using secret
+	SetSignedCookie(cookie *http.Cookie, secret []byte)
+	// SignedCookie returns the value of a cookie set with SetSignedCookie.
+	// It returns ErrInvalidCookie if the signature doesn't match.
+	SignedCookie(name string, secret []byte) (string, error)
 	RequestID() string
+	// HTTPClient returns a client propagating the request ID to the services it calls.
+	HTTPClient() *http.Client
+	// PreferredLanguage returns the supported language that best matches the Accept-Language
+	// header, defaulting to the first supported language.
+	PreferredLanguage(supported ...string) string
+	// Locale returns the locale of the request, see Options.I18n.
+	Locale() string
+	// SetLocale makes locale the locale of this and the following requests of the client.
+	SetLocale(locale string) error
+	// T returns the message key in the locale of the request, formatted with args.
+	T(key string, args ...any) string
+	// RealIP returns the client IP address. Use RealIPMiddleware to resolve it behind proxies.
+	RealIP() string
+	// IsHTTPS reports whether the client made the request over HTTPS, see IsHTTPS.
+	IsHTTPS() bool
+	// Pattern returns the pattern of the matched route, with its method and group prefixes,
+	// e.g. "GET /api/users/{id}". See MatchedRoute.
+	Pattern() string
+	// Host returns the host the request was sent to, lowercase and without port.
+	Host() string
+	// Subdomain returns the part of the host matched by the wildcard labels of the HostGroup
+	// serving the request, e.g. "acme" for "acme.example.com" and "{tenant}.example.com".
+	Subdomain() string
 	UrlParam(key string) string
+	// Param returns the first value of key in the query string or the form body. Multipart
+	// bodies are parsed with Options.MaxMultipartMemory.
 	Param(key string) string
+	// Stream copies r to the response, flushing as it goes, see HandlerContext.Stream.
+	Stream(code int, contentType string, r io.Reader) error
+	// AttachmentReader streams r as a download named filename.
+	AttachmentReader(filename, contentType string, r io.Reader) error
+	// File serves a file from Options.FileRoot, see HandlerContext.File.
+	File(name string) error
+	// Attachment serves a file from Options.FileRoot as a download named filename.
+	Attachment(name, filename string) error
+	// Blob serves data with Range and conditional request support, see HandlerContext.Blob.
+	Blob(name string, modtime time.Time, data []byte) error
+	// FormFile returns the first file uploaded under key in a multipart form.
+	FormFile(key string) (multipart.File, *multipart.FileHeader, error)
+	// ParamInt returns the path parameter key as an int. A conversion failure is a 400 HTTPError.
+	ParamInt(key string) (int, error)
+	// BindQuery copies the query string into the struct dst points to using `query` field tags.
+	// Fields that fail to convert are also added to the error bag.
+	BindQuery(dst any) error
+	// BindForm copies the query string and the url-encoded or multipart form body into the
+	// struct dst points to using `form` field tags. Fields that fail to convert are also added
+	// to the error bag.
+	BindForm(dst any) error
+	// BindJSON decodes the JSON request body into dst. Unknown fields are rejected when
+	// Options.StrictJSON is set. Decoding failures are 400 HTTPErrors.
+	BindJSON(dst any) error
+	// BindJSONStrict is BindJSON rejecting unknown fields regardless of Options.StrictJSON.
+	BindJSONStrict(dst any) error
+	// AddError adds a validation error for field to the request's error bag.
+	AddError(field, msg string)
+	// Errors returns the error bag, keyed by field.
+	Errors() map[string][]string
+	HasErrors() bool
 	GetRoutePath(name string, params ...string) string
 	StillStreaming(state bool)
 }
@@ -36,11 +145,16 @@ type HandlerContext struct {
 	r                *http.Request
 	srv              *Server
 	streamingNotDone bool
+	errors           map[string][]string
+	viewData         ViewData
 }
 
 func NewContext(w http.ResponseWriter, r *http.Request) *HandlerContext {
+	if _, ok := w.(*contextWriter); !ok {
+		w = &contextWriter{ResponseWriter: w, r: r}
+	}
 	ctx := &HandlerContext{w: w, r: r}
-	srv, ok := r.Context().Value(CtxKeyServer).(*Server)
+	srv, ok := FromContext(r.Context(), CtxKeyServer)
 	if !ok {
 		return nil
 	}
@@ -49,10 +163,103 @@ func NewContext(w http.ResponseWriter, r *http.Request) *HandlerContext {
 	return ctx
 }
 
+// contextWriter is the response writer of a HandlerContext. It keeps the first status code
+// written: net/http drops later ones with a generic "superfluous WriteHeader" message, this
+// logs them with the request they belong to.
+type contextWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	// status is 0 until the header is written
+	status int
+}
+
+func (w *contextWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		requestLogger(w.r).Warn("superfluous WriteHeader ignored",
+			append([]any{"status", w.status, "ignored", code}, requestLogAttrs(w.r, time.Now())...)...)
+		return
+	}
+	// informational responses can precede the final status
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps the writer an http.Flusher for handlers asserting it.
+func (w *contextWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack keeps the writer an http.Hijacker. A hijacked response counts as written: the
+// connection belongs to the handler and later WriteHeader calls are ignored.
+func (w *contextWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+func (w *contextWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (c *HandlerContext) Context() context.Context {
 	return c.r.Context()
 }
 
+// Detach returns a context for goroutines spawned by the handler, which is not canceled when the
+// request ends or times out. It holds the request ID and the scoped logger, read back with
+// RequestIDFromContext and LoggerFromContext, and the request values stored under keys. Other
+// request values are left out, so the background work doesn't keep them alive.
+//
+// The spawned work must not use the Context, the request body or the ResponseWriter once the
+// handler has returned, and session changes made after that are not saved. Bound the work with
+// its own deadline, e.g. context.WithTimeout.
+func (c *HandlerContext) Detach(keys ...any) context.Context {
+	reqCtx := c.r.Context()
+	ctx := ContextWithValue(context.Background(), scopedLoggerKey, requestLogger(c.r))
+	if reqID, ok := FromContext(reqCtx, requestIDKey); ok {
+		ctx = ContextWithValue(ctx, requestIDKey, reqID)
+	}
+	for _, key := range keys {
+		if val := reqCtx.Value(key); val != nil {
+			ctx = context.WithValue(ctx, key, val)
+		}
+	}
+	return ctx
+}
+
+// RequestIDFromContext returns the request ID set by RequestIDMiddleware in ctx, e.g. a context
+// from Detach, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	reqID, _ := FromContext(ctx, requestIDKey)
+	return reqID
+}
+
+// LoggerFromContext returns the request scoped logger in ctx, e.g. a context from Detach,
+// falling back to the server logger.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := FromContext(ctx, scopedLoggerKey); ok && logger != nil {
+		return logger
+	}
+	if srv, ok := FromContext(ctx, CtxKeyServer); ok {
+		return srv.logger()
+	}
+	return appLog
+}
+
 func (c *HandlerContext) ContextGet(key any, defa ...any) any {
 	var dv any = ""
 	if len(defa) > 0 {
@@ -73,8 +280,8 @@ func (c *HandlerContext) ContextSet(key any, val any) *http.Request {
 }
 
 func (c *HandlerContext) GetRoutePath(name string, params ...string) string {
-	srv := c.Context().Value(CtxKeyServer).(*Server)
-	if srv == nil {
+	srv, ok := FromContext(c.Context(), CtxKeyServer)
+	if !ok || srv == nil {
 		return ""
 	}
 
@@ -89,14 +296,27 @@ func (c *HandlerContext) Response() http.ResponseWriter {
 	return c.w
 }
 
+func (c *HandlerContext) Header() http.Header {
+	return c.w.Header()
+}
+
+func (c *HandlerContext) SetHeader(key, value string) Context {
+	c.w.Header().Set(key, value)
+	return c
+}
+
+func (c *HandlerContext) WithHeaders(headers map[string]string) Context {
+	for k, v := range headers {
+		c.w.Header().Set(k, v)
+	}
+	return c
+}
+
 func (c *HandlerContext) StillStreaming(state bool) {
 	c.streamingNotDone = state
 }
 
 func (c *HandlerContext) JSON(status int, data JSONResponse) error {
-	c.writeContentType(ContentTypeJSON)
-	c.Response().WriteHeader(status)
-
 	if data.Error != nil && data.ErrorType == "" {
 		if status >= 500 {
 			data.ErrorType = ErrorTypeServer
@@ -105,12 +325,58 @@ func (c *HandlerContext) JSON(status int, data JSONResponse) error {
 		}
 	}
 
-	enc := json.NewEncoder(c.Response())
-	if err := enc.Encode(data); err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := c.encodeJSON(buf, data, true); err != nil {
 		return err
 	}
 
-	return nil
+	c.writeContentType(ContentTypeJSON)
+	c.Response().WriteHeader(status)
+	_, err := buf.WriteTo(c.Response())
+	return err
+}
+
+func (c *HandlerContext) StreamArray(status int, fn func(write func(v any) error) error) error {
+	c.writeContentType(ContentTypeJSON)
+	c.Response().WriteHeader(status)
+
+	w := c.Response()
+	rc := http.NewResponseController(w)
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	count := 0
+	write := func(v any) error {
+		buf.Reset()
+		if count > 0 {
+			buf.WriteByte(',')
+		}
+		// elements stay on one line each
+		if err := c.encodeJSON(buf, v, false); err != nil {
+			return err
+		}
+		if _, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil {
+			return err
+		}
+		count++
+
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+
+	// on error the array is left open so clients can tell the response is incomplete
+	if err := fn(write); err != nil {
+		return err
+	}
+
+	_, err := w.Write([]byte("]"))
+	return err
 }
 
 func (c *HandlerContext) Redirect(url string) error {
@@ -118,6 +384,75 @@ func (c *HandlerContext) Redirect(url string) error {
 	return nil
 }
 
+var ErrNoSessionManager = errors.New("no session manager configured")
+
+func (c *HandlerContext) FlashRedirect(url, flashKey, msg string) error {
+	sess := c.Session()
+	if sess == nil {
+		return ErrNoSessionManager
+	}
+	sess.Put(flashKey, msg)
+	keys, _ := sess.Get(flashKeysSessionKey).([]string)
+	if !slices.Contains(keys, flashKey) {
+		sess.Put(flashKeysSessionKey, append(keys, flashKey))
+	}
+
+	if c.IsHTMX() {
+		c.Response().Header().Set("HX-Redirect", url)
+		c.Response().WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	return c.Redirect(url)
+}
+
+func (c *HandlerContext) IsHTMX() bool {
+	return c.Request().Header.Get("HX-Request") == "true"
+}
+
+func (c *HandlerContext) HXTarget() string {
+	return c.Request().Header.Get("HX-Target")
+}
+
+func (c *HandlerContext) HXTrigger() string {
+	return c.Request().Header.Get("HX-Trigger")
+}
+
+func (c *HandlerContext) HXCurrentURL() string {
+	return c.Request().Header.Get("HX-Current-URL")
+}
+
+// RenderHX renders opt like Render and, for htmx requests, sets HX-Retarget and HX-Reswap so
+// the fragment replaces retarget (a CSS selector) with the reswap strategy, e.g. a form with
+// its validation errors. Empty values leave the header unset, and so do requests not made by htmx.
+func (c *HandlerContext) RenderHX(status int, opt RenderOpt, retarget, reswap string) error {
+	if c.IsHTMX() {
+		if retarget != "" {
+			c.Response().Header().Set("HX-Retarget", retarget)
+		}
+		if reswap != "" {
+			c.Response().Header().Set("HX-Reswap", reswap)
+		}
+	}
+	return c.Render(status, opt)
+}
+
+// RenderAuto renders fragment for htmx requests and full otherwise, including the requests of
+// boosted links, which swap the whole body. Responses vary on HX-Request so caches keep both.
+func (c *HandlerContext) RenderAuto(status int, fragment, full RenderOpt) error {
+	c.Response().Header().Add("Vary", "HX-Request")
+	if c.isHTMXFragment() {
+		return c.Render(status, fragment)
+	}
+	return c.Render(status, full)
+}
+
+// isHTMXFragment reports whether the request is an htmx request for a fragment, that is not
+// one of a boosted link.
+func (c *HandlerContext) isHTMXFragment() bool {
+	return c.IsHTMX() && c.Request().Header.Get("HX-Boosted") != "true"
+}
+
 func (c *HandlerContext) String(code int, out string) error {
 	c.writeContentType(ContentTypeText)
 	c.Response().WriteHeader(code)
@@ -132,20 +467,11 @@ func (c *HandlerContext) Status(code int) error {
 }
 
 func (c *HandlerContext) Log() *slog.Logger {
-	logger, ok := c.r.Context().Value(scopedLoggerKey).(*slog.Logger)
-	if ok && logger != nil {
-		return logger
-	}
-
-	if c.srv != nil && c.srv.log != nil {
-		return c.srv.log
-	}
-
-	return appLog
+	return requestLogger(c.r)
 }
 
 func (c *HandlerContext) RequestID() string {
-	reqID, ok := c.r.Context().Value(requestIDKey).(string)
+	reqID, ok := FromContext(c.r.Context(), requestIDKey)
 	if ok && reqID != "" {
 		return reqID
 	}
@@ -154,14 +480,111 @@ func (c *HandlerContext) RequestID() string {
 	return ""
 }
 
+func (c *HandlerContext) RealIP() string {
+	return remoteIP(c.Request().RemoteAddr)
+}
+
+func (c *HandlerContext) Pattern() string {
+	method, pattern := MatchedRoute(c.Request())
+	return strings.TrimSpace(method + " " + pattern)
+}
+
+func (c *HandlerContext) Host() string {
+	return requestHost(c.Request())
+}
+
+func (c *HandlerContext) Subdomain() string {
+	if info, ok := FromContext(c.Request().Context(), requestInfoKey); ok {
+		return info.subdomain
+	}
+	return ""
+}
+
 func (c *HandlerContext) UrlParam(key string) string {
 	return c.Request().PathValue(key)
 }
 
 func (c *HandlerContext) Param(key string) string {
+	// FormValue ignores parse errors as well
+	_ = parseForm(c.Request(), c.srv.maxMultipart)
 	return c.Request().FormValue(key)
 }
 
+func (c *HandlerContext) FormFile(key string) (multipart.File, *multipart.FileHeader, error) {
+	if err := parseForm(c.Request(), c.srv.maxMultipart); err != nil {
+		return nil, nil, err
+	}
+	return c.Request().FormFile(key)
+}
+
+func (c *HandlerContext) ParamInt(key string) (int, error) {
+	v, err := strconv.Atoi(c.UrlParam(key))
+	if err != nil {
+		return 0, NewHTTPError(http.StatusBadRequest, err, fmt.Sprintf("invalid path parameter %q", key))
+	}
+	return v, nil
+}
+
+func (c *HandlerContext) BindQuery(dst any) error {
+	err := bindValues(c.Request().URL.Query(), "query", dst)
+
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		c.AddError(bindErr.Field, "invalid value")
+	}
+	return err
+}
+
+func (c *HandlerContext) BindForm(dst any) error {
+	if err := parseForm(c.Request(), c.srv.maxMultipart); err != nil {
+		return err
+	}
+	err := bindValues(c.Request().Form, "form", dst)
+
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		c.AddError(bindErr.Field, "invalid value")
+	}
+	return err
+}
+
+func (c *HandlerContext) BindJSON(dst any) error {
+	return c.bindJSON(dst, c.srv.strictJSON)
+}
+
+func (c *HandlerContext) BindJSONStrict(dst any) error {
+	return c.bindJSON(dst, true)
+}
+
+func (c *HandlerContext) bindJSON(dst any, strict bool) error {
+	err := decodeJSON(c.Request().Body, dst, strict)
+
+	var bindErr *BindError
+	if errors.As(err, &bindErr) && bindErr.Field != "" {
+		msg := "invalid value"
+		if errors.Is(err, ErrUnknownField) {
+			msg = "unknown field"
+		}
+		c.AddError(bindErr.Field, msg)
+	}
+	return err
+}
+
+func (c *HandlerContext) AddError(field, msg string) {
+	if c.errors == nil {
+		c.errors = make(map[string][]string)
+	}
+	c.errors[field] = append(c.errors[field], msg)
+}
+
+func (c *HandlerContext) Errors() map[string][]string {
+	return c.errors
+}
+
+func (c *HandlerContext) HasErrors() bool {
+	return len(c.errors) > 0
+}
+
 const HeaderContentType = "Content-Type"
 
 func (c *HandlerContext) writeContentType(value string) {
@@ -193,12 +616,7 @@ func (h *SessionHelper) Mgr() *scs.SessionManager {
 }
 
 func (c *HandlerContext) Session() *SessionHelper {
-	retv := c.Request().Context().Value(CtxKeySessionMgr)
-	if retv == nil {
-		return nil
-	}
-
-	sess, ok := retv.(*scs.SessionManager)
+	sess, ok := FromContext(c.Request().Context(), CtxKeySessionMgr)
 	if !ok || sess == nil {
 		return nil
 	}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidCookie = errors.New("invalid cookie signature")
+
+// signCookieValue returns value with an HMAC-SHA256 signature over the cookie name and value.
+func signCookieValue(name, value string, secret []byte) string {
+	enc := base64.RawURLEncoding.EncodeToString([]byte(value))
+	return enc + "." + base64.RawURLEncoding.EncodeToString(cookieMAC(name, enc, secret))
+}
+
+// verifyCookieValue checks the signature added by signCookieValue and returns the original value.
+func verifyCookieValue(name, signed string, secret []byte) (string, error) {
+	enc, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", ErrInvalidCookie
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, cookieMAC(name, enc, secret)) {
+		return "", ErrInvalidCookie
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+	return string(value), nil
+}
+
+func cookieMAC(name, value string, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+// SetSignedCookie sets cookie with its value signed. The cookie is marked Secure when the request
+// was made over HTTPS, see IsHTTPS.
+func (c *HandlerContext) SetSignedCookie(cookie *http.Cookie, secret []byte) {
+	signed := *cookie
+	if c.IsHTTPS() {
+		signed.Secure = true
+	}
+	signed.Value = signCookieValue(cookie.Name, cookie.Value, secret)
+	http.SetCookie(c.Response(), &signed)
+}
+
+func (c *HandlerContext) SignedCookie(name string, secret []byte) (string, error) {
+	cookie, err := c.Request().Cookie(name)
+	if err != nil {
+		return "", err
+	}
+
+	return verifyCookieValue(name, cookie.Value, secret)
+}
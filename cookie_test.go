@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedCookie(t *testing.T) {
+	secret := []byte("s3cr3t")
+
+	w := httptest.NewRecorder()
+	ctx := &HandlerContext{w: w, r: httptest.NewRequest(http.MethodGet, "/", nil)}
+	ctx.SetSignedCookie(&http.Cookie{Name: "user", Value: "alice; admin=1", Path: "/"}, secret)
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "/", cookies[0].Path)
+	assert.NotContains(t, cookies[0].Value, "alice")
+
+	readCookie := func(c *http.Cookie) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(c)
+		return (&HandlerContext{w: httptest.NewRecorder(), r: r}).SignedCookie(c.Name, secret)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		val, err := readCookie(cookies[0])
+		require.NoError(t, err)
+		assert.Equal(t, "alice; admin=1", val)
+	})
+
+	t.Run("tampered value", func(t *testing.T) {
+		tampered := *cookies[0]
+		tampered.Value = signCookieValue("user", "mallory", []byte("guess"))
+		_, err := readCookie(&tampered)
+		assert.ErrorIs(t, err, ErrInvalidCookie)
+	})
+
+	t.Run("renamed cookie", func(t *testing.T) {
+		renamed := *cookies[0]
+		renamed.Name = "admin"
+		_, err := readCookie(&renamed)
+		assert.ErrorIs(t, err, ErrInvalidCookie)
+	})
+
+	t.Run("missing cookie", func(t *testing.T) {
+		ctx := &HandlerContext{w: httptest.NewRecorder(), r: httptest.NewRequest(http.MethodGet, "/", nil)}
+		_, err := ctx.SignedCookie("user", secret)
+		assert.ErrorIs(t, err, http.ErrNoCookie)
+	})
+}
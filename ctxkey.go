@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// Key is a typed context key. Keys are compared by identity, so two keys created with the
+// same name never collide, and values can only be stored and read with the key's type.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new context key for values of type T. name is only used for debugging.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return "server.Key(" + k.name + ")"
+}
+
+// ContextWithValue returns a copy of ctx carrying val under key.
+func ContextWithValue[T any](ctx context.Context, key *Key[T], val T) context.Context {
+	return context.WithValue(ctx, key, val)
+}
+
+// FromContext returns the value stored under key and whether it was found.
+func FromContext[T any](ctx context.Context, key *Key[T]) (T, bool) {
+	val, ok := ctx.Value(key).(T)
+	return val, ok
+}
+
+// CtxKey is the string type context keys used to have.
+//
+// Deprecated: use a Key created with NewKey. CtxKeyServer and CtxKeySessionMgr are Keys now;
+// lookups such as r.Context().Value(CtxKeyServer).(*Server) keep working.
+type CtxKey string
+
+var (
+	CtxKeyServer     = NewKey[*Server]("server")
+	CtxKeySessionMgr = NewKey[*scs.SessionManager]("sessionMgr")
+
+	requestIDKey    = NewKey[string]("requestID")
+	scopedLoggerKey = NewKey[*slog.Logger]("scopedLogger")
+	timeoutBaseKey  = NewKey[context.Context]("timeoutBase")
+	requestInfoKey  = NewKey[*requestInfo]("requestInfo")
+)
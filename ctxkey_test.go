@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextKeys(t *testing.T) {
+	ageKey := NewKey[int]("age")
+	otherAgeKey := NewKey[int]("age")
+
+	ctx := ContextWithValue(context.Background(), ageKey, 22)
+
+	age, ok := FromContext(ctx, ageKey)
+	assert.True(t, ok)
+	assert.Equal(t, 22, age)
+
+	_, ok = FromContext(ctx, otherAgeKey)
+	assert.False(t, ok, "keys with the same name must not collide")
+
+	assert.Nil(t, ctx.Value("age"), "raw string lookups must not find typed values")
+
+	srv, err := Init(Options{})
+	assert.NoError(t, err)
+	ctx = ContextWithValue(context.Background(), CtxKeyServer, srv)
+	assert.Nil(t, ctx.Value("_server_"))
+
+	got, ok := FromContext(ctx, CtxKeyServer)
+	assert.True(t, ok)
+	assert.Same(t, srv, got)
+
+	_, ok = FromContext(context.Background(), CtxKeyServer)
+	assert.False(t, ok)
+
+	legacy, ok := ctx.Value(CtxKeyServer).(*Server)
+	assert.True(t, ok, "untyped lookups of the exported keys keep working")
+	assert.Same(t, srv, legacy)
+
+	ctx = context.WithValue(context.Background(), CtxKey("age"), 22)
+	assert.Equal(t, 22, ctx.Value(CtxKey("age")), "the deprecated CtxKey type still works")
+}
+
+func TestContextKeys_Handler(t *testing.T) {
+	ageKey := NewKey[int]("age")
+
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/age", func(ctx Context) error {
+		age, _ := FromContext(ctx.Context(), ageKey)
+		return ctx.String(http.StatusOK, fmt.Sprint("age ", age))
+	}, WithCtxMiddleware(func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			ctx.ContextSet(ageKey, 22)
+			return next(ctx)
+		}
+	}))
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/age")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "age 22", string(body))
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultDecompressMaxSize caps the decompressed request bodies of DecompressMiddleware by default.
+const DefaultDecompressMaxSize int64 = 10 << 20
+
+// DecompressConfig configures DecompressMiddlewareWithConfig.
+type DecompressConfig struct {
+	// MaxSize caps the decompressed size of a body, so a small compressed body can't expand
+	// without bound. Defaults to DefaultDecompressMaxSize.
+	MaxSize int64
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// DecompressMiddleware decompresses request bodies sent with Content-Encoding gzip or deflate,
+// so handlers read them as plain bytes.
+func DecompressMiddleware(next http.Handler) http.Handler {
+	return DecompressMiddlewareWithConfig(DecompressConfig{})(next)
+}
+
+// DecompressMiddlewareWithConfig returns a DecompressMiddleware using the given config. Bodies
+// with another content coding are rejected with 415 and corrupt ones with 400. Reading past
+// MaxSize fails with an *http.MaxBytesError, which BindJSON reports as 413.
+func DecompressMiddlewareWithConfig(cfg DecompressConfig) Middleware {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultDecompressMaxSize
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var (
+				zr  io.ReadCloser
+				err error
+			)
+			switch encoding {
+			case "gzip", "x-gzip":
+				zr, err = gzip.NewReader(r.Body)
+			case "deflate":
+				zr, err = zlib.NewReader(r.Body)
+			default:
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+			if err != nil {
+				http.Error(w, "invalid "+encoding+" request body", http.StatusBadRequest)
+				return
+			}
+
+			body := r.Body
+			r.Body = http.MaxBytesReader(w, struct {
+				io.Reader
+				io.Closer
+			}{zr, closerFunc(func() error {
+				zr.Close()
+				return body.Close()
+			})}, cfg.MaxSize)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+
+			next.ServeHTTP(w, r)
+		})
+	}, cfg.Skipper)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
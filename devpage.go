@@ -0,0 +1,129 @@
+package server
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed devpage.html
+var devPageSource string
+
+var devPage = sync.OnceValue(func() *template.Template {
+	return template.Must(template.New("devpage").Parse(devPageSource))
+})
+
+// devPageHeaders are the request headers whose values the developer error page hides.
+var devPageHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+type devPageData struct {
+	Code       int
+	Status     string
+	Chain      []string
+	Template   *devPageTemplate
+	Method     string
+	URL        string
+	Pattern    string
+	RequestID  string
+	RemoteAddr string
+	Headers    []devPageHeader
+	Stack      string
+}
+
+type devPageTemplate struct {
+	Name string
+	Line int
+}
+
+type devPageHeader struct {
+	Name, Value string
+}
+
+// templateErrorPos matches the position text/template and html/template put in their errors,
+// e.g. "template: users/list.tmpl:12:5: executing ...".
+var templateErrorPos = regexp.MustCompile(`template: ([^:\s]+):(\d+)`)
+
+// writeDevErrorPage writes the developer error page for err, which failed r with code, in place
+// of the plain text error. htmx requests get the page body only, as a fragment.
+func writeDevErrorPage(w http.ResponseWriter, r *http.Request, code int, err error, stack []byte) {
+	data := devPageData{
+		Code:       code,
+		Status:     http.StatusText(code),
+		Chain:      errorChain(err),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		RemoteAddr: r.RemoteAddr,
+		Stack:      string(stack),
+	}
+	if method, pattern := MatchedRoute(r); pattern != "" {
+		data.Pattern = strings.TrimSpace(method + " " + pattern)
+	}
+	data.RequestID, _ = FromContext(r.Context(), requestIDKey)
+
+	var tmplErr *template.Error
+	if errors.As(err, &tmplErr) && tmplErr.Name != "" {
+		data.Template = &devPageTemplate{Name: tmplErr.Name, Line: tmplErr.Line}
+	} else if m := templateErrorPos.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[2])
+		data.Template = &devPageTemplate{Name: m[1], Line: line}
+	}
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := strings.Join(r.Header[name], ", ")
+		if slices.Contains(devPageHeaders, name) {
+			value = "[hidden]"
+		}
+		data.Headers = append(data.Headers, devPageHeader{Name: name, Value: value})
+	}
+
+	name := "devpage"
+	if r.Header.Get("HX-Request") == "true" {
+		name = "body"
+	}
+	w.Header().Set(HeaderContentType, ContentTypeHTML)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	devPage().ExecuteTemplate(w, name, data)
+}
+
+// errorChain returns the messages of err and of the errors it wraps, outermost first.
+func errorChain(err error) []string {
+	var chain []string
+	queue := []error{err}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		if e == nil {
+			continue
+		}
+		chain = append(chain, e.Error())
+		switch u := e.(type) {
+		case interface{ Unwrap() error }:
+			queue = append(queue, u.Unwrap())
+		case interface{ Unwrap() []error }:
+			queue = append(queue, u.Unwrap()...)
+		}
+	}
+	return chain
+}
+
+// useDevErrorPage reports whether an error with code for ctx's request should get the developer
+// error page: a 5xx in ENVDev, before anything was written.
+func useDevErrorPage(ctx *HandlerContext, code int) bool {
+	if ctx.srv == nil || ctx.srv.env != ENVDev || code < http.StatusInternalServerError {
+		return false
+	}
+	cw, ok := ctx.w.(*contextWriter)
+	return ok && cw.status == 0
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_DevErrorPage(t *testing.T) {
+	newServer := func(env ENVTypes) *Server {
+		tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+			"404.page.tmpl": {Data: []byte(`not found`)},
+			"500.page.tmpl": {Data: []byte(`oops`)},
+			"broken.tmpl":   {Data: []byte("<p>\n{{.User.Name}}</p>")},
+		}})
+		require.NoError(t, err)
+		srv, err := Init(Options{Env: env, Templates: tmpl, Middleware: []Middleware{RequestIDMiddleware}})
+		require.NoError(t, err)
+		srv.HandleFunc("GET /broken", func(ctx Context) error {
+			return ctx.Render(http.StatusOK, RenderOpt{Template: "broken", Data: map[string]any{"User": 42}})
+		})
+		srv.HandleFunc("GET /panic", func(ctx Context) error {
+			panic("boom")
+		})
+		srv.HandleFunc("GET /wrapped", func(ctx Context) error {
+			return fmt.Errorf("load user: %w", errors.Join(errors.New("db down"), errors.New("cache down")))
+		})
+		srv.HandleFunc("GET /missing", func(ctx Context) error {
+			return NewHTTPError(http.StatusNotFound, nil)
+		})
+		require.NoError(t, srv.Route())
+		return srv
+	}
+	serve := func(srv *Server, path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	dev := newServer(ENVDev)
+	rec := serve(dev, "/broken")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+	body := rec.Body.String()
+	assert.True(t, strings.HasPrefix(body, "<!DOCTYPE html>"), body)
+	assert.Contains(t, body, "<code>broken.tmpl</code> line 2")
+	assert.Contains(t, body, "can&#39;t evaluate field Name")
+	assert.Contains(t, body, "GET /broken")
+	assert.Contains(t, body, rec.Header().Get(RequestIDHeaderKey))
+	assert.Contains(t, body, "goroutine ")
+	assert.Contains(t, body, "[hidden]")
+	assert.NotContains(t, body, "secret-token")
+
+	rec = serve(dev, "/broken", "HX-Request", "true")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), `<section class="dev-error">`), "htmx gets a fragment")
+
+	body = serve(dev, "/panic").Body.String()
+	assert.Contains(t, body, "panic: boom")
+	assert.Contains(t, body, "devpage_test.go")
+
+	body = serve(dev, "/wrapped").Body.String()
+	for _, msg := range []string{"load user: db down\ncache down", "db down", "cache down"} {
+		assert.Contains(t, body, "<li><pre>"+msg+"</pre></li>")
+	}
+
+	rec = serve(dev, "/missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "Not Found\n", rec.Body.String(), "client errors are unchanged")
+
+	prod := newServer(ENVProduction)
+	rec = serve(prod, "/panic")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "Internal Server Error\n", rec.Body.String())
+	rec = serve(prod, "/broken")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "<!DOCTYPE html>")
+	assert.NotContains(t, rec.Body.String(), "goroutine ")
+}
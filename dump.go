@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDumpMaxBody is how much of the request and response bodies DebugDumpMiddleware logs by default.
+const DefaultDumpMaxBody = 4096
+
+// DefaultDumpRedact are the headers DebugDumpMiddleware hides by default.
+var DefaultDumpRedact = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// DumpConfig configures DebugDumpMiddleware.
+type DumpConfig struct {
+	// MaxBody caps the bytes of each body that are logged. Defaults to DefaultDumpMaxBody.
+	MaxBody int
+	// Redact lists the headers whose values are replaced. Defaults to DefaultDumpRedact.
+	Redact []string
+	// ForceAllow dumps requests outside ENVDev too. Dumps can contain credentials and
+	// personal data, don't set it in production.
+	ForceAllow bool
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// DebugDumpMiddleware logs each request and its response: the request line, headers and the
+// start of the bodies. Binary bodies are summarized by length and content type. It only runs
+// when the server's Options.Env is ENVDev, unless cfg.ForceAllow is set.
+func DebugDumpMiddleware(cfg DumpConfig) Middleware {
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = DefaultDumpMaxBody
+	}
+	if cfg.Redact == nil {
+		cfg.Redact = DefaultDumpRedact
+	}
+	redact := make(map[string]bool, len(cfg.Redact))
+	for _, h := range cfg.Redact {
+		redact[http.CanonicalHeaderKey(h)] = true
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if srv, ok := FromContext(r.Context(), CtxKeyServer); !cfg.ForceAllow && (!ok || srv.env != ENVDev) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reqBody, truncated, err := peekBody(r, cfg.MaxBody)
+			if err != nil {
+				requestLogger(r).Warn("request dump: reading body", "err", err)
+			}
+
+			dw := &dumpWriter{ResponseWriter: w, status: http.StatusOK, max: cfg.MaxBody}
+			next.ServeHTTP(dw, r)
+
+			requestLogger(r).Info("request dump",
+				slog.Group("request",
+					"line", fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
+					dumpHeaders(r.Header, redact),
+					"body", dumpBody(reqBody, r.Header.Get(HeaderContentType), truncated),
+				),
+				slog.Group("response",
+					"status", dw.status,
+					dumpHeaders(dw.Header(), redact),
+					"body", dumpBody(dw.body.Bytes(), dw.Header().Get(HeaderContentType), dw.size > int64(dw.body.Len())),
+				),
+			)
+		})
+	}, cfg.Skipper)
+}
+
+// peekBody reads up to max bytes of the request body and puts them back in front of the rest,
+// so the handler still reads the whole body.
+func peekBody(r *http.Request, max int) (prefix []byte, truncated bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false, nil
+	}
+
+	prefix, err = io.ReadAll(io.LimitReader(r.Body, int64(max)+1))
+	truncated = len(prefix) > max
+
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), body), body}
+
+	if truncated {
+		prefix = prefix[:max]
+	}
+	return prefix, truncated, err
+}
+
+func dumpHeaders(h http.Header, redact map[string]bool) slog.Attr {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		if redact[k] {
+			v = "[REDACTED]"
+		}
+		attrs = append(attrs, slog.String(k, v))
+	}
+	return slog.Group("headers", attrs...)
+}
+
+// dumpBody returns body as text, or a summary when it isn't text.
+func dumpBody(body []byte, contentType string, truncated bool) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !isTextBody(body, contentType) {
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		if truncated {
+			return fmt.Sprintf("[binary %s, more than %d bytes]", contentType, len(body))
+		}
+		return fmt.Sprintf("[binary %s, %d bytes]", contentType, len(body))
+	}
+
+	if truncated {
+		return string(body) + "…(truncated)"
+	}
+	return string(body)
+}
+
+func isTextBody(body []byte, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		return !bytes.ContainsRune(body, 0) && validUTF8Prefix(body)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded", "application/graphql":
+		return true
+	}
+	return false
+}
+
+// validUTF8Prefix reports whether b is valid UTF-8, allowing for a multi-byte character cut
+// short at the end by the size limit.
+func validUTF8Prefix(b []byte) bool {
+	for cut := 0; cut < utf8.UTFMax && cut <= len(b); cut++ {
+		if utf8.Valid(b[:len(b)-cut]) {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpWriter keeps the status and the start of the body written through it.
+type dumpWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	max         int
+	body        bytes.Buffer
+	size        int64
+}
+
+func (dw *dumpWriter) WriteHeader(statusCode int) {
+	if !dw.wroteHeader {
+		dw.wroteHeader = true
+		dw.status = statusCode
+	}
+	dw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (dw *dumpWriter) Write(p []byte) (int, error) {
+	dw.wroteHeader = true
+	if room := dw.max - dw.body.Len(); room > 0 {
+		dw.body.Write(p[:min(room, len(p))])
+	}
+	n, err := dw.ResponseWriter.Write(p)
+	dw.size += int64(n)
+	return n, err
+}
+
+func (dw *dumpWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrFileOutsideRoot is the cause of the 403 returned by File for paths outside Options.FileRoot.
+var ErrFileOutsideRoot = errors.New("file outside the allowed root")
+
+// File serves the file at name, relative to Options.FileRoot, with http.ServeContent: the
+// content type, Range and conditional requests are handled. It returns a 403 HTTPError for
+// paths leading outside the root and a 404 one for missing files or directories, so the error
+// goes through the error handling of HandlerFunc.
+func (c *HandlerContext) File(name string) error {
+	return c.serveFile(name, "")
+}
+
+// Attachment is File with a Content-Disposition header prompting the client to save the file
+// as filename.
+func (c *HandlerContext) Attachment(name, filename string) error {
+	if filename == "" {
+		filename = filepath.Base(name)
+	}
+	return c.serveFile(name, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// Blob serves data from memory with http.ServeContent, as File does for files: the content type
+// is detected from the extension of name, then from data, and Range and conditional requests
+// are handled. A zero modtime leaves out Last-Modified. Stream can't answer Range requests, its
+// reader not being seekable, so content that clients seek in, e.g. audio or video, is served
+// with File or Blob.
+func (c *HandlerContext) Blob(name string, modtime time.Time, data []byte) error {
+	http.ServeContent(c.Response(), c.Request(), name, modtime, bytes.NewReader(data))
+	return nil
+}
+
+// streamChunk is the size of the reads of Stream.
+const streamChunk = 32 << 10
+
+// Stream writes r to the response with status code and contentType, flushing after every read,
+// e.g. for a generated export. The response is committed by the first chunk read, so an error
+// reading it is returned to go through the error handling of HandlerFunc. A later read error
+// can't change the response: it is logged and the response ends there, as it does when the
+// client goes away.
+func (c *HandlerContext) Stream(code int, contentType string, r io.Reader) error {
+	w := c.Response()
+	rc := http.NewResponseController(w)
+	commit := func() {
+		if contentType != "" {
+			c.writeContentType(contentType)
+		}
+		w.WriteHeader(code)
+	}
+
+	buf := make([]byte, streamChunk)
+	committed := false
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if !committed {
+				commit()
+				committed = true
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				c.Log().Debug("stream interrupted", "err", werr)
+				return nil
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				c.Log().Debug("stream interrupted", "err", ferr)
+				return nil
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			if !committed {
+				commit()
+			}
+			return nil
+		case err != nil && !committed:
+			return err
+		case err != nil:
+			c.Log().Error("stream aborted", "err", err)
+			return nil
+		}
+	}
+}
+
+// AttachmentReader is Stream with a 200 and a Content-Disposition header prompting the client
+// to save the response as filename.
+func (c *HandlerContext) AttachmentReader(filename, contentType string, r io.Reader) error {
+	c.Response().Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	return c.Stream(http.StatusOK, contentType, r)
+}
+
+func (c *HandlerContext) serveFile(name, disposition string) error {
+	root := "."
+	var timeout time.Duration
+	if c.srv != nil {
+		root, timeout = c.srv.fileRoot, c.srv.fileTimeout
+	}
+
+	path, err := resolveFile(root, name)
+	if err != nil {
+		return NewHTTPError(http.StatusForbidden, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fileError(err)
+	}
+	if info.IsDir() {
+		return NewHTTPError(http.StatusNotFound, fs.ErrNotExist)
+	}
+
+	if timeout > 0 {
+		// large files get their own deadline instead of HTTPServer.WriteTimeout
+		err := http.NewResponseController(c.Response()).SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+
+	if disposition != "" {
+		c.Response().Header().Set("Content-Disposition", disposition)
+	}
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// resolveFile joins name to root and returns the absolute path, failing with
+// ErrFileOutsideRoot when the result isn't inside root. Symbolic links aren't resolved.
+func resolveFile(root, name string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(absRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+
+	if path != absRoot && !strings.HasPrefix(path, absRoot+string(filepath.Separator)) {
+		return "", ErrFileOutsideRoot
+	}
+	return path, nil
+}
+
+// fileError maps the error of opening a file to an HTTPError.
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return NewHTTPError(http.StatusNotFound, err)
+	case errors.Is(err, fs.ErrPermission):
+		return NewHTTPError(http.StatusForbidden, err)
+	}
+	return err
+}
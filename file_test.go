@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext_File(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "files")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "report.txt"), []byte("quarterly report"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "files-evil.txt"), []byte("sibling"), 0o644))
+
+	srv, err := Init(Options{FileRoot: root, FileWriteTimeout: time.Minute})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /files", func(ctx Context) error {
+		return ctx.File(ctx.Request().URL.Query().Get("name"))
+	})
+	srv.HandleFunc("GET /download", func(ctx Context) error {
+		return ctx.Attachment(ctx.Request().URL.Query().Get("name"), "")
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := serve("/files?name=docs/report.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "quarterly report", rec.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(HeaderContentType))
+	assert.Empty(t, rec.Header().Get("Content-Disposition"))
+
+	rec = serve("/download?name=/docs/report.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `attachment; filename=report.txt`, rec.Header().Get("Content-Disposition"))
+
+	tests := []struct {
+		name string
+		code int
+	}{
+		{name: "../secret.txt", code: http.StatusForbidden},
+		{name: "docs/../../secret.txt", code: http.StatusForbidden},
+		{name: "../files-evil.txt", code: http.StatusForbidden},
+		{name: "docs/missing.txt", code: http.StatusNotFound},
+		{name: "docs", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve("/files?name=" + tt.name)
+			assert.Equal(t, tt.code, rec.Code)
+			assert.NotContains(t, rec.Body.String(), "secret")
+		})
+	}
+
+	_, err = resolveFile(root, "/etc/passwd")
+	require.NoError(t, err, "absolute names are joined to the root")
+	_, err = resolveFile(root, "../files/docs/report.txt")
+	assert.NoError(t, err)
+	_, err = resolveFile(root, "../secret.txt")
+	assert.ErrorIs(t, err, ErrFileOutsideRoot)
+}
+
+func TestContext_FileRange(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("0123456789abcdef")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clip.txt"), content, 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "public"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "public", "clip.txt"), content, 0o644))
+
+	// the request log, the stats and the cache control writers all wrap the response
+	srv, err := Init(Options{
+		FileRoot:         dir,
+		Public:           filepath.Join(dir, "public"),
+		StaticMiddleware: []Middleware{CacheControlMiddleware("public, max-age=3600")},
+		LogRequests:      true,
+		Log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, err)
+	cache := WithMiddleware(CacheControlMiddleware("private, max-age=60"))
+	srv.HandleFunc("GET /file", func(ctx Context) error {
+		return ctx.File("clip.txt")
+	}, cache)
+	srv.HandleFunc("GET /blob", func(ctx Context) error {
+		return ctx.Blob("clip.txt", time.Time{}, content)
+	}, cache)
+	require.NoError(t, srv.Route())
+
+	for _, target := range []string{"/file", "/blob", "/public/clip.txt"} {
+		t.Run(target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Range", "bytes=2-5")
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, "2345", rec.Body.String())
+			assert.Equal(t, fmt.Sprintf("bytes 2-5/%d", len(content)), rec.Header().Get("Content-Range"))
+			assert.Equal(t, "4", rec.Header().Get("Content-Length"))
+			assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+			assert.NotEmpty(t, rec.Header().Get("Cache-Control"), "206 is a success")
+
+			req = httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Range", "bytes=100-")
+			rec = httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+			assert.Equal(t, fmt.Sprintf("bytes */%d", len(content)), rec.Header().Get("Content-Range"))
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/blob", nil)
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, string(content), rec.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(HeaderContentType))
+	assert.Empty(t, rec.Header().Get("Last-Modified"))
+}
+
+// failingReader returns data, then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestContext_Stream(t *testing.T) {
+	var logs bytes.Buffer
+	srv, err := Init(Options{Log: slog.New(slog.NewTextHandler(&logs, nil))})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /export.csv", func(ctx Context) error {
+		pr, pw := io.Pipe()
+		go func() {
+			w := csv.NewWriter(pw)
+			w.Write([]string{"id", "name"})
+			for i := range 3 {
+				w.Write([]string{fmt.Sprint(i + 1), fmt.Sprint("user ", i+1)})
+			}
+			w.Flush()
+			pw.CloseWithError(w.Error())
+		}()
+		return ctx.AttachmentReader("users export.csv", "text/csv", pr)
+	})
+	srv.HandleFunc("GET /broken", func(ctx Context) error {
+		return ctx.Stream(http.StatusOK, "text/plain", &failingReader{data: []byte("partial"), err: errors.New("disk gone")})
+	})
+	srv.HandleFunc("GET /unreadable", func(ctx Context) error {
+		return ctx.Stream(http.StatusOK, "text/plain", &failingReader{err: errors.New("disk gone")})
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := serve("/export.csv")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get(HeaderContentType))
+	assert.Equal(t, `attachment; filename="users export.csv"`, rec.Header().Get("Content-Disposition"))
+	assert.Equal(t, "id,name\n1,user 1\n2,user 2\n3,user 3\n", rec.Body.String())
+	assert.True(t, rec.Flushed)
+
+	rec = serve("/broken")
+	assert.Equal(t, http.StatusOK, rec.Code, "the response was committed")
+	assert.Equal(t, "partial", rec.Body.String())
+	assert.Contains(t, logs.String(), "stream aborted")
+	assert.Contains(t, logs.String(), "disk gone")
+
+	rec = serve("/unreadable")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
@@ -1,15 +1,20 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"runtime/debug"
+	"strings"
+	"time"
 )
 
 type HandlerFunc func(Context) error
 
 func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	ctx := NewContext(w, r)
 	if ctx == nil {
 		slog.Error("Failed to create context")
@@ -18,12 +23,25 @@ func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if rec := recover(); rec != nil {
-			ctx.Log().Error("panic recovered", "panic", rec, "stack", string(debug.Stack()))
+			if rec == http.ErrAbortHandler {
+				// net/http aborts the response without logging
+				panic(rec)
+			}
+			stack := debug.Stack()
+			attrs := append([]any{"panic", rec, "stack", string(stack)}, requestLogAttrs(r, start)...)
+			attrs = append(attrs, requestBodyAttrs(r)...)
+			ctx.Log().Error("panic recovered", attrs...)
+			recordPanic(r, rec, stack)
+
+			panicErr := fmt.Errorf("panic: %v", rec)
+			if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+				info.err = panicErr
+			}
 
-			srv, ok := ctx.ContextGet(CtxKeyServer).(*Server)
-			if ok && srv != nil && srv.errorFunc != nil {
-				panicErr := fmt.Errorf("panic: %v\n%s", rec, debug.Stack())
-				srv.errorFunc(ctx, panicErr)
+			if errorFunc := errorFuncFor(r); errorFunc != nil {
+				errorFunc(ctx, fmt.Errorf("%w\n%s", panicErr, stack))
+			} else if useDevErrorPage(ctx, http.StatusInternalServerError) {
+				writeDevErrorPage(ctx.w, r, http.StatusInternalServerError, panicErr, stack)
 			} else {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
@@ -32,15 +50,208 @@ func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	err := h(ctx)
 	if err != nil {
-		ctx.Log().Error("internal server error", "err", err, "code", http.StatusInternalServerError)
+		code, msg := http.StatusInternalServerError, err.Error()
+		var httpErr *HTTPError
+		cancelled := false
+		if !errors.As(err, &httpErr) {
+			httpErr, cancelled = contextHTTPError(r.Context(), err)
+			if cancelled {
+				err = httpErr
+			}
+		}
+		if httpErr != nil {
+			code, msg = httpErr.Code, httpErr.Message
+		}
 
-		srv, ok := ctx.ContextGet(CtxKeyServer).(*Server)
-		if ok && srv != nil && srv.errorFunc != nil {
-			srv.errorFunc(ctx, err)
+		if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+			info.err = err
+		}
+
+		attrs := append([]any{"err", err, "code", code}, requestLogAttrs(r, start)...)
+		attrs = append(attrs, requestBodyAttrs(r)...)
+		switch {
+		case cancelled:
+			// the client went away or the deadline passed, nothing is wrong with the server
+			ctx.Log().Debug("request cancelled", attrs...)
+		case code >= http.StatusInternalServerError:
+			ctx.Log().Error("internal server error", attrs...)
+		default:
+			ctx.Log().Info("client error", attrs...)
+		}
+
+		if errorFunc := errorFuncFor(r); errorFunc != nil {
+			errorFunc(ctx, err)
+		} else if useDevErrorPage(ctx, code) {
+			writeDevErrorPage(ctx.w, r, code, err, debug.Stack())
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, msg, code)
 		}
 
 		return
 	}
 }
+
+// errorFuncFor returns the ErrorFunc handling the errors of r: the one set with WithErrorFunc on
+// its route, or else on the closest of its groups, then Options.ErrorFunc. It returns nil when
+// none is set.
+func errorFuncFor(r *http.Request) ErrorFunc {
+	if info, ok := FromContext(r.Context(), requestInfoKey); ok && info.errorFunc != nil {
+		return info.errorFunc
+	}
+	if srv, ok := FromContext(r.Context(), CtxKeyServer); ok && srv != nil {
+		return srv.errorFunc
+	}
+	return nil
+}
+
+// requestInfo is shared by the handlers a request goes through, so error logs can tell
+// which route served it and for how long, wherever they are written.
+type requestInfo struct {
+	start time.Time
+	// path is the request path before any group prefix was stripped
+	path string
+	// prefix is the path of the groups the request was routed through
+	prefix string
+	// method and pattern are those of the matched route, the pattern includes the method and
+	// group prefix
+	method  string
+	pattern string
+	// host is the pattern of the HostGroup serving the request and subdomain the part of the
+	// host its wildcards matched
+	host      string
+	subdomain string
+	// clientIP is the address resolved by RealIPMiddleware
+	clientIP string
+	// https is set when a trusted proxy reported the request was made over HTTPS
+	https bool
+	// logRequests is the request log setting of the route, if it has one
+	logRequests *bool
+	// layout is the default layout set by the route or its groups
+	layout string
+	// errorFunc is the ErrorFunc set by the route or its groups
+	errorFunc ErrorFunc
+	// locale is the locale resolved by Context.Locale or set by Context.SetLocale
+	locale string
+	// body is the request body captured by Options.LogBodyOnError
+	body *capturedBody
+	// err is the error returned by the handler
+	err   error
+	trace TraceContext
+	// aborted is set when the response is aborted with http.ErrAbortHandler
+	aborted bool
+}
+
+// withRequestInfo adds a requestInfo to r unless it already has one.
+func withRequestInfo(r *http.Request) *http.Request {
+	if _, ok := FromContext(r.Context(), requestInfoKey); ok {
+		return r
+	}
+
+	info := &requestInfo{start: time.Now(), path: r.URL.Path}
+	info.trace, _ = traceFromHeaders(r.Header)
+	return r.WithContext(ContextWithValue(r.Context(), requestInfoKey, info))
+}
+
+// recordRoute records the pattern of route, qualified with the group prefix, and its request
+// log, layout and error handling settings as those of the route serving the request.
+func recordRoute(route Route, next http.Handler) http.Handler {
+	method, host, pth := PatternParts(route.Match)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+			h := host
+			if h == "" {
+				h = info.host
+			}
+			info.method = method
+			info.pattern = strings.TrimSpace(method + " " + h + info.prefix + pth)
+			if route.LogRequests != nil {
+				info.logRequests = route.LogRequests
+			}
+			if route.Layout != "" {
+				info.layout = route.Layout
+			}
+			if route.ErrorFunc != nil {
+				info.errorFunc = route.ErrorFunc
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MatchedRoute returns the method and the pattern, including group prefixes, of the route
+// serving r. The method is empty for routes matching any method. Route middleware sees them
+// before calling the handler; middleware wrapping the whole server only once it has returned,
+// as routing happens in between.
+func MatchedRoute(r *http.Request) (method, pattern string) {
+	if info, ok := FromContext(r.Context(), requestInfoKey); ok && info.pattern != "" {
+		return info.method, strings.TrimPrefix(info.pattern, info.method+" ")
+	}
+
+	method, host, pth := PatternParts(r.Pattern)
+	return method, host + pth
+}
+
+// requestLogAttrs describes r for error logs. The request ID comes with the scoped logger.
+// start is used for the duration when the request didn't go through a Server.
+func requestLogAttrs(r *http.Request, start time.Time) []any {
+	pth := r.URL.Path
+	info, ok := FromContext(r.Context(), requestInfoKey)
+	if ok {
+		pth, start = info.path, info.start
+	}
+
+	attrs := []any{"method", r.Method, "path", pth}
+	if ok && info.pattern != "" {
+		attrs = append(attrs, "pattern", info.pattern)
+	} else if r.Pattern != "" {
+		attrs = append(attrs, "pattern", r.Pattern)
+	}
+	return append(attrs, "ip", remoteIP(r.RemoteAddr), "duration", time.Since(start))
+}
+
+// StatusClientClosedRequest is the non-standard status, from nginx, of requests whose client
+// went away before the response was written.
+const StatusClientClosedRequest = 499
+
+// contextHTTPError maps an error caused by the end of the request context ctx to the response:
+// 499 when the request was cancelled and 504 when its deadline passed. Context errors while ctx
+// is still live, e.g. the timeout of a call to another service, are server errors and aren't
+// mapped.
+func contextHTTPError(ctx context.Context, err error) (*HTTPError, bool) {
+	if ctx.Err() == nil || !(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return nil, false
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return NewHTTPError(http.StatusGatewayTimeout, err), true
+	}
+	return NewHTTPError(StatusClientClosedRequest, err, "Client Closed Request"), true
+}
+
+// HTTPError is an error with an HTTP status code. Returning it from a HandlerFunc responds
+// with Code instead of 500. The ErrorFunc still receives the error when one is set.
+type HTTPError struct {
+	Code    int
+	Message string
+	Err     error
+}
+
+// NewHTTPError returns an HTTPError for code. The message defaults to the status text.
+func NewHTTPError(code int, err error, message ...string) *HTTPError {
+	msg := http.StatusText(code)
+	if len(message) > 0 {
+		msg = message[0]
+	}
+
+	return &HTTPError{Code: code, Message: msg, Err: err}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
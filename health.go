@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Defaults of the readiness endpoint.
+const (
+	DefaultReadyCheckTimeout = 2 * time.Second
+	DefaultReadyCacheTTL     = time.Second
+)
+
+// errCheckFailed replaces the errors of failed readiness checks outside ENVDev.
+var errCheckFailed = errors.New("check failed")
+
+// BuildInfo describes the running build, e.g. as set with -ldflags "-X main.version=...".
+// Empty fields default to the module version and the VCS revision and time recorded by the Go
+// toolchain, see debug.ReadBuildInfo.
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildTime string
+}
+
+// resolveBuildInfo fills the empty fields of build from debug.ReadBuildInfo.
+func resolveBuildInfo(build *BuildInfo) BuildInfo {
+	var info BuildInfo
+	if build != nil {
+		info = *build
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	// binaries built inside the module report "(devel)", which says nothing about the build
+	if info.Version == "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = s.Value
+		case s.Key == "vcs.time" && info.BuildTime == "":
+			info.BuildTime = s.Value
+		}
+	}
+	return info
+}
+
+// versionResponse is the body of the version endpoint.
+type versionResponse struct {
+	Version   string    `json:"version,omitempty"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildTime string    `json:"build_time,omitempty"`
+	GoVersion string    `json:"go_version"`
+	Started   time.Time `json:"started"`
+}
+
+// healthResponse is the body of the health endpoint.
+type healthResponse struct {
+	Status string `json:"status"`
+	// Uptime is in seconds
+	Uptime  int64  `json:"uptime"`
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+}
+
+// withHealth serves the health endpoint at path and passes every other request to next. It
+// runs before the session and server middleware, so probes don't load sessions and aren't logged.
+func withHealth(path string, info BuildInfo, started time.Time, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, ContentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		json.NewEncoder(w).Encode(healthResponse{
+			Status:  "ok",
+			Uptime:  int64(time.Since(started).Seconds()),
+			Version: info.Version,
+			Commit:  info.Commit,
+		})
+	})
+}
+
+// withVersion serves the version endpoint at path and passes every other request to next. Like
+// the health endpoint, it runs before the session and server middleware.
+func withVersion(path string, info BuildInfo, started time.Time, next http.Handler) http.Handler {
+	body := versionResponse{
+		Version:   info.Version,
+		Commit:    info.Commit,
+		BuildTime: info.BuildTime,
+		GoVersion: runtime.Version(),
+		Started:   started,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, ContentTypeJSON)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// AddReadinessCheck registers a dependency check for the readiness endpoint, replacing the
+// check registered under the same name. fn should return once ctx is done; the endpoint reports
+// it as failed when it takes longer than Options.ReadyCheckTimeout. Checks can be added while
+// the server is running.
+func (s *Server) AddReadinessCheck(name string, fn func(ctx context.Context) error) {
+	s.ready.add(name, fn)
+}
+
+type readyCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// readyResponse is the body of the readiness endpoint.
+type readyResponse struct {
+	Status string             `json:"status"`
+	Checks []readyCheckResult `json:"checks"`
+}
+
+type readyCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Latency is in milliseconds
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// readiness runs the readiness checks and caches their result for ttl.
+type readiness struct {
+	timeout time.Duration
+	ttl     time.Duration
+	// dev reports check errors as is
+	dev bool
+
+	mu       sync.Mutex
+	checks   []readyCheck
+	cached   *readyResponse
+	cachedAt time.Time
+	// gen counts the changes to checks
+	gen int
+
+	// running serializes the runs, so concurrent probes share one
+	running sync.Mutex
+}
+
+func newReadiness(timeout, ttl time.Duration, env ENVTypes) *readiness {
+	if timeout <= 0 {
+		timeout = DefaultReadyCheckTimeout
+	}
+	if ttl == 0 {
+		ttl = DefaultReadyCacheTTL
+	}
+	return &readiness{timeout: timeout, ttl: ttl, dev: env == ENVDev}
+}
+
+func (rd *readiness) add(name string, fn func(ctx context.Context) error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.cached = nil
+	rd.gen++
+	for i, c := range rd.checks {
+		if c.name == name {
+			rd.checks[i].fn = fn
+			return
+		}
+	}
+	rd.checks = append(rd.checks, readyCheck{name: name, fn: fn})
+}
+
+// lookup returns the cached result while it is fresh, and the checks to run and their
+// generation otherwise.
+func (rd *readiness) lookup() (*readyResponse, []readyCheck, int) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.cached != nil && time.Since(rd.cachedAt) < rd.ttl {
+		return rd.cached, nil, rd.gen
+	}
+	return nil, append([]readyCheck(nil), rd.checks...), rd.gen
+}
+
+// result runs the checks unless a fresh result is cached.
+func (rd *readiness) result(ctx context.Context) *readyResponse {
+	if res, _, _ := rd.lookup(); res != nil {
+		return res
+	}
+
+	rd.running.Lock()
+	defer rd.running.Unlock()
+	res, checks, gen := rd.lookup()
+	if res != nil {
+		return res
+	}
+
+	// the result is shared with other probes, a client going away must not fail it
+	ctx = context.WithoutCancel(ctx)
+	res = &readyResponse{Status: "ok", Checks: make([]readyCheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Checks[i] = rd.run(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	for _, c := range res.Checks {
+		if c.Status != "ok" {
+			res.Status = "unavailable"
+		}
+	}
+
+	rd.mu.Lock()
+	// a check added during the run invalidated the result
+	if rd.gen == gen {
+		rd.cached, rd.cachedAt = res, time.Now()
+	}
+	rd.mu.Unlock()
+	return res
+}
+
+// run runs c with the check timeout. A check ignoring ctx fails at the timeout and is left
+// running.
+func (rd *readiness) run(ctx context.Context, c readyCheck) readyCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- errPanic
+			}
+		}()
+		done <- c.fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := readyCheckResult{Name: c.name, Status: "ok", Latency: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		if !rd.dev {
+			err = errCheckFailed
+		}
+		res.Status, res.Error = "failed", err.Error()
+	}
+	return res
+}
+
+// withReady serves the readiness endpoint at path and passes every other request to next. Like
+// the health endpoint, it runs before the session and server middleware.
+func withReady(path string, rd *readiness, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := rd.result(r.Context())
+		status := http.StatusOK
+		if res.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set(HeaderContentType, ContentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+}
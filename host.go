@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostGroup serves the routes registered with HostGroup for the hosts matching labels.
+type hostGroup struct {
+	pattern string
+	labels  []string
+	// suffix is the number of literal labels at the end of the pattern
+	suffix  int
+	handler http.Handler
+
+	// name, middleware and routes describe the group for the route table
+	name       string
+	middleware int
+	routes     []Route
+}
+
+// HostGroup registers the routes fn adds for requests whose host matches hostPattern, e.g.
+// "{tenant}.example.com". A "{name}" label matches any single DNS label and is available as
+// the path value name, the labels left of the pattern's literal suffix through ctx.Subdomain().
+// Host groups are tried in the order they are registered, before the routes without a host.
+// Named routes resolve to their path, prefixed with the group name as for Group.
+//
+// HostGroup panics if hostPattern is empty, if a route name is taken, or if the group's named
+// middleware can't be resolved. It is only supported on the server, not inside a Group.
+func (s *Server) HostGroup(hostPattern, name string, fn func(srv *Server)) {
+	hostPattern = strings.ToLower(strings.TrimSuffix(hostPattern, "."))
+	if hostPattern == "" {
+		panic("HostGroup: empty host pattern")
+	}
+
+	mux := http.NewServeMux()
+	sub := &Server{log: s.log, routeNames: make(map[string]string)}
+	fn(sub)
+
+	for _, r := range sub.routes {
+		mux.Handle(r.Match, r.handler())
+		if r.Name != "" {
+			_, _, pth := PatternParts(r.Match)
+			if err := s.addRouteName(fmt.Sprint(name, "/", r.Name), pth); err != nil {
+				panic(fmt.Sprintf("HostGroup(%q): %v", hostPattern, err))
+			}
+		}
+	}
+	for subName, subPath := range sub.routeNames {
+		if err := s.addRouteName(fmt.Sprint(name, "/", subName), subPath); err != nil {
+			panic(fmt.Sprintf("HostGroup(%q): %v", hostPattern, err))
+		}
+	}
+
+	mwChain, _, err := sub.middlewareChain()
+	if err != nil {
+		panic(fmt.Sprintf("HostGroup(%q): %v", hostPattern, err))
+	}
+
+	g := hostGroup{
+		pattern: hostPattern,
+		labels:  strings.Split(hostPattern, "."),
+		handler: mwChain.Then(mux),
+
+		name:       name,
+		middleware: len(mwChain),
+		routes:     sub.routes,
+	}
+	for i := len(g.labels) - 1; i >= 0 && !isHostWildcard(g.labels[i]); i-- {
+		g.suffix++
+	}
+	s.hostGroups = append(s.hostGroups, g)
+	if sub.hasLogOverrides() {
+		s.logOverrides = true
+	}
+}
+
+func isHostWildcard(label string) bool {
+	return len(label) > 2 && label[0] == '{' && label[len(label)-1] == '}'
+}
+
+// match reports whether host matches the group, setting the values of the wildcard labels on r.
+func (g hostGroup) match(host string, r *http.Request) bool {
+	labels := strings.Split(host, ".")
+	if len(labels) != len(g.labels) {
+		return false
+	}
+	for i, label := range g.labels {
+		if label != labels[i] && (!isHostWildcard(label) || labels[i] == "") {
+			return false
+		}
+	}
+
+	for i, label := range g.labels {
+		if isHostWildcard(label) {
+			r.SetPathValue(label[1:len(label)-1], labels[i])
+		}
+	}
+	return true
+}
+
+// hostRouter sends requests to the first host group matching their host, and the others to next.
+func (s *Server) hostRouter(next http.Handler) http.Handler {
+	if len(s.hostGroups) == 0 {
+		return next
+	}
+
+	groups := s.hostGroups
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		for _, g := range groups {
+			if !g.match(host, r) {
+				continue
+			}
+			if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+				info.host = g.pattern
+				info.subdomain = strings.Join(strings.Split(host, ".")[:len(g.labels)-g.suffix], ".")
+			}
+			g.handler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestHost returns the host r was sent to, lowercase and without port or trailing dot.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
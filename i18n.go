@@ -0,0 +1,327 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoI18n            = errors.New("i18n not configured")
+	ErrUnsupportedLocale = errors.New("unsupported locale")
+)
+
+// DefaultLocaleParam is the query parameter and the cookie a locale is chosen with, unless
+// I18nOptions.QueryParam or I18nOptions.Cookie is set.
+const DefaultLocaleParam = "lang"
+
+// LocaleSessionKey is the session key Context.SetLocale stores the chosen locale under.
+const LocaleSessionKey = "server.locale"
+
+// localeCookieMaxAge keeps the locale chosen with Context.SetLocale for a year.
+const localeCookieMaxAge = 365 * 24 * 60 * 60
+
+// I18nOptions configures Context.T and the t template function. Messages are read from one
+// JSON file per locale, named after it, e.g. en.json and pt-BR.json:
+//
+//	{"nav": {"home": "Home"}, "inbox": {"zero": "No messages", "one": "One message", "other": "%d messages"}}
+//
+// Nested objects are flattened into dotted keys, "nav.home". An object of plural forms, with
+// "other" and any of "zero", "one" and "two", is a plural message: the form is picked by the
+// first argument, "zero" and "two" only being used when present.
+type I18nOptions struct {
+	// FS holds the message files, or its Dir subdirectory does. Without FS they are read from
+	// the Dir directory.
+	FS  fs.FS
+	Dir string
+	// Default is the locale of the requests that don't ask for a supported one, and the
+	// messages of other locales fall back to it. Its file must exist.
+	Default string
+	// QueryParam is the query parameter a request chooses its locale with, e.g. ?lang=fr.
+	// Defaults to DefaultLocaleParam.
+	QueryParam string
+	// Cookie is the cookie Context.SetLocale stores the chosen locale in. Defaults to
+	// DefaultLocaleParam.
+	Cookie string
+}
+
+// i18n holds the messages of the locales and resolves the locale of requests.
+type i18n struct {
+	opts I18nOptions
+	srv  *Server
+	// locales lists the loaded locales, the default one first
+	locales  []string
+	messages map[string]map[string]i18nMessage
+	// missing holds the keys already logged as missing
+	missing sync.Map
+}
+
+// i18nMessage is a message, or the forms of a plural message.
+type i18nMessage struct {
+	text   string
+	plural map[string]string
+}
+
+var pluralForms = []string{"zero", "one", "two", "other"}
+
+func newI18n(srv *Server, opts I18nOptions) (*i18n, error) {
+	if opts.Default == "" {
+		return nil, errors.New("i18n: Default must be set")
+	}
+	if opts.QueryParam == "" {
+		opts.QueryParam = DefaultLocaleParam
+	}
+	if opts.Cookie == "" {
+		opts.Cookie = DefaultLocaleParam
+	}
+
+	fsys := opts.FS
+	switch {
+	case fsys == nil && opts.Dir == "":
+		return nil, errors.New("i18n: either Dir or FS must be set")
+	case fsys == nil:
+		fsys = os.DirFS(opts.Dir)
+	case opts.Dir != "" && opts.Dir != ".":
+		sub, err := fs.Sub(fsys, opts.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("i18n: %w", err)
+		}
+		fsys = sub
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("i18n: %w", err)
+	}
+
+	i := &i18n{opts: opts, srv: srv, messages: make(map[string]map[string]i18nMessage)}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		locale := strings.TrimSuffix(entry.Name(), ".json")
+		messages, err := readMessages(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		i.messages[locale] = messages
+		if locale != opts.Default {
+			i.locales = append(i.locales, locale)
+		}
+	}
+	if _, ok := i.messages[opts.Default]; !ok {
+		return nil, fmt.Errorf("i18n: no messages for the default locale %q", opts.Default)
+	}
+	slices.Sort(i.locales)
+	i.locales = append([]string{opts.Default}, i.locales...)
+	return i, nil
+}
+
+// readMessages reads the message file name, flattening it into dotted keys.
+func readMessages(fsys fs.FS, name string) (map[string]i18nMessage, error) {
+	src, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("i18n: %w", err)
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(src, &tree); err != nil {
+		return nil, fmt.Errorf("i18n: %s: %w", name, err)
+	}
+
+	messages := make(map[string]i18nMessage)
+	if err := flattenMessages(messages, "", tree); err != nil {
+		return nil, fmt.Errorf("i18n: %s: %w", name, err)
+	}
+	return messages, nil
+}
+
+func flattenMessages(messages map[string]i18nMessage, prefix string, tree map[string]any) error {
+	for k, v := range tree {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch v := v.(type) {
+		case string:
+			messages[key] = i18nMessage{text: v}
+		case map[string]any:
+			if plural, ok := pluralMessage(v); ok {
+				messages[key] = i18nMessage{plural: plural}
+				continue
+			}
+			if err := flattenMessages(messages, key, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%q is neither a string nor an object", key)
+		}
+	}
+	return nil
+}
+
+// pluralMessage returns the forms of obj when it is a plural message.
+func pluralMessage(obj map[string]any) (map[string]string, bool) {
+	if _, ok := obj["other"]; !ok {
+		return nil, false
+	}
+
+	forms := make(map[string]string, len(obj))
+	for k, v := range obj {
+		text, ok := v.(string)
+		if !ok || !slices.Contains(pluralForms, k) {
+			return nil, false
+		}
+		forms[k] = text
+	}
+	return forms, true
+}
+
+// format returns the message for args, formatted with fmt.Sprintf when it has verbs.
+func (m i18nMessage) format(args []any) string {
+	text := m.text
+	if m.plural != nil {
+		text = m.plural["other"]
+		if len(args) > 0 {
+			if n, ok := pluralCount(args[0]); ok {
+				text = m.form(n)
+			}
+		}
+	}
+
+	if len(args) == 0 || !strings.Contains(text, "%") {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// form returns the plural form for the count n.
+func (m i18nMessage) form(n int64) string {
+	var form string
+	switch n {
+	case 0:
+		form = "zero"
+	case 1:
+		form = "one"
+	case 2:
+		form = "two"
+	}
+	if text, ok := m.plural[form]; ok {
+		return text
+	}
+	return m.plural["other"]
+}
+
+// pluralCount returns v as a count when it is an integer.
+func pluralCount(v any) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.CanInt():
+		return rv.Int(), true
+	case rv.CanUint():
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// translate returns the message key of locale formatted with args. Messages missing from
+// locale are looked up in its primary language, then in the default locale. A message missing
+// everywhere is logged once and rendered as its key.
+func (i *i18n) translate(locale, key string, args []any) string {
+	for _, l := range []string{locale, primarySubtag(locale), i.opts.Default} {
+		if msg, ok := i.messages[l][key]; ok {
+			return msg.format(args)
+		}
+	}
+
+	if _, logged := i.missing.LoadOrStore(key, true); !logged {
+		i.srv.logger().Warn("missing translation", "key", key, "locale", locale)
+	}
+	return key
+}
+
+// resolve returns the locale of r: the one chosen with the query parameter, then the one
+// stored by Context.SetLocale in the session or the cookie, then the Accept-Language match.
+func (i *i18n) resolve(r *http.Request) string {
+	if locale, ok := matchTag(r.URL.Query().Get(i.opts.QueryParam), i.locales); ok {
+		return locale
+	}
+	if sess, ok := FromContext(r.Context(), CtxKeySessionMgr); ok && sess != nil {
+		if locale, ok := matchTag(sess.GetString(r.Context(), LocaleSessionKey), i.locales); ok {
+			return locale
+		}
+	}
+	if cookie, err := r.Cookie(i.opts.Cookie); err == nil {
+		if locale, ok := matchTag(cookie.Value, i.locales); ok {
+			return locale
+		}
+	}
+	return matchLanguage(r.Header.Get("Accept-Language"), i.locales)
+}
+
+// Locale returns the locale of the request, see Options.I18n. It is resolved once per request,
+// and is empty when Options.I18n isn't set.
+func (c *HandlerContext) Locale() string {
+	if c.srv == nil || c.srv.i18n == nil {
+		return ""
+	}
+
+	info, ok := FromContext(c.Request().Context(), requestInfoKey)
+	if ok && info.locale != "" {
+		return info.locale
+	}
+	locale := c.srv.i18n.resolve(c.Request())
+	if ok {
+		info.locale = locale
+	}
+	return locale
+}
+
+// SetLocale makes locale the locale of the request and, through a cookie and the session when
+// there is one, of the following requests. It returns ErrUnsupportedLocale when there are no
+// messages for locale.
+func (c *HandlerContext) SetLocale(locale string) error {
+	if c.srv == nil || c.srv.i18n == nil {
+		return ErrNoI18n
+	}
+	i := c.srv.i18n
+	supported, ok := matchTag(locale, i.locales)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnsupportedLocale, locale)
+	}
+
+	http.SetCookie(c.Response(), &http.Cookie{
+		Name:     i.opts.Cookie,
+		Value:    supported,
+		Path:     "/",
+		MaxAge:   localeCookieMaxAge,
+		HttpOnly: true,
+		Secure:   c.IsHTTPS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if sess := c.Session(); sess != nil {
+		sess.Put(LocaleSessionKey, supported)
+	}
+	if info, ok := FromContext(c.Request().Context(), requestInfoKey); ok {
+		info.locale = supported
+	}
+	return nil
+}
+
+// T returns the message key in the locale of the request, formatted with args. See I18nOptions
+// for plural messages. Missing messages, or all of them without Options.I18n, render as key.
+func (c *HandlerContext) T(key string, args ...any) string {
+	if c.srv == nil || c.srv.i18n == nil {
+		return key
+	}
+	return c.srv.i18n.translate(c.Locale(), key, args)
+}
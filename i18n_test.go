@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext_T(t *testing.T) {
+	messages := fstest.MapFS{
+		"locales/en.json": {Data: []byte(`{
+			"nav": {"home": "Home", "docs": "Docs"},
+			"inbox": {"zero": "No messages", "one": "One message", "other": "%d messages"},
+			"hello": "Hello %s"
+		}`)},
+		"locales/fr.json": {Data: []byte(`{
+			"nav": {"home": "Accueil"},
+			"inbox": {"one": "%d message", "other": "%d messages"}
+		}`)},
+	}
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"nav.tmpl": {Data: []byte(`{{t "nav.home"}} {{t "nav.docs"}} {{t "inbox" .Count}}`)},
+	}})
+	require.NoError(t, err)
+
+	var logs bytes.Buffer
+	srv, err := Init(Options{
+		Templates: tmpl,
+		Log:       slog.New(slog.NewTextHandler(&logs, nil)),
+		I18n:      I18nOptions{FS: messages, Dir: "locales", Default: "en"},
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /t", func(ctx Context) error {
+		return ctx.String(http.StatusOK, ctx.Locale()+": "+ctx.T("nav.home")+", "+ctx.T("hello", "Ann")+", "+ctx.T("inbox", 0)+", "+ctx.T("nav.missing"))
+	})
+	srv.HandleFunc("GET /nav", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "nav", Data: map[string]any{"Count": 1}})
+	})
+	srv.HandleFunc("POST /locale", func(ctx Context) error {
+		if err := ctx.SetLocale(ctx.Param("lang")); err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+		return ctx.String(http.StatusOK, ctx.T("nav.home"))
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/t", nil)
+	assert.Equal(t, "en: Home, Hello Ann, No messages, nav.missing", rec.Body.String())
+
+	rec = serve(http.MethodGet, "/t", http.Header{"Accept-Language": {"fr-CA, en;q=0.5"}})
+	assert.Equal(t, "fr: Accueil, Hello Ann, 0 messages, nav.missing", rec.Body.String(), "fr falls back to en and has no zero form")
+	assert.Equal(t, 1, strings.Count(logs.String(), "missing translation"), "a missing key is logged once")
+	assert.Contains(t, logs.String(), "key=nav.missing")
+
+	rec = serve(http.MethodGet, "/nav?lang=fr", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "Accueil Docs 1 message", rec.Body.String(), "the query parameter wins")
+	rec = serve(http.MethodGet, "/nav", http.Header{"Cookie": {"lang=fr"}})
+	assert.Equal(t, "Accueil Docs 1 message", rec.Body.String())
+	rec = serve(http.MethodGet, "/nav", nil)
+	assert.Equal(t, "Home Docs One message", rec.Body.String())
+
+	rec = serve(http.MethodPost, "/locale?lang=FR", nil)
+	assert.Equal(t, "Accueil", rec.Body.String())
+	cookie := rec.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, "lang=fr;")
+	assert.Contains(t, cookie, "HttpOnly")
+
+	rec = serve(http.MethodPost, "/locale?lang=de", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `unsupported locale: "de"`, rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Set-Cookie"))
+}
+
+func TestInit_I18nErrors(t *testing.T) {
+	messages := fstest.MapFS{"en.json": {Data: []byte(`{"count": 1}`)}}
+
+	_, err := Init(Options{I18n: I18nOptions{FS: messages}})
+	assert.EqualError(t, err, "i18n: Default must be set")
+
+	_, err = Init(Options{I18n: I18nOptions{FS: messages, Default: "en"}})
+	assert.EqualError(t, err, `i18n: en.json: "count" is neither a string nor an object`)
+
+	_, err = Init(Options{I18n: I18nOptions{FS: fstest.MapFS{"fr.json": {Data: []byte(`{}`)}}, Default: "en"}})
+	assert.EqualError(t, err, `i18n: no messages for the default locale "en"`)
+}
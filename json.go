@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// JSONEncodeOptions are the encoding settings of the JSON responses, see Options.JSONEncoder.
+type JSONEncodeOptions struct {
+	// EscapeHTML escapes <, > and & in strings, as json.Encoder does by default.
+	EscapeHTML bool
+	// Indent indents nested elements with this string; the output is compact when it is empty.
+	Indent string
+}
+
+// JSONEncoder encodes the JSON responses of Context.JSON, StreamArray and negotiated Render
+// calls, e.g. to use another JSON library.
+type JSONEncoder interface {
+	// EncodeJSON writes v to w as JSON followed by a newline.
+	EncodeJSON(w io.Writer, v any, opts JSONEncodeOptions) error
+}
+
+// StdJSONEncoder is the default JSONEncoder, using encoding/json.
+type StdJSONEncoder struct{}
+
+func (StdJSONEncoder) EncodeJSON(w io.Writer, v any, opts JSONEncodeOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(opts.EscapeHTML)
+	if opts.Indent != "" {
+		enc.SetIndent("", opts.Indent)
+	}
+	return enc.Encode(v)
+}
+
+// DefaultJSONDevIndent indents the JSON responses in ENVDev unless Options.JSONIndent is set.
+const DefaultJSONDevIndent = "  "
+
+// encodeJSON encodes v into buf with the server's encoder and settings, so nothing is written
+// to the response before the whole value is encoded.
+func (c *HandlerContext) encodeJSON(buf *bytes.Buffer, v any, indent bool) error {
+	opts := c.srv.jsonOpts
+	if !indent {
+		opts.Indent = ""
+	}
+	return c.srv.jsonEncoder.EncodeJSON(buf, v, opts)
+}
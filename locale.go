@@ -0,0 +1,92 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type weightedLanguage struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the language tags in header ordered by preference.
+// Malformed entries are skipped and entries with q=0 are dropped.
+func parseAcceptLanguage(header string) []weightedLanguage {
+	var langs []weightedLanguage
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		if params != "" {
+			key, val, ok := strings.Cut(strings.TrimSpace(params), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		if q > 0 {
+			langs = append(langs, weightedLanguage{tag: tag, q: q})
+		}
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	return langs
+}
+
+// matchLanguage returns the supported language that best matches the Accept-Language header,
+// or the first supported language when nothing matches. A language matches exactly or by its
+// primary subtag, so "en-US" matches a supported "en" and "en" matches a supported "en-GB".
+func matchLanguage(header string, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+
+	for _, lang := range parseAcceptLanguage(header) {
+		if lang.tag == "*" {
+			return supported[0]
+		}
+		if s, ok := matchTag(lang.tag, supported); ok {
+			return s
+		}
+	}
+
+	return supported[0]
+}
+
+// matchTag returns the supported language matching tag exactly or by its primary subtag.
+func matchTag(tag string, supported []string) (string, bool) {
+	for _, s := range supported {
+		if strings.EqualFold(tag, s) {
+			return s, true
+		}
+	}
+
+	primary := primarySubtag(tag)
+	for _, s := range supported {
+		if strings.EqualFold(primary, primarySubtag(s)) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func primarySubtag(tag string) string {
+	primary, _, _ := strings.Cut(tag, "-")
+	return primary
+}
+
+func (c *HandlerContext) PreferredLanguage(supported ...string) string {
+	return matchLanguage(c.Request().Header.Get("Accept-Language"), supported)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	supported := []string{"en", "fr", "de-CH", "pt-BR"}
+
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "exact match", header: "fr", expected: "fr"},
+		{name: "weighted", header: "de;q=0.5, fr;q=0.8, es", expected: "fr"},
+		{name: "region falls back to primary", header: "fr-CA, en;q=0.9", expected: "fr"},
+		{name: "primary matches region", header: "pt, en;q=0.1", expected: "pt-BR"},
+		{name: "case insensitive", header: "DE-ch", expected: "de-CH"},
+		{name: "excluded with q=0", header: "fr;q=0, de;q=0.2", expected: "de-CH"},
+		{name: "wildcard", header: "es, *;q=0.5", expected: "en"},
+		{name: "no match", header: "ja, zh;q=0.9", expected: "en"},
+		{name: "missing header", expected: "en"},
+		{name: "malformed", header: ";;, fr;q=abc, ,de;q=2, pt-BR;q=0.3", expected: "pt-BR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Accept-Language", tt.header)
+			}
+
+			ctx := &HandlerContext{w: httptest.NewRecorder(), r: r}
+			assert.Equal(t, tt.expected, ctx.PreferredLanguage(supported...))
+		})
+	}
+
+	t.Run("no supported languages", func(t *testing.T) {
+		assert.Equal(t, "", matchLanguage("en", nil))
+	})
+}
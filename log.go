@@ -1,11 +1,18 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 var appLog *slog.Logger
@@ -24,35 +31,283 @@ const (
 )
 
 func InitLog(env ENVTypes, logLevel slog.Level, setLogDefault bool) error {
+	return InitLogWithOptions(LogOptions{Env: env, Level: logLevel, SetDefault: setLogDefault})
+}
+
+// LogOptions configures InitLogWithOptions.
+type LogOptions struct {
+	Env        ENVTypes
+	Level      slog.Level
+	SetDefault bool
+	// Output is where logs are written. Defaults to stdout in production and staging and
+	// stderr otherwise.
+	Output io.Writer
+	// File writes logs to a rotating file. It takes precedence over Output.
+	File *LogFileOptions
+	// Outputs sends every record to several destinations, each with its own format and
+	// level. When set, Output and File are ignored.
+	Outputs []LogOutput
+	// Sampling drops a share of high-volume records. See SamplingHandler.
+	Sampling *SamplingOptions
+}
+
+type LogFormat string
+
+const (
+	// LogFormatEnv picks JSON in production and staging and text otherwise.
+	LogFormatEnv  LogFormat = ""
+	LogFormatJSON LogFormat = "json"
+	// LogFormatText is the CustomLogHandler format.
+	LogFormatText LogFormat = "text"
+)
+
+// LogOutput is one destination of LogOptions.Outputs.
+type LogOutput struct {
+	// Writer is where the records are written. Defaults like LogOptions.Output.
+	Writer io.Writer
+	// File writes to a rotating file instead of Writer.
+	File   *LogFileOptions
+	Format LogFormat
+	// Level is the minimum level for this output. Records below the global level
+	// (see SetLogLevel) are dropped regardless.
+	Level slog.Leveler
+}
+
+// logLevel is the level of the logger set up by InitLog. It can be changed at runtime.
+var logLevel = new(slog.LevelVar)
+
+// SetLogLevel changes the level of the logger set up by InitLog, including loggers derived from it.
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// LogLevel returns the current level of the logger set up by InitLog.
+func LogLevel() slog.Level {
+	return logLevel.Level()
+}
+
+// LogLevelPath is where the log level endpoint is mounted when Options.EnableLogLevelEndpoint is set.
+const LogLevelPath = "/_admin/log-level"
+
+// logLevelHandler returns the log level on GET and sets it from the request body
+// ("debug", "info", "warn" or "error") on PUT.
+func logLevelHandler(ctx Context) error {
+	switch ctx.Request().Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(ctx.Request().Body, 64))
+		if err != nil {
+			return NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText(bytes.TrimSpace(body)); err != nil {
+			return NewHTTPError(http.StatusBadRequest, err, fmt.Sprintf("invalid log level %q", body))
+		}
+
+		SetLogLevel(level)
+		ctx.Log().Info("log level changed", "level", level)
+	default:
+		ctx.Response().Header().Set("Allow", "GET, PUT")
+		return NewHTTPError(http.StatusMethodNotAllowed, nil)
+	}
+
+	return ctx.String(http.StatusOK, LogLevel().String())
+}
+
+// maxLeveler is the higher of two levels.
+type maxLeveler struct {
+	a, b slog.Leveler
+}
+
+func (l maxLeveler) Level() slog.Level {
+	return max(l.a.Level(), l.b.Level())
+}
 
-	option := &slog.HandlerOptions{
-		AddSource: true,
-		Level:     logLevel,
+var (
+	// logFilesMu guards logFiles, swapped by InitLogWithOptions and rotated by RotateLog
+	logFilesMu sync.Mutex
+	// logFiles are the files opened by the last InitLogWithOptions call, if any.
+	logFiles []*RotatingFile
+)
+
+// InitLogWithOptions configures the application logger. Unless set otherwise by LogOutput.Format,
+// the log format follows the environment: JSON in production and staging, CustomLogHandler otherwise.
+//
+// Calling it again closes the LogOutput.File files of the previous call once the new logger is
+// installed. Loggers built on the previous one, e.g. passed to Options.Log or SetLogger, taken
+// from slog.Default or scoped to a request in flight, then stop writing to those files: their
+// records are dropped, so build them again from the new logger.
+func InitLogWithOptions(opts LogOptions) error {
+	logLevel.Set(opts.Level)
+
+	outputs := opts.Outputs
+	if len(outputs) == 0 {
+		outputs = []LogOutput{{Writer: opts.Output, File: opts.File}}
 	}
 
-	if env == ENVProduction || env == ENVStaging {
-		appLog = slog.New(slog.NewJSONHandler(os.Stdout, option))
-	} else {
-		appLog = slog.New(NewCustomLogHandler(os.Stderr, option))
+	var files []*RotatingFile
+	handlers := make([]slog.Handler, 0, len(outputs))
+	for _, o := range outputs {
+		var out io.Writer = os.Stderr
+		if opts.Env == ENVProduction || opts.Env == ENVStaging {
+			out = os.Stdout
+		}
+		if o.Writer != nil {
+			out = o.Writer
+		}
+
+		if o.File != nil {
+			rf, err := OpenRotatingFile(*o.File)
+			if err != nil {
+				for _, f := range files {
+					f.Close()
+				}
+				return err
+			}
+			files = append(files, rf)
+			out = rf
+		}
+
+		option := &slog.HandlerOptions{
+			AddSource: true,
+			Level:     logLevel,
+		}
+		if o.Level != nil {
+			option.Level = maxLeveler{logLevel, o.Level}
+		}
+
+		format := o.Format
+		if format == LogFormatEnv {
+			format = LogFormatText
+			if opts.Env == ENVProduction || opts.Env == ENVStaging {
+				format = LogFormatJSON
+			}
+		}
+
+		if format == LogFormatJSON {
+			handlers = append(handlers, slog.NewJSONHandler(out, option))
+		} else {
+			handlers = append(handlers, NewCustomLogHandler(out, option))
+		}
 	}
 
-	if setLogDefault {
+	handler := handlers[0]
+	if len(handlers) > 1 {
+		handler = NewMultiHandler(handlers...)
+	}
+
+	if opts.Sampling != nil {
+		handler = NewSamplingHandler(handler, *opts.Sampling)
+	}
+	appLog = slog.New(handler)
+
+	if opts.SetDefault {
 		slog.SetDefault(appLog)
 	}
 
+	// the previous files are closed once nothing new logs to them
+	logFilesMu.Lock()
+	previous := logFiles
+	logFiles = files
+	logFilesMu.Unlock()
+	for _, f := range previous {
+		f.Close()
+	}
+
 	return nil
 }
 
+// RotateLog forces a rotation of the log files configured with InitLogWithOptions.
+func RotateLog() error {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if len(logFiles) == 0 {
+		return errors.New("no log file configured")
+	}
+
+	var errs []error
+	for _, f := range logFiles {
+		errs = append(errs, f.Rotate())
+	}
+	return errors.Join(errs...)
+}
+
+// MultiHandler is a slog.Handler that sends every record to each of its handlers that is
+// enabled for the record's level.
+type MultiHandler struct {
+	handlers []slog.Handler
+}
+
+// NewMultiHandler returns a handler fanning out to handlers.
+func NewMultiHandler(handlers ...slog.Handler) *MultiHandler {
+	return &MultiHandler{handlers: handlers}
+}
+
+// Enabled reports whether any of the handlers is enabled for level.
+func (h *MultiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, child := range h.handlers {
+		if child.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle passes r to every enabled handler. A failing handler doesn't stop the others;
+// their errors are joined.
+func (h *MultiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, child := range h.handlers {
+		if !child.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := child.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *MultiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, child := range h.handlers {
+		handlers[i] = child.WithAttrs(attrs)
+	}
+	return &MultiHandler{handlers: handlers}
+}
+
+func (h *MultiHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, child := range h.handlers {
+		handlers[i] = child.WithGroup(name)
+	}
+	return &MultiHandler{handlers: handlers}
+}
+
 // CustomLogHandler is a custom slog handler that displays time (YYYY/MM/DD HH:MM:SS)
 // without a key, followed by Level, Message and any other provided attributes
 type CustomLogHandler struct {
 	slog.Handler
 	opts *slog.HandlerOptions
-	w    *os.File
+	w    io.Writer
+	// mu serializes writes to w and is shared with handlers derived by WithAttrs and WithGroup
+	mu *sync.Mutex
+	// preformatted holds the attributes added with WithAttrs, already rendered
+	preformatted string
+	// groupPrefix is the dotted path of the groups opened with WithGroup
+	groupPrefix string
+	// color is set when w is a terminal and NO_COLOR isn't set
+	color bool
+
+	// NoColor disables colored output even when writing to a terminal
+	NoColor bool
 }
 
-// NewCustomLogHandler creates a new CustomHandler that writes to w
-func NewCustomLogHandler(w *os.File, opts *slog.HandlerOptions) *CustomLogHandler {
+// NewCustomLogHandler creates a new CustomHandler that writes to w. Each record is written
+// with a single Write call, and writes are serialized so w doesn't need to be safe for
+// concurrent use.
+func NewCustomLogHandler(w io.Writer, opts *slog.HandlerOptions) *CustomLogHandler {
 	if opts == nil {
 		opts = &slog.HandlerOptions{}
 	}
@@ -61,6 +316,40 @@ func NewCustomLogHandler(w *os.File, opts *slog.HandlerOptions) *CustomLogHandle
 		Handler: slog.NewTextHandler(w, opts),
 		opts:    opts,
 		w:       w,
+		mu:      &sync.Mutex{},
+		color:   isTerminal(w) && os.Getenv("NO_COLOR") == "",
+	}
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiGrey   = "\x1b[90m"
+)
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || f == nil {
+		return false
+	}
+
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return ansiRed
+	case level >= slog.LevelWarn:
+		return ansiYellow
+	case level >= slog.LevelInfo:
+		return ansiGreen
+	default:
+		return ansiGrey
 	}
 }
 
@@ -68,48 +357,112 @@ func NewCustomLogHandler(w *os.File, opts *slog.HandlerOptions) *CustomLogHandle
 func (h *CustomLogHandler) Handle(ctx context.Context, r slog.Record) error {
 	timeStr := r.Time.Format("2006/01/02 15:04:05")
 
-	// Create a new record with the formatted time and same attributes
-	attrs := make([]slog.Attr, 0)
-	r.Attrs(func(a slog.Attr) bool {
-		attrs = append(attrs, a)
-		return true
-	})
-
 	// Build the log line with custom format
 	level := r.Level.String()
 	message := r.Message
 
+	color := h.color && !h.NoColor
+	if color {
+		timeStr = ansiDim + timeStr + ansiReset
+		level = levelColor(r.Level) + level + ansiReset
+	}
+
 	// Start with formatted time
 	line := timeStr + " " + level + " " + message
 
-	// Create a buffer for the attributes
+	// Create a buffer for the attributes, starting with the ones bound to the handler
 	var buf strings.Builder
-	for _, attr := range attrs {
-		buf.WriteString(" ")
-		buf.WriteString(attr.Key)
-		buf.WriteString("=")
-		buf.WriteString(attr.Value.String())
-	}
+	buf.WriteString(h.preformatted)
+	r.Attrs(func(a slog.Attr) bool {
+		if color && r.Level >= slog.LevelError && a.Key == "err" {
+			buf.WriteString(ansiRed)
+			writeAttr(&buf, h.groupPrefix, a)
+			buf.WriteString(ansiReset)
+			return true
+		}
 
-	line += buf.String()
+		writeAttr(&buf, h.groupPrefix, a)
+		return true
+	})
+
+	line += buf.String() + "\n"
 
 	// Write to the output
-	_, err := fmt.Fprintln(h.w, line)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
 	return err
 }
 
-// WithAttrs implements slog.Handler.WithAttrs
+// WithAttrs implements slog.Handler.WithAttrs. The attributes are rendered ahead of the
+// record's own attributes, in the same order as the JSON handler.
 func (h *CustomLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &CustomLogHandler{
-		Handler: h.Handler.WithAttrs(attrs),
-		opts:    h.opts,
+	var buf strings.Builder
+	for _, a := range attrs {
+		writeAttr(&buf, h.groupPrefix, a)
 	}
+
+	h2 := *h
+	h2.Handler = h.Handler.WithAttrs(attrs)
+	h2.preformatted = h.preformatted + buf.String()
+	return &h2
 }
 
 // WithGroup implements slog.Handler.WithGroup
 func (h *CustomLogHandler) WithGroup(name string) slog.Handler {
-	return &CustomLogHandler{
-		Handler: h.Handler.WithGroup(name),
-		opts:    h.opts,
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.Handler = h.Handler.WithGroup(name)
+	h2.groupPrefix = joinKey(h.groupPrefix, name)
+	return &h2
+}
+
+// writeAttr writes a as " key=value", qualifying the key with prefix.
+// Group attributes are flattened into dotted keys.
+func writeAttr(buf *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		// a group with an empty key is inlined
+		if a.Key != "" {
+			prefix = joinKey(prefix, a.Key)
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(buf, prefix, ga)
+		}
+		return
+	}
+
+	buf.WriteString(" ")
+	buf.WriteString(joinKey(prefix, a.Key))
+	buf.WriteString("=")
+	buf.WriteString(quoteLogValue(a.Value.String()))
+}
+
+// quoteLogValue quotes v when it is empty or contains characters that would make the
+// key=value pairs ambiguous, so the line stays parseable.
+func quoteLogValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+
+	for _, c := range v {
+		if c == ' ' || c == '=' || c == '"' || !unicode.IsPrint(c) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
 	}
+	return prefix + "." + key
 }
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomLogHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		logger   func(l *slog.Logger) *slog.Logger
+		expected string
+	}{
+		{
+			name:     "plain",
+			logger:   func(l *slog.Logger) *slog.Logger { return l },
+			expected: "INFO request path=/hello",
+		},
+		{
+			name:     "with attrs",
+			logger:   func(l *slog.Logger) *slog.Logger { return l.With("reqID", "abc") },
+			expected: "INFO request reqID=abc path=/hello",
+		},
+		{
+			name:     "with attrs and group",
+			logger:   func(l *slog.Logger) *slog.Logger { return l.With("reqID", "abc").WithGroup("http") },
+			expected: "INFO request reqID=abc http.path=/hello",
+		},
+		{
+			name: "nested groups",
+			logger: func(l *slog.Logger) *slog.Logger {
+				return l.WithGroup("http").With("method", "GET").WithGroup("req")
+			},
+			expected: "INFO request http.method=GET http.req.path=/hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+			require.NoError(t, err)
+			defer f.Close()
+
+			logger := tt.logger(slog.New(NewCustomLogHandler(f, nil)))
+			logger.Info("request", "path", "/hello")
+
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			out, err := io.ReadAll(f)
+			require.NoError(t, err)
+
+			// strip the "YYYY/MM/DD HH:MM:SS " prefix
+			require.Greater(t, len(out), 20)
+			assert.Equal(t, tt.expected+"\n", string(out[20:]))
+		})
+	}
+
+	t.Run("group attribute", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		slog.New(NewCustomLogHandler(f, nil)).Info("request", slog.Group("http", "status", 200))
+
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		out, _ := io.ReadAll(f)
+		assert.Equal(t, "INFO request http.status=200\n", string(out[20:]))
+	})
+}
+
+func TestCustomLogHandler_Color(t *testing.T) {
+	readLine := func(t *testing.T, f *os.File) string {
+		t.Helper()
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		out, err := io.ReadAll(f)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	t.Run("not a terminal", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		h := NewCustomLogHandler(f, nil)
+		assert.False(t, h.color)
+	})
+
+	t.Run("colored", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		h := NewCustomLogHandler(f, nil)
+		h.color = true
+		slog.New(h).Error("failed", "err", "boom", "path", "/x")
+
+		line := readLine(t, f)
+		assert.Contains(t, line, ansiDim)
+		assert.Contains(t, line, ansiRed+"ERROR"+ansiReset+" failed"+ansiRed+" err=boom"+ansiReset+" path=/x\n")
+	})
+
+	t.Run("no color", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		h := NewCustomLogHandler(f, nil)
+		h.color = true
+		h.NoColor = true
+		slog.New(h).Error("failed", "err", "boom")
+
+		line := readLine(t, f)
+		assert.NotContains(t, line, "\x1b[")
+		assert.Equal(t, "ERROR failed err=boom\n", line[20:])
+	})
+}
+
+func TestCustomLogHandler_Concurrent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(NewCustomLogHandler(buf, nil)).With("reqID", "abc")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 100; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				logger.WithGroup("http").Info("request", "worker", g, "payload", strings.Repeat("x", 64))
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 5000)
+	for _, line := range lines {
+		require.Greater(t, len(line), 20)
+		assert.Regexp(t, `^INFO request reqID=abc http\.worker=\d+ http\.payload=x{64}$`, line[20:])
+	}
+}
+
+func TestInitLogWithOptions_Output(t *testing.T) {
+	defer func(l *slog.Logger) { appLog = l }(appLog)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, InitLogWithOptions(LogOptions{Env: ENVProduction, Level: slog.LevelInfo, Output: buf}))
+
+	appLog.Info("hello", "to", "buffer")
+	assert.Contains(t, buf.String(), `"msg":"hello","to":"buffer"`)
+}
+
+// parseCustomLogLine returns the attributes of a CustomLogHandler line, after the time, level and message.
+func parseCustomLogLine(t *testing.T, line string) map[string]string {
+	t.Helper()
+
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n")[20:], " ", 3)
+	attrs := map[string]string{}
+	if len(fields) < 3 {
+		return attrs
+	}
+
+	rest := fields[2]
+	for rest != "" {
+		key, val, ok := strings.Cut(rest, "=")
+		require.True(t, ok, "malformed attrs %q", rest)
+
+		if strings.HasPrefix(val, `"`) {
+			quoted, err := strconv.QuotedPrefix(val)
+			require.NoError(t, err)
+			rest = strings.TrimPrefix(val[len(quoted):], " ")
+			val, err = strconv.Unquote(quoted)
+			require.NoError(t, err)
+		} else {
+			val, rest, _ = strings.Cut(val, " ")
+		}
+		attrs[key] = val
+	}
+	return attrs
+}
+
+// flattenJSONLog returns the attributes of a JSON log line with groups flattened into dotted keys.
+func flattenJSONLog(t *testing.T, line []byte) map[string]string {
+	t.Helper()
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(line, &m))
+	delete(m, "time")
+	delete(m, "level")
+	delete(m, "msg")
+
+	attrs := map[string]string{}
+	var flatten func(prefix string, m map[string]any)
+	flatten = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]any); ok {
+				flatten(joinKey(prefix, k), sub)
+				continue
+			}
+			attrs[joinKey(prefix, k)] = fmt.Sprint(v)
+		}
+	}
+	flatten("", m)
+	return attrs
+}
+
+func TestCustomLogHandler_JSONParity(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(l *slog.Logger)
+	}{
+		{name: "record attrs", log: func(l *slog.Logger) { l.Info("request", "path", "/hello", "status", 200) }},
+		{name: "scoped logger", log: func(l *slog.Logger) { l.With("reqID", "abc").Info("request", "path", "/hello") }},
+		{name: "groups", log: func(l *slog.Logger) {
+			l.With("reqID", "abc").WithGroup("http").With("method", "GET").Info("request", "path", "/hello", slog.Group("resp", "status", 404))
+		}},
+		{name: "values needing quotes", log: func(l *slog.Logger) {
+			l.Info("request", "agent", "Mozilla/5.0 (X11; Linux)", "query", "a=b&c=d", "empty", "", "quote", `say "hi"`, "multi", "line\nbreak")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			custom := new(bytes.Buffer)
+			tt.log(slog.New(NewCustomLogHandler(custom, nil)))
+
+			jsonOut := new(bytes.Buffer)
+			tt.log(slog.New(slog.NewJSONHandler(jsonOut, nil)))
+
+			assert.Equal(t, flattenJSONLog(t, jsonOut.Bytes()), parseCustomLogLine(t, custom.String()))
+		})
+	}
+
+	t.Run("golden", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		slog.New(NewCustomLogHandler(buf, nil)).With("reqID", "abc").WithGroup("http").
+			Info("request", "agent", "curl 8.0", "q", "a=b", "path", "/x")
+		assert.Equal(t, `INFO request reqID=abc http.agent="curl 8.0" http.q="a=b" http.path=/x`+"\n", buf.String()[20:])
+	})
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer func(l *slog.Logger, level slog.Level) {
+		appLog = l
+		SetLogLevel(level)
+	}(appLog, LogLevel())
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, InitLogWithOptions(LogOptions{Env: ENVDev, Level: slog.LevelInfo, Output: buf}))
+	scoped := appLog.With("reqID", "abc")
+
+	scoped.Debug("hidden")
+	assert.Empty(t, buf.String())
+
+	SetLogLevel(slog.LevelDebug)
+	assert.Equal(t, slog.LevelDebug, LogLevel())
+
+	scoped.Debug("visible")
+	assert.Contains(t, buf.String(), "DEBUG visible reqID=abc")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestMultiHandler(t *testing.T) {
+	text := new(bytes.Buffer)
+	jsonOut := new(bytes.Buffer)
+
+	h := NewMultiHandler(
+		NewCustomLogHandler(failingWriter{}, nil),
+		NewCustomLogHandler(text, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		slog.NewJSONHandler(jsonOut, &slog.HandlerOptions{Level: slog.LevelWarn}),
+	)
+	assert.True(t, h.Enabled(context.Background(), slog.LevelDebug))
+
+	logger := slog.New(h).With("reqID", "abc").WithGroup("http")
+
+	err := h.WithAttrs(nil).Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "direct", 0))
+	assert.ErrorContains(t, err, "disk full")
+
+	logger.Debug("debug", "path", "/a")
+	logger.Warn("warn", "path", "/b")
+
+	assert.Contains(t, text.String(), "DEBUG debug reqID=abc http.path=/a")
+	assert.Contains(t, text.String(), "WARN warn reqID=abc http.path=/b")
+	assert.NotContains(t, jsonOut.String(), "debug")
+	assert.Contains(t, jsonOut.String(), `"msg":"warn","reqID":"abc","http":{"path":"/b"}`)
+
+	none := NewMultiHandler(slog.NewJSONHandler(jsonOut, &slog.HandlerOptions{Level: slog.LevelError}))
+	assert.False(t, none.Enabled(context.Background(), slog.LevelInfo))
+}
+
+func TestInitLogWithOptions_Outputs(t *testing.T) {
+	defer func(l *slog.Logger, level slog.Level) {
+		appLog = l
+		SetLogLevel(level)
+	}(appLog, LogLevel())
+
+	console := new(bytes.Buffer)
+	path := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, InitLogWithOptions(LogOptions{
+		Env:   ENVStaging,
+		Level: slog.LevelInfo,
+		Outputs: []LogOutput{
+			{Writer: console, Format: LogFormatText},
+			{File: &LogFileOptions{Path: path}, Format: LogFormatJSON, Level: slog.LevelWarn},
+		},
+	}))
+	defer func() {
+		for _, f := range logFiles {
+			f.Close()
+		}
+		logFiles = nil
+	}()
+
+	appLog.Info("started")
+	appLog.Warn("slow request")
+
+	assert.Contains(t, console.String(), "INFO started")
+	assert.Contains(t, console.String(), "WARN slow request")
+
+	file, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(file), "started")
+	assert.Contains(t, string(file), `"msg":"slow request"`)
+}
+
+func TestInitLogWithOptions_ReplacesFiles(t *testing.T) {
+	defer func(l *slog.Logger, level slog.Level) {
+		appLog = l
+		SetLogLevel(level)
+	}(appLog, LogLevel())
+	defer func() {
+		for _, f := range logFiles {
+			f.Close()
+		}
+		logFiles = nil
+	}()
+
+	dir := t.TempDir()
+	initFile := func(name string) {
+		require.NoError(t, InitLogWithOptions(LogOptions{
+			Level:   slog.LevelInfo,
+			Outputs: []LogOutput{{File: &LogFileOptions{Path: filepath.Join(dir, name)}, Format: LogFormatJSON}},
+		}))
+	}
+
+	initFile("first.log")
+	previous := appLog
+	previous.Info("before")
+
+	// RotateLog may run while the files are replaced
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RotateLog()
+	}()
+	initFile("second.log")
+	<-done
+
+	previous.Info("dropped")
+	appLog.Info("after")
+
+	first, err := os.ReadFile(filepath.Join(dir, "first.log"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(first), "dropped", "loggers of the previous call stop writing")
+	second, err := os.ReadFile(filepath.Join(dir, "second.log"))
+	require.NoError(t, err)
+	assert.Contains(t, string(second), `"msg":"after"`)
+	assert.NoError(t, RotateLog())
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogFileOptions configures logging to a file with size based rotation.
+type LogFileOptions struct {
+	Path string
+	// MaxSizeMB is the size at which the file is rotated. Zero means no size limit.
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files to keep. Zero keeps all of them.
+	MaxBackups int
+	// MaxAgeDays removes rotated files older than this. Zero keeps them regardless of age.
+	MaxAgeDays int
+	// Compress gzips rotated files.
+	Compress bool
+	// RotateOnSIGHUP rotates the file when the process receives SIGHUP, for use with logrotate.
+	RotateOnSIGHUP bool
+}
+
+const backupTimeFormat = "20060102T150405.000"
+
+// RotatingFile is an io.Writer that writes to a file and rotates it when it grows past
+// MaxSizeMB. It is safe for concurrent use.
+type RotatingFile struct {
+	opts LogFileOptions
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// lastStamp is the timestamp of the newest backup, so backup names keep sorting
+	// chronologically even when rotating more than once per millisecond
+	lastStamp time.Time
+
+	cleanup sync.WaitGroup
+	stop    chan struct{}
+}
+
+// OpenRotatingFile opens, or creates, the log file at opts.Path for appending.
+func OpenRotatingFile(opts LogFileOptions) (*RotatingFile, error) {
+	if opts.Path == "" {
+		return nil, errors.New("log file: path is required")
+	}
+
+	rf := &RotatingFile{opts: opts, stop: make(chan struct{})}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	if opts.RotateOnSIGHUP {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(sig)
+			for {
+				select {
+				case <-sig:
+					if err := rf.Rotate(); err != nil {
+						fmt.Fprintln(os.Stderr, "log file rotation failed:", err)
+					}
+				case <-rf.stop:
+					return
+				}
+			}
+		}()
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.opts.Path), 0o755); err != nil {
+		return fmt.Errorf("log file: %w", err)
+	}
+
+	f, err := os.OpenFile(rf.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("log file: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("log file: %w", err)
+	}
+
+	rf.file, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write implements io.Writer. The file is rotated first if p would take it past MaxSizeMB.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	maxSize := int64(rf.opts.MaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > maxSize {
+		// a failed rotation keeps writing to the current file rather than dropping logs
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "log file rotation failed:", err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate renames the current file with a timestamp and opens a new one. When either step
+// fails, the current file is kept and written to.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	ext := filepath.Ext(rf.opts.Path)
+	base := strings.TrimSuffix(rf.opts.Path, ext)
+	stamp := time.Now().Truncate(time.Millisecond)
+	if !stamp.After(rf.lastStamp) {
+		stamp = rf.lastStamp.Add(time.Millisecond)
+	}
+	backup := base + "-" + stamp.Format(backupTimeFormat) + ext
+	// don't overwrite an earlier backup, e.g. from a previous run
+	for fileExists(backup) || fileExists(backup+".gz") {
+		stamp = stamp.Add(time.Millisecond)
+		backup = base + "-" + stamp.Format(backupTimeFormat) + ext
+	}
+
+	// the file is renamed while open, so that on failure the current one is still usable
+	if err := os.Rename(rf.opts.Path, backup); err != nil {
+		return fmt.Errorf("log file: %w", err)
+	}
+	prev := rf.file
+	if err := rf.open(); err != nil {
+		// move the current file back where it was and keep writing to it
+		if rerr := os.Rename(backup, rf.opts.Path); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("log file: %w", rerr))
+		}
+		return err
+	}
+	rf.lastStamp = stamp
+	if err := prev.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "log file close failed:", err)
+	}
+
+	rf.cleanup.Add(1)
+	go func() {
+		defer rf.cleanup.Done()
+		rf.processBackups(backup)
+	}()
+
+	return nil
+}
+
+// processBackups compresses the new backup and removes backups past MaxBackups or MaxAgeDays.
+func (rf *RotatingFile) processBackups(backup string) {
+	if rf.opts.Compress {
+		if err := compressFile(backup); err != nil {
+			fmt.Fprintln(os.Stderr, "log file compression failed:", err)
+		}
+	}
+
+	if rf.opts.MaxBackups <= 0 && rf.opts.MaxAgeDays <= 0 {
+		return
+	}
+
+	backups, err := rf.Backups()
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -rf.opts.MaxAgeDays)
+	for i, b := range backups {
+		tooMany := rf.opts.MaxBackups > 0 && i >= rf.opts.MaxBackups
+		tooOld := false
+		if fi, err := os.Stat(b); err == nil && rf.opts.MaxAgeDays > 0 {
+			tooOld = fi.ModTime().Before(cutoff)
+		}
+
+		if tooMany || tooOld {
+			_ = os.Remove(b)
+		}
+	}
+}
+
+// Backups returns the rotated files, newest first.
+func (rf *RotatingFile) Backups() ([]string, error) {
+	ext := filepath.Ext(rf.opts.Path)
+	base := strings.TrimSuffix(rf.opts.Path, ext)
+
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(m, base+"-"), ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+
+	// the timestamp format sorts chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
+
+// Close closes the file and waits for pending compression and cleanup.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	select {
+	case <-rf.stop:
+	default:
+		close(rf.stop)
+	}
+
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	rf.cleanup.Wait()
+	return err
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	t.Run("rotates on size without losing records", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "app.log")
+		rf, err := OpenRotatingFile(LogFileOptions{Path: path, MaxSizeMB: 1})
+		require.NoError(t, err)
+
+		line := strings.Repeat("x", 1023) + "\n"
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 600; i++ {
+					_, err := rf.Write([]byte(line))
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		require.NoError(t, rf.Close())
+
+		backups, err := rf.Backups()
+		require.NoError(t, err)
+		assert.Len(t, backups, 2)
+
+		total := 0
+		for _, name := range append(backups, path) {
+			b, err := os.ReadFile(name)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(b), 1024*1024)
+			total += bytes.Count(b, []byte("\n"))
+		}
+		assert.Equal(t, 2400, total)
+	})
+
+	t.Run("rotate compresses and prunes backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "app.log")
+		rf, err := OpenRotatingFile(LogFileOptions{Path: path, MaxBackups: 2, Compress: true})
+		require.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			_, err := fmt.Fprintf(rf, "record %d\n", i)
+			require.NoError(t, err)
+			require.NoError(t, rf.Rotate())
+			// wait for compression so backup timestamps and pruning are deterministic
+			rf.cleanup.Wait()
+		}
+		require.NoError(t, rf.Close())
+
+		backups, err := rf.Backups()
+		require.NoError(t, err)
+		require.Len(t, backups, 2)
+		assert.True(t, strings.HasSuffix(backups[0], ".log.gz"))
+
+		f, err := os.Open(backups[0])
+		require.NoError(t, err)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		b, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, "record 3\n", string(b))
+	})
+
+	t.Run("a failed rotation keeps the current file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "app.log")
+		rf, err := OpenRotatingFile(LogFileOptions{Path: path, MaxSizeMB: 1, RotateOnSIGHUP: true})
+		require.NoError(t, err)
+		_, err = rf.Write([]byte("before\n"))
+		require.NoError(t, err)
+
+		// the open file stays reachable through the link once its path is gone
+		require.NoError(t, os.Link(path, path+".keep"))
+		require.NoError(t, os.Remove(path))
+		assert.Error(t, rf.Rotate())
+
+		_, err = rf.Write([]byte(strings.Repeat("x", 1024*1024)))
+		require.NoError(t, err, "the rotation on size fails too but the record is written")
+		_, err = rf.Write([]byte("after\n"))
+		require.NoError(t, err)
+
+		require.NoError(t, rf.Close())
+		require.NoError(t, rf.Close())
+		select {
+		case <-rf.stop:
+		default:
+			t.Fatal("Close didn't stop the rotation goroutine")
+		}
+
+		b, err := os.ReadFile(path + ".keep")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(b), "before\n"))
+		assert.True(t, strings.HasSuffix(string(b), "after\n"))
+		_, err = rf.Write([]byte("closed\n"))
+		assert.ErrorIs(t, err, os.ErrClosed)
+	})
+}
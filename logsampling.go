@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SamplingOptions configures SamplingHandler. Records at WARN and above are never sampled.
+type SamplingOptions struct {
+	// Every emits one in every N matching records per key.
+	Every int
+	// First emits the first N matching records per key in each second.
+	First int
+	// Match selects the records to sample. When nil, every record below WARN is sampled.
+	Match func(r slog.Record) bool
+	// KeyAttr names the attribute whose value, together with the message, counts are kept
+	// per, e.g. "path". When empty counts are kept per message.
+	KeyAttr string
+}
+
+func (o SamplingOptions) enabled() bool {
+	return o.Every > 1 || o.First > 0
+}
+
+// maxSampleKeys bounds the number of keys tracked before counts are reset.
+const maxSampleKeys = 10_000
+
+// SamplingHandler is a slog.Handler that drops a share of high-volume records before passing
+// them on. Emitted records that were sampled get a "sampled" attribute and a "suppressed"
+// count of the records dropped for the same key since the previous emit.
+type SamplingHandler struct {
+	next  slog.Handler
+	opts  SamplingOptions
+	state *samplingState
+}
+
+type samplingState struct {
+	mu       sync.Mutex
+	counters map[string]*sampleCounter
+}
+
+type sampleCounter struct {
+	seen        uint64
+	windowStart time.Time
+	windowCount int
+	suppressed  int
+}
+
+// NewSamplingHandler wraps next with sampling. next can be any slog.Handler.
+func NewSamplingHandler(next slog.Handler, opts SamplingOptions) *SamplingHandler {
+	return &SamplingHandler{
+		next:  next,
+		opts:  opts,
+		state: &samplingState{counters: make(map[string]*sampleCounter)},
+	}
+}
+
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.opts.enabled() || r.Level >= slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+	if h.opts.Match != nil && !h.opts.Match(r) {
+		return h.next.Handle(ctx, r)
+	}
+
+	emit, suppressed := h.state.sample(h.sampleKey(r), r.Time, h.opts)
+	if !emit {
+		return nil
+	}
+
+	r = r.Clone()
+	r.AddAttrs(slog.Bool("sampled", true), slog.Int("suppressed", suppressed))
+	return h.next.Handle(ctx, r)
+}
+
+func (h *SamplingHandler) sampleKey(r slog.Record) string {
+	if h.opts.KeyAttr == "" {
+		return r.Message
+	}
+
+	key := r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == h.opts.KeyAttr {
+			key += "\x00" + a.Value.String()
+			return false
+		}
+		return true
+	})
+	return key
+}
+
+// sample reports whether the record should be emitted and, if so, how many were suppressed before it.
+func (s *samplingState) sample(key string, now time.Time, opts SamplingOptions) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok {
+		if len(s.counters) >= maxSampleKeys {
+			clear(s.counters)
+		}
+		c = &sampleCounter{windowStart: now}
+		s.counters[key] = c
+	}
+
+	c.seen++
+	emit := opts.Every > 1 && (c.seen-1)%uint64(opts.Every) == 0
+
+	if opts.First > 0 {
+		if now.Sub(c.windowStart) >= time.Second {
+			c.windowStart, c.windowCount = now, 0
+		}
+		c.windowCount++
+		emit = emit || c.windowCount <= opts.First
+	}
+
+	if !emit {
+		c.suppressed++
+		return false, 0
+	}
+
+	suppressed := c.suppressed
+	c.suppressed = 0
+	return true, suppressed
+}
+
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SamplingHandler{next: h.next.WithAttrs(attrs), opts: h.opts, state: h.state}
+}
+
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	return &SamplingHandler{next: h.next.WithGroup(name), opts: h.opts, state: h.state}
+}
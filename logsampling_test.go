@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sampledLine struct {
+	Level      string
+	Msg        string
+	Path       string
+	Sampled    bool
+	Suppressed int
+}
+
+func decodeSampledLines(t *testing.T, buf *bytes.Buffer) []sampledLine {
+	t.Helper()
+
+	var lines []sampledLine
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var l sampledLine
+		require.NoError(t, dec.Decode(&l))
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestSamplingHandler(t *testing.T) {
+	t.Run("one in n per path", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := slog.New(NewSamplingHandler(slog.NewJSONHandler(buf, nil), SamplingOptions{Every: 3, KeyAttr: "path"}))
+
+		for i := 0; i < 7; i++ {
+			logger.Info("request", "path", "/a")
+		}
+		logger.Info("request", "path", "/b")
+		logger.Warn("request", "path", "/a")
+
+		lines := decodeSampledLines(t, buf)
+		require.Len(t, lines, 5)
+		assert.Equal(t, []int{0, 2, 2}, []int{lines[0].Suppressed, lines[1].Suppressed, lines[2].Suppressed})
+		assert.Equal(t, "/b", lines[3].Path)
+		assert.True(t, lines[3].Sampled)
+		assert.Equal(t, "WARN", lines[4].Level)
+		assert.False(t, lines[4].Sampled)
+	})
+
+	t.Run("first n per second", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		h := NewSamplingHandler(slog.NewJSONHandler(buf, nil), SamplingOptions{First: 2})
+
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			require.NoError(t, h.Handle(context.Background(), slog.NewRecord(start, slog.LevelInfo, "request", 0)))
+		}
+		require.NoError(t, h.Handle(context.Background(), slog.NewRecord(start.Add(time.Second), slog.LevelInfo, "request", 0)))
+
+		lines := decodeSampledLines(t, buf)
+		require.Len(t, lines, 3)
+		assert.Equal(t, 3, lines[2].Suppressed)
+	})
+
+	t.Run("match", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := slog.New(NewSamplingHandler(slog.NewJSONHandler(buf, nil), SamplingOptions{
+			Every: 100,
+			Match: func(r slog.Record) bool { return r.Message == "request" },
+		}))
+
+		for i := 0; i < 3; i++ {
+			logger.Info("request")
+			logger.Info("started")
+		}
+		assert.Len(t, decodeSampledLines(t, buf), 4)
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := slog.New(NewSamplingHandler(slog.NewJSONHandler(buf, nil), SamplingOptions{Every: 10}))
+
+		var wg sync.WaitGroup
+		for g := 0; g < 100; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					logger.With("worker", g).Info("request")
+				}
+			}()
+		}
+		wg.Wait()
+
+		lines := decodeSampledLines(t, buf)
+		assert.Len(t, lines, 1000)
+		suppressed := 0
+		for _, l := range lines {
+			suppressed += l.Suppressed
+		}
+		// the 9 records after the last emit are still pending
+		assert.Equal(t, 8991, suppressed)
+	})
+}
+
+func BenchmarkSamplingHandler(b *testing.B) {
+	b.Run("unwrapped", func(b *testing.B) {
+		logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+		for i := 0; i < b.N; i++ {
+			logger.Info("request", "path", "/a")
+		}
+	})
+
+	b.Run("disabled", func(b *testing.B) {
+		logger := slog.New(NewSamplingHandler(slog.NewJSONHandler(io.Discard, nil), SamplingOptions{}))
+		for i := 0; i < b.N; i++ {
+			logger.Info("request", "path", "/a")
+		}
+	})
+
+	b.Run("enabled", func(b *testing.B) {
+		logger := slog.New(NewSamplingHandler(slog.NewJSONHandler(io.Discard, nil), SamplingOptions{Every: 10, KeyAttr: "path"}))
+		for i := 0; i < b.N; i++ {
+			logger.Info("request", "path", "/a")
+		}
+	})
+}
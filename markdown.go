@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+)
+
+var ErrNoMarkdown = errors.New("markdown converter not configured")
+
+// MarkdownConverter converts markdown to HTML, e.g. an adapter around goldmark:
+//
+//	server.MarkdownConverterFunc(func(src []byte, w io.Writer) error { return md.Convert(src, w) })
+type MarkdownConverter interface {
+	Convert(src []byte, w io.Writer) error
+}
+
+// MarkdownConverterFunc adapts a function to MarkdownConverter.
+type MarkdownConverterFunc func(src []byte, w io.Writer) error
+
+func (f MarkdownConverterFunc) Convert(src []byte, w io.Writer) error {
+	return f(src, w)
+}
+
+// HTMLSanitizer removes what its policy disallows from converted markdown. A bluemonday
+// policy, e.g. bluemonday.UGCPolicy(), is one.
+type HTMLSanitizer interface {
+	SanitizeBytes(html []byte) []byte
+}
+
+// HTMLSanitizerFunc adapts a function to HTMLSanitizer. TrustedHTML is one.
+type HTMLSanitizerFunc func(html []byte) []byte
+
+func (f HTMLSanitizerFunc) SanitizeBytes(html []byte) []byte {
+	return f(html)
+}
+
+// TrustedHTML is an HTMLSanitizer keeping the HTML as is, for markdown only the developers
+// write, such as documentation pages embedded in the binary.
+var TrustedHTML = HTMLSanitizerFunc(func(html []byte) []byte { return html })
+
+// DefaultMarkdownTemplate renders the pages of Context.RenderMarkdown unless
+// MarkdownOptions.Template or MarkdownOpt.Template is set.
+const DefaultMarkdownTemplate = "markdown"
+
+// MarkdownDataKey is the key the converted HTML is added under to the data of the markdown
+// page template.
+const MarkdownDataKey = "Markdown"
+
+// MarkdownOptions configures Context.RenderMarkdown and the markdown template function.
+type MarkdownOptions struct {
+	Converter MarkdownConverter
+	// Sanitizer cleans the converted HTML and is required with Converter, so that markdown
+	// from users can't inject scripts. Set it to TrustedHTML to keep the HTML as is.
+	Sanitizer HTMLSanitizer
+	// FS holds the markdown files MarkdownOpt.File names.
+	FS fs.FS
+	// Template is the page template the HTML is rendered in, under MarkdownDataKey. Defaults
+	// to DefaultMarkdownTemplate.
+	Template string
+}
+
+// MarkdownOpt describes what Context.RenderMarkdown should render.
+type MarkdownOpt struct {
+	// Source is the markdown to render, unless File is set.
+	Source string
+	// File is the path of the markdown file in MarkdownOptions.FS.
+	File string
+	// Template overrides MarkdownOptions.Template.
+	Template string
+	// Data is added to the data of the template, next to MarkdownDataKey.
+	Data     map[string]any
+	Layout   string
+	NoLayout bool
+}
+
+// markdown converts and sanitizes markdown, caching the HTML of the files.
+type markdown struct {
+	opts MarkdownOptions
+
+	mu sync.Mutex
+	// files maps file paths to the HTML of their last content
+	files map[string]markdownFile
+}
+
+type markdownFile struct {
+	sum  [sha256.Size]byte
+	html template.HTML
+}
+
+func newMarkdown(opts MarkdownOptions) (*markdown, error) {
+	if opts.Sanitizer == nil {
+		return nil, errors.New("markdown: Sanitizer must be set, TrustedHTML keeps the HTML as is")
+	}
+	if opts.Template == "" {
+		opts.Template = DefaultMarkdownTemplate
+	}
+	return &markdown{opts: opts, files: make(map[string]markdownFile)}, nil
+}
+
+// html converts src and sanitizes the result.
+func (m *markdown) html(src []byte) (template.HTML, error) {
+	if m == nil || m.opts.Converter == nil {
+		return "", ErrNoMarkdown
+	}
+
+	var buf bytes.Buffer
+	if err := m.opts.Converter.Convert(src, &buf); err != nil {
+		return "", fmt.Errorf("markdown: %w", err)
+	}
+	return template.HTML(m.opts.Sanitizer.SanitizeBytes(buf.Bytes())), nil
+}
+
+// file returns the HTML of the named file, converting it again only when its content changed.
+func (m *markdown) file(name string) (template.HTML, error) {
+	if m == nil || m.opts.FS == nil {
+		return "", fmt.Errorf("markdown: no FS to read %q from", name)
+	}
+	src, err := fs.ReadFile(m.opts.FS, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", NewHTTPError(http.StatusNotFound, err)
+		}
+		return "", err
+	}
+
+	sum := sha256.Sum256(src)
+	m.mu.Lock()
+	cached, ok := m.files[name]
+	m.mu.Unlock()
+	if ok && cached.sum == sum {
+		return cached.html, nil
+	}
+
+	html, err := m.html(src)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.files[name] = markdownFile{sum: sum, html: html}
+	m.mu.Unlock()
+	return html, nil
+}
+
+// RenderMarkdown converts opt.Source, or the opt.File of MarkdownOptions.FS, to HTML with the
+// configured converter and sanitizer, and renders it through Render in the markdown page
+// template, so layouts and view data apply. The HTML of files is cached until their content
+// changes; a missing file is a 404 HTTPError.
+func (c *HandlerContext) RenderMarkdown(status int, opt MarkdownOpt) error {
+	if c.srv == nil || c.srv.markdown == nil {
+		return ErrNoMarkdown
+	}
+	md := c.srv.markdown
+
+	var html template.HTML
+	var err error
+	if opt.File != "" {
+		html, err = md.file(opt.File)
+	} else {
+		html, err = md.html([]byte(opt.Source))
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]any, len(opt.Data)+1)
+	for k, v := range opt.Data {
+		data[k] = v
+	}
+	data[MarkdownDataKey] = html
+
+	tmpl := opt.Template
+	if tmpl == "" {
+		tmpl = md.opts.Template
+	}
+	return c.Render(status, RenderOpt{Template: tmpl, Data: data, Layout: opt.Layout, NoLayout: opt.NoLayout})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headingConverter converts "# " lines to h1 and passes the other lines through as paragraphs.
+type headingConverter struct {
+	calls int
+}
+
+func (c *headingConverter) Convert(src []byte, w io.Writer) error {
+	c.calls++
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# "):
+			fmt.Fprintf(w, "<h1>%s</h1>", strings.TrimPrefix(line, "# "))
+		default:
+			fmt.Fprintf(w, "<p>%s</p>", line)
+		}
+	}
+	return sc.Err()
+}
+
+// scriptSanitizer drops script elements.
+type scriptSanitizer struct{}
+
+func (scriptSanitizer) SanitizeBytes(html []byte) []byte {
+	return regexp.MustCompile(`(?s)<script.*?</script>`).ReplaceAll(html, nil)
+}
+
+func TestContext_RenderMarkdown(t *testing.T) {
+	docs := fstest.MapFS{
+		"help/intro.md": {Data: []byte("# Intro\nWelcome<script>alert(1)</script>")},
+	}
+	tmpl, err := InitTemplates(TemplateOptions{DefaultLayout: "layout", FS: fstest.MapFS{
+		"layout.tmpl":   {Data: []byte(`<html>{{template "content" .}}</html>`)},
+		"markdown.tmpl": {Data: []byte(`<title>{{.Title}}</title><article>{{.Markdown}}</article>`)},
+		"note.tmpl":     {Data: []byte(`{{markdown "# Note\nsee *docs*"}}`)},
+	}})
+	require.NoError(t, err)
+
+	conv := &headingConverter{}
+	srv, err := Init(Options{Templates: tmpl, Markdown: MarkdownOptions{Converter: conv, Sanitizer: scriptSanitizer{}, FS: docs}})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /help/{page}", func(ctx Context) error {
+		return ctx.RenderMarkdown(http.StatusOK, MarkdownOpt{File: "help/" + ctx.UrlParam("page") + ".md", Data: map[string]any{"Title": "Help"}})
+	})
+	srv.HandleFunc("GET /inline", func(ctx Context) error {
+		return ctx.RenderMarkdown(http.StatusOK, MarkdownOpt{Source: "# Inline", NoLayout: true})
+	})
+	srv.HandleFunc("GET /note", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "note", NoLayout: true})
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := serve("/help/intro")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `<html><title>Help</title><article><h1>Intro</h1><p>Welcome</p></article></html>`, rec.Body.String())
+	serve("/help/intro")
+	assert.Equal(t, 1, conv.calls, "the file is converted once")
+
+	docs["help/intro.md"] = &fstest.MapFile{Data: []byte("# Intro v2")}
+	assert.Contains(t, serve("/help/intro").Body.String(), "<h1>Intro v2</h1>")
+	assert.Equal(t, 2, conv.calls, "a changed file is converted again")
+
+	assert.Equal(t, http.StatusNotFound, serve("/help/missing").Code)
+	assert.Equal(t, `<title></title><article><h1>Inline</h1></article>`, serve("/inline").Body.String())
+	assert.Equal(t, `<h1>Note</h1><p>see *docs*</p>`, serve("/note").Body.String())
+
+	_, err = Init(Options{Templates: tmpl, Markdown: MarkdownOptions{Converter: conv}})
+	assert.EqualError(t, err, "markdown: Sanitizer must be set, TrustedHTML keeps the HTML as is")
+	srv, err = Init(Options{Templates: tmpl, Markdown: MarkdownOptions{Converter: conv, Sanitizer: TrustedHTML}})
+	require.NoError(t, err)
+	html, err := srv.markdown.html([]byte("# Docs<script>init()</script>"))
+	require.NoError(t, err)
+	assert.EqualValues(t, "<h1>Docs<script>init()</script></h1>", html)
+
+	srv, err = Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /inline", func(ctx Context) error {
+		return ctx.RenderMarkdown(http.StatusOK, MarkdownOpt{Source: "# Inline"})
+	})
+	require.NoError(t, srv.Route())
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/inline", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "no converter configured")
+}
@@ -1,25 +1,30 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// Define custom types for context keys
-type contextKey string
-
-const (
-	requestIDKey    contextKey = "requestID"
-	scopedLoggerKey contextKey = "scopedLogger"
-)
-
-// ResponseWriter a response writer that captures the status code
+// ResponseWriter a response writer that captures the status code and the number of bytes written
 type ResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rw *ResponseWriter) WriteHeader(statusCode int) {
@@ -27,33 +32,532 @@ func (rw *ResponseWriter) WriteHeader(statusCode int) {
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush and Hijack keep the writer an http.Flusher and an http.Hijacker for handlers asserting
+// them.
+func (rw *ResponseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 const RequestIDHeaderKey string = "X-Request-ID"
 
+// DefaultRequestIDMaxLength is the longest incoming request ID that is reused.
+const DefaultRequestIDMaxLength = 128
+
+// RequestIDConfig configures RequestIDMiddlewareWithConfig.
+type RequestIDConfig struct {
+	// Generator creates new request IDs. Defaults to a UUID.
+	Generator func() string
+	// MaxLength caps the length of an incoming request ID. Defaults to DefaultRequestIDMaxLength.
+	MaxLength int
+	// IgnoreIncoming always generates a new ID, even when the request carries one.
+	IgnoreIncoming bool
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// RequestIDMiddleware adds a request ID to the request context and the response headers.
+// A valid X-Request-ID sent by the client is reused, otherwise a UUID is generated.
 func RequestIDMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		srvr := r.Context().Value("_server_")
-		logr := appLog
-		if srvr != nil && srvr.(*Server).log != nil {
-			logr = srvr.(*Server).log
-		}
-
-		requestID := uuid.New().String()
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-		ctx = context.WithValue(ctx, scopedLoggerKey, logr.With("reqID", requestID))
-		*r = *r.WithContext(ctx)
-		w.Header().Set(RequestIDHeaderKey, requestID)
-		next.ServeHTTP(w, r)
-	})
+	return RequestIDMiddlewareWithConfig(RequestIDConfig{})(next)
+}
+
+// RequestIDMiddlewareWithConfig returns a RequestIDMiddleware using the given config.
+func RequestIDMiddlewareWithConfig(cfg RequestIDConfig) Middleware {
+	if cfg.Generator == nil {
+		cfg.Generator = func() string { return uuid.New().String() }
+	}
+	if cfg.MaxLength <= 0 {
+		cfg.MaxLength = DefaultRequestIDMaxLength
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logr := appLog
+			if srvr, ok := FromContext(r.Context(), CtxKeyServer); ok {
+				logr = srvr.logger()
+			}
+
+			requestID := ""
+			if !cfg.IgnoreIncoming {
+				requestID = r.Header.Get(RequestIDHeaderKey)
+			}
+			if !validRequestID(requestID, cfg.MaxLength) {
+				requestID = cfg.Generator()
+			}
+
+			ctx := ContextWithValue(r.Context(), requestIDKey, requestID)
+			attrs := append([]any{"reqID", requestID}, traceLogAttrs(ctx)...)
+			ctx = ContextWithValue(ctx, scopedLoggerKey, logr.With(attrs...))
+			*r = *r.WithContext(ctx)
+			w.Header().Set(RequestIDHeaderKey, requestID)
+			next.ServeHTTP(w, r)
+		})
+	}, cfg.Skipper)
 }
 
+// validRequestID reports whether id is non-empty, at most maxLen long and only
+// contains letters, digits and the characters - _ . :
+func validRequestID(id string, maxLen int) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RecoveryConfig configures RecoveryMiddlewareWithConfig.
+type RecoveryConfig struct {
+	// OnPanic is called with the recovered value and stack trace, e.g. to report to an error tracker.
+	OnPanic func(ctx context.Context, recovered any, stack []byte)
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// RecoveryMiddleware recovers from panics, logs them with a stack trace and responds with a 500.
 func RecoveryMiddleware(next http.Handler) http.Handler {
+	return RecoveryMiddlewareWithConfig(RecoveryConfig{})(next)
+}
+
+// RecoveryMiddlewareWithConfig returns a RecoveryMiddleware using the given config.
+// The stack trace is included in the response only when the server runs in ENVDev.
+// http.ErrAbortHandler is re-panicked so net/http can abort the response.
+func RecoveryMiddlewareWithConfig(cfg RecoveryConfig) Middleware {
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				stack := debug.Stack()
+				attrs := append([]any{"error", rec, "stack", string(stack)}, requestLogAttrs(r, start)...)
+				requestLogger(r).Error("Recovered from panic", attrs...)
+				recordPanic(r, rec, stack)
+				if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+					info.err = fmt.Errorf("panic: %v", rec)
+				}
+				if cfg.OnPanic != nil {
+					cfg.OnPanic(r.Context(), rec, stack)
+				}
+
+				msg := http.StatusText(http.StatusInternalServerError)
+				if srv, ok := FromContext(r.Context(), CtxKeyServer); ok && srv.env == ENVDev {
+					msg = fmt.Sprintf("%s\n\npanic: %v\n\n%s", msg, rec, stack)
+				}
+				http.Error(w, msg, http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}, cfg.Skipper)
+}
+
+// requestLogger returns the request scoped logger, falling back to the server logger.
+func requestLogger(r *http.Request) *slog.Logger {
+	return LoggerFromContext(r.Context())
+}
+
+// TimeoutMiddleware returns a middleware that cancels the request context after d.
+// Routes registered with WithTimeout replace this deadline with their own.
+func TimeoutMiddleware(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			base := r.Context()
+			ctx, cancel := context.WithTimeout(base, d)
+			defer cancel()
+
+			ctx = ContextWithValue(ctx, timeoutBaseKey, base)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// routeTimeout applies a route specific deadline. When a global deadline was set by
+// TimeoutMiddleware the route deadline is derived from the context that existed before it,
+// while keeping any values added to the request context since.
+func routeTimeout(d time.Duration, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				slog.Error("Recovered from panic", "error", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
-		}()
-		next.ServeHTTP(w, r)
+		parent := r.Context()
+		if base, ok := FromContext(parent, timeoutBaseKey); ok {
+			var cancelBase context.CancelFunc
+			parent, cancelBase = context.WithCancel(context.WithoutCancel(parent))
+			defer cancelBase()
+
+			// still cancel when the client goes away
+			stop := context.AfterFunc(base, cancelBase)
+			defer stop()
+		}
+
+		ctx, cancel := context.WithTimeout(parent, d)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RealIPMiddleware returns a middleware that replaces r.RemoteAddr with the client address
+// reported by a trusted proxy. trusted is a list of CIDRs or single IPs. The headers are only
+// consulted when the immediate peer is trusted, in order X-Forwarded-For, Forwarded and X-Real-IP.
+// For the list headers the right-most address that isn't trusted is used.
+// RealIPMiddleware panics if an entry in trusted can't be parsed.
+func RealIPMiddleware(trusted []string) Middleware {
+	nets, err := parseTrustedNets(trusted)
+	if err != nil {
+		panic("realip: " + err.Error())
+	}
+	isTrusted := nets.contains
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := net.ParseIP(remoteIP(r.RemoteAddr))
+			if peer == nil || !isTrusted(peer) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var client net.IP
+			if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+				client = rightmostUntrusted(splitHeaderList(xff), isTrusted)
+			} else if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+				client = rightmostUntrusted(forwardedFor(fwd), isTrusted)
+			} else if xri := r.Header.Get("X-Real-IP"); xri != "" {
+				client = net.ParseIP(strings.TrimSpace(xri))
+			}
+
+			if client == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+				info.clientIP = client.String()
+			}
+
+			r2 := r.Clone(r.Context())
+			r2.RemoteAddr = client.String()
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// trustedNets are the networks of trusted proxies.
+type trustedNets []*net.IPNet
+
+// parseTrustedNets parses a list of CIDRs or single IPs.
+func parseTrustedNets(trusted []string) (trustedNets, error) {
+	nets := make(trustedNets, 0, len(trusted))
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			ip := net.ParseIP(t)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %q", t)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %v", t, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (nets trustedNets) contains(ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the host part of a RemoteAddr, which may or may not carry a port.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+// rightmostUntrusted walks addrs from the nearest hop backwards and returns the first address
+// not in a trusted network. If every hop is trusted the left-most address is returned.
+func rightmostUntrusted(addrs []string, isTrusted func(net.IP) bool) net.IP {
+	var last net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(remoteIP(addrs[i]))
+		if ip == nil {
+			// anything beyond an unparsable hop can't be relied on
+			return nil
+		}
+
+		if !isTrusted(ip) {
+			return ip
+		}
+		last = ip
+	}
+	return last
+}
+
+func splitHeaderList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// forwardedFor extracts the for= parameters of an RFC 7239 Forwarded header.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, elem := range splitHeaderList(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(key, "for") {
+				continue
+			}
+			out = append(out, strings.Trim(val, `"`))
+		}
+	}
+	return out
+}
+
+// RequireContentTypeMiddleware returns a middleware that responds with 415 Unsupported Media Type
+// when a POST, PUT or PATCH request doesn't have one of the given content types.
+// Parameters such as charset are ignored when comparing.
+func RequireContentTypeMiddleware(types ...string) Middleware {
+	allowed := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(strings.TrimSpace(t))] = struct{}{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+			if _, ok := allowed[mediaType]; err != nil || !ok {
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MethodOverrideConfig configures MethodOverrideMiddlewareWithConfig.
+type MethodOverrideConfig struct {
+	// Methods are the methods a POST can be turned into. Defaults to PUT, PATCH and DELETE.
+	Methods []string
+	// Header carries the method. Defaults to X-HTTP-Method-Override.
+	Header string
+	// FormField carries the method in url-encoded and multipart bodies. Defaults to _method.
+	FormField string
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// MethodOverrideMiddleware lets HTML forms send PUT, PATCH and DELETE requests: a POST with an
+// X-HTTP-Method-Override header or a _method form field is routed with that method. Use it as
+// server middleware, which runs before the routes are matched.
+func MethodOverrideMiddleware(next http.Handler) http.Handler {
+	return MethodOverrideMiddlewareWithConfig(MethodOverrideConfig{})(next)
+}
+
+// MethodOverrideMiddlewareWithConfig returns a MethodOverrideMiddleware using the given config.
+// Only POST requests are overridden, and only with cfg.Methods; other overrides are ignored and
+// the request stays a POST. The header takes precedence over the form field, which is read from
+// the body only, never from the query string.
+func MethodOverrideMiddlewareWithConfig(cfg MethodOverrideConfig) Middleware {
+	if cfg.Methods == nil {
+		cfg.Methods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	if cfg.Header == "" {
+		cfg.Header = "X-HTTP-Method-Override"
+	}
+	if cfg.FormField == "" {
+		cfg.FormField = "_method"
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			method := r.Header.Get(cfg.Header)
+			if method == "" {
+				maxMemory := DefaultMaxMultipartMemory
+				if srv, ok := FromContext(r.Context(), CtxKeyServer); ok {
+					maxMemory = srv.maxMultipart
+				}
+				if err := parseForm(r, maxMemory); err == nil {
+					method = r.PostForm.Get(cfg.FormField)
+				}
+			}
+
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if slices.Contains(cfg.Methods, method) {
+				r.Method = method
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, cfg.Skipper)
+}
+
+// MaintenanceTemplate is rendered by MaintenanceMiddleware when the server renderer has it.
+const MaintenanceTemplate = "maintenance"
+
+// MaintenanceMiddleware returns a middleware that responds with 503 and a Retry-After header while
+// enabled is true. The maintenance template is rendered if it exists, otherwise a plain text
+// message is sent. Requests matching one of exempt are served normally; by default /healthz,
+// /livez, /readyz and /public/ are exempt.
+func MaintenanceMiddleware(enabled *atomic.Bool, retryAfter time.Duration, exempt ...Skipper) Middleware {
+	if len(exempt) == 0 {
+		exempt = []Skipper{SkipPaths("/healthz", "/livez", "/readyz"), SkipPathPrefixes("/public/")}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled.Load() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, skip := range exempt {
+				if skip(r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			}
+
+			if srv, ok := FromContext(r.Context(), CtxKeyServer); ok && srv.renderer != nil && srv.renderer.Exists(MaintenanceTemplate) {
+				var buf bytes.Buffer
+				err := srv.renderer.Render(&buf, RenderOpt{Template: MaintenanceTemplate})
+				if err == nil {
+					w.Header().Set(HeaderContentType, ContentTypeHTML)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					_, _ = buf.WriteTo(w)
+					return
+				}
+				requestLogger(r).Error("maintenance template", "err", err)
+			}
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		})
+	}
+}
+
+// CacheControlMiddleware returns a middleware that sets the Cache-Control header of successful
+// responses to directive, e.g. "public, max-age=3600". A directive set by the handler is kept.
+func CacheControlMiddleware(directive string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, directive: directive}, r)
+		})
+	}
+}
+
+// NoCacheMiddleware keeps successful responses out of caches with Cache-Control: no-store,
+// unless the handler set a directive.
+func NoCacheMiddleware(next http.Handler) http.Handler {
+	return CacheControlMiddleware("no-store")(next)
+}
+
+// cacheControlWriter sets Cache-Control when the response status is known.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	directive   string
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(statusCode int) {
+	if !cw.wroteHeader && statusCode >= 100 && statusCode < 200 {
+		// informational responses are followed by the final one
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		h := cw.Header()
+		if statusCode >= 200 && statusCode < 300 && h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", cw.directive)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *cacheControlWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends the header, with the directive, before flushing, since flushing through the
+// underlying writer would commit it without WriteHeader.
+func (cw *cacheControlWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *cacheControlWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
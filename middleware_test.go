@@ -1,9 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -38,3 +52,718 @@ func TestRecoveryMiddleware(t *testing.T) {
 	// no error checks - a successful recover should leave no traces
 	assert.Equal(t, w.Result().StatusCode, http.StatusInternalServerError)
 }
+
+func TestRealIPMiddleware(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.1"}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "untrusted peer without headers",
+			remoteAddr: "203.0.113.9:5000",
+			expected:   "203.0.113.9:5000",
+		},
+		{
+			name:       "single trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			expected:   "203.0.113.9",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.9, 192.168.1.1, 10.1.2.3"},
+			expected:   "203.0.113.9",
+		},
+		{
+			name:       "spoofed header from untrusted peer",
+			remoteAddr: "203.0.113.9:5000",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"},
+			expected:   "203.0.113.9:5000",
+		},
+		{
+			name:       "forwarded header",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`},
+			expected:   "2001:db8:cafe::17",
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "192.168.1.1:5000",
+			headers:    map[string]string{"X-Real-IP": "203.0.113.9"},
+			expected:   "203.0.113.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			middleware := RealIPMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "http://dummy.com/target", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			middleware.ServeHTTP(httptest.NewRecorder(), r)
+
+			assert.Equal(t, tt.expected, got)
+			assert.Equal(t, tt.remoteAddr, r.RemoteAddr)
+		})
+	}
+}
+
+func TestRequireContentTypeMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		contentType    string
+		expectedStatus int
+	}{
+		{name: "accepted type", method: http.MethodPost, contentType: "application/json", expectedStatus: http.StatusOK},
+		{name: "accepted type with charset", method: http.MethodPost, contentType: "Application/JSON; charset=utf-8", expectedStatus: http.StatusOK},
+		{name: "rejected type", method: http.MethodPost, contentType: "text/plain", expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "missing header", method: http.MethodPut, expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "bodyless method", method: http.MethodGet, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := RequireContentTypeMiddleware(ContentTypeJSON)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "http://dummy.com/target", nil)
+			if tt.contentType != "" {
+				r.Header.Set(HeaderContentType, tt.contentType)
+			}
+			middleware.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestIDMiddleware_Incoming(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		expected string
+	}{
+		{name: "reuse valid id", incoming: "edge-1234.abc", expected: "edge-1234.abc"},
+		{name: "reject invalid characters", incoming: "bad id<script>", expected: "generated"},
+		{name: "reject long id", incoming: strings.Repeat("a", 65), expected: "generated"},
+		{name: "generate when absent", expected: "generated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := RequestIDConfig{Generator: func() string { return "generated" }, MaxLength: 64}
+
+			var ctxID string
+			middleware := RequestIDMiddlewareWithConfig(cfg)(HandlerFunc(func(ctx Context) error {
+				ctxID = ctx.RequestID()
+				return nil
+			}))
+
+			srv, err := Init(Options{})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://dummy.com/target", nil)
+			r = r.WithContext(context.WithValue(r.Context(), CtxKeyServer, srv))
+			if tt.incoming != "" {
+				r.Header.Set(RequestIDHeaderKey, tt.incoming)
+			}
+			middleware.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expected, ctxID)
+			assert.Equal(t, tt.expected, w.Header().Get(RequestIDHeaderKey))
+		})
+	}
+}
+
+func TestRecoveryMiddlewareWithConfig(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("testing recover")
+	})
+
+	for _, env := range []ENVTypes{ENVDev, ENVProduction} {
+		t.Run(string(env), func(t *testing.T) {
+			var recovered any
+			var stack []byte
+			middleware := RecoveryMiddlewareWithConfig(RecoveryConfig{
+				OnPanic: func(ctx context.Context, rec any, stk []byte) {
+					recovered, stack = rec, stk
+				},
+			})(panicking)
+
+			srv, err := Init(Options{Env: env})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://dummy.com/target", nil)
+			r = r.WithContext(context.WithValue(r.Context(), CtxKeyServer, srv))
+			middleware.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+			assert.Equal(t, "testing recover", recovered)
+			assert.NotEmpty(t, stack)
+			assert.Equal(t, env == ENVDev, strings.Contains(w.Body.String(), "goroutine"))
+		})
+	}
+
+	t.Run("abort handler", func(t *testing.T) {
+		middleware := RecoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://dummy.com/target", nil)
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() { middleware.ServeHTTP(w, r) })
+	})
+}
+
+func TestWithMiddlewareForMethods(t *testing.T) {
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	srv.Group("/notes", "", func(srv *Server) {
+		srv.HandleFunc("/{id}", func(ctx Context) error {
+			return ctx.String(http.StatusOK, ctx.Request().Method+" "+ctx.UrlParam("id"))
+		})
+	}, WithMiddlewareForMethods([]string{"post", "PUT", "DELETE"}, auth))
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		method string
+		token  string
+		code   int
+	}{
+		{method: http.MethodGet, code: http.StatusOK},
+		{method: http.MethodHead, code: http.StatusOK},
+		{method: http.MethodPost, code: http.StatusUnauthorized},
+		{method: http.MethodDelete, code: http.StatusUnauthorized},
+		{method: http.MethodPost, token: "Bearer secret", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+tt.token, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/notes/7", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusUnauthorized {
+				assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+			} else if tt.method != http.MethodHead {
+				assert.Equal(t, tt.method+" 7", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSkip(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	chain := Chain{
+		record("first"),
+		Skip(record("skippable"), SkipPathPrefixes("/events")),
+		Skip(record("auth"), SkipPaths("/login")),
+		record("last"),
+	}
+	handler := chain.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	})
+
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{path: "/", expected: []string{"first", "skippable", "auth", "last", "handler"}},
+		{path: "/events/stream", expected: []string{"first", "auth", "last", "handler"}},
+		{path: "/login", expected: []string{"first", "skippable", "last", "handler"}},
+		{path: "/login/help", expected: []string{"first", "skippable", "auth", "last", "handler"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			order = nil
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expected, order)
+		})
+	}
+
+	t.Run("config skipper", func(t *testing.T) {
+		middleware := RequestIDMiddlewareWithConfig(RequestIDConfig{Skipper: SkipPaths("/health")})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		)
+
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Empty(t, w.Header().Get(RequestIDHeaderKey))
+	})
+}
+
+func TestSingleflightMiddleware(t *testing.T) {
+	const n = 10
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	g := &flightGroup{calls: make(map[string]*flightCall)}
+	h := g.middleware(DefaultSingleflightVary)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("X-Result", "expensive")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("computed once"))
+	}))
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, n)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/report?year=2024", nil))
+		}(recorders[i])
+	}
+
+	// wait until every request joined the one in flight
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, c := range g.calls {
+			return c.dups == n-1
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, calls.Load())
+	for _, w := range recorders {
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, "expensive", w.Header().Get("X-Result"))
+		assert.Equal(t, "computed once", w.Body.String())
+	}
+	assert.Empty(t, g.calls)
+
+	t.Run("distinct requests", func(t *testing.T) {
+		calls.Store(0)
+		mw := SingleflightMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+
+		for _, r := range []*http.Request{
+			httptest.NewRequest(http.MethodGet, "/report?year=2024", nil),
+			httptest.NewRequest(http.MethodPost, "/report?year=2024", nil),
+		} {
+			mw.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		assert.EqualValues(t, 2, calls.Load())
+
+		a := httptest.NewRequest(http.MethodGet, "/report", nil)
+		a.Header.Set("Authorization", "Bearer a")
+		b := httptest.NewRequest(http.MethodGet, "/report", nil)
+		b.Header.Set("Authorization", "Bearer b")
+		assert.NotEqual(t, flightKey(a, DefaultSingleflightVary), flightKey(b, DefaultSingleflightVary))
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		g := &flightGroup{calls: make(map[string]*flightCall)}
+		h := g.middleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Empty(t, g.calls)
+	})
+
+	t.Run("each request keeps its own context", func(t *testing.T) {
+		release := make(chan struct{})
+		var handlerErr atomic.Value
+		g := &flightGroup{calls: make(map[string]*flightCall)}
+		h := g.middleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			handlerErr.Store(fmt.Sprint(r.Context().Err()))
+			w.Write([]byte("done"))
+		}))
+
+		leaderCtx, cancelLeader := context.WithCancel(context.Background())
+		leader := httptest.NewRecorder()
+		leaderDone := make(chan struct{})
+		go func() {
+			defer close(leaderDone)
+			h.ServeHTTP(leader, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(leaderCtx))
+		}()
+		require.Eventually(t, func() bool {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			return len(g.calls) == 1
+		}, time.Second, time.Millisecond)
+
+		waiterCtx, cancelWaiter := context.WithTimeout(context.Background(), time.Minute)
+		defer cancelWaiter()
+		waiter := httptest.NewRecorder()
+		waiterDone := make(chan struct{})
+		go func() {
+			defer close(waiterDone)
+			h.ServeHTTP(waiter, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(waiterCtx))
+		}()
+		require.Eventually(t, func() bool {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for _, c := range g.calls {
+				return c.dups == 1
+			}
+			return false
+		}, time.Second, time.Millisecond)
+
+		cancelLeader()
+		<-leaderDone
+		assert.Equal(t, StatusClientClosedRequest, leader.Code, "the leader stops waiting when its client goes away")
+
+		close(release)
+		<-waiterDone
+		assert.Equal(t, http.StatusOK, waiter.Code)
+		assert.Equal(t, "done", waiter.Body.String())
+		assert.Equal(t, "<nil>", handlerErr.Load(), "the shared call isn't canceled with the leader")
+	})
+
+	t.Run("the handler stops when no request waits", func(t *testing.T) {
+		stopped := make(chan error, 2)
+		var deadlines atomic.Int32
+		g := &flightGroup{calls: make(map[string]*flightCall)}
+		h := g.middleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := r.Context().Deadline(); ok {
+				deadlines.Add(1)
+			}
+			<-r.Context().Done()
+			stopped <- r.Context().Err()
+		}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		}()
+		require.Eventually(t, func() bool {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			return len(g.calls) == 1
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		<-done
+		assert.Equal(t, StatusClientClosedRequest, rec.Code)
+		assert.ErrorIs(t, <-stopped, context.Canceled)
+		assert.EqualValues(t, 1, deadlines.Load(), "the handler keeps the deadline of the request")
+
+		g.mu.Lock()
+		assert.Empty(t, g.calls, "a later request doesn't get the canceled response")
+		g.mu.Unlock()
+	})
+}
+
+func TestServer_StaticMiddleware(t *testing.T) {
+	public := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(public, "app.css"), []byte("body{}"), 0o644))
+
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	srv, err := Init(Options{
+		Public:           public,
+		Middleware:       []Middleware{record("server")},
+		StaticMiddleware: []Middleware{record("static"), CacheControlMiddleware("public, max-age=31536000, immutable")},
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/page", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "page")
+	})
+	require.NoError(t, srv.Route())
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/public/app.css", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "body{}", rec.Body.String())
+	assert.Equal(t, "public, max-age=31536000, immutable", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"static"}, order)
+
+	order = nil
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+	assert.Empty(t, rec.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"server"}, order)
+}
+
+func TestCacheControlMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		mw     Middleware
+		status int
+		preset string
+		flush  bool
+		want   string
+	}{
+		{"sets directive", CacheControlMiddleware("public, max-age=3600"), http.StatusOK, "", false, "public, max-age=3600"},
+		{"implicit 200", CacheControlMiddleware("public, max-age=60"), 0, "", false, "public, max-age=60"},
+		{"flushed first", NoCacheMiddleware, 0, "", true, "no-store"},
+		{"flushed after the status", NoCacheMiddleware, http.StatusNotFound, "", true, ""},
+		{"keeps handler directive", CacheControlMiddleware("public, max-age=3600"), http.StatusOK, "private", false, "private"},
+		{"skips errors", CacheControlMiddleware("public, max-age=3600"), http.StatusNotFound, "", false, ""},
+		{"skips redirects", CacheControlMiddleware("public, max-age=3600"), http.StatusFound, "", false, ""},
+		{"no cache", NoCacheMiddleware, http.StatusCreated, "", false, "no-store"},
+		{"no cache keeps handler directive", NoCacheMiddleware, http.StatusOK, "max-age=10", false, "max-age=10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.preset != "" {
+					w.Header().Set("Cache-Control", tt.preset)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				if tt.flush {
+					// as a server-sent event stream does before its first event
+					require.NoError(t, http.NewResponseController(w).Flush())
+				}
+				w.Write([]byte("body"))
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			// the header as sent, not as changed after it was written
+			assert.Equal(t, tt.want, w.Result().Header.Get("Cache-Control"))
+		})
+	}
+}
+
+func TestDebugDumpMiddleware(t *testing.T) {
+	dump := func(t *testing.T, env ENVTypes, cfg DumpConfig, r *http.Request, respond http.HandlerFunc) map[string]any {
+		t.Helper()
+
+		out := new(bytes.Buffer)
+		srv := &Server{env: env, log: slog.New(slog.NewJSONHandler(out, nil))}
+		r = r.WithContext(ContextWithValue(r.Context(), CtxKeyServer, srv))
+
+		DebugDumpMiddleware(cfg)(respond).ServeHTTP(httptest.NewRecorder(), r)
+		if out.Len() == 0 {
+			return nil
+		}
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		return entry
+	}
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set(HeaderContentType, "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}
+
+	newRequest := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/items?draft=1", strings.NewReader(body))
+		r.Header.Set(HeaderContentType, "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("HX-Request", "true")
+		return r
+	}
+
+	t.Run("dev", func(t *testing.T) {
+		entry := dump(t, ENVDev, DumpConfig{}, newRequest("name=widget&count=2"), echo)
+		require.NotNil(t, entry)
+
+		req := entry["request"].(map[string]any)
+		assert.Equal(t, "POST /items?draft=1 HTTP/1.1", req["line"])
+		assert.Equal(t, "[REDACTED]", req["headers"].(map[string]any)["Authorization"])
+		assert.Equal(t, "true", req["headers"].(map[string]any)["Hx-Request"])
+		assert.Equal(t, "name=widget&count=2", req["body"])
+
+		resp := entry["response"].(map[string]any)
+		assert.EqualValues(t, http.StatusCreated, resp["status"])
+		assert.Equal(t, "[REDACTED]", resp["headers"].(map[string]any)["Set-Cookie"])
+		// the handler still read the whole body
+		assert.Equal(t, "name=widget&count=2", resp["body"])
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		entry := dump(t, ENVDev, DumpConfig{MaxBody: 4}, newRequest("name=widget"), echo)
+		assert.Equal(t, "name…(truncated)", entry["request"].(map[string]any)["body"])
+		assert.Equal(t, "name…(truncated)", entry["response"].(map[string]any)["body"])
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader([]byte{0x89, 'P', 'N', 'G', 0, 1, 2}))
+		r.Header.Set(HeaderContentType, "image/png")
+		entry := dump(t, ENVDev, DumpConfig{}, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte{0, 1, 2, 3})
+		})
+		assert.Equal(t, "[binary image/png, 7 bytes]", entry["request"].(map[string]any)["body"])
+		assert.Equal(t, "[binary application/octet-stream, 4 bytes]", entry["response"].(map[string]any)["body"])
+	})
+
+	t.Run("not dev", func(t *testing.T) {
+		for _, env := range []ENVTypes{ENVProduction, ENVStaging, ""} {
+			assert.Nil(t, dump(t, env, DumpConfig{}, newRequest("a=1"), echo), env)
+		}
+		assert.NotNil(t, dump(t, ENVProduction, DumpConfig{ForceAllow: true}, newRequest("a=1"), echo))
+	})
+}
+
+func TestDecompressMiddleware(t *testing.T) {
+	gzipped := func(s string) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return &buf
+	}
+	deflated := func(s string) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return &buf
+	}
+
+	srv, err := Init(Options{Middleware: []Middleware{DecompressMiddlewareWithConfig(DecompressConfig{MaxSize: 64})}})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /echo", func(ctx Context) error {
+		body, err := io.ReadAll(ctx.Request().Body)
+		if err != nil {
+			return NewHTTPError(http.StatusRequestEntityTooLarge, err)
+		}
+		return ctx.String(http.StatusOK, ctx.Request().Header.Get("Content-Encoding")+string(body))
+	})
+	srv.HandleFunc("POST /json", func(ctx Context) error {
+		var v map[string]string
+		if err := ctx.BindJSON(&v); err != nil {
+			return err
+		}
+		return ctx.String(http.StatusOK, v["name"])
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		name     string
+		path     string
+		encoding string
+		body     io.Reader
+		code     int
+		want     string
+	}{
+		{"gzip", "/echo", "gzip", gzipped("hello, gzip"), http.StatusOK, "hello, gzip"},
+		{"deflate", "/echo", "deflate", deflated("hello, deflate"), http.StatusOK, "hello, deflate"},
+		{"plain", "/echo", "", strings.NewReader("hello"), http.StatusOK, "hello"},
+		{"bind json", "/json", "GZIP", gzipped(`{"name":"ada"}`), http.StatusOK, "ada"},
+		{"bomb", "/echo", "gzip", gzipped(strings.Repeat("a", 1<<20)), http.StatusRequestEntityTooLarge, ""},
+		{"bomb json", "/json", "gzip", gzipped(`{"name":"` + strings.Repeat("a", 1<<20) + `"}`), http.StatusRequestEntityTooLarge, ""},
+		{"corrupt", "/echo", "gzip", strings.NewReader("not gzip"), http.StatusBadRequest, ""},
+		{"unsupported", "/echo", "br", strings.NewReader("..."), http.StatusUnsupportedMediaType, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, tt.body)
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMethodOverrideMiddleware(t *testing.T) {
+	srv, err := Init(Options{Middleware: []Middleware{MethodOverrideMiddleware}})
+	require.NoError(t, err)
+	for _, pattern := range []string{"GET /items/1", "POST /items/1", "PUT /items/1", "DELETE /items/1"} {
+		srv.HandleFunc(pattern, func(ctx Context) error {
+			return ctx.String(http.StatusOK, ctx.Pattern()+" "+ctx.Param("name"))
+		})
+	}
+	require.NoError(t, srv.Route())
+
+	serve := func(req *http.Request) string {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	form := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/items/1", strings.NewReader(body))
+		req.Header.Set(HeaderContentType, "application/x-www-form-urlencoded")
+		return req
+	}
+
+	assert.Equal(t, "DELETE /items/1 widget", serve(form("_method=DELETE&name=widget")), "form field")
+	assert.Equal(t, "PUT /items/1 widget", serve(form("_method=put&name=widget")), "case-insensitive")
+
+	req := httptest.NewRequest(http.MethodPost, "/items/1", nil)
+	req.Header.Set("X-HTTP-Method-Override", "PUT")
+	assert.Equal(t, "PUT /items/1 ", serve(req), "header")
+
+	req = form("_method=DELETE")
+	req.Header.Set("X-HTTP-Method-Override", "PUT")
+	assert.Equal(t, "PUT /items/1 ", serve(req), "the header wins")
+
+	assert.Equal(t, "POST /items/1 ", serve(form("_method=GET")), "GET isn't a target")
+	assert.Equal(t, "POST /items/1 ", serve(httptest.NewRequest(http.MethodPost, "/items/1?_method=DELETE", nil)),
+		"the query string is ignored")
+
+	req = httptest.NewRequest(http.MethodGet, "/items/1", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	assert.Equal(t, "GET /items/1 ", serve(req), "only POST is overridden")
+
+	req = httptest.NewRequest(http.MethodGet, "/items/1", nil)
+	req.Header.Set("X-HTTP-Method-Override", "POST")
+	assert.Equal(t, "GET /items/1 ", serve(req), "no escalation from GET to POST")
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// namedMiddleware is a middleware registered with UseNamed, UseBefore or UseAfter.
+type namedMiddleware struct {
+	name   string
+	mw     Middleware
+	before string
+	after  string
+}
+
+// UseNamed appends a named middleware. Named middleware runs before middleware added with Use
+// and can be referenced by UseBefore, UseAfter and Replace.
+func (s *Server) UseNamed(name string, mw Middleware) {
+	s.named = append(s.named, namedMiddleware{name: name, mw: mw})
+}
+
+// UseBefore adds a named middleware that runs right before the middleware named ref.
+func (s *Server) UseBefore(ref string, name string, mw Middleware) {
+	s.named = append(s.named, namedMiddleware{name: name, mw: mw, before: ref})
+}
+
+// UseAfter adds a named middleware that runs right after the middleware named ref.
+func (s *Server) UseAfter(ref string, name string, mw Middleware) {
+	s.named = append(s.named, namedMiddleware{name: name, mw: mw, after: ref})
+}
+
+// Replace swaps the middleware registered under name, keeping its position.
+func (s *Server) Replace(name string, mw Middleware) {
+	if s.replaced == nil {
+		s.replaced = make(map[string]Middleware)
+	}
+	s.replaced[name] = mw
+}
+
+// resolveMiddleware orders the named middleware. It fails on duplicate or unknown names
+// and on cycles between UseBefore/UseAfter references.
+func (s *Server) resolveMiddleware() ([]namedMiddleware, error) {
+	byName := make(map[string]*namedMiddleware, len(s.named))
+	for i := range s.named {
+		e := &s.named[i]
+		if _, ok := byName[e.name]; ok {
+			return nil, fmt.Errorf("middleware %q registered more than once", e.name)
+		}
+		byName[e.name] = e
+	}
+
+	for name, mw := range s.replaced {
+		e, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot replace unknown middleware %q", name)
+		}
+		e.mw = mw
+	}
+
+	const (
+		visiting = 1
+		placed   = 2
+	)
+	state := make(map[string]int, len(s.named))
+	order := make([]namedMiddleware, 0, len(s.named))
+
+	var place func(e *namedMiddleware) error
+	place = func(e *namedMiddleware) error {
+		switch state[e.name] {
+		case placed:
+			return nil
+		case visiting:
+			return fmt.Errorf("middleware ordering cycle at %q", e.name)
+		}
+		state[e.name] = visiting
+
+		ref := e.before + e.after
+		if ref == "" {
+			order = append(order, *e)
+			state[e.name] = placed
+			return nil
+		}
+
+		refEntry, ok := byName[ref]
+		if !ok {
+			return fmt.Errorf("middleware %q references unknown middleware %q", e.name, ref)
+		}
+		if err := place(refEntry); err != nil {
+			return err
+		}
+
+		idx := slices.IndexFunc(order, func(o namedMiddleware) bool { return o.name == ref })
+		if e.after != "" {
+			// keep registration order among middleware placed after the same reference
+			idx++
+			for idx < len(order) && order[idx].after == ref {
+				idx++
+			}
+		}
+		order = slices.Insert(order, idx, *e)
+		state[e.name] = placed
+		return nil
+	}
+
+	for i := range s.named {
+		if err := place(&s.named[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// middlewareChain returns the named middleware, in resolved order, followed by s.Middleware.
+func (s *Server) middlewareChain() (Chain, []string, error) {
+	named, err := s.resolveMiddleware()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain := make(Chain, 0, len(named)+len(s.Middleware))
+	names := make([]string, 0, len(named)+len(s.Middleware))
+	for _, n := range named {
+		chain = append(chain, n.mw)
+		names = append(names, n.name)
+	}
+	for range s.Middleware {
+		names = append(names, "<anonymous>")
+	}
+
+	return append(chain, s.Middleware...), names, nil
+}
+
+// MiddlewareOrder returns the names of the server middleware in the order they run.
+// Middleware added with Use is listed as "<anonymous>".
+func (s *Server) MiddlewareOrder() ([]string, error) {
+	_, names, err := s.middlewareChain()
+	return names, err
+}
+
+// Routes returns the routes registered on the server.
+func (s *Server) Routes() []Route {
+	return slices.Clone(s.routes)
+}
+
+// PrintRoutes writes the middleware order and the registered routes to w, including the routes
+// of groups and host groups.
+func (s *Server) PrintRoutes(w io.Writer) error {
+	names, err := s.MiddlewareOrder()
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "middleware: %s\n", strings.Join(names, " -> ")); err != nil {
+		return err
+	}
+
+	for _, e := range s.routeTable() {
+		line := e.pattern
+		if e.method != "" {
+			line = e.method + " " + line
+		}
+		if e.name != "" {
+			line += " (" + e.name + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// routeGroup describes the routes of a Group.
+type routeGroup struct {
+	name       string
+	middleware int
+	routes     []Route
+}
+
+// routeEntry is a line of the route table.
+type routeEntry struct {
+	method  string
+	pattern string
+	name    string
+	// middleware counts the middleware of the route and its groups, not the server middleware
+	middleware int
+}
+
+// routeTable lists the registered routes, with the routes of groups and host groups in place of
+// the groups themselves. Patterns include the group prefix and names the group name.
+func (s *Server) routeTable() []routeEntry {
+	var entries []routeEntry
+	var walk func(routes []Route, host, prefix, namePrefix string, middleware int)
+	walk = func(routes []Route, host, prefix, namePrefix string, middleware int) {
+		for _, r := range routes {
+			method, h, pth := PatternParts(r.Match)
+			if h == "" {
+				h = host
+			}
+			if r.group != nil {
+				walk(r.group.routes, h, strings.TrimSuffix(prefix+pth, "/"), namePrefix+r.group.name+"/",
+					middleware+len(r.Middleware)+r.group.middleware)
+				continue
+			}
+
+			name := r.Name
+			if name != "" {
+				name = namePrefix + name
+			}
+			entries = append(entries, routeEntry{method, h + prefix + pth, name, middleware + len(r.Middleware)})
+		}
+	}
+
+	for _, g := range s.hostGroups {
+		walk(g.routes, g.pattern, "", g.name+"/", g.middleware)
+	}
+	walk(s.routes, "", "", "", 0)
+	return entries
+}
+
+// logRouteTable logs the middleware order and the route table at debug level.
+func (s *Server) logRouteTable() {
+	names, err := s.MiddlewareOrder()
+	if err != nil {
+		s.logger().Warn("route table: middleware order", "err", err)
+	}
+	s.logger().Debug("middleware", "order", names)
+
+	for _, e := range s.routeTable() {
+		method := e.method
+		if method == "" {
+			method = "*"
+		}
+		s.logger().Debug("route", "method", method, "pattern", e.pattern, "name", e.name, "middleware", e.middleware)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// Option sets fields of the Options New initializes the server with. Options missing a
+// helper are set with a function literal:
+//
+//	server.New(server.WithPort(8080), func(o *server.Options) { o.StrictJSON = true })
+type Option func(*Options)
+
+// New is Init with the Options set by opts, in order, leaving the others to their defaults.
+func New(opts ...Option) (*Server, error) {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return Init(options)
+}
+
+// WithOptions replaces all the options with o, e.g. a base configuration later options adjust.
+func WithOptions(o Options) Option {
+	return func(options *Options) { *options = o }
+}
+
+func WithHost(host string) Option {
+	return func(o *Options) { o.Host = host }
+}
+
+func WithPort(port int) Option {
+	return func(o *Options) { o.Port = port }
+}
+
+// WithPublic serves the dir directory under Options.PublicPrefix.
+func WithPublic(dir string) Option {
+	return func(o *Options) { o.Public = dir }
+}
+
+func WithEnv(env ENVTypes) Option {
+	return func(o *Options) { o.Env = env }
+}
+
+func WithLogger(log *slog.Logger) Option {
+	return func(o *Options) { o.Log = log }
+}
+
+func WithTemplates(t *Templates) Option {
+	return func(o *Options) { o.Templates = t }
+}
+
+func WithRenderer(r Renderer) Option {
+	return func(o *Options) { o.Renderer = r }
+}
+
+func WithSessionManager(mgr *scs.SessionManager) Option {
+	return func(o *Options) { o.SessionMgr = mgr }
+}
+
+// WithServerMiddleware appends to the server middleware. WithMiddleware is the route option.
+func WithServerMiddleware(middleware ...Middleware) Option {
+	return func(o *Options) { o.Middleware = append(o.Middleware, middleware...) }
+}
+
+// WithRoutes appends to the routes mounted by Route.
+func WithRoutes(routes ...Route) Option {
+	return func(o *Options) { o.Routes = append(o.Routes, routes...) }
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mgr := scs.New()
+
+	srv, err := New(
+		WithOptions(Options{Host: "0.0.0.0", Port: 80, StrictJSON: true}),
+		WithHost("localhost"),
+		WithPort(8080),
+		WithPublic("testData/public"),
+		WithEnv(ENVStaging),
+		WithLogger(log),
+		WithTemplates(tmpl),
+		WithSessionManager(mgr),
+		WithServerMiddleware(RequestIDMiddleware),
+		WithServerMiddleware(RecoveryMiddleware),
+		func(o *Options) { o.NegotiateRender = true },
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost", srv.Host)
+	assert.Equal(t, 8080, srv.Port)
+	assert.Equal(t, "testData/public", srv.Public)
+	assert.EqualValues(t, ENVStaging, srv.env)
+	assert.Same(t, log, srv.logger())
+	assert.Same(t, tmpl, srv.Templates())
+	assert.Same(t, mgr, srv.sessionMgr)
+	assert.Len(t, srv.Middleware, 2)
+	assert.True(t, srv.strictJSON, "set by WithOptions")
+	assert.True(t, srv.negotiate)
+
+	srv, err = New()
+	require.NoError(t, err)
+	assert.Zero(t, srv.Port)
+	assert.Nil(t, srv.Templates())
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errPanic is the error of spans whose handler panicked.
+var errPanic = errors.New("handler panicked")
+
+// SpanStarter starts the server span of a request. It is the part of an OpenTelemetry
+// trace.Tracer OTelMiddleware needs, so the server doesn't depend on the OpenTelemetry modules;
+// see the README for an adapter.
+type SpanStarter interface {
+	// Start starts a server span for r named name, as a child of the span in ctx if any, and
+	// returns ctx with the new span.
+	Start(ctx context.Context, name string, r *http.Request) (context.Context, ServerSpan)
+}
+
+// ServerSpan is a span started by a SpanStarter.
+type ServerSpan interface {
+	// SetName renames the span once the route serving the request is known.
+	SetName(name string)
+	// End records the response status and the error the request failed with, if any, and
+	// ends the span. err is nil for 5xx responses written without a handler error.
+	End(status int, err error)
+	// TraceContext returns the trace and span IDs of the span.
+	TraceContext() TraceContext
+}
+
+// OTelConfig configures OTelMiddleware.
+type OTelConfig struct {
+	// Tracer starts the spans. OTelMiddleware is a no-op when it is nil, e.g. when no
+	// TracerProvider is configured.
+	Tracer SpanStarter
+	// Propagator returns ctx with the trace context the caller sent in h, e.g. with
+	// otel.GetTextMapPropagator().Extract. Spans are started as roots when it is nil.
+	Propagator func(ctx context.Context, h http.Header) context.Context
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// OTelMiddleware starts a server span for each request. The span is named after the pattern of
+// the route that served it, e.g. "GET /users/{id}", rather than the URL, and ends with the
+// response status, also when the handler panics. Its IDs replace those of the traceparent
+// header for the request log and for loggers scoped afterwards: add OTelMiddleware before
+// RequestIDMiddleware so handler logs get them.
+func OTelMiddleware(cfg OTelConfig) Middleware {
+	if cfg.Tracer == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if cfg.Propagator != nil {
+				ctx = cfg.Propagator(ctx, r.Header)
+			}
+			ctx, span := cfg.Tracer.Start(ctx, r.Method, r)
+			r = r.WithContext(ctx)
+			SetTrace(r, span.TraceContext())
+
+			rw := &ResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			panicked := true
+			// not recovering keeps the panic, and its stack, for RecoveryMiddleware
+			defer func() {
+				if _, pattern := MatchedRoute(r); pattern != "" {
+					span.SetName(r.Method + " " + pattern)
+				}
+
+				if panicked {
+					span.End(http.StatusInternalServerError, errPanic)
+					return
+				}
+
+				var err error
+				if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+					err = info.err
+				}
+				span.End(rw.statusCode, err)
+			}()
+
+			next.ServeHTTP(rw, r)
+			panicked = false
+		})
+	}, cfg.Skipper)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent string
+	tc     TraceContext
+	status int
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetName(name string)        { s.name = name }
+func (s *testSpan) TraceContext() TraceContext { return s.tc }
+
+func (s *testSpan) End(status int, err error) {
+	s.status, s.err, s.ended = status, err, true
+}
+
+// testTracer starts spans continuing the trace in the context, as a propagator would leave it.
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, r *http.Request) (context.Context, ServerSpan) {
+	span := &testSpan{name: name, tc: TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "b7ad6b7169203331"}}
+	if parent, ok := ctx.Value(testSpanKey{}).(TraceContext); ok {
+		span.parent, span.tc.TraceID = parent.SpanID, parent.TraceID
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span.tc), span
+}
+
+func TestOTelMiddleware(t *testing.T) {
+	tracer := &testTracer{}
+	logs := new(bytes.Buffer)
+	srv, err := Init(Options{
+		Log: slog.New(slog.NewJSONHandler(logs, nil)),
+		Middleware: []Middleware{
+			OTelMiddleware(OTelConfig{
+				Tracer: tracer,
+				Propagator: func(ctx context.Context, h http.Header) context.Context {
+					if tc, ok := traceFromHeaders(h); ok {
+						return context.WithValue(ctx, testSpanKey{}, tc)
+					}
+					return ctx
+				},
+			}),
+			RequestIDMiddleware,
+			RecoveryMiddleware,
+		},
+	})
+	require.NoError(t, err)
+
+	srv.HandleFunc("GET /users/{id}", func(ctx Context) error {
+		assert.NotNil(t, ctx.Context().Value(testSpanKey{}), "the span is in the handler context")
+		ctx.Log().Info("loading user")
+		return ctx.String(http.StatusOK, ctx.UrlParam("id"))
+	})
+	srv.HandleFunc("/fail", func(ctx Context) error {
+		return errors.New("db down")
+	})
+	srv.Handle("/raw-panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	require.NoError(t, srv.Route())
+
+	serve := func(path string, header http.Header) (*testSpan, int) {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		require.NotEmpty(t, tracer.spans)
+		return tracer.spans[len(tracer.spans)-1], rec.Code
+	}
+
+	t.Run("route pattern", func(t *testing.T) {
+		span, code := serve("/users/42", http.Header{
+			"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-00f067aa0ba902b7-01"},
+		})
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "GET /users/{id}", span.name)
+		assert.Equal(t, "00f067aa0ba902b7", span.parent)
+		assert.True(t, span.ended)
+		assert.Equal(t, http.StatusOK, span.status)
+		assert.NoError(t, span.err)
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(logs.Bytes(), &entry), logs.String())
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", entry["trace_id"])
+		assert.Equal(t, "b7ad6b7169203331", entry["span_id"], "the server span, not the caller's")
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		span, code := serve("/fail", nil)
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, "GET /fail", span.name)
+		assert.Equal(t, http.StatusInternalServerError, span.status)
+		assert.EqualError(t, span.err, "db down")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		span, code := serve("/raw-panic", nil)
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.True(t, span.ended)
+		assert.Equal(t, http.StatusInternalServerError, span.status)
+		assert.EqualError(t, span.err, "panic: boom")
+		assert.True(t, strings.Contains(logs.String(), "Recovered from panic"))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		span, code := serve("/missing", nil)
+		assert.Equal(t, http.StatusNotFound, code)
+		assert.Equal(t, http.MethodGet, span.name, "unmatched requests keep the method as name")
+	})
+}
+
+func TestOTelMiddleware_Panic(t *testing.T) {
+	tracer := &testTracer{}
+	panics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	h := RecoveryMiddleware(OTelMiddleware(OTelConfig{Tracer: tracer})(panics))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Len(t, tracer.spans, 1)
+	assert.True(t, tracer.spans[0].ended, "spans end when the panic goes through the middleware")
+	assert.ErrorIs(t, tracer.spans[0].err, errPanic)
+}
+
+func TestOTelMiddleware_NoTracer(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := OTelMiddleware(OTelConfig{})(next)
+
+	rec, req := httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Zero(t, testing.AllocsPerRun(100, func() { h.ServeHTTP(rec, req) }))
+}
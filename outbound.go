@@ -0,0 +1,41 @@
+package server
+
+import "net/http"
+
+// RequestIDTransport is an http.RoundTripper that sets X-Request-ID on outgoing requests to the
+// request ID of their context, see RequestIDFromContext, so the logs of downstream services
+// can be correlated with the request that called them. A request that already has the header
+// keeps it.
+type RequestIDTransport struct {
+	// Base sends the requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+
+	// requestID is used when the context of the outgoing request has none
+	requestID string
+}
+
+func (t *RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	id := RequestIDFromContext(req.Context())
+	if id == "" {
+		id = t.requestID
+	}
+	if id == "" || req.Header.Get(RequestIDHeaderKey) != "" {
+		return base.RoundTrip(req)
+	}
+
+	// RoundTrip must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(RequestIDHeaderKey, id)
+	return base.RoundTrip(req)
+}
+
+// HTTPClient returns a client for calls to other services made while handling the request.
+// Its requests carry the request ID in X-Request-ID, even when made with another context.
+func (c *HandlerContext) HTTPClient() *http.Client {
+	return &http.Client{Transport: &RequestIDTransport{requestID: c.RequestID()}}
+}
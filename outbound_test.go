@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext_HTTPClient(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get(RequestIDHeaderKey))
+	}))
+	defer downstream.Close()
+
+	call := func(client *http.Client, req *http.Request) string {
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	srv, err := Init(Options{Middleware: []Middleware{RequestIDMiddleware}})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /client", func(ctx Context) error {
+		req, _ := http.NewRequest(http.MethodGet, downstream.URL, nil)
+		return ctx.String(http.StatusOK, call(ctx.HTTPClient(), req))
+	})
+	srv.HandleFunc("GET /transport", func(ctx Context) error {
+		client := &http.Client{Transport: &RequestIDTransport{}}
+		req, _ := http.NewRequestWithContext(ctx.Detach(), http.MethodGet, downstream.URL, nil)
+		return ctx.String(http.StatusOK, call(client, req))
+	})
+	srv.HandleFunc("GET /explicit", func(ctx Context) error {
+		req, _ := http.NewRequest(http.MethodGet, downstream.URL, nil)
+		req.Header.Set(RequestIDHeaderKey, "mine")
+		return ctx.String(http.StatusOK, call(ctx.HTTPClient(), req))
+	})
+	require.NoError(t, srv.Route())
+
+	for _, path := range []string{"/client", "/transport"} {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, rec.Body.String(), path)
+		assert.Equal(t, rec.Header().Get(RequestIDHeaderKey), rec.Body.String(), path)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/explicit", nil))
+	assert.Equal(t, "mine", rec.Body.String())
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"strings"
+)
+
+// routeOverlap is a pair of routes of the same mux that match some of the same requests. The
+// mux serves those with wins, the more specific pattern, whichever was registered first.
+type routeOverlap struct {
+	wins string
+	over string
+}
+
+// overlappingRoutes finds the overlapping routes of each mux: the server's, a group's or a host
+// group's. ServeMux panics on overlapping patterns when neither is more specific, but when one is
+// it silently serves the shared requests with it, e.g. "/users/new" over "/users/{id}". Only
+// patterns matching a fixed number of segments are compared: a pattern ending in "/" or
+// "{name...}" is expected to be a fallback for the paths below it.
+func (s *Server) overlappingRoutes() []routeOverlap {
+	var overlaps []routeOverlap
+	var walk func(routes []Route, host, prefix string)
+	walk = func(routes []Route, host, prefix string) {
+		var patterns []routePattern
+		for _, r := range routes {
+			method, h, pth := PatternParts(r.Match)
+			if h == "" {
+				h = host
+			}
+			if r.group != nil {
+				walk(r.group.routes, h, strings.TrimSuffix(prefix+pth, "/"))
+				continue
+			}
+			if p, ok := parseRoutePattern(method, h, pth); ok {
+				p.display = strings.TrimSpace(method + " " + h + prefix + pth)
+				patterns = append(patterns, p)
+			}
+		}
+
+		for i, a := range patterns {
+			for _, b := range patterns[i+1:] {
+				if !a.overlaps(b) {
+					continue
+				}
+				switch {
+				case a.moreSpecific(b):
+					overlaps = append(overlaps, routeOverlap{wins: a.display, over: b.display})
+				case b.moreSpecific(a):
+					overlaps = append(overlaps, routeOverlap{wins: b.display, over: a.display})
+				default:
+					// ServeMux rejects them when they are registered
+				}
+			}
+		}
+	}
+
+	for _, g := range s.hostGroups {
+		walk(g.routes, g.pattern, "")
+	}
+	walk(s.routes, "", "")
+	return overlaps
+}
+
+// warnOverlappingRoutes logs the overlapping routes of the server.
+func (s *Server) warnOverlappingRoutes() {
+	for _, o := range s.overlappingRoutes() {
+		s.logger().Warn("overlapping routes, the more specific pattern serves the requests both match",
+			"wins", o.wins, "over", o.over)
+	}
+}
+
+// routePattern is a parsed pattern matching a fixed number of path segments.
+type routePattern struct {
+	method string
+	host   string
+	// segments are literals, or "" for the wildcards
+	segments []string
+	display  string
+}
+
+func parseRoutePattern(method, host, pth string) (routePattern, bool) {
+	if pth == "" || strings.Contains(pth, "...}") || strings.HasSuffix(pth, "/") {
+		return routePattern{}, false
+	}
+
+	p := routePattern{method: method, host: host}
+	for _, seg := range strings.Split(pth[1:], "/") {
+		switch {
+		case seg == "{$}":
+			// the trailing slash of "/a/{$}", an empty segment
+			p.segments = append(p.segments, "/")
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			p.segments = append(p.segments, "")
+		default:
+			p.segments = append(p.segments, "/"+seg)
+		}
+	}
+	return p, true
+}
+
+// overlaps reports whether a request can match both p and o.
+func (p routePattern) overlaps(o routePattern) bool {
+	if p.host != o.host || len(p.segments) != len(o.segments) || !methodsOverlap(p.method, o.method) {
+		return false
+	}
+
+	identical := true
+	for i, seg := range p.segments {
+		other := o.segments[i]
+		if seg != "" && other != "" && seg != other {
+			return false
+		}
+		// wildcards don't match empty segments
+		if seg == "" && other == "/" || seg == "/" && other == "" {
+			return false
+		}
+		identical = identical && seg == other
+	}
+	// the same path for different methods is a deliberate split
+	return !identical
+}
+
+// moreSpecific reports whether p matches a strict subset of the paths o matches.
+func (p routePattern) moreSpecific(o routePattern) bool {
+	more := false
+	for i, seg := range p.segments {
+		switch other := o.segments[i]; {
+		case seg != "" && other == "":
+			more = true
+		case seg == "" && other != "":
+			return false
+		}
+	}
+	return more
+}
+
+func methodsOverlap(a, b string) bool {
+	return a == "" || b == "" || a == b ||
+		a == "HEAD" && b == "GET" || a == "GET" && b == "HEAD"
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentPanicsSize is the number of panics RecentPanics keeps.
+const RecentPanicsSize = 32
+
+// Limits of the recovered value and the stack kept for a panic.
+const (
+	panicValueLimit = 1 << 10
+	panicStackLimit = 8 << 10
+)
+
+// PanicRecord describes a panic recovered by HandlerFunc or RecoveryMiddleware. It only holds
+// what identifies the request, never its body or headers.
+type PanicRecord struct {
+	Time time.Time `json:"time"`
+	// Pattern is the pattern of the matched route with its method, e.g. "GET /users/{id}".
+	Pattern   string `json:"pattern,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Value is the recovered value, formatted with %v.
+	Value string `json:"value"`
+	Stack string `json:"stack"`
+}
+
+// panicRing keeps the last RecentPanicsSize panics.
+type panicRing struct {
+	mu      sync.Mutex
+	records [RecentPanicsSize]PanicRecord
+	// n counts the panics added
+	n int
+}
+
+func (pr *panicRing) add(rec PanicRecord) {
+	pr.mu.Lock()
+	pr.records[pr.n%RecentPanicsSize] = rec
+	pr.n++
+	pr.mu.Unlock()
+}
+
+// list returns the kept panics, newest first.
+func (pr *panicRing) list() []PanicRecord {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	records := make([]PanicRecord, 0, min(pr.n, RecentPanicsSize))
+	for i := pr.n - 1; i >= 0 && i >= pr.n-RecentPanicsSize; i-- {
+		records = append(records, pr.records[i%RecentPanicsSize])
+	}
+	return records
+}
+
+// RecentPanics returns the last RecentPanicsSize panics recovered while serving requests,
+// newest first, with the recovered value and stack truncated. The total is in Stats().Panics.
+func (s *Server) RecentPanics() []PanicRecord {
+	return s.panicRing.list()
+}
+
+// MountRecentPanics serves RecentPanics as JSON at path, wrapped with mw only: like MountPprof,
+// the server middleware doesn't run for it. Stacks reveal the code, so guard it with mw.
+func (s *Server) MountRecentPanics(path string, mw ...Middleware) {
+	s.mux.Handle(path, Chain(mw).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderContentType, ContentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(s.RecentPanics())
+	})))
+}
+
+// recordPanic counts a panic recovered while serving r in the stats of the server and keeps it
+// for RecentPanics.
+func recordPanic(r *http.Request, rec any, stack []byte) {
+	srv, ok := FromContext(r.Context(), CtxKeyServer)
+	if !ok {
+		return
+	}
+	if srv.stats != nil {
+		srv.stats.panics.Add(1)
+	}
+
+	method, pattern := MatchedRoute(r)
+	reqID, _ := FromContext(r.Context(), requestIDKey)
+	srv.panicRing.add(PanicRecord{
+		Time:      time.Now(),
+		Pattern:   strings.TrimSpace(method + " " + pattern),
+		RequestID: reqID,
+		Value:     truncate(fmt.Sprint(rec), panicValueLimit),
+		Stack:     truncate(string(stack), panicStackLimit),
+	})
+}
+
+// truncate cuts s to at most limit bytes, marking the cut.
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "…(truncated)"
+}
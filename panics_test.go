@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_RecentPanics(t *testing.T) {
+	guard := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Ops-Token") != "let-me-in" {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv, err := Init(Options{Middleware: []Middleware{RequestIDMiddleware}})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /items/{id}", func(ctx Context) error {
+		panic("item " + ctx.UrlParam("id"))
+	})
+	srv.HandleFunc("GET /huge", func(ctx Context) error {
+		panic(strings.Repeat("x", 2*panicValueLimit))
+	})
+	srv.Handle("GET /plain", RecoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("plain")
+	})))
+	srv.MountRecentPanics("/debug/panics", guard)
+	require.NoError(t, srv.Route())
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Empty(t, srv.RecentPanics())
+
+	var wg sync.WaitGroup
+	for i := range RecentPanicsSize + 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(httptest.NewRequest(http.MethodGet, fmt.Sprint("/items/", i), nil))
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, srv.RecentPanics(), RecentPanicsSize)
+	assert.EqualValues(t, RecentPanicsSize+8, srv.Stats().Panics)
+
+	serve(httptest.NewRequest(http.MethodGet, "/huge", nil))
+	rec := serve(httptest.NewRequest(http.MethodGet, "/plain", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	panics := srv.RecentPanics()
+	require.Len(t, panics, RecentPanicsSize)
+	plain, huge, item := panics[0], panics[1], panics[2]
+	assert.Equal(t, "plain", plain.Value)
+	assert.Equal(t, "GET /plain", plain.Pattern)
+	assert.Equal(t, rec.Header().Get(RequestIDHeaderKey), plain.RequestID)
+	assert.Contains(t, plain.Stack, "panics_test.go")
+	assert.Equal(t, strings.Repeat("x", panicValueLimit)+"…(truncated)", huge.Value)
+	assert.Equal(t, "GET /items/{id}", item.Pattern)
+	assert.True(t, strings.HasPrefix(item.Value, "item "), item.Value)
+	assert.False(t, item.Time.IsZero())
+	assert.LessOrEqual(t, len(item.Stack), panicStackLimit+len("…(truncated)"))
+
+	assert.Equal(t, http.StatusForbidden, serve(httptest.NewRequest(http.MethodGet, "/debug/panics", nil)).Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/panics", nil)
+	req.Header.Set("X-Ops-Token", "let-me-in")
+	rec = serve(req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(RequestIDHeaderKey), "the server middleware doesn't run")
+	var listed []PanicRecord
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&listed))
+	require.Len(t, listed, RecentPanicsSize)
+	assert.Equal(t, "plain", listed[0].Value)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tableTemplates renders a table of Rows, the kind of page the buffer pool is for.
+func tableTemplates(t testing.TB) *Templates {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"table.tmpl": {Data: []byte(`<h1>{{.Title}}</h1><table>{{range .Rows}}<tr><td>{{.ID}}</td><td>{{.Name}}</td></tr>{{end}}</table>`)},
+	}})
+	require.NoError(t, err)
+	return tmpl
+}
+
+type tableRow struct {
+	ID   int
+	Name string
+}
+
+func tableRows(n int) []tableRow {
+	rows := make([]tableRow, n)
+	for i := range rows {
+		rows[i] = tableRow{ID: i, Name: fmt.Sprintf("row %d", i)}
+	}
+	return rows
+}
+
+func TestContext_RenderConcurrent(t *testing.T) {
+	srv, err := Init(Options{Templates: tableTemplates(t)})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /table/{n}", func(ctx Context) error {
+		n, err := ctx.ParamInt("n")
+		if err != nil {
+			return err
+		}
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "table", Data: map[string]any{"Title": n, "Rows": tableRows(n)}})
+	})
+	srv.HandleFunc("GET /json/{n}", func(ctx Context) error {
+		return ctx.JSON(http.StatusOK, JSONResponse{Data: ctx.UrlParam("n")})
+	})
+	require.NoError(t, srv.Route())
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every fifth page outgrows maxPooledBuffer
+			n := i * 10
+			if i%5 == 0 {
+				n = 10000
+			}
+
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/table/%d", n), nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			body := rec.Body.String()
+			assert.True(t, strings.HasPrefix(body, fmt.Sprintf("<h1>%d</h1><table>", n)), body[:min(len(body), 40)])
+			assert.Equal(t, n, strings.Count(body, "<tr>"))
+
+			rec = httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/json/%d", n), nil))
+			assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"Data":"%d"`, n))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPutBuffer(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("stale")
+	putBuffer(buf)
+	assert.Zero(t, buf.Len(), "pooled buffers are reset")
+
+	large := bytes.NewBuffer(make([]byte, 0, maxPooledBuffer+1))
+	putBuffer(large)
+	for range 10 {
+		assert.NotSame(t, large, getBuffer(), "large buffers aren't pooled")
+	}
+}
+
+// BenchmarkTemplates_Render compares rendering a 200 row table into a new buffer with rendering
+// it into a pooled one, as Context.Render does.
+func BenchmarkTemplates_Render(b *testing.B) {
+	tmpl := tableTemplates(b)
+	data := map[string]any{"Title": "Rows", "Rows": tableRows(200)}
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var buf bytes.Buffer
+			if _, err := tmpl.render(&buf, "table", "", "", data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := getBuffer()
+			if _, err := tmpl.render(buf, "table", "", "", data); err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+}
+
+func BenchmarkContext_Render(b *testing.B) {
+	srv, err := Init(Options{Templates: tableTemplates(b)})
+	require.NoError(b, err)
+	data := map[string]any{"Title": "Rows", "Rows": tableRows(200)}
+	srv.HandleFunc("GET /table", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "table", Data: data})
+	})
+	require.NoError(b, srv.Route())
+	req := httptest.NewRequest(http.MethodGet, "/table", nil)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		srv.HTTPServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
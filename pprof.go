@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// PprofPath is where the net/http/pprof handlers are mounted when Options.EnablePprof is set.
+const PprofPath = "/debug/pprof/"
+
+// BasicAuthCredentials are the user and password required by endpoints protected with basic auth.
+type BasicAuthCredentials struct {
+	User     string
+	Password string
+}
+
+// pprofProfiles are the runtime profiles served next to the pprof index.
+var pprofProfiles = []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"}
+
+// pprofHandler returns the pprof handlers under prefix, requiring auth when it isn't nil.
+func pprofHandler(prefix string, auth *BasicAuthCredentials) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, pprof.Index)
+	mux.HandleFunc(prefix+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(prefix+"profile", pprof.Profile)
+	mux.HandleFunc(prefix+"symbol", pprof.Symbol)
+	mux.HandleFunc(prefix+"trace", pprof.Trace)
+	// pprof.Index only serves these itself under /debug/pprof/
+	for _, name := range pprofProfiles {
+		mux.Handle(prefix+name, pprof.Handler(name))
+	}
+
+	if auth == nil {
+		return mux
+	}
+	return basicAuth(*auth, "pprof", mux)
+}
+
+// MountPprof mounts the net/http/pprof index, profile, heap, goroutine, trace and symbol
+// handlers, and the other runtime profiles, under prefix. They are wrapped with mw only: the
+// server middleware doesn't run for them, so timeouts and response compression don't get in
+// the way of profiles. Use mw to guard them, e.g. with basic auth or an IP filter.
+// PprofSkipper matches the mounted paths for middleware wrapping the whole server.
+func (s *Server) MountPprof(prefix string, mw ...Middleware) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s.mux.Handle(prefix, Chain(mw).Then(pprofHandler(prefix, nil)))
+	s.pprofPaths = append(s.pprofPaths, prefix)
+}
+
+// PprofSkipper returns a Skipper matching the paths mounted by MountPprof and
+// Options.EnablePprof on the main listener.
+func (s *Server) PprofSkipper() Skipper {
+	return SkipPathPrefixes(s.pprofPaths...)
+}
+
+// basicAuth responds with 401 to requests without the expected credentials.
+func basicAuth(creds BasicAuthCredentials, realm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// evaluate both so the response time doesn't tell which one is wrong
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(creds.User)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(creds.Password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
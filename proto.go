@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsHTTPS reports whether the client made r over HTTPS: r was received over TLS, or a proxy
+// listed in Options.TrustedProxies reported https with X-Forwarded-Proto or the proto parameter
+// of a Forwarded header.
+func IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	info, ok := FromContext(r.Context(), requestInfoKey)
+	return ok && info.https
+}
+
+// forwardedHTTPS reports whether r comes from a trusted proxy that received it over HTTPS.
+func forwardedHTTPS(r *http.Request, proxies trustedNets) bool {
+	peer := net.ParseIP(remoteIP(r.RemoteAddr))
+	if peer == nil || !proxies.contains(peer) {
+		return false
+	}
+	return strings.EqualFold(forwardedProto(r), "https")
+}
+
+// forwardedProto returns the scheme the client used according to the last entry of
+// X-Forwarded-Proto, otherwise of the Forwarded header. Proxies append to these headers, so the
+// last entry is the one set by the trusted peer, earlier ones may come from the client, as
+// RealIPMiddleware reads X-Forwarded-For from the right. Values that aren't http or https are
+// ignored.
+func forwardedProto(r *http.Request) string {
+	if xfp := splitHeaderList(r.Header.Values("X-Forwarded-Proto")); len(xfp) > 0 {
+		return validProto(xfp[len(xfp)-1])
+	}
+
+	elems := splitHeaderList(r.Header.Values("Forwarded"))
+	if len(elems) == 0 {
+		return ""
+	}
+	for _, pair := range strings.Split(elems[len(elems)-1], ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "proto") {
+			return validProto(strings.Trim(strings.TrimSpace(val), `"`))
+		}
+	}
+	return ""
+}
+
+func validProto(proto string) string {
+	switch proto = strings.ToLower(proto); proto {
+	case "http", "https":
+		return proto
+	}
+	return ""
+}
+
+// IsHTTPS reports whether the client made the request over HTTPS, see IsHTTPS.
+func (c *HandlerContext) IsHTTPS() bool {
+	return IsHTTPS(c.Request())
+}
+
+// HSTSConfig configures HSTSMiddlewareWithConfig.
+type HSTSConfig struct {
+	// MaxAge is how long browsers only use HTTPS for the host. Defaults to DefaultHSTSMaxAge.
+	MaxAge time.Duration
+	// IncludeSubDomains extends the policy to the subdomains of the host.
+	IncludeSubDomains bool
+	// Preload asks for the host to be included in the browsers' preload lists, which requires
+	// IncludeSubDomains and a MaxAge of at least a year.
+	Preload bool
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// DefaultHSTSMaxAge is the default of HSTSConfig.MaxAge, a year.
+const DefaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// HSTSMiddleware sets the Strict-Transport-Security header on the responses to HTTPS requests,
+// see IsHTTPS. Browsers ignore it over plain HTTP, so it isn't sent there.
+func HSTSMiddleware(next http.Handler) http.Handler {
+	return HSTSMiddlewareWithConfig(HSTSConfig{})(next)
+}
+
+// HSTSMiddlewareWithConfig returns an HSTSMiddleware using the given config.
+func HSTSMiddlewareWithConfig(cfg HSTSConfig) Middleware {
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultHSTSMaxAge
+	}
+	value := "max-age=" + strconv.FormatInt(int64(cfg.MaxAge/time.Second), 10)
+	if cfg.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if cfg.Preload {
+		value += "; preload"
+	}
+
+	return Skip(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsHTTPS(r) {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, cfg.Skipper)
+}
+
+// secureSessionCookie marks the session cookie Secure on the responses to HTTPS requests, see
+// IsHTTPS, unless the session manager always does with Cookie.Secure. It wraps LoadAndSave,
+// which runs before ServeHTTP records whether a trusted proxy forwarded HTTPS.
+func (s *Server) secureSessionCookie(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mgr := s.sessionMgr
+		if mgr == nil || mgr.Cookie.Secure || (r.TLS == nil && !forwardedHTTPS(r, s.proxies)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &secureCookieWriter{ResponseWriter: w, name: mgr.Cookie.Name}
+		next.ServeHTTP(sw, r)
+		// the header of a response without a body is sent once the handler returned
+		sw.secure()
+	})
+}
+
+// secureCookieWriter adds the Secure attribute to the cookie name before the header is sent.
+type secureCookieWriter struct {
+	http.ResponseWriter
+	name string
+	done bool
+}
+
+func (w *secureCookieWriter) secure() {
+	if w.done {
+		return
+	}
+	w.done = true
+	cookies := w.Header()["Set-Cookie"]
+	for i, c := range cookies {
+		if strings.HasPrefix(c, w.name+"=") && !strings.Contains(strings.ToLower(c), "; secure") {
+			cookies[i] = c + "; Secure"
+		}
+	}
+}
+
+func (w *secureCookieWriter) WriteHeader(code int) {
+	w.secure()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *secureCookieWriter) Write(p []byte) (int, error) {
+	w.secure()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *secureCookieWriter) Flush() {
+	w.secure()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *secureCookieWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *secureCookieWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
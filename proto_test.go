@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ForwardedHTTPS(t *testing.T) {
+	srv, err := Init(Options{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Middleware:     []Middleware{HSTSMiddleware},
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /", func(ctx Context) error {
+		ctx.SetSignedCookie(&http.Cookie{Name: "id", Value: "1"}, []byte("secret"))
+		return ctx.String(http.StatusOK, "ok")
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		name   string
+		remote string
+		header http.Header
+		tls    bool
+		https  bool
+	}{
+		{"forwarded https", "10.0.0.5:4000", http.Header{"X-Forwarded-Proto": {"https"}}, false, true},
+		{"last entry", "10.0.0.5:4000", http.Header{"X-Forwarded-Proto": {"http, HTTPS"}}, false, true},
+		{"client supplied entry", "10.0.0.5:4000", http.Header{"X-Forwarded-Proto": {"https", "http"}}, false, false},
+		{"forwarded header", "10.0.0.5:4000", http.Header{"Forwarded": {`for=1.2.3.4;proto=http, for=10.0.0.2;proto="https"`}}, false, true},
+		{"forwarded client entry", "10.0.0.5:4000", http.Header{"Forwarded": {`for=1.2.3.4;proto="https", for=10.0.0.2`}}, false, false},
+		{"forwarded http", "10.0.0.5:4000", http.Header{"X-Forwarded-Proto": {"http"}}, false, false},
+		{"malformed", "10.0.0.5:4000", http.Header{"X-Forwarded-Proto": {"https://"}}, false, false},
+		{"untrusted peer", "203.0.113.9:4000", http.Header{"X-Forwarded-Proto": {"https"}}, false, false},
+		{"direct tls", "203.0.113.9:4000", nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			req.Header = tt.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusOK, rec.Code)
+			if tt.https {
+				assert.Equal(t, "max-age=31536000", rec.Header().Get("Strict-Transport-Security"))
+				assert.Contains(t, rec.Header().Get("Set-Cookie"), "; Secure")
+			} else {
+				assert.Empty(t, rec.Header().Get("Strict-Transport-Security"))
+				assert.NotContains(t, rec.Header().Get("Set-Cookie"), "; Secure")
+			}
+		})
+	}
+
+	_, err = Init(Options{TrustedProxies: []string{"10.0.0/8"}})
+	assert.ErrorContains(t, err, `trusted proxies: invalid trusted network "10.0.0/8"`)
+}
+
+func TestServer_SessionCookieSecure(t *testing.T) {
+	srv, err := Init(Options{SessionMgr: scs.New(), TrustedProxies: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /login", func(ctx Context) error {
+		ctx.Session().Put("user", "ann")
+		return ctx.String(http.StatusOK, "ok")
+	})
+	srv.HandleFunc("GET /silent", func(ctx Context) error {
+		ctx.Session().Put("user", "ann")
+		return nil
+	})
+	require.NoError(t, srv.Route())
+
+	for _, path := range []string{"/login", "/silent"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.5:4000"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		cookie := rec.Header().Get("Set-Cookie")
+		assert.True(t, strings.HasPrefix(cookie, "session="), cookie)
+		assert.Contains(t, cookie, "; Secure", path)
+
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		rec = httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		assert.NotContains(t, rec.Header().Get("Set-Cookie"), "; Secure", path)
+	}
+}
+
+func TestHSTSMiddlewareWithConfig(t *testing.T) {
+	h := HSTSMiddlewareWithConfig(HSTSConfig{MaxAge: 24 * time.Hour, IncludeSubDomains: true, Preload: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "max-age=86400; includeSubDomains; preload", rec.Header().Get("Strict-Transport-Security"))
+}
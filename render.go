@@ -0,0 +1,1022 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoTemplates = errors.New("templates not configured")
+
+// Templates loads html templates from TemplateOptions.Root and renders them by name.
+// A template name is its path relative to Root without the extension, e.g. "users/list",
+// prefixed by the source name for TemplateOptions.Sources, e.g. "admin:users/list".
+type Templates struct {
+	opts    TemplateOptions
+	sources []templateSource
+	mu      sync.RWMutex
+	cache   map[templateKey]*template.Template
+	// localeFuncs are template functions bound to the locale a template is rendered in
+	localeFuncs map[string]func(locale string) any
+}
+
+// templateKey identifies a parsed template in the cache.
+type templateKey struct {
+	name, layout, locale string
+}
+
+type templateSource struct {
+	name      string
+	fsys      fs.FS
+	qualified bool
+}
+
+// InitTemplates prepares templates for rendering. Templates are read from opts.FS when set,
+// otherwise from the opts.Root directory, or from opts.Sources. Parsed templates are cached
+// unless opts.Debug is true.
+func InitTemplates(opts TemplateOptions) (*Templates, error) {
+	if opts.Ext == "" {
+		opts.Ext = ".tmpl"
+	}
+	if !strings.HasPrefix(opts.Ext, ".") {
+		opts.Ext = "." + opts.Ext
+	}
+
+	t := &Templates{opts: opts, cache: make(map[templateKey]*template.Template)}
+	if err := t.initSVG(); err != nil {
+		return nil, err
+	}
+	if len(opts.Sources) == 0 {
+		fsys, err := sourceFS(opts.Root, opts.FS)
+		if err != nil {
+			return nil, err
+		}
+		t.sources = []templateSource{{fsys: fsys}}
+		return t, nil
+	}
+
+	if opts.Root != "" || opts.FS != nil {
+		return nil, errors.New("templates: Sources can't be combined with Root or FS")
+	}
+	names := make(map[string]bool, len(opts.Sources))
+	for _, src := range opts.Sources {
+		switch {
+		case strings.Contains(src.Name, ":"):
+			return nil, fmt.Errorf("templates: source name %q contains ':'", src.Name)
+		case src.Name == "" && src.Qualified:
+			return nil, errors.New("templates: a Qualified source must have a Name")
+		case src.Name != "" && names[src.Name]:
+			return nil, fmt.Errorf("templates: duplicate source %q", src.Name)
+		}
+		names[src.Name] = true
+
+		fsys, err := sourceFS(src.Root, src.FS)
+		if err != nil {
+			return nil, fmt.Errorf("%w (source %q)", err, src.Name)
+		}
+		t.sources = append(t.sources, templateSource{name: src.Name, fsys: fsys, qualified: src.Qualified})
+	}
+
+	if err := t.checkConflicts(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// sourceFS returns the file system templates are read from: fsys, or its root subdirectory,
+// or the root directory.
+func sourceFS(root string, fsys fs.FS) (fs.FS, error) {
+	if fsys == nil {
+		if root == "" {
+			return nil, errors.New("templates: either Root or FS must be set")
+		}
+		return os.DirFS(root), nil
+	}
+	if root == "" || root == "." {
+		return fsys, nil
+	}
+
+	sub, err := fs.Sub(fsys, root)
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	return sub, nil
+}
+
+// checkConflicts fails when an unqualified name would find templates in more than one source.
+func (t *Templates) checkConflicts() error {
+	found := make(map[string]string)
+	for _, src := range t.sources {
+		if src.qualified {
+			continue
+		}
+		names, err := t.sourceNames(src)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if other, ok := found[name]; ok {
+				return fmt.Errorf("templates: %q is in sources %q and %q, make one of them Qualified", name, other, src.name)
+			}
+			found[name] = src.name
+		}
+	}
+	return nil
+}
+
+// resolve returns the source and file of the named template. Unqualified names resolve to the
+// first source having the file, or to the first unqualified source when none has it.
+func (t *Templates) resolve(name string) (fs.FS, string, bool) {
+	if ns, rest, ok := strings.Cut(name, ":"); ok {
+		for _, src := range t.sources {
+			if src.name == ns {
+				return src.fsys, t.filename(rest), true
+			}
+		}
+		return nil, "", false
+	}
+
+	file := t.filename(name)
+	var first fs.FS
+	for _, src := range t.sources {
+		if src.qualified {
+			continue
+		}
+		if first == nil {
+			first = src.fsys
+		}
+		if len(t.sources) == 1 {
+			break
+		}
+		if _, err := fs.Stat(src.fsys, file); err == nil {
+			return src.fsys, file, true
+		}
+	}
+	return first, file, first != nil
+}
+
+// Exists reports whether a template with the given name exists.
+func (t *Templates) Exists(name string) bool {
+	fsys, file, ok := t.resolve(name)
+	if !ok {
+		return false
+	}
+	_, err := fs.Stat(fsys, file)
+	return err == nil
+}
+
+// Render executes the named template with data and writes the result to w, without a layout.
+// Nothing is written if executing the template fails.
+func (t *Templates) Render(w io.Writer, name string, data any) error {
+	return t.RenderLayout(w, name, "", data)
+}
+
+// RenderLayout is Render within layout, see LayoutContentTemplate. An empty layout renders the
+// template alone.
+func (t *Templates) RenderLayout(w io.Writer, name, layout string, data any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := t.render(buf, name, layout, "", data); err != nil {
+		return err
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// render executes the named template, within layout when set and in locale, into w, reporting
+// whether it came from the cache. w holds partial output when executing the template fails.
+func (t *Templates) render(w io.Writer, name, layout, locale string, data any) (cached bool, err error) {
+	tmpl, cached, err := t.lookupLayout(name, layout, locale)
+	if err != nil {
+		return false, err
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		return cached, fmt.Errorf("templates: execute %q: %w", name, err)
+	}
+	return cached, nil
+}
+
+// Lookup returns the parsed html/template for name, e.g. to run one of its associated templates.
+// The result is shared with the render cache and must not be modified.
+func (t *Templates) Lookup(name string) (*template.Template, error) {
+	tmpl, _, err := t.lookup(name)
+	return tmpl, err
+}
+
+// Names returns the names of all the templates, sorted. The templates of Qualified sources
+// are listed with their source name.
+func (t *Templates) Names() ([]string, error) {
+	var names []string
+	for _, src := range t.sources {
+		srcNames, err := t.sourceNames(src)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range srcNames {
+			if src.qualified {
+				name = src.name + ":" + name
+			}
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// sourceNames returns the unqualified names of the templates of src.
+func (t *Templates) sourceNames(src templateSource) ([]string, error) {
+	var names []string
+	err := fs.WalkDir(src.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(p, t.opts.Ext) {
+			names = append(names, strings.TrimSuffix(p, t.opts.Ext))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	return names, nil
+}
+
+// Reload drops the named templates, and the pages rendered within them when they are layouts,
+// from the cache so they are parsed again on next use. Without names the whole cache is dropped.
+func (t *Templates) Reload(names ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(names) == 0 {
+		clear(t.cache)
+		return
+	}
+	for key := range t.cache {
+		if slices.Contains(names, key.name) || slices.Contains(names, key.layout) {
+			delete(t.cache, key)
+		}
+	}
+}
+
+// addFunc adds fn to the template functions as name, unless TemplateOptions.FuncMap has it.
+func (t *Templates) addFunc(name string, fn any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.opts.FuncMap[name]; ok {
+		return
+	}
+	funcs := make(template.FuncMap, len(t.opts.FuncMap)+1)
+	for k, v := range t.opts.FuncMap {
+		funcs[k] = v
+	}
+	funcs[name] = fn
+	t.opts.FuncMap = funcs
+	clear(t.cache)
+}
+
+// addLocaleFunc adds the function fn returns for the locale of a render as name, unless
+// TemplateOptions.FuncMap has it. Templates are parsed and cached per locale.
+func (t *Templates) addLocaleFunc(name string, fn func(locale string) any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.opts.FuncMap[name]; ok {
+		return
+	}
+	if t.localeFuncs == nil {
+		t.localeFuncs = make(map[string]func(locale string) any)
+	}
+	t.localeFuncs[name] = fn
+	clear(t.cache)
+}
+
+// funcs returns the template functions for locale.
+func (t *Templates) funcs(locale string) template.FuncMap {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.localeFuncs) == 0 {
+		return t.opts.FuncMap
+	}
+	funcs := make(template.FuncMap, len(t.opts.FuncMap)+len(t.localeFuncs))
+	for k, v := range t.opts.FuncMap {
+		funcs[k] = v
+	}
+	for k, fn := range t.localeFuncs {
+		funcs[k] = fn(locale)
+	}
+	return funcs
+}
+
+func (t *Templates) filename(name string) string {
+	return strings.TrimPrefix(name, "/") + t.opts.Ext
+}
+
+// LayoutContentTemplate is the name a template is defined as when rendered within a layout: the
+// layout includes it with {{template "content" .}}. The templates the page defines replace the
+// layout's blocks of the same name.
+const LayoutContentTemplate = "content"
+
+// lookup returns the parsed template for name and whether it was cached.
+func (t *Templates) lookup(name string) (*template.Template, bool, error) {
+	return t.lookupLayout(name, "", "")
+}
+
+// lookupLayout returns the parsed template for name within layout and in locale, and whether it
+// was cached.
+func (t *Templates) lookupLayout(name, layout, locale string) (*template.Template, bool, error) {
+	if len(t.localeFuncs) == 0 {
+		locale = ""
+	}
+	key := templateKey{name: name, layout: layout, locale: locale}
+	if !t.opts.Debug {
+		t.mu.RLock()
+		tmpl, ok := t.cache[key]
+		t.mu.RUnlock()
+		if ok {
+			return tmpl, true, nil
+		}
+	}
+
+	tmpl, err := t.parse(name, layout, locale)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !t.opts.Debug {
+		t.mu.Lock()
+		t.cache[key] = tmpl
+		t.mu.Unlock()
+	}
+
+	return tmpl, false, nil
+}
+
+// parse parses the named template, as the content of layout when set, with the functions of
+// locale.
+func (t *Templates) parse(name, layout, locale string) (*template.Template, error) {
+	fsys, file, ok := t.resolve(name)
+	if !ok {
+		return nil, fmt.Errorf("templates: parse %q: unknown source", name)
+	}
+	funcs := t.funcs(locale)
+	if layout == "" {
+		tmpl, err := template.New(path.Base(file)).Funcs(funcs).ParseFS(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("templates: parse %q: %w", name, err)
+		}
+		return tmpl, nil
+	}
+
+	layoutFS, layoutFile, ok := t.resolve(layout)
+	if !ok {
+		return nil, fmt.Errorf("templates: parse layout %q: unknown source", layout)
+	}
+	tmpl, err := template.New(path.Base(layoutFile)).Funcs(funcs).ParseFS(layoutFS, layoutFile)
+	if err != nil {
+		return nil, fmt.Errorf("templates: parse layout %q: %w", layout, err)
+	}
+	src, err := fs.ReadFile(fsys, file)
+	if err == nil {
+		_, err = tmpl.New(LayoutContentTemplate).Parse(string(src))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("templates: parse %q: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// Templates returns the templates set with Options.Templates, or nil when they aren't set or
+// Options.Renderer is used instead. Rendering through them directly bypasses Context.Render, so
+// the status code, error bag and error pages are up to the caller.
+func (s *Server) Templates() *Templates {
+	if tr, ok := s.renderer.(templatesRenderer); ok {
+		return tr.t
+	}
+	return nil
+}
+
+// Renderer renders the html views of Context.Render, Context.Error and MaintenanceMiddleware.
+// Set Options.Renderer to use another template engine; Options.Templates is used through
+// TemplatesRenderer otherwise.
+type Renderer interface {
+	// Render writes opt.Template executed with opt.Data to w, within opt.Layout or the
+	// renderer's default layout unless opt.NoLayout is set. Context.Render buffers w, so nothing
+	// reaches the response when Render fails, unless opt.Stream is set. opt.Negotiate is handled
+	// by the caller.
+	Render(w io.Writer, opt RenderOpt) error
+	// Exists reports whether the named template exists, e.g. an error template.
+	Exists(name string) bool
+}
+
+// TemplatesRenderer adapts t to the Renderer interface. Rendering through it keeps the template
+// cache stats of Stats().
+func TemplatesRenderer(t *Templates) Renderer {
+	return templatesRenderer{t: t}
+}
+
+type templatesRenderer struct {
+	t *Templates
+}
+
+func (tr templatesRenderer) Render(w io.Writer, opt RenderOpt) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := tr.t.render(buf, opt.Template, tr.layout(opt), opt.Locale, opt.Data); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// renderLayout returns the layout opt is rendered in, "" for none.
+func (s *Server) renderLayout(opt RenderOpt) string {
+	if tr, ok := s.renderer.(templatesRenderer); ok {
+		return tr.layout(opt)
+	}
+	if opt.NoLayout {
+		return ""
+	}
+	return opt.Layout
+}
+
+// layout returns the layout of opt, defaulting to TemplateOptions.DefaultLayout.
+func (tr templatesRenderer) layout(opt RenderOpt) string {
+	switch {
+	case opt.NoLayout:
+		return ""
+	case opt.Layout != "":
+		return opt.Layout
+	}
+	return tr.t.opts.DefaultLayout
+}
+
+func (tr templatesRenderer) Exists(name string) bool {
+	return tr.t.Exists(name)
+}
+
+// render renders opt into w, reporting whether *Templates found the template in its cache.
+func (s *Server) render(w io.Writer, opt RenderOpt) (cached bool, err error) {
+	if tr, ok := s.renderer.(templatesRenderer); ok {
+		return tr.t.render(w, opt.Template, tr.layout(opt), opt.Locale, opt.Data)
+	}
+	return false, s.renderer.Render(w, opt)
+}
+
+// RenderOpt describes what Context.Render should render.
+type RenderOpt struct {
+	Template string
+	Data     any
+	// Negotiate responds with Data as JSON instead of the template when the request's Accept
+	// header ranks application/json above text/html.
+	Negotiate bool
+	// Layout renders Template within this layout, see LayoutContentTemplate. Context.Render
+	// defaults it to the layout set with WithLayout, then to TemplateOptions.DefaultLayout.
+	Layout string
+	// NoLayout renders Template alone, ignoring Layout and the default layouts. Context.Render
+	// sets it for htmx requests, which swap fragments, unless Layout is set or they are boosted.
+	NoLayout bool
+	// Locale is the locale of the t template function. Context.Render defaults it to
+	// Context.Locale.
+	Locale string
+	// Stream writes the page to the response as it renders instead of buffering all of it
+	// first, halving the memory of multi-megabyte pages. Rendering errors within the first 4 KiB
+	// are handled as usual, but once the status is sent a failure can
+	// only be logged and the connection aborted, so the client doesn't take a truncated page
+	// for a complete one.
+	Stream bool
+	// Cache reuses the output of an earlier render when Cache.Key is set, see RenderCache.
+	// A cached render is a fragment, rendered without a layout. Cache is ignored with Stream,
+	// with TemplateOptions.Debug and when the render shows the error bag or flash messages.
+	Cache RenderCache
+}
+
+// ErrorPageData is passed to error templates rendered by Context.Error.
+type ErrorPageData struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+// DefaultErrorTemplatePattern is used to name error templates not listed in Options.ErrorTemplates.
+const DefaultErrorTemplatePattern = "%d.page"
+
+// errorTemplate returns the template name for the status code. Exact codes in errorTemplates
+// take precedence over status classes (4 for 4xx, 5 for 5xx), then the fallback pattern is used.
+func (s *Server) errorTemplate(code int) string {
+	if name, ok := s.errorTemplates[code]; ok {
+		return name
+	}
+	if name, ok := s.errorTemplates[code/100]; ok {
+		return name
+	}
+
+	pattern := s.errorTemplatePattern
+	if pattern == "" {
+		pattern = DefaultErrorTemplatePattern
+	}
+	return fmt.Sprintf(pattern, code)
+}
+
+// ErrMissingTemplates is returned by CheckTemplates, wrapped with the missing template names.
+var ErrMissingTemplates = errors.New("missing templates")
+
+// CheckTemplates reports the templates the renderer can't find among the 404 and 500 error
+// templates, the TemplateOptions.DefaultLayout and names. Route runs it with
+// Options.RequiredTemplates.
+func (s *Server) CheckTemplates(names ...string) error {
+	if s.renderer == nil {
+		return ErrNoTemplates
+	}
+
+	required := []string{s.errorTemplate(http.StatusNotFound), s.errorTemplate(http.StatusInternalServerError)}
+	if tr, ok := s.renderer.(templatesRenderer); ok && tr.t.opts.DefaultLayout != "" {
+		required = append(required, tr.t.opts.DefaultLayout)
+	}
+	required = append(required, names...)
+
+	var missing []string
+	for _, name := range required {
+		if !s.renderer.Exists(name) && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingTemplates, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c *HandlerContext) Render(status int, opt RenderOpt) error {
+	if c.srv != nil && (opt.Negotiate || c.srv.negotiate) {
+		c.Response().Header().Add("Vary", "Accept")
+		if prefersJSON(c.Request().Header.Get("Accept")) {
+			return c.renderJSON(status, c.withErrors(opt.Data))
+		}
+	}
+
+	if c.srv == nil || c.srv.renderer == nil {
+		return ErrNoTemplates
+	}
+
+	var start time.Time
+	if c.srv.stats != nil {
+		start = time.Now()
+	}
+	// the cache is looked up before the flashes are popped, and is left out when the render
+	// would show them or the error bag
+	var fingerprint [sha256.Size]byte
+	withViewData := c.withViewData
+	useCache := opt.Cache.Key != "" && !opt.Stream && c.srv.renderCache != nil && !c.HasErrors() && !c.hasFlashes()
+	if useCache {
+		opt.NoLayout = true
+		if opt.Locale == "" {
+			opt.Locale = c.Locale()
+		}
+		viewData := c.requestViewData()
+		withViewData = func(data any) any { return mergeViewData(data, viewData) }
+		if _, ok := opt.Data.(map[string]any); !ok && opt.Data != nil {
+			viewData = nil
+		}
+		fingerprint, useCache = renderFingerprint(opt, viewData)
+	}
+	if useCache {
+		body, ok := c.srv.renderCache.get(opt.Cache.Key, fingerprint)
+		c.srv.recordRenderCache(ok)
+		if ok {
+			c.writeContentType(ContentTypeHTML)
+			c.Response().WriteHeader(status)
+			_, err := c.Response().Write(body)
+			return err
+		}
+	}
+
+	opt = c.prepareRenderWith(opt, withViewData)
+	if opt.Stream {
+		return c.renderStream(status, opt, start)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	cached, err := c.srv.render(buf, opt)
+	if err != nil {
+		return err
+	}
+	if !start.IsZero() {
+		c.srv.recordRender(c.Request(), opt, cached, time.Since(start), buf.Len())
+	}
+	if useCache {
+		c.srv.renderCache.put(opt.Cache.Key, fingerprint, buf.Bytes(), opt.Cache.TTL)
+	}
+
+	c.writeContentType(ContentTypeHTML)
+	c.Response().WriteHeader(status)
+	_, err = buf.WriteTo(c.Response())
+	return err
+}
+
+// prepareRenderWith adds the error bag, flashes and locale of the request to opt, with the view
+// data merged by withViewData, so renders sharing it run the Options.ViewDataProviders once, and
+// resolves its layout.
+func (c *HandlerContext) prepareRenderWith(opt RenderOpt, withViewData func(any) any) RenderOpt {
+	data := c.withErrors(opt.Data)
+	if c.srv.renderFlash {
+		data = c.withFlashes(data)
+	}
+	opt.Data = withViewData(data)
+	if opt.Locale == "" {
+		opt.Locale = c.Locale()
+	}
+	if opt.Layout == "" && !opt.NoLayout {
+		if c.isHTMXFragment() {
+			opt.NoLayout = true
+		} else if info, ok := FromContext(c.Request().Context(), requestInfoKey); ok && info.layout != "" {
+			opt.Layout = info.layout
+		}
+	}
+	return opt
+}
+
+// OOBFragment is a fragment Context.RenderOOB swaps out of band into the element with the id
+// Target, e.g. a flash message area or a cart badge.
+type OOBFragment struct {
+	Template string
+	Target   string
+	Data     any
+	// Swap is the hx-swap-oob strategy. Defaults to innerHTML, replacing the content of Target
+	// with the fragment. With outerHTML the wrapping element replaces Target, so it takes its id.
+	Swap string
+	// Tag is the element the fragment is wrapped in. Defaults to div; use template for table
+	// rows and other elements a div can't hold.
+	Tag string
+}
+
+// RenderOOB renders main followed by the oob fragments for htmx requests, each wrapped in an
+// element with the hx-swap-oob attribute selecting its target, so one response updates several
+// parts of the page. Other requests, boosted links included, get main alone, in its layout.
+func (c *HandlerContext) RenderOOB(status int, main RenderOpt, oob ...OOBFragment) error {
+	if !c.isHTMXFragment() {
+		return c.Render(status, main)
+	}
+	if c.srv == nil || c.srv.renderer == nil {
+		return ErrNoTemplates
+	}
+
+	// the fragments share the view data of the request
+	viewData := c.requestViewData()
+	withViewData := func(data any) any { return mergeViewData(data, viewData) }
+	buf := getBuffer()
+	defer putBuffer(buf)
+	render := func(opt RenderOpt) error {
+		var start time.Time
+		if c.srv.stats != nil {
+			start = time.Now()
+		}
+		size := buf.Len()
+		opt = c.prepareRenderWith(opt, withViewData)
+		cached, err := c.srv.render(buf, opt)
+		if err == nil && !start.IsZero() {
+			c.srv.recordRender(c.Request(), opt, cached, time.Since(start), buf.Len()-size)
+		}
+		return err
+	}
+
+	if err := render(main); err != nil {
+		return err
+	}
+	for _, f := range oob {
+		tag := cmp.Or(f.Tag, "div")
+		target := strings.TrimPrefix(f.Target, "#")
+		swap := cmp.Or(f.Swap, "innerHTML")
+		if strings.EqualFold(swap, "outerHTML") {
+			// the wrapper replaces the target and must keep its id for later swaps
+			fmt.Fprintf(buf, `<%s id="%s" hx-swap-oob="%s">`, tag, html.EscapeString(target), html.EscapeString(swap))
+		} else {
+			fmt.Fprintf(buf, `<%s hx-swap-oob="%s">`, tag, html.EscapeString(swap+":#"+target))
+		}
+		if err := render(RenderOpt{Template: f.Template, Data: f.Data, NoLayout: true}); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "</%s>", tag)
+	}
+
+	c.writeContentType(ContentTypeHTML)
+	c.Response().WriteHeader(status)
+	_, err := buf.WriteTo(c.Response())
+	return err
+}
+
+// streamRenderBuffer is the size of the buffer between a streamed render and the response.
+const streamRenderBuffer = 4 << 10
+
+// renderStream renders opt straight into the response, see RenderOpt.Stream.
+func (c *HandlerContext) renderStream(status int, opt RenderOpt, start time.Time) error {
+	sw := &streamWriter{c: c, status: status}
+	bw := bufio.NewWriterSize(sw, streamRenderBuffer)
+	cached, err := c.srv.render(bw, opt)
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	switch {
+	case err != nil && !sw.started:
+		// nothing was sent, the error is handled like the ones of buffered renders
+		return err
+	case sw.err != nil:
+		c.Log().Debug("streamed render aborted", "template", opt.Template, "err", sw.err)
+		return nil
+	case err != nil:
+		c.Log().Error("streamed render failed", "template", opt.Template, "err", err)
+		if info, ok := FromContext(c.Request().Context(), requestInfoKey); ok {
+			info.aborted = true
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	if !start.IsZero() {
+		c.srv.recordRender(c.Request(), opt, cached, time.Since(start), sw.n)
+	}
+	return nil
+}
+
+// streamWriter sends the response header on the first write of a streamed render.
+type streamWriter struct {
+	c       *HandlerContext
+	status  int
+	started bool
+	n       int
+	// err is the first write error, e.g. when the client went away
+	err error
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		sw.c.writeContentType(ContentTypeHTML)
+		sw.c.Response().WriteHeader(sw.status)
+	}
+	n, err := sw.c.Response().Write(p)
+	sw.n += n
+	if err != nil && sw.err == nil {
+		sw.err = err
+	}
+	return n, err
+}
+
+// renderJSON writes data as the JSON body of a negotiated Render. Unlike Context.JSON it isn't
+// wrapped in a JSONResponse, so the HTML and JSON representations share the same data.
+func (c *HandlerContext) renderJSON(status int, data any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := c.encodeJSON(buf, data, true); err != nil {
+		return err
+	}
+
+	c.writeContentType(ContentTypeJSON)
+	c.Response().WriteHeader(status)
+	_, err := buf.WriteTo(c.Response())
+	return err
+}
+
+// prefersJSON reports whether the Accept header ranks application/json above text/html. Equal
+// q-values go to the type named more specifically, and then to HTML, so browsers and clients
+// accepting only */* still get the template.
+func prefersJSON(accept string) bool {
+	jsonQ, jsonSpec := acceptQuality(accept, "application", "json")
+	htmlQ, htmlSpec := acceptQuality(accept, "text", "html")
+	return jsonQ > htmlQ || jsonQ == htmlQ && jsonQ > 0 && jsonSpec > htmlSpec
+}
+
+// acceptQuality returns the q-value the Accept header gives to typ/subtype, taken from the most
+// specific media range matching it, and that range's specificity: 2 for typ/subtype, 1 for
+// typ/* and 0 for */*. It returns 0, -1 when no range matches.
+func acceptQuality(accept, typ, subtype string) (q float64, specificity int) {
+	q, specificity = 0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		t, s, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mediaRange)), "/")
+		if !ok {
+			continue
+		}
+
+		var spec int
+		switch {
+		case t == typ && s == subtype:
+			spec = 2
+		case t == typ && s == "*":
+			spec = 1
+		case t == "*" && s == "*":
+			spec = 0
+		default:
+			continue
+		}
+		if spec < specificity {
+			continue
+		}
+
+		rangeQ := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil && v >= 0 && v <= 1 {
+				rangeQ = v
+			}
+		}
+		q, specificity = rangeQ, spec
+	}
+	return q, specificity
+}
+
+// ErrorsDataKey is the key the error bag is added under when rendering map data.
+const ErrorsDataKey = "Errors"
+
+// FlashesDataKey is the key Options.RenderFlashes adds the pending flash messages under when
+// rendering map data.
+const FlashesDataKey = "Flashes"
+
+// flashKeysSessionKey lists the keys of the flash messages set by FlashRedirect in the session.
+const flashKeysSessionKey = "server.flashKeys"
+
+// withFlashes pops the pending flash messages from the session and adds them to data, keyed by
+// flash key, when data is nil or a map[string]any. Other data types are returned unchanged and
+// the flashes are left in the session.
+func (c *HandlerContext) withFlashes(data any) any {
+	switch d := data.(type) {
+	case nil:
+	case map[string]any:
+		if _, ok := d[FlashesDataKey]; ok {
+			return d
+		}
+	default:
+		return data
+	}
+
+	sess := c.Session()
+	if sess == nil {
+		return data
+	}
+	ctx := c.Request().Context()
+	keys, _ := sess.Mgr().Pop(ctx, flashKeysSessionKey).([]string)
+	if len(keys) == 0 {
+		return data
+	}
+
+	flashes := make(map[string]string, len(keys))
+	for _, key := range keys {
+		// handlers may have read the flash already
+		if msg := sess.Mgr().PopString(ctx, key); msg != "" {
+			flashes[key] = msg
+		}
+	}
+
+	merged := map[string]any{FlashesDataKey: flashes}
+	if d, ok := data.(map[string]any); ok {
+		for k, v := range d {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// hasFlashes reports whether Options.RenderFlashes has flash messages to add to the next render.
+func (c *HandlerContext) hasFlashes() bool {
+	if !c.srv.renderFlash {
+		return false
+	}
+	sess := c.Session()
+	return sess != nil && sess.Mgr().Exists(c.Request().Context(), flashKeysSessionKey)
+}
+
+// ViewData holds the values a request adds to the data of every template it renders, e.g. the
+// current user for the layout. See Context.ViewData.
+type ViewData map[string]any
+
+// Set adds the value under key.
+func (v ViewData) Set(key string, val any) {
+	v[key] = val
+}
+
+// Get returns the value under key, or nil.
+func (v ViewData) Get(key string) any {
+	return v[key]
+}
+
+// ViewDataProvider returns view data for the request, see Options.ViewDataProviders.
+type ViewDataProvider func(ctx Context) map[string]any
+
+// ViewData returns the view data of the request. Render merges it, after the values of
+// Options.ViewDataProviders, into nil or map[string]any data, with the keys of the data winning.
+// Other data types are rendered unchanged.
+func (c *HandlerContext) ViewData() ViewData {
+	if c.viewData == nil {
+		c.viewData = make(ViewData)
+	}
+	return c.viewData
+}
+
+// withViewData merges the provider and request view data into data when data is nil or a
+// map[string]any, without modifying data.
+func (c *HandlerContext) withViewData(data any) any {
+	if _, ok := data.(map[string]any); !ok && data != nil {
+		return data
+	}
+	return mergeViewData(data, c.requestViewData())
+}
+
+// requestViewData returns the values of Options.ViewDataProviders followed by the view data of
+// the request, nil when there are none.
+func (c *HandlerContext) requestViewData() map[string]any {
+	if len(c.srv.viewData) == 0 && len(c.viewData) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]any, len(c.viewData))
+	for _, provider := range c.srv.viewData {
+		for k, v := range provider(c) {
+			merged[k] = v
+		}
+	}
+	for k, v := range c.viewData {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeViewData merges viewData into data when data is nil or a map[string]any, the keys of
+// data winning, without modifying either.
+func mergeViewData(data any, viewData map[string]any) any {
+	d, ok := data.(map[string]any)
+	if (!ok && data != nil) || len(viewData) == 0 {
+		return data
+	}
+
+	merged := make(map[string]any, len(viewData)+len(d))
+	for k, v := range viewData {
+		merged[k] = v
+	}
+	for k, v := range d {
+		merged[k] = v
+	}
+	return merged
+}
+
+// withErrors adds the error bag to data when data is nil or a map[string]any.
+// Other data types are returned unchanged.
+func (c *HandlerContext) withErrors(data any) any {
+	if !c.HasErrors() {
+		return data
+	}
+
+	switch d := data.(type) {
+	case nil:
+		return map[string]any{ErrorsDataKey: c.errors}
+	case map[string]any:
+		if _, ok := d[ErrorsDataKey]; ok {
+			return d
+		}
+		merged := make(map[string]any, len(d)+1)
+		for k, v := range d {
+			merged[k] = v
+		}
+		merged[ErrorsDataKey] = c.errors
+		return merged
+	}
+
+	return data
+}
+
+func (c *HandlerContext) Error(code int, err error) error {
+	data := ErrorPageData{Code: code, Status: http.StatusText(code), Message: http.StatusText(code)}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		data.Message = httpErr.Message
+	}
+
+	if c.srv != nil && c.srv.renderer != nil {
+		name := c.srv.errorTemplate(code)
+		if c.srv.renderer.Exists(name) {
+			return c.Render(code, RenderOpt{Template: name, Data: data})
+		}
+	}
+
+	http.Error(c.Response(), data.Message, code)
+	return nil
+}
@@ -0,0 +1,647 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplates_Render(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "hello"})
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentTypeHTML, resp.Header.Get(HeaderContentType))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Hello, World!", string(body))
+}
+
+func TestServer_ErrorTemplates(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{
+		Templates:      tmpl,
+		ErrorTemplates: map[int]string{http.StatusTeapot: "teapot", 4: "client-error"},
+	})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/error/{code}", func(ctx Context) error {
+		code, err := ctx.ParamInt("code")
+		if err != nil {
+			return err
+		}
+		return ctx.Error(code, NewHTTPError(code, errors.New("internal detail"), "short and stout"))
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		url          string
+		expectedBody string
+	}{
+		{url: "/error/418", expectedBody: "I am a teapot: 418 short and stout"},
+		{url: "/error/409", expectedBody: "Client error: 409 Conflict"},
+		{url: "/error/500", expectedBody: "short and stout\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			resp, err := runTestServer(t, srv, tt.url)
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.expectedBody, string(body))
+		})
+	}
+
+	t.Run("fallback pattern", func(t *testing.T) {
+		srv, err := Init(Options{Templates: tmpl})
+		require.NoError(t, err, "server init failed")
+		assert.Equal(t, "404.page", srv.errorTemplate(http.StatusNotFound))
+
+		srv, err = Init(Options{Templates: tmpl, ErrorTemplatePattern: "errors/%d"})
+		require.NoError(t, err, "server init failed")
+		assert.Equal(t, "errors/404", srv.errorTemplate(http.StatusNotFound))
+	})
+}
+
+func TestContext_ErrorBag(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/form", func(ctx Context) error {
+		var form struct {
+			Age int `query:"age"`
+		}
+		if err := ctx.BindQuery(&form); err != nil {
+			ctx.Log().Debug("bind failed", "err", err)
+		}
+
+		if ctx.Param("name") == "" {
+			ctx.AddError("name", "is required")
+			ctx.AddError("name", "must be at least 2 characters")
+		}
+
+		status := http.StatusOK
+		if ctx.HasErrors() {
+			status = http.StatusUnprocessableEntity
+		}
+		return ctx.Render(status, RenderOpt{Template: "form", Data: map[string]any{"Title": "Signup"}})
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/form?age=old")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Signup age: invalid value name: is required must be at least 2 characters", string(body))
+
+	resp, err = runTestServer(t, srv, "/form?age=30&name=Ada")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "Signup", string(body))
+}
+
+func TestServer_Templates(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	assert.Nil(t, srv.Templates())
+
+	fsys := fstest.MapFS{
+		"hello.tmpl":       {Data: []byte(`Hello, {{.}}!`)},
+		"users/list.tmpl":  {Data: []byte(`{{define "row"}}<li>{{.}}</li>{{end}}<ul></ul>`)},
+		"users/notes.text": {Data: []byte(`not a template`)},
+	}
+	tmpl, err := InitTemplates(TemplateOptions{FS: fsys})
+	require.NoError(t, err)
+
+	srv, err = Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	require.Same(t, tmpl, srv.Templates())
+
+	names, err := srv.Templates().Names()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello", "users/list"}, names)
+
+	list, err := srv.Templates().Lookup("users/list")
+	require.NoError(t, err)
+	var buf strings.Builder
+	require.NoError(t, list.ExecuteTemplate(&buf, "row", "ada"))
+	assert.Equal(t, "<li>ada</li>", buf.String())
+
+	buf.Reset()
+	require.NoError(t, tmpl.Render(&buf, "hello", "World"))
+	assert.Equal(t, "Hello, World!", buf.String())
+
+	fsys["hello.tmpl"] = &fstest.MapFile{Data: []byte(`Hi, {{.}}!`)}
+	buf.Reset()
+	require.NoError(t, tmpl.Render(&buf, "hello", "World"))
+	assert.Equal(t, "Hello, World!", buf.String(), "served from the cache")
+
+	tmpl.Reload("hello")
+	buf.Reset()
+	require.NoError(t, tmpl.Render(&buf, "hello", "World"))
+	assert.Equal(t, "Hi, World!", buf.String())
+}
+
+func TestTemplates_Sources(t *testing.T) {
+	admin := fstest.MapFS{
+		"dashboard.tmpl": {Data: []byte(`admin dashboard`)},
+		"index.tmpl":     {Data: []byte(`admin index`)},
+	}
+	blog := fstest.MapFS{
+		"index.tmpl": {Data: []byte(`blog index`)},
+	}
+	shared := fstest.MapFS{
+		"views/404.page.tmpl": {Data: []byte(`shared {{.Code}}`)},
+		"views/footer.tmpl":   {Data: []byte(`footer`)},
+	}
+
+	tmpl, err := InitTemplates(TemplateOptions{Sources: []TemplateSource{
+		{Name: "admin", FS: admin},
+		{Name: "blog", FS: blog, Qualified: true},
+		{Name: "shared", FS: shared, Root: "views"},
+	}})
+	require.NoError(t, err)
+
+	render := func(name string) string {
+		var buf strings.Builder
+		require.NoError(t, tmpl.Render(&buf, name, nil))
+		return buf.String()
+	}
+	assert.Equal(t, "admin dashboard", render("admin:dashboard"))
+	assert.Equal(t, "admin index", render("index"), "blog is only reachable qualified")
+	assert.Equal(t, "blog index", render("blog:index"))
+	assert.Equal(t, "footer", render("footer"))
+	assert.Equal(t, "footer", render("shared:footer"))
+	assert.True(t, tmpl.Exists("404.page"))
+	assert.False(t, tmpl.Exists("blog:dashboard"))
+	assert.False(t, tmpl.Exists("unknown:footer"))
+	assert.Error(t, tmpl.Render(io.Discard, "unknown:footer", nil))
+
+	names, err := tmpl.Names()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"404.page", "blog:index", "dashboard", "footer", "index"}, names)
+
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("/missing", func(ctx Context) error {
+		return ctx.Error(http.StatusNotFound, nil)
+	})
+	require.NoError(t, srv.Route())
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "shared 404", rec.Body.String(), "error pages fall back through the sources")
+
+	_, err = InitTemplates(TemplateOptions{Sources: []TemplateSource{
+		{Name: "admin", FS: admin},
+		{Name: "blog", FS: blog},
+	}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"index" is in sources "admin" and "blog"`)
+
+	_, err = InitTemplates(TemplateOptions{Root: "testData/templates", Sources: []TemplateSource{{FS: blog}}})
+	assert.Error(t, err)
+	_, err = InitTemplates(TemplateOptions{Sources: []TemplateSource{{Name: "a", FS: blog}, {Name: "a", FS: admin, Qualified: true}}})
+	assert.Error(t, err)
+}
+
+func TestContext_RenderLayout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.tmpl":  {Data: []byte(`<main>{{block "title" .}}Site{{end}}|{{template "content" .}}</main>`)},
+		"layouts/admin.tmpl": {Data: []byte(`<admin>{{template "content" .}}</admin>`)},
+		"page.tmpl":          {Data: []byte(`{{define "title"}}Page{{end}}hello {{.}}`)},
+	}
+	tmpl, err := InitTemplates(TemplateOptions{FS: fsys, DefaultLayout: "layouts/base"})
+	require.NoError(t, err)
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+
+	render := func(opt RenderOpt) HandlerFunc {
+		return func(ctx Context) error {
+			opt.Template, opt.Data = "page", "ada"
+			return ctx.Render(http.StatusOK, opt)
+		}
+	}
+	srv.HandleFunc("/default", render(RenderOpt{}))
+	srv.HandleFunc("/explicit", render(RenderOpt{Layout: "layouts/admin"}))
+	srv.HandleFunc("/bare", render(RenderOpt{Layout: "layouts/admin", NoLayout: true}))
+	srv.Group("/admin", "", func(srv *Server) {
+		srv.HandleFunc("/group", render(RenderOpt{}))
+		srv.HandleFunc("/route", render(RenderOpt{}), WithLayout("layouts/base"))
+	}, WithLayout("layouts/admin"))
+	require.NoError(t, srv.Route())
+
+	serve := func(path string, headers ...string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, "<main>Page|hello ada</main>", serve("/default"))
+	assert.Equal(t, "<admin>hello ada</admin>", serve("/explicit"))
+	assert.Equal(t, "hello ada", serve("/bare"))
+	assert.Equal(t, "<admin>hello ada</admin>", serve("/admin/group"))
+	assert.Equal(t, "<main>Page|hello ada</main>", serve("/admin/route"))
+
+	assert.Equal(t, "hello ada", serve("/default", "HX-Request", "true"), "htmx fragments skip the default layout")
+	assert.Equal(t, "hello ada", serve("/admin/group", "HX-Request", "true"))
+	assert.Equal(t, "<admin>hello ada</admin>", serve("/explicit", "HX-Request", "true"))
+	assert.Equal(t, "<main>Page|hello ada</main>", serve("/default", "HX-Request", "true", "HX-Boosted", "true"))
+
+	fsys["layouts/base.tmpl"] = &fstest.MapFile{Data: []byte(`<body>{{template "content" .}}</body>`)}
+	tmpl.Reload("layouts/base")
+	assert.Equal(t, "<body>hello ada</body>", serve("/default"))
+}
+
+func TestServer_CheckTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"404.page.tmpl":   {Data: []byte(`not found`)},
+		"errors/5xx.tmpl": {Data: []byte(`oops`)},
+		"layout.tmpl":     {Data: []byte(`{{template "content" .}}`)},
+		"home.tmpl":       {Data: []byte(`home`)},
+	}
+	tmpl, err := InitTemplates(TemplateOptions{FS: fsys, DefaultLayout: "layout"})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, srv.CheckTemplates(), ErrNoTemplates)
+
+	srv, err = Init(Options{Templates: tmpl, ErrorTemplates: map[int]string{5: "errors/5xx"}})
+	require.NoError(t, err)
+	assert.NoError(t, srv.CheckTemplates("home"))
+	err = srv.CheckTemplates("home", "signup", "signup")
+	assert.ErrorIs(t, err, ErrMissingTemplates)
+	assert.EqualError(t, err, "missing templates: signup")
+
+	srv, err = Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	assert.EqualError(t, srv.CheckTemplates(), "missing templates: 500.page")
+
+	srv, err = Init(Options{Templates: tmpl, Env: ENVProduction, RequiredTemplates: []string{"home", "admin/home"}})
+	require.NoError(t, err)
+	err = srv.Route()
+	assert.ErrorIs(t, err, ErrMissingTemplates)
+	assert.EqualError(t, err, "missing templates: 500.page, admin/home")
+
+	var records []slog.Record
+	srv, err = Init(Options{
+		Templates: tmpl,
+		Env:       ENVDev,
+		Log:       slog.New(recordHandler{level: slog.LevelWarn, records: &records}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, srv.Route(), "only logged in dev")
+	require.Len(t, records, 1)
+	assert.Contains(t, records[0].Message, "TEMPLATES MISSING")
+}
+
+func TestContext_RenderViewData(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{DefaultLayout: "layout", FS: fstest.MapFS{
+		"layout.tmpl": {Data: []byte(`[{{.path}} {{.user}} {{.theme}}] {{template "content" .}}`)},
+		"page.tmpl":   {Data: []byte(`{{.title}}`)},
+	}})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{Templates: tmpl, ViewDataProviders: []ViewDataProvider{
+		func(ctx Context) map[string]any {
+			return map[string]any{"path": ctx.Request().URL.Path, "theme": "light", "title": "provided"}
+		},
+		func(ctx Context) map[string]any {
+			return map[string]any{"theme": "dark"}
+		},
+	}})
+	require.NoError(t, err)
+
+	data := map[string]any{"title": "Dashboard"}
+	srv.HandleFunc("/dashboard", func(ctx Context) error {
+		ctx.ViewData().Set("user", "ada")
+		ctx.ViewData().Set("title", "from view data")
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "page", Data: data})
+	})
+	srv.HandleFunc("/anonymous", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "page"})
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(path string) string {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, "[/dashboard ada dark] Dashboard", serve("/dashboard"), "handler data wins")
+	assert.Equal(t, map[string]any{"title": "Dashboard"}, data, "the handler's map isn't modified")
+	assert.Equal(t, "[/anonymous  dark] provided", serve("/anonymous"))
+}
+
+func TestContext_RenderNegotiate(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"user.tmpl": {Data: []byte(`<h1>{{.Name}}</h1>`)},
+	}})
+	require.NoError(t, err)
+
+	get := func(srv *Server, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	user := map[string]any{"Name": "Ada"}
+
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("/users/42", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Data: user, Negotiate: true})
+	})
+	srv.HandleFunc("/html-only", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Data: user})
+	})
+	require.NoError(t, srv.Route())
+
+	rec := get(srv, "/users/42", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+	assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+	assert.Equal(t, "<h1>Ada</h1>", rec.Body.String())
+
+	rec = get(srv, "/users/42", "application/json")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeJSON, rec.Header().Get(HeaderContentType))
+	assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+	assert.JSONEq(t, `{"Name":"Ada"}`, rec.Body.String())
+
+	rec = get(srv, "/html-only", "application/json")
+	assert.Equal(t, "<h1>Ada</h1>", rec.Body.String(), "negotiation is opt-in")
+	assert.Empty(t, rec.Header().Get("Vary"))
+
+	srv, err = Init(Options{Templates: tmpl, NegotiateRender: true})
+	require.NoError(t, err)
+	srv.HandleFunc("/users/42", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Data: user})
+	})
+	require.NoError(t, srv.Route())
+
+	assert.Equal(t, "<h1>Ada</h1>", get(srv, "/users/42", "").Body.String())
+	assert.JSONEq(t, `{"Name":"Ada"}`, get(srv, "/users/42", "application/json").Body.String())
+}
+
+func TestContext_RenderStats(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"user.tmpl": {Data: []byte(`<h1>{{.}}</h1>`)},
+		"base.tmpl": {Data: []byte(`<main>{{template "content" .}}</main>`)},
+	}})
+	require.NoError(t, err)
+
+	var records []slog.Record
+	srv, err := Init(Options{
+		Templates:           tmpl,
+		Log:                 slog.New(recordHandler{level: slog.LevelWarn, records: &records}),
+		SlowRenderThreshold: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/users/{name}", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Data: ctx.UrlParam("name")})
+	})
+	srv.HandleFunc("/admin/{name}", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Layout: "base", Data: ctx.UrlParam("name")})
+	})
+	srv.HandleFunc("/broken", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "missing"})
+	})
+	require.NoError(t, srv.Route())
+
+	for _, path := range []string{"/users/Ada", "/users/Grace", "/admin/Ada", "/broken"} {
+		srv.HTTPServer.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	stats := srv.Stats()
+	require.Len(t, stats.Templates, 2, "failed renders aren't counted")
+	user, admin := stats.Templates[0], stats.Templates[1]
+	assert.Equal(t, "user", user.Template)
+	assert.Empty(t, user.Layout)
+	assert.EqualValues(t, 2, user.Renders)
+	assert.EqualValues(t, len("<h1>Ada</h1><h1>Grace</h1>"), user.Bytes)
+	assert.Positive(t, user.Duration)
+	assert.Equal(t, "user", admin.Template)
+	assert.Equal(t, "base", admin.Layout, "counted apart in each layout")
+	assert.EqualValues(t, 1, admin.Renders)
+	assert.EqualValues(t, len("<main><h1>Ada</h1></main>"), admin.Bytes)
+	assert.Equal(t, TemplateCacheStats{Hits: 1, Misses: 2}, stats.TemplateCache)
+
+	out, err := json.Marshal(admin)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `{"template":"user","layout":"base","renders":1,`)
+
+	var slow []string
+	for _, r := range records {
+		if r.Message == "slow template render" {
+			r.Attrs(func(a slog.Attr) bool {
+				if a.Key == "template" {
+					slow = append(slow, a.Value.String())
+				}
+				return true
+			})
+		}
+	}
+	assert.Equal(t, []string{"user", "user", "user"}, slow)
+
+	srv, err = Init(Options{
+		Templates:           tmpl,
+		DisableStats:        true,
+		Log:                 slog.New(recordHandler{level: slog.LevelWarn, records: &records}),
+		SlowRenderThreshold: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/users/{name}", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "user", Data: ctx.UrlParam("name")})
+	})
+	require.NoError(t, srv.Route())
+	records = nil // the missing error templates are reported by Route
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/Ada", nil))
+	assert.Equal(t, "<h1>Ada</h1>", rec.Body.String())
+	assert.Empty(t, srv.Stats().Templates)
+	assert.Empty(t, records, "the slow render warning is off with the stats")
+}
+
+// fakeRenderer renders "<name>:<data>" for the templates it has.
+type fakeRenderer struct {
+	templates map[string]bool
+	rendered  []RenderOpt
+}
+
+func (f *fakeRenderer) Render(w io.Writer, opt RenderOpt) error {
+	if !f.templates[opt.Template] {
+		return errors.New("fake: no template " + opt.Template)
+	}
+	f.rendered = append(f.rendered, opt)
+	_, err := fmt.Fprintf(w, "%s:%v", opt.Template, opt.Data)
+	return err
+}
+
+func (f *fakeRenderer) Exists(name string) bool {
+	return f.templates[name]
+}
+
+func TestServer_Renderer(t *testing.T) {
+	fake := &fakeRenderer{templates: map[string]bool{"home": true, "404.page": true}}
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{Renderer: fake, Templates: tmpl})
+	require.NoError(t, err)
+	assert.Nil(t, srv.Templates(), "Renderer takes precedence over Templates")
+
+	srv.HandleFunc("/home", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "home", Data: "hi"})
+	})
+	srv.HandleFunc("/missing", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "missing"})
+	})
+	srv.HandleFunc("/gone", func(ctx Context) error {
+		return ctx.Error(http.StatusNotFound, nil)
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := serve("/home")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "home:hi", rec.Body.String())
+	assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+
+	rec = serve("/missing")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "missing:")
+
+	rec = serve("/gone")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "404.page:"), rec.Body.String())
+	require.Len(t, fake.rendered, 2)
+	assert.IsType(t, ErrorPageData{}, fake.rendered[1].Data)
+
+	stats := srv.Stats()
+	require.Len(t, stats.Templates, 2)
+	assert.Equal(t, "404.page", stats.Templates[0].Template)
+	assert.Equal(t, "home", stats.Templates[1].Template)
+	assert.EqualValues(t, 1, stats.Templates[1].Renders)
+	assert.Zero(t, stats.TemplateCache, "only *Templates reports its cache")
+
+	srv, err = Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	assert.Same(t, tmpl, srv.Templates())
+	assert.True(t, TemplatesRenderer(tmpl).Exists("hello"))
+}
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html", false},
+		{"application/json", true},
+		{"application/json, text/plain, */*", true},
+		{"text/html, application/json", false},
+		{"application/json;q=0.9, */*", false},
+		{"text/html;q=0.5, application/json", true},
+		{"application/*", true},
+		{"application/*, text/html;q=0.9", true},
+		{"application/json;q=0, */*", false},
+		{"text/*;q=0.2, application/json;q=0.4", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, prefersJSON(tt.accept), tt.accept)
+	}
+}
+
+func TestContext_RenderStream(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"table.tmpl": {Data: []byte(`<table>{{range .Rows}}<tr><td>{{.}}</td></tr>{{end}}</table>{{if .Fail}}{{call .Fail}}{{end}}`)},
+	}})
+	require.NoError(t, err)
+
+	var logs strings.Builder
+	srv, err := Init(Options{Templates: tmpl, LogRequests: true, Log: slog.New(slog.NewTextHandler(&logs, nil))})
+	require.NoError(t, err)
+	fail := func() (string, error) { return "", errors.New("db gone") }
+	rows := func(n int) []int {
+		r := make([]int, n)
+		for i := range r {
+			r[i] = i
+		}
+		return r
+	}
+	srv.HandleFunc("GET /table", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "table", Stream: true, Data: map[string]any{"Rows": rows(5000)}})
+	})
+	srv.HandleFunc("GET /late-failure", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "table", Stream: true, Data: map[string]any{"Rows": rows(5000), "Fail": fail}})
+	})
+	srv.HandleFunc("GET /early-failure", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "table", Stream: true, Data: map[string]any{"Rows": rows(3), "Fail": fail}})
+	})
+	require.NoError(t, srv.Route())
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/table", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+	assert.Equal(t, 5000, strings.Count(rec.Body.String(), "<tr>"))
+	assert.True(t, strings.HasSuffix(rec.Body.String(), "<td>4999</td></tr></table>"))
+
+	rec = httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/late-failure", nil))
+	})
+	assert.Equal(t, http.StatusOK, rec.Code, "the status was sent before the failure")
+	assert.Contains(t, logs.String(), `msg="streamed render failed" template=table`)
+	assert.Contains(t, logs.String(), "db gone")
+	assert.Contains(t, logs.String(), "path=/late-failure status=200", "the aborted request is logged")
+
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/early-failure", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "nothing was sent, so the usual error response is")
+	assert.NotContains(t, rec.Body.String(), "<table>")
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RenderCache caches the output of a Context.Render under Key, e.g. for a navigation menu
+// built from the database. The template is rendered alone, whatever the layout, and the entry
+// is reused while the template, locale, data and view data stay the same, so a render with
+// other data replaces it and users with their own view data don't share it. Renders showing
+// the error bag or flash messages skip the cache, and the flashes are kept for them.
+//
+// The data and view data are compared by their JSON encoding: unexported fields and values
+// computed by methods aren't seen, and data that can't be encoded, e.g. holding functions,
+// isn't cached.
+type RenderCache struct {
+	Key string
+	// TTL is how long the output is reused. Zero keeps it until it is evicted or invalidated
+	// with Server.InvalidateRenderCache.
+	TTL time.Duration
+	// KeyOnly reuses the entry of Key whatever the data, e.g. when building the data is what
+	// the cache saves. The template, locale and view data are still compared.
+	KeyOnly bool
+}
+
+// DefaultRenderCacheSize is the default of Options.RenderCacheSize.
+const DefaultRenderCacheSize = 8 << 20
+
+// renderCache is an LRU cache of rendered output, bounded by the total size of the output.
+type renderCache struct {
+	max int64
+	now func() time.Time
+
+	mu   sync.Mutex
+	size int64
+	// lru holds the *renderEntry values, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type renderEntry struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	body        []byte
+	expires     time.Time
+}
+
+func newRenderCache(max int64) *renderCache {
+	return &renderCache{max: max, now: time.Now, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// renderFingerprint identifies what opt renders, before prepareRenderWith, with the view data
+// merged into its data. The data is left out with KeyOnly. It fails when the data or view data
+// can't be encoded in JSON, and the render isn't cached then.
+func renderFingerprint(opt RenderOpt, viewData map[string]any) ([sha256.Size]byte, bool) {
+	h := sha256.New()
+	h.Write([]byte(opt.Template + "\x00" + opt.Locale + "\x00"))
+	enc := json.NewEncoder(h)
+	if err := enc.Encode(viewData); err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	if !opt.Cache.KeyOnly {
+		if err := enc.Encode(opt.Data); err != nil {
+			return [sha256.Size]byte{}, false
+		}
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum, true
+}
+
+// get returns the output cached for key and fingerprint.
+func (rc *renderCache) get(key string, fingerprint [sha256.Size]byte) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*renderEntry)
+	if entry.fingerprint != fingerprint {
+		return nil, false
+	}
+	if !entry.expires.IsZero() && rc.now().After(entry.expires) {
+		rc.remove(elem)
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	return entry.body, true
+}
+
+// put caches a copy of body for key, evicting the least recently used entries over the size
+// bound. Output larger than the bound isn't cached.
+func (rc *renderCache) put(key string, fingerprint [sha256.Size]byte, body []byte, ttl time.Duration) {
+	if int64(len(body)) > rc.max {
+		return
+	}
+	entry := &renderEntry{key: key, fingerprint: fingerprint, body: bytes.Clone(body)}
+	if ttl > 0 {
+		entry.expires = rc.now().Add(ttl)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[key]; ok {
+		rc.remove(elem)
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	rc.size += int64(len(entry.body))
+	for rc.size > rc.max {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+func (rc *renderCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*renderEntry)
+	delete(rc.entries, entry.key)
+	rc.size -= int64(len(entry.body))
+}
+
+// InvalidateRenderCache drops the output cached with RenderOpt.Cache under the keys starting
+// with keyPrefix, or all of it when keyPrefix is empty.
+func (s *Server) InvalidateRenderCache(keyPrefix string) {
+	rc := s.renderCache
+	if rc == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for key, elem := range rc.entries {
+		if strings.HasPrefix(key, keyPrefix) {
+			rc.remove(elem)
+		}
+	}
+}
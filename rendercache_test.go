@@ -0,0 +1,187 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext_RenderCache(t *testing.T) {
+	renders := 0
+	pages := fstest.MapFS{
+		"layout.tmpl": {Data: []byte(`<html>{{template "content" .}}</html>`)},
+		"menu.tmpl":   {Data: []byte(`<nav>{{.}} #{{rendered}}</nav>`)},
+		"list.tmpl":   {Data: []byte(`<ul>{{.Items}} {{.user}} #{{rendered}}</ul>`)},
+	}
+	funcs := map[string]any{"rendered": func() int { renders++; return renders }}
+
+	tmpl, err := InitTemplates(TemplateOptions{FS: pages, FuncMap: funcs, DefaultLayout: "layout"})
+	require.NoError(t, err)
+	srv, err := Init(Options{
+		Templates: tmpl,
+		ViewDataProviders: []ViewDataProvider{func(ctx Context) map[string]any {
+			return map[string]any{"user": ctx.Param("user")}
+		}},
+	})
+	require.NoError(t, err)
+	now := time.Now()
+	srv.renderCache.now = func() time.Time { return now }
+	srv.HandleFunc("GET /menu", func(ctx Context) error {
+		cache := RenderCache{Key: "menu:" + ctx.Param("user"), KeyOnly: ctx.Param("keyonly") != ""}
+		if ttl := ctx.Param("ttl"); ttl != "" {
+			cache.TTL, _ = time.ParseDuration(ttl)
+		}
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "menu", Data: ctx.Param("items"), Cache: cache})
+	})
+	srv.HandleFunc("GET /list", func(ctx Context) error {
+		cache := RenderCache{Key: "list", KeyOnly: ctx.Param("keyonly") != ""}
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "list", Data: map[string]any{"Items": ctx.Param("items")}, Cache: cache})
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(target string, htmx bool) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+		return rec.Body.String()
+	}
+	get := func(query string) string { return serve("/menu?"+query, false) }
+
+	assert.Equal(t, "<nav>home #1</nav>", get("user=1&items=home"), "rendered without the default layout")
+	assert.Equal(t, "<nav>home #1</nav>", get("user=1&items=home"), "served from the cache")
+	assert.Equal(t, "<nav>home #2</nav>", get("user=2&items=home"), "another key")
+	assert.Equal(t, "<nav>docs #3</nav>", get("user=1&items=docs"), "other data replaces the entry")
+
+	srv.InvalidateRenderCache("menu:1")
+	assert.Equal(t, "<nav>home #4</nav>", get("user=1&items=home"))
+	assert.Equal(t, "<nav>home #2</nav>", get("user=2&items=home"), "other prefixes are kept")
+	srv.InvalidateRenderCache("")
+	assert.Equal(t, "<nav>home #5</nav>", get("user=2&items=home"))
+
+	assert.Equal(t, "<nav>ttl #6</nav>", get("user=3&items=ttl&ttl=1m"))
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, "<nav>ttl #6</nav>", get("user=3&items=ttl&ttl=1m"))
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, "<nav>ttl #7</nav>", get("user=3&items=ttl&ttl=1m"), "expired")
+
+	assert.Equal(t, "<ul>a ann #8</ul>", serve("/list?items=a&user=ann", false))
+	assert.Equal(t, "<ul>a ann #8</ul>", serve("/list?items=a&user=ann", true), "a fragment either way")
+	assert.Equal(t, "<ul>a bob #9</ul>", serve("/list?items=a&user=bob", false), "users with other view data don't share it")
+	assert.Equal(t, "<ul>a bob #10</ul>", serve("/list?items=a&user=bob&keyonly=1", false))
+	assert.Equal(t, "<ul>a bob #10</ul>", serve("/list?items=b&user=bob&keyonly=1", false))
+	assert.Equal(t, "<ul>b ann #11</ul>", serve("/list?items=b&user=ann&keyonly=1", false), "KeyOnly still compares the view data")
+
+	stats := srv.Stats().RenderCache
+	assert.Equal(t, TemplateCacheStats{Hits: 5, Misses: 11}, stats)
+
+	tmpl, err = InitTemplates(TemplateOptions{FS: pages, FuncMap: funcs, Debug: true})
+	require.NoError(t, err)
+	srv, err = Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /menu", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "menu", Data: "debug", Cache: RenderCache{Key: "menu"}})
+	})
+	require.NoError(t, srv.Route())
+	assert.Equal(t, "<nav>debug #12</nav>", get(""))
+	assert.Equal(t, "<nav>debug #13</nav>", get(""), "Debug disables the cache")
+}
+
+func TestContext_RenderCacheFlashes(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"items.tmpl": {Data: []byte(`{{with .Flashes}}<p class="flash">{{.flash}}</p>{{end}}<h1>{{.Title}}</h1>{{with .Errors}}<p>{{.name}}</p>{{end}}`)},
+	}})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{SessionMgr: scs.New(), Templates: tmpl, RenderFlashes: true})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /items", func(ctx Context) error {
+		return ctx.FlashRedirect("/items", "flash", "Item saved")
+	})
+	srv.HandleFunc("GET /items", func(ctx Context) error {
+		if ctx.Param("invalid") != "" {
+			ctx.AddError("name", "required")
+		}
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "items", Data: map[string]any{"Title": "Items"}, Cache: RenderCache{Key: "items"}})
+	})
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := tSrv.Client()
+	client.Jar = jar
+	read := func(resp *http.Response, err error) string {
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, `<h1>Items</h1>`, read(client.Get(tSrv.URL+"/items")))
+	assert.Equal(t, `<p class="flash">Item saved</p><h1>Items</h1>`, read(client.Post(tSrv.URL+"/items", "", nil)), "the flash isn't lost to the cached page")
+	assert.Equal(t, `<h1>Items</h1>`, read(client.Get(tSrv.URL+"/items")))
+	assert.Equal(t, `<h1>Items</h1><p>[required]</p>`, read(client.Get(tSrv.URL+"/items?invalid=1")), "nor the error bag")
+	assert.Equal(t, TemplateCacheStats{Hits: 1, Misses: 1}, srv.Stats().RenderCache)
+}
+
+func TestRenderCache_Evicts(t *testing.T) {
+	rc := newRenderCache(10)
+	fp, ok := renderFingerprint(RenderOpt{Template: "a", Data: map[string]any{"n": 1}}, nil)
+	require.True(t, ok)
+
+	rc.put("a", fp, []byte("aaaa"), 0)
+	rc.put("b", fp, []byte("bbbb"), 0)
+	_, ok = rc.get("a", fp)
+	require.True(t, ok, "a is now the most recently used")
+	rc.put("c", fp, []byte("cccc"), 0)
+
+	_, ok = rc.get("b", fp)
+	assert.False(t, ok, "b was evicted")
+	_, ok = rc.get("a", fp)
+	assert.True(t, ok)
+	assert.EqualValues(t, 8, rc.size)
+
+	rc.put("huge", fp, []byte(strings.Repeat("x", 11)), 0)
+	_, ok = rc.get("huge", fp)
+	assert.False(t, ok, "larger than the cache")
+
+	_, ok = renderFingerprint(RenderOpt{Data: func() {}}, nil)
+	assert.False(t, ok, "data that can't be encoded isn't cached")
+}
+
+func TestRenderFingerprint_KeyOnly(t *testing.T) {
+	fingerprint := func(opt RenderOpt, viewData map[string]any) [32]byte {
+		opt.Cache.KeyOnly = true
+		fp, ok := renderFingerprint(opt, viewData)
+		require.True(t, ok)
+		return fp
+	}
+
+	base := RenderOpt{Template: "menu", Locale: "en", Data: 1}
+	fp := fingerprint(base, nil)
+	assert.Equal(t, fp, fingerprint(RenderOpt{Template: "menu", Locale: "en", Data: 2}, nil), "the data is ignored")
+	assert.Equal(t, fp, fingerprint(RenderOpt{Template: "menu", Locale: "en", Data: func() {}}, nil), "and needn't be encodable")
+
+	for _, opt := range []RenderOpt{
+		{Template: "footer", Locale: "en"},
+		{Template: "menu", Locale: "fr"},
+	} {
+		assert.NotEqual(t, fp, fingerprint(opt, nil), "%+v", opt)
+	}
+	assert.NotEqual(t, fp, fingerprint(base, map[string]any{"user": "ann"}), "the view data is compared")
+}
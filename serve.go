@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"html/template"
@@ -30,21 +33,230 @@ type Options struct {
 	SessionMgr         *scs.SessionManager
 	ErrorFunc          ErrorFunc
 	DisableLoadAndSave bool
+	// MaxConcurrentRequests caps the number of requests served at once. Requests over the
+	// limit get a 503 with a Retry-After header. Zero means no limit.
+	MaxConcurrentRequests int
+	// Templates renders html views. See InitTemplates.
+	Templates *Templates
+	// ErrorTemplates maps status codes, or status classes (4 for 4xx, 5 for 5xx), to the
+	// template Context.Error renders. Other codes use ErrorTemplatePattern.
+	ErrorTemplates map[int]string
+	// ErrorTemplatePattern names error templates by status code. Defaults to DefaultErrorTemplatePattern.
+	ErrorTemplatePattern string
+	// EnableLogLevelEndpoint mounts LogLevelPath, which reports the log level on GET and
+	// changes it on PUT. It runs behind the server middleware, protect it there.
+	EnableLogLevelEndpoint bool
+	// Env is the environment the server runs in. In ENVDev error responses include debug details.
+	Env ENVTypes
+	// AdminPort starts a second listener on Host, serving AdminHandler, alongside the main
+	// one. Use it to keep metrics, health and debug endpoints off the public port.
+	AdminPort    int
+	AdminHandler http.Handler
+	// EnablePprof mounts the net/http/pprof handlers under PprofPath, on the admin listener
+	// when AdminPort is set and on the main one otherwise. It is only honored when Env is set
+	// to an environment other than ENVProduction, e.g. ENVDev. Set PprofAuth to require basic
+	// auth.
+	EnablePprof bool
+	PprofAuth   *BasicAuthCredentials
+	// RequestLogSkip lists the paths LogRequests doesn't log. Entries ending in "/" match as
+	// prefixes. Nil means DefaultRequestLogSkip; use an empty slice to log every request.
+	RequestLogSkip []string
+	// RequestLogSkipStatuses maps path prefixes to the status codes, or status classes (2 for
+	// 2xx), that aren't logged for them, e.g. {"/public/": {2, 304}}.
+	RequestLogSkipStatuses map[string][]int
+	// RequestLogSkipper suppresses the log line of any request it returns true for.
+	RequestLogSkipper func(r *http.Request, status int) bool
+	// RequestLogFields selects the optional fields of the default request log line. Nil means
+	// DefaultRequestLogFields; method, path, status and duration are always logged.
+	RequestLogFields []RequestLogField
+	// AccessLog selects the format and destination of the request log. It defaults to an
+	// info record through the server logger.
+	AccessLog *AccessLogOptions
+	// SlowRequestThreshold logs requests that take longer as warnings with slow=true, and
+	// calls OnSlowRequest for them. Requests the request log skips aren't checked.
+	SlowRequestThreshold time.Duration
+	OnSlowRequest        func(e AccessLogEntry)
+	// StrictJSON makes Context.BindJSON reject request bodies with fields the target doesn't have.
+	StrictJSON bool
+	// NegotiateRender makes every Context.Render respond with JSON when the client prefers it,
+	// as RenderOpt.Negotiate does for a single call.
+	NegotiateRender bool
+	// LogBodyOnError captures the start of request bodies and adds it to the error log and the
+	// request log line of requests that fail with a 4xx or 5xx status or a handler error. The
+	// bodies of successful requests are discarded as soon as they are served.
+	LogBodyOnError *BodyLogOptions
+	// RequestLogLevel is the level of the request log line, Info by default. Slow requests are
+	// logged at Warn at least.
+	RequestLogLevel slog.Level
+	// RequestLogger receives the request log instead of the server logger, e.g. to write it to
+	// its own file at its own level. It is unused when AccessLog selects another format.
+	RequestLogger *slog.Logger
+	// RequestLogLevelByStatus logs 4xx responses at Warn and 5xx at Error at least.
+	RequestLogLevelByStatus bool
+	// LogRoutes logs the middleware order and every route, with its method, pattern, name and
+	// middleware count, at debug level when Run starts.
+	LogRoutes bool
+	// HealthPath mounts a liveness endpoint answering GET and HEAD with 200 and
+	// {"status":"ok","uptime":<seconds>,"version":...}. It runs before the session and server
+	// middleware and isn't logged. Off when empty.
+	HealthPath string
+	// BuildInfo is the build reported by the health and version endpoints, added as the
+	// "version" attribute to the server logger and as the buildVersion function to the
+	// templates, which returns "" when the version is unknown, e.g. with go run. Empty fields
+	// default to the values from debug.ReadBuildInfo.
+	BuildInfo *BuildInfo
+	// ReadyPath mounts a readiness endpoint, next to HealthPath, that runs the checks added
+	// with AddReadinessCheck concurrently and answers 200 when all pass and 503 otherwise,
+	// with each check's status, latency and error. Errors are only detailed in ENVDev.
+	ReadyPath string
+	// ReadyCheckTimeout fails a readiness check that takes longer. Defaults to
+	// DefaultReadyCheckTimeout.
+	ReadyCheckTimeout time.Duration
+	// ReadyCacheTTL is how long the readiness endpoint reuses the last result, so probes don't
+	// hammer the dependencies. Defaults to DefaultReadyCacheTTL; negative disables the cache.
+	ReadyCacheTTL time.Duration
+	// MaxMultipartMemory is how many bytes of multipart file parts Context.Param, FormFile and
+	// BindForm keep in memory; larger uploads spill to temporary files. Defaults to
+	// DefaultMaxMultipartMemory.
+	MaxMultipartMemory int64
+	// DisableStats turns off the request counters behind Server.Stats, and the render
+	// instrumentation with SlowRenderThreshold.
+	DisableStats bool
+	// StatsPath mounts an endpoint returning Server.Stats as JSON on GET. Like HealthPath it
+	// runs before the session and server middleware; it is public, keep it on an internal
+	// path or host. Off when empty.
+	StatsPath string
+	// SlowRenderThreshold logs a warning for Context.Render calls whose template takes longer
+	// to execute. Off when zero and with DisableStats.
+	SlowRenderThreshold time.Duration
+	// RenderFlashes makes Context.Render pop the flash messages set with FlashRedirect from the
+	// session and add them to map or nil data under FlashesDataKey, as a map from flash key to
+	// message.
+	RenderFlashes bool
+	// VersionPath mounts an endpoint returning the build info, the Go version and the time the
+	// server started as JSON on GET. Like HealthPath it runs before the session and server
+	// middleware. Off when empty.
+	VersionPath string
+	// TrackConnections counts the connections of the main listener by state, for
+	// Stats().Connections. Init sets HTTPServer.ConnState to count them and call ConnState,
+	// so set your callback there rather than on HTTPServer. LogConnectionStates also logs every
+	// state change at debug level with the remote address.
+	TrackConnections    bool
+	LogConnectionStates bool
+	// ConnState is the http.Server.ConnState callback of HTTPServer.
+	ConnState func(net.Conn, http.ConnState)
+	// JSONEncoder encodes the JSON responses of Context. Defaults to StdJSONEncoder.
+	JSONEncoder JSONEncoder
+	// JSONDisableHTMLEscape leaves <, > and & unescaped in JSON responses, e.g. for JSON
+	// embedded in script tags by the client.
+	JSONDisableHTMLEscape bool
+	// JSONIndent indents JSON responses. Defaults to DefaultJSONDevIndent in ENVDev and to
+	// compact output elsewhere.
+	JSONIndent string
+	// Renderer renders the html views of Context.Render, the error templates and the
+	// maintenance page, e.g. with another template engine. It takes precedence over Templates,
+	// which is then optional.
+	Renderer Renderer
+	// FileRoot is the directory Context.File and Attachment serve files from; paths leading
+	// outside of it are rejected. Defaults to the working directory.
+	FileRoot string
+	// RequiredTemplates extends the templates Route checks with CheckTemplates. A missing
+	// template fails Route in ENVProduction and ENVStaging and is logged as a warning elsewhere.
+	RequiredTemplates []string
+	// ViewDataProviders add request data to every Context.Render, e.g. the current user or the
+	// CSRF token for the layout, see Context.ViewData. Later providers override earlier ones.
+	ViewDataProviders []ViewDataProvider
+	// Markdown configures Context.RenderMarkdown and the markdown template function, which
+	// are available once Markdown.Converter is set.
+	Markdown MarkdownOptions
+	// StaticMiddleware wraps the file server of the Public directory, e.g. with
+	// CacheControlMiddleware or security headers. The server middleware doesn't run for it.
+	StaticMiddleware []Middleware
+	// PublicPrefix is the URL path the Public directory is served under. Defaults to
+	// DefaultPublicPrefix; RequestLogSkip still lists the default one.
+	PublicPrefix string
+	// FileWriteTimeout is the write deadline of the responses of Context.File and Attachment,
+	// replacing HTTPServer.WriteTimeout so large files can take longer while slow clients are
+	// still cut off. Zero keeps HTTPServer.WriteTimeout.
+	FileWriteTimeout time.Duration
+	// RenderCacheSize bounds the total size of the output cached with RenderOpt.Cache, the
+	// least recently used being evicted first. Defaults to DefaultRenderCacheSize; a negative
+	// size disables the cache.
+	RenderCacheSize int64
+	// TrustedProxies lists the CIDRs or IPs of the proxies whose X-Forwarded-Proto header is
+	// honored by IsHTTPS, which HSTSMiddleware and the Secure flag of the cookies the server
+	// sets, the session cookie included, rely on. List the TLS-terminating proxies in front of the server.
+	TrustedProxies []string
+	// I18n configures the translations of Context.T and the t template function, which are
+	// available once I18n.Dir or I18n.FS is set.
+	I18n I18nOptions
 }
 
+// DefaultMaxMultipartMemory is the default of Options.MaxMultipartMemory, the limit
+// http.Request.FormValue uses.
+const DefaultMaxMultipartMemory int64 = 32 << 20
+
 type TemplateOptions struct {
-	Root      string
-	Ext       string
-	FuncMap   template.FuncMap
+	Root    string
+	Ext     string
+	FuncMap template.FuncMap
+	// PathToSVG is the directory of the SVG files the svg template function inlines.
 	PathToSVG string
 	FS        fs.FS
 	Debug     bool
+	// Sources reads the templates from several roots, e.g. one per feature module plus a
+	// shared one, instead of Root and FS. See TemplateSource.
+	Sources []TemplateSource
+	// DefaultLayout is the layout of the Context.Render calls that set neither RenderOpt.Layout
+	// nor RenderOpt.NoLayout. WithLayout overrides it for a route or group.
+	DefaultLayout string
+	// SVGSources are more directories of SVG files for the svg template function, looked up
+	// in order after PathToSVG, e.g. icon sets and the project's own art.
+	SVGSources []SVGSource
+}
+
+// TemplateSource is a directory of templates, read from FS when set, otherwise from the Root
+// directory. Its templates are rendered as "name:template", e.g. "admin:dashboard". Unqualified
+// names are looked up in the sources in order, skipping the Qualified ones; a name found in more
+// than one of those sources fails InitTemplates.
+type TemplateSource struct {
+	Name string
+	Root string
+	FS   fs.FS
+	// Qualified leaves the source out of the lookup of unqualified names, so its templates
+	// can share names with other sources.
+	Qualified bool
 }
 
 type Route struct {
 	Match   string
 	Handler http.Handler
 	Name    string
+	// Middleware wraps only this route, inside the server middleware.
+	Middleware []Middleware
+	// Timeout overrides the deadline set by TimeoutMiddleware for this route.
+	Timeout time.Duration
+	// LogRequests overrides Options.LogRequests for this route when set.
+	LogRequests *bool
+	// Layout overrides TemplateOptions.DefaultLayout for this route when set.
+	Layout string
+	// ErrorFunc overrides Options.ErrorFunc for this route when set.
+	ErrorFunc ErrorFunc
+
+	// group holds the routes of a Group for the route table
+	group *routeGroup
+}
+
+// handler returns the route handler wrapped with the route's middleware and timeout.
+func (r Route) handler() http.Handler {
+	h := r.Handler
+	if len(r.Middleware) > 0 {
+		h = Chain(r.Middleware).Then(h)
+	}
+	if r.Timeout > 0 {
+		h = routeTimeout(r.Timeout, h)
+	}
+	return recordRoute(r, h)
 }
 
 type Server struct {
@@ -52,16 +264,69 @@ type Server struct {
 	Port   int
 	Public string
 
-	Middleware   []Middleware
-	HTTPServer   *http.Server
+	Middleware []Middleware
+	HTTPServer *http.Server
+	// AdminHTTPServer serves Options.AdminHandler when Options.AdminPort is set.
+	AdminHTTPServer *http.Server
+
 	routes       []Route
 	log          *slog.Logger
 	mux          *http.ServeMux
 	routeMounted bool
 	logRequests  bool
+	logSkip      requestLogSkip
+	logOverrides bool
+	logFields    []RequestLogField
+	accessLog    AccessLogger
+	reqLogger    *slog.Logger
+	reqLogLevel  slog.Level
+	levelByCode  bool
+	strictJSON   bool
+	negotiate    bool
+	bodyLog      *bodyLog
+	slowRequest  time.Duration
+	onSlow       func(e AccessLogEntry)
 	sessionMgr   *scs.SessionManager
+	loadAndSave  bool
+	fileRoot     string
+	fileTimeout  time.Duration
+	pubPrefix    string
+	staticMW     []Middleware
+	requiredTmpl []string
+	assets       *assets
+	outerWrap    Middleware
 	routeNames   map[string]string
 	errorFunc    ErrorFunc
+	env          ENVTypes
+	inFlight     chan struct{}
+	logLevelAPI  bool
+	adminPort    int
+	named        []namedMiddleware
+	hostGroups   []hostGroup
+	logRoutes    bool
+	pprofPaths   []string
+	ready        *readiness
+	maxMultipart int64
+	stats        *serverStats
+	slowRender   time.Duration
+	renderFlash  bool
+	viewData     []ViewDataProvider
+	markdown     *markdown
+	i18n         *i18n
+	proxies      trustedNets
+	renderCache  *renderCache
+	panicRing    *panicRing
+	build        BuildInfo
+	started      time.Time
+	versionLog   atomic.Pointer[derivedLogger]
+	conns        *connTracker
+	jsonEncoder  JSONEncoder
+	jsonOpts     JSONEncodeOptions
+	replaced     map[string]Middleware
+
+	renderer             Renderer
+	errorTemplates       map[int]string
+	errorTemplatePattern string
 }
 
 func Init(option Options) (*Server, error) {
@@ -74,24 +339,188 @@ func Init(option Options) (*Server, error) {
 		Public:      option.Public,
 		Middleware:  option.Middleware,
 		routes:      option.Routes,
-		log:         option.Log,
 		logRequests: option.LogRequests,
 		sessionMgr:  option.SessionMgr,
 		routeNames:  make(map[string]string),
 		errorFunc:   option.ErrorFunc,
+		env:         option.Env,
+		logLevelAPI: option.EnableLogLevelEndpoint,
+		panicRing:   new(panicRing),
+		build:       resolveBuildInfo(option.BuildInfo),
+		started:     time.Now(),
+
+		errorTemplates:       option.ErrorTemplates,
+		errorTemplatePattern: option.ErrorTemplatePattern,
 	}
 
-	if srv.log == nil {
-		srv.log = appLog
+	srv.SetLogger(option.Log)
+	switch {
+	case option.Renderer != nil:
+		srv.renderer = option.Renderer
+	case option.Templates != nil:
+		srv.renderer = TemplatesRenderer(option.Templates)
+	}
+	if option.Templates != nil {
+		// always defined, templates render an empty version when the build has none
+		option.Templates.addFunc("buildVersion", func() string { return srv.build.Version })
 	}
 
-	srv.HTTPServer = &http.Server{}
+	srv.requiredTmpl = option.RequiredTemplates
+	if option.RenderCacheSize >= 0 && (option.Templates == nil || !option.Templates.opts.Debug) {
+		size := option.RenderCacheSize
+		if size == 0 {
+			size = DefaultRenderCacheSize
+		}
+		srv.renderCache = newRenderCache(size)
+	}
+	srv.staticMW = option.StaticMiddleware
+	if option.Markdown.Converter != nil {
+		md, err := newMarkdown(option.Markdown)
+		if err != nil {
+			return nil, err
+		}
+		srv.markdown = md
+		if option.Templates != nil {
+			option.Templates.addFunc("markdown", func(src string) (template.HTML, error) {
+				return srv.markdown.html([]byte(src))
+			})
+		}
+	}
+	if option.I18n.Dir != "" || option.I18n.FS != nil {
+		i, err := newI18n(srv, option.I18n)
+		if err != nil {
+			return nil, err
+		}
+		srv.i18n = i
+		if option.Templates != nil {
+			option.Templates.addLocaleFunc("t", func(locale string) any {
+				return func(key string, args ...any) string { return i.translate(locale, key, args) }
+			})
+		}
+	}
+	srv.pubPrefix = "/" + strings.Trim(option.PublicPrefix, "/")
+	if srv.pubPrefix == "/" {
+		srv.pubPrefix = DefaultPublicPrefix
+	}
+	srv.assets = newAssets(srv, srv.pubPrefix, option.Templates != nil && option.Templates.opts.Debug)
+	if option.Templates != nil {
+		option.Templates.addFunc("asset", srv.assets.url)
+	}
 
-	var s http.Handler = srv
-	if srv.sessionMgr != nil && !option.DisableLoadAndSave {
-		s = srv.sessionMgr.LoadAndSave(s)
+	srv.logSkip = requestLogSkip{
+		paths:    option.RequestLogSkip,
+		statuses: option.RequestLogSkipStatuses,
+		skipper:  option.RequestLogSkipper,
+	}
+	if srv.logSkip.paths == nil {
+		srv.logSkip.paths = DefaultRequestLogSkip
+	}
+	srv.logFields = option.RequestLogFields
+	if srv.logFields == nil {
+		srv.logFields = DefaultRequestLogFields
+	}
+	srv.accessLog = srv.accessLogger(option.AccessLog)
+	srv.reqLogger = option.RequestLogger
+	srv.reqLogLevel = option.RequestLogLevel
+	srv.levelByCode = option.RequestLogLevelByStatus
+	srv.logRoutes = option.LogRoutes
+	srv.strictJSON = option.StrictJSON
+	srv.negotiate = option.NegotiateRender
+	srv.bodyLog = newBodyLog(option.LogBodyOnError)
+	srv.slowRequest = option.SlowRequestThreshold
+	srv.onSlow = option.OnSlowRequest
+	srv.maxMultipart = option.MaxMultipartMemory
+	if srv.maxMultipart <= 0 {
+		srv.maxMultipart = DefaultMaxMultipartMemory
+	}
+	srv.slowRender = option.SlowRenderThreshold
+	srv.jsonEncoder = option.JSONEncoder
+	if srv.jsonEncoder == nil {
+		srv.jsonEncoder = StdJSONEncoder{}
+	}
+	srv.jsonOpts = JSONEncodeOptions{EscapeHTML: !option.JSONDisableHTMLEscape, Indent: option.JSONIndent}
+	if srv.jsonOpts.Indent == "" && option.Env == ENVDev {
+		srv.jsonOpts.Indent = DefaultJSONDevIndent
+	}
+	if option.TrackConnections {
+		srv.conns = newConnTracker(srv, option.LogConnectionStates)
+	}
+	srv.renderFlash = option.RenderFlashes
+	srv.viewData = option.ViewDataProviders
+	if !option.DisableStats {
+		srv.stats = new(serverStats)
+	}
+	srv.ready = newReadiness(option.ReadyCheckTimeout, option.ReadyCacheTTL, option.Env)
+	if option.AccessLog != nil {
+		srv.logRequests = true
+	}
+
+	if option.MaxConcurrentRequests > 0 {
+		srv.inFlight = make(chan struct{}, option.MaxConcurrentRequests)
+	}
+
+	srv.HTTPServer = &http.Server{ConnState: srv.connState(option.ConnState)}
+
+	fileRoot := option.FileRoot
+	if fileRoot == "" {
+		fileRoot = "."
+	}
+	root, err := filepath.Abs(fileRoot)
+	if err != nil {
+		return nil, fmt.Errorf("file root: %w", err)
+	}
+	srv.fileRoot = root
+	srv.fileTimeout = option.FileWriteTimeout
+	srv.proxies, err = parseTrustedNets(option.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+
+	srv.loadAndSave = !option.DisableLoadAndSave
+	srv.outerWrap = func(s http.Handler) http.Handler {
+		if option.HealthPath != "" {
+			s = withHealth(option.HealthPath, srv.build, srv.started, s)
+		}
+		if option.VersionPath != "" {
+			s = withVersion(option.VersionPath, srv.build, srv.started, s)
+		}
+		if option.ReadyPath != "" {
+			s = withReady(option.ReadyPath, srv.ready, s)
+		}
+		if option.StatsPath != "" {
+			s = withStats(option.StatsPath, srv, s)
+		}
+		return s
+	}
+	srv.HTTPServer.Handler = srv.handler()
+
+	// an unset Env may well be production, so the profiles need an explicit other one
+	enablePprof := option.EnablePprof && option.Env != "" && option.Env != ENVProduction
+	if option.EnablePprof && !enablePprof {
+		srv.logger().Warn("EnablePprof is ignored unless Env is set to a non-production environment, use MountPprof with a guard", "env", option.Env)
+	}
+
+	if option.AdminPort > 0 {
+		if option.AdminHandler == nil {
+			return nil, ErrNoAdminHandler
+		}
+		adminHandler := option.AdminHandler
+		if enablePprof {
+			mux := http.NewServeMux()
+			mux.Handle(PprofPath, pprofHandler(PprofPath, option.PprofAuth))
+			mux.Handle("/", option.AdminHandler)
+			adminHandler = mux
+		}
+
+		srv.adminPort = option.AdminPort
+		srv.AdminHTTPServer = &http.Server{Handler: adminHandler}
+	} else if enablePprof {
+		var mw []Middleware
+		if auth := option.PprofAuth; auth != nil {
+			mw = append(mw, func(next http.Handler) http.Handler { return basicAuth(*auth, "pprof", next) })
+		}
+		srv.MountPprof(PprofPath, mw...)
 	}
-	srv.HTTPServer.Handler = s
 
 	return srv, nil
 }
@@ -103,29 +532,54 @@ func (s *Server) Route() error {
 		return nil
 	}
 
-	chain := Chain(s.Middleware)
-	pubFolder := s.Public
-	if pubFolder == "" {
-		pubFolder = "./public"
+	chain, _, err := s.middlewareChain()
+	if err != nil {
+		return err
+	}
+
+	if s.renderer != nil {
+		if err := s.CheckTemplates(s.requiredTmpl...); err != nil {
+			if s.env != ENVProduction && s.env != ENVStaging {
+				s.logger().Warn("TEMPLATES MISSING, error pages will fall back to plain text", "err", err)
+			} else {
+				return err
+			}
+		}
 	}
 
-	s.mux.Handle("/public/", http.StripPrefix("/public", http.FileServer(http.Dir(pubFolder))))
-	root := http.NewServeMux()
 	for _, r := range s.routes {
-		root.Handle(r.Match, r.Handler)
 		if r.Name != "" {
-			s.addRouteName(r.Name, r.Match)
+			if err := s.addRouteName(r.Name, r.Match); err != nil {
+				return err
+			}
 		}
 	}
 
-	s.mux.Handle("/", chain.Then(root))
+	s.warnOverlappingRoutes()
+
+	static := http.StripPrefix(s.pubPrefix, http.FileServer(http.Dir(s.publicDir())))
+	s.mux.Handle(s.pubPrefix+"/", Chain(s.staticMW).Then(static))
+	root := http.NewServeMux()
+	if s.logLevelAPI {
+		root.Handle(LogLevelPath, HandlerFunc(logLevelHandler))
+	}
+	for _, r := range s.routes {
+		root.Handle(r.Match, r.handler())
+	}
+
+	s.mux.Handle("/", chain.Then(s.hostRouter(root)))
+	s.logOverrides = s.hasLogOverrides()
 	s.routeMounted = true
 	return nil
 }
 
 type HandleOption struct {
-	name       string
-	middleware []Middleware
+	name        string
+	middleware  []Middleware
+	timeout     time.Duration
+	logRequests *bool
+	layout      string
+	errorFunc   ErrorFunc
 }
 type HandleOptionFn func(*HandleOption)
 
@@ -137,8 +591,100 @@ func WithName(name string) HandleOptionFn {
 
 func WithMiddleware(middleware ...Middleware) HandleOptionFn {
 	return func(o *HandleOption) {
-		o.middleware = middleware
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+// WithMiddlewareForMethods is WithMiddleware for the requests whose method is one of methods
+// only, e.g. to require authentication for the mutating methods of a group while GET stays
+// public. See ForMethods.
+func WithMiddlewareForMethods(methods []string, middleware ...Middleware) HandleOptionFn {
+	return WithMiddleware(ForMethods(methods, middleware...))
+}
+
+// WithTimeout sets a request deadline for this route only. It takes precedence over the
+// deadline set by TimeoutMiddleware, so it can be used to give slow endpoints more time.
+func WithTimeout(d time.Duration) HandleOptionFn {
+	return func(o *HandleOption) {
+		o.timeout = d
+	}
+}
+
+// WithRequestLogging turns the request log on or off for this route, or for every route of
+// a group, regardless of Options.LogRequests. Routes of a group can override it in turn.
+func WithRequestLogging(enabled bool) HandleOptionFn {
+	return func(o *HandleOption) {
+		o.logRequests = &enabled
+	}
+}
+
+// WithLayout sets the layout Context.Render uses by default for this route, or for every route
+// of a group, instead of TemplateOptions.DefaultLayout. Routes of a group can override it in turn.
+func WithLayout(layout string) HandleOptionFn {
+	return func(o *HandleOption) {
+		o.layout = layout
+	}
+}
+
+// WithErrorFunc handles the errors returned, and panics recovered, by the handler of this route,
+// or of every route of a group, instead of Options.ErrorFunc, e.g. to render JSON errors for
+// an API group. Routes of a group can override it in turn.
+func WithErrorFunc(fn ErrorFunc) HandleOptionFn {
+	return func(o *HandleOption) {
+		o.errorFunc = fn
+	}
+}
+
+// WithCtxMiddleware is WithMiddleware for CtxMiddleware.
+func WithCtxMiddleware(middleware ...CtxMiddleware) HandleOptionFn {
+	return func(o *HandleOption) {
+		o.middleware = append(o.middleware, CtxChain(middleware...)...)
+	}
+}
+
+// publicDir returns the directory served under the public prefix.
+func (s *Server) publicDir() string {
+	if s.Public == "" {
+		return "./public"
+	}
+	return s.Public
+}
+
+// handler returns the server wrapped with the session loading and the endpoints served before it.
+func (s *Server) handler() http.Handler {
+	var h http.Handler = s
+	if s.sessionMgr != nil && s.loadAndSave {
+		h = s.secureSessionCookie(s.sessionMgr.LoadAndSave(h))
+	}
+	return s.outerWrap(h)
+}
+
+// SetSessionManager replaces the session manager set with Options.SessionMgr, e.g. to use a
+// test store, or removes it when mgr is nil. It sets HTTPServer.Handler again, so it must be
+// called before Route() and before replacing HTTPServer.Handler.
+func (s *Server) SetSessionManager(mgr *scs.SessionManager) {
+	if s.routeMounted {
+		s.logger().Warn("routes already mounted")
+		return
+	}
+
+	s.sessionMgr = mgr
+	s.HTTPServer.Handler = s.handler()
+}
+
+// Use appends middleware to the server (or group) middleware. It must be called before Route().
+func (s *Server) Use(middleware ...Middleware) {
+	if s.routeMounted {
+		s.logger().Warn("routes already mounted")
+		return
 	}
+
+	s.Middleware = append(s.Middleware, middleware...)
+}
+
+// UseCtx is Use for CtxMiddleware.
+func (s *Server) UseCtx(middleware ...CtxMiddleware) {
+	s.Use(CtxChain(middleware...)...)
 }
 
 func (s *Server) Handle(pattern string, handler http.Handler, args ...HandleOptionFn) {
@@ -148,36 +694,65 @@ func (s *Server) Handle(pattern string, handler http.Handler, args ...HandleOpti
 	}
 
 	if s.routeMounted {
-		s.log.Warn("routes already mounted")
+		s.logger().Warn("routes already mounted")
 		return
 	}
 
-	if len(options.middleware) > 0 {
-		handler = Chain(options.middleware).Then(handler)
+	s.routes = append(s.routes, Route{
+		Match:       pattern,
+		Handler:     handler,
+		Name:        options.name,
+		Middleware:  options.middleware,
+		Timeout:     options.timeout,
+		LogRequests: options.logRequests,
+		Layout:      options.layout,
+		ErrorFunc:   options.errorFunc,
+	})
+}
+
+// AddRoutes registers routes the same way as Options.Routes. Named routes can be resolved
+// with RouteName, including routes added to a group.
+func (s *Server) AddRoutes(routes ...Route) {
+	if s.routeMounted {
+		s.logger().Warn("routes already mounted")
+		return
 	}
 
-	s.routes = append(s.routes, Route{Match: pattern, Handler: handler, Name: options.name})
+	s.routes = append(s.routes, routes...)
 }
 
 func (s *Server) HandleFunc(pattern string, handler HandlerFunc, args ...HandleOptionFn) {
 	s.Handle(pattern, handler, args...)
 }
 
-// Group panics if a name isn't provided but named routes are registered
-func (s *Server) Group(pattern string, name string, fn func(srv *Server)) {
+// Group panics if a name isn't provided but named routes are registered, or if
+// the group's named middleware can't be resolved. args apply to the route of the
+// group as a whole, e.g. WithRequestLogging.
+func (s *Server) Group(pattern string, name string, fn func(srv *Server), args ...HandleOptionFn) {
 	grp := http.NewServeMux()
-	sub := &Server{}
+	sub := &Server{log: s.log, routeNames: make(map[string]string)}
 	fn(sub)
 
 	hasNamedRoutes := false
 	for _, r := range sub.routes {
-		grp.Handle(r.Match, r.Handler)
+		grp.Handle(r.Match, r.handler())
 		if r.Name != "" {
-			s.addRouteName(fmt.Sprint(name, "/", r.Name), path.Join(pattern, r.Match))
+			_, _, pth := PatternParts(r.Match)
+			if err := s.addRouteName(fmt.Sprint(name, "/", r.Name), path.Join(pattern, pth)); err != nil {
+				panic(fmt.Sprintf("group(%q): %v", pattern, err))
+			}
 			hasNamedRoutes = true
 		}
 	}
 
+	// named routes of groups nested in this one
+	for subName, subPath := range sub.routeNames {
+		if err := s.addRouteName(fmt.Sprint(name, "/", subName), path.Join(pattern, subPath)); err != nil {
+			panic(fmt.Sprintf("group(%q): %v", pattern, err))
+		}
+		hasNamedRoutes = true
+	}
+
 	if hasNamedRoutes && name == "" {
 		panic(fmt.Sprintf("group(%q) has named routes but no group name was provided", pattern))
 	}
@@ -186,48 +761,271 @@ func (s *Server) Group(pattern string, name string, fn func(srv *Server)) {
 		pattern += "/"
 	}
 
-	mwChain := Chain(sub.Middleware)
+	mwChain, _, err := sub.middlewareChain()
+	if err != nil {
+		panic(fmt.Sprintf("group(%q): %v", pattern, err))
+	}
+
 	sPattern := pattern[:len(pattern)-1]
-	s.Handle(pattern, http.StripPrefix(sPattern, mwChain.Then(grp)))
+	s.Handle(pattern, http.StripPrefix(sPattern, groupPrefix(sPattern, mwChain.Then(grp))), args...)
+	if n := len(s.routes); n > 0 && s.routes[n-1].Match == pattern {
+		s.routes[n-1].group = &routeGroup{name: name, middleware: len(mwChain), routes: sub.routes}
+	}
+	if sub.hasLogOverrides() {
+		s.logOverrides = true
+	}
+}
+
+// hasLogOverrides reports whether a route, or a route of a group, sets LogRequests.
+func (s *Server) hasLogOverrides() bool {
+	if s.logOverrides {
+		return true
+	}
+	for _, r := range s.routes {
+		if r.LogRequests != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// groupPrefix adds prefix to the group path recorded for the request.
+func groupPrefix(prefix string, next http.Handler) http.Handler {
+	_, _, prefix = PatternParts(prefix)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+			info.prefix += prefix
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 var ErrRoutesNotMounted = errors.New("routes not mounted")
 
+var ErrDuplicateRouteName = errors.New("duplicate route name")
+
+var ErrNoAdminHandler = errors.New("AdminPort is set but AdminHandler is nil")
+
+// Handler mounts the routes if needed and returns the fully composed handler, including the
+// session middleware. Use it to serve the server from another mux instead of calling Run().
+func (s *Server) Handler() (http.Handler, error) {
+	if err := s.Route(); err != nil {
+		return nil, err
+	}
+
+	return s.HTTPServer.Handler, nil
+}
+
+// Run mounts the routes and serves them, and Options.AdminHandler when AdminPort is set, until
+// a listener stops. The error of the first listener to stop is joined with those of shutting
+// down both.
 func (s *Server) Run() error {
 	if err := s.Route(); err != nil {
 		return err
 	}
+	if s.logRoutes {
+		s.logRouteTable()
+	}
 
 	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
 	slog.Info("listening on", "addr", addr)
 
 	s.HTTPServer.Addr = addr
-	return s.HTTPServer.ListenAndServe()
+	if s.AdminHTTPServer == nil {
+		return s.HTTPServer.ListenAndServe()
+	}
+
+	s.AdminHTTPServer.Addr = fmt.Sprintf("%s:%d", s.Host, s.adminPort)
+	slog.Info("admin listening on", "addr", s.AdminHTTPServer.Addr)
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.HTTPServer.ListenAndServe() }()
+	go func() { errc <- s.AdminHTTPServer.ListenAndServe() }()
+
+	// when either listener stops, stop the other one too
+	err := <-errc
+	ctx, cancel := context.WithTimeout(context.Background(), listenerShutdownTimeout)
+	defer cancel()
+	err = errors.Join(err, s.HTTPServer.Shutdown(ctx), s.AdminHTTPServer.Shutdown(ctx))
+	<-errc
+
+	return err
 }
 
-type CtxKey string
+// listenerShutdownTimeout bounds the shutdown of the remaining listener when Run stops because
+// the other one failed.
+var listenerShutdownTimeout = 5 * time.Second
+
+// DefaultRequestLogSkip are the health check and static asset paths LogRequests skips by default.
+var DefaultRequestLogSkip = []string{"/healthz", "/livez", "/readyz", "/public/"}
+
+// requestLogSkip decides which requests LogRequests leaves out.
+type requestLogSkip struct {
+	paths    []string
+	statuses map[string][]int
+	skipper  func(r *http.Request, status int) bool
+}
+
+func (l requestLogSkip) skip(r *http.Request, status int) bool {
+	pth := r.URL.Path
+	for _, p := range l.paths {
+		if p == pth || (strings.HasSuffix(p, "/") && strings.HasPrefix(pth, p)) {
+			return true
+		}
+	}
+
+	for prefix, codes := range l.statuses {
+		if !strings.HasPrefix(pth, prefix) {
+			continue
+		}
+		for _, code := range codes {
+			if code == status || code == status/100 {
+				return true
+			}
+		}
+	}
+
+	return l.skipper != nil && l.skipper(r, status)
+}
+
+// RequestLogField is an optional field of the LogRequests line.
+type RequestLogField string
 
 const (
-	CtxKeyServer     CtxKey = "_server_"
-	CtxKeySessionMgr CtxKey = "_sessMgr_"
+	// RequestLogID is the ID set by RequestIDMiddleware.
+	RequestLogID RequestLogField = "reqID"
+	// RequestLogIP is the client IP, as resolved by RealIPMiddleware when used.
+	RequestLogIP        RequestLogField = "ip"
+	RequestLogBytes     RequestLogField = "bytes"
+	RequestLogProto     RequestLogField = "proto"
+	RequestLogUserAgent RequestLogField = "userAgent"
+	RequestLogReferer   RequestLogField = "referer"
 )
 
+// DefaultRequestLogFields are the optional fields LogRequests logs by default.
+var DefaultRequestLogFields = []RequestLogField{
+	RequestLogID, RequestLogIP, RequestLogBytes, RequestLogProto, RequestLogUserAgent, RequestLogReferer,
+}
+
+// requestLogFields returns the configured fields for the access log. Empty headers are left out.
+func (s *Server) requestLogFields(e AccessLogEntry) []any {
+	attrs := make([]any, 0, 2*len(s.logFields))
+	addHeader := func(field RequestLogField, value string) {
+		if value != "" {
+			attrs = append(attrs, string(field), value)
+		}
+	}
+
+	for _, field := range s.logFields {
+		switch field {
+		case RequestLogID:
+			addHeader(field, e.RequestID)
+		case RequestLogIP:
+			attrs = append(attrs, string(field), e.IP)
+		case RequestLogBytes:
+			attrs = append(attrs, string(field), e.Bytes)
+		case RequestLogProto:
+			attrs = append(attrs, string(field), e.Proto)
+		case RequestLogUserAgent:
+			addHeader(field, e.UserAgent)
+		case RequestLogReferer:
+			addHeader(field, e.Referer)
+		}
+	}
+	return attrs
+}
+
+// overloadRetryAfter is the Retry-After value, in seconds, sent when MaxConcurrentRequests is hit.
+const overloadRetryAfter = "1"
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r = r.WithContext(context.WithValue(r.Context(), CtxKeyServer, s))
+	if s.stats != nil {
+		sw, done := s.stats.begin(w, r)
+		// counted even if a handler panics past the recovery middleware
+		defer done()
+		w = sw
+	}
+
+	if s.inFlight != nil {
+		select {
+		case s.inFlight <- struct{}{}:
+			// released even if a handler panics past the recovery middleware
+			defer func() { <-s.inFlight }()
+		default:
+			w.Header().Set("Retry-After", overloadRetryAfter)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	r = withRequestInfo(r.WithContext(ContextWithValue(r.Context(), CtxKeyServer, s)))
+	if len(s.proxies) > 0 && r.TLS == nil {
+		if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+			info.https = forwardedHTTPS(r, s.proxies)
+		}
+	}
 	if s.sessionMgr != nil {
-		r = r.WithContext(context.WithValue(r.Context(), CtxKeySessionMgr, s.sessionMgr))
+		r = r.WithContext(ContextWithValue(r.Context(), CtxKeySessionMgr, s.sessionMgr))
+	}
+
+	if s.bodyLog != nil {
+		s.bodyLog.capture(r)
 	}
 
-	if !s.logRequests {
+	if !s.logRequests && s.slowRequest <= 0 && !s.logOverrides && s.bodyLog == nil {
 		s.mux.ServeHTTP(w, r)
 		return
 	}
 
 	start := time.Now()
 	rw := &ResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	logged := false
+	defer func() {
+		// a failed streamed render aborts the response with a panic, the request is logged
+		// before net/http closes the connection
+		if info, ok := FromContext(r.Context(), requestInfoKey); ok && info.aborted && !logged {
+			s.logServed(rw, r, start)
+		}
+	}()
 	s.mux.ServeHTTP(rw, r)
-	s.log.Info(r.RequestURI, "method", r.Method, "path", r.URL.Path, "status", rw.statusCode, "duration", time.Since(start))
+	logged = true
+	s.logServed(rw, r, start)
+}
+
+// logServed writes the request log line of r, and reports it when slow, as ServeHTTP is set to.
+func (s *Server) logServed(rw *ResponseWriter, r *http.Request, start time.Time) {
+	info, ok := FromContext(r.Context(), requestInfoKey)
+	if ok && rw.statusCode < http.StatusBadRequest && info.err == nil {
+		info.body = nil
+	}
+
+	logRequest := s.logRequests
+	if ok && info.logRequests != nil {
+		// routes with the request log turned off aren't checked for slowness either
+		if !*info.logRequests {
+			return
+		}
+		logRequest = true
+	}
+	if !logRequest && s.slowRequest <= 0 {
+		return
+	}
+
+	// only the log line is skipped, the request is served and counted as any other
+	if s.logSkip.skip(r, rw.statusCode) {
+		return
+	}
 
+	e := accessLogEntry(rw, r, start)
+	if s.slowRequest > 0 && e.Duration > s.slowRequest {
+		e.Slow = true
+		if s.onSlow != nil {
+			s.onSlow(e)
+		}
+	}
+	if logRequest {
+		s.accessLog.LogAccess(e)
+	}
 }
 
 // RouteName returns the route path for the given name. If params are provided, they are used to replace
@@ -258,18 +1056,64 @@ func (s *Server) RouteName(name string, params ...string) string {
 	return route
 }
 
-func (s *Server) addRouteName(name string, pattern string) {
+// SetLogger replaces the server logger, including the one Options.Log set. Request scoped
+// loggers created after the call derive from it. The build version is added to it.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	if logger != nil && s.build.Version != "" {
+		logger = logger.With("version", s.build.Version)
+	}
+	s.log = logger
+}
+
+// derivedLogger is a logger derived from base.
+type derivedLogger struct {
+	base, log *slog.Logger
+}
+
+// logger returns the logger set by SetLogger or Options.Log, falling back to the current
+// application logger so a later InitLog call takes effect.
+func (s *Server) logger() *slog.Logger {
+	if s.log != nil {
+		return s.log
+	}
+	if s.build.Version == "" {
+		return appLog
+	}
+
+	// derive the versioned logger once per application logger
+	base := appLog
+	if d := s.versionLog.Load(); d != nil && d.base == base {
+		return d.log
+	}
+	d := &derivedLogger{base: base, log: base.With("version", s.build.Version)}
+	s.versionLog.Store(d)
+	return d.log
+}
+
+// addRouteName maps name to the path of pattern. A name can only be reused for the same path,
+// e.g. for the GET and POST routes of a form.
+func (s *Server) addRouteName(name string, pattern string) error {
 	_, host, pth := PatternParts(pattern)
 	if host == "" && pth == "" {
-		s.log.Warn("route name not added", "name", name, "pattern", pattern)
-		return
+		s.logger().Warn("route name not added", "name", name, "pattern", pattern)
+		return nil
+	}
+
+	name = strings.ToLower(name)
+	if existing, ok := s.routeNames[name]; ok && existing != host+pth {
+		return fmt.Errorf("%w: %q is used by %q and %q", ErrDuplicateRouteName, name, existing, host+pth)
 	}
 
-	s.routeNames[strings.ToLower(name)] = host + pth
+	s.routeNames[name] = host + pth
+	return nil
 }
 
+// Shutdown gracefully shuts down the server and, if configured, the admin listener.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.HTTPServer.Shutdown(ctx)
+	if s.AdminHTTPServer == nil {
+		return s.HTTPServer.Shutdown(ctx)
+	}
+	return errors.Join(s.HTTPServer.Shutdown(ctx), s.AdminHTTPServer.Shutdown(ctx))
 }
 
 var rePattern = regexp.MustCompile(`^(?:(\w+)\s+)?([^/ ]+)?(/.*)?$`)
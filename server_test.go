@@ -3,14 +3,25 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -33,7 +44,7 @@ func TestInit(t *testing.T) {
 	assert.Equal(options.Port, srv.Port)
 	assert.Equal(options.Public, srv.Public)
 	assert.Equal(options.Middleware, srv.Middleware)
-	assert.Equal(srv.log, appLog)
+	assert.Equal(srv.logger(), appLog)
 	assert.Equal(options.LogRequests, srv.logRequests)
 	assert.Equal(options.SessionMgr, srv.sessionMgr)
 }
@@ -136,6 +147,59 @@ func TestServerMux_Group(t *testing.T) {
 
 }
 
+func TestServer_GroupErrorFunc(t *testing.T) {
+	errorFunc := func(name string) ErrorFunc {
+		return func(ctx Context, err error) {
+			code := http.StatusInternalServerError
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) {
+				code = httpErr.Code
+			}
+			ctx.String(code, name)
+		}
+	}
+	fail := func(ctx Context) error {
+		return NewHTTPError(http.StatusTeapot, errors.New("teapot"))
+	}
+
+	srv, err := Init(Options{ErrorFunc: errorFunc("global")})
+	require.NoError(t, err)
+	srv.HandleFunc("/root", fail)
+	srv.Group("/api", "", func(srv *Server) {
+		srv.HandleFunc("/items", fail)
+		srv.HandleFunc("/panic", func(ctx Context) error { panic("boom") })
+		srv.HandleFunc("/legacy", fail, WithErrorFunc(errorFunc("route")))
+		srv.Group("/v2", "", func(srv *Server) {
+			srv.HandleFunc("/items", fail)
+		}, WithErrorFunc(errorFunc("api v2")))
+	}, WithErrorFunc(errorFunc("api")))
+	srv.Group("/web", "", func(srv *Server) {
+		srv.HandleFunc("/items", fail)
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{path: "/root", code: http.StatusTeapot, body: "global"},
+		{path: "/api/items", code: http.StatusTeapot, body: "api"},
+		{path: "/api/panic", code: http.StatusInternalServerError, body: "api"},
+		{path: "/api/legacy", code: http.StatusTeapot, body: "route"},
+		{path: "/api/v2/items", code: http.StatusTeapot, body: "api v2"},
+		{path: "/web/items", code: http.StatusTeapot, body: "global"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			assert.Equal(t, tt.body, rec.Body.String())
+		})
+	}
+}
+
 func TestServerMux_ChainedGroup(t *testing.T) {
 	options := Options{}
 	srv, err := Init(options)
@@ -146,7 +210,7 @@ func TestServerMux_ChainedGroup(t *testing.T) {
 			func(next http.Handler) http.Handler {
 				return HandlerFunc(func(ctx Context) error {
 					r := ctx.Request()
-					r = r.WithContext(context.WithValue(r.Context(), "age", 22))
+					r = r.WithContext(ContextWithValue(r.Context(), testAgeKey, 22))
 
 					next.ServeHTTP(ctx.Response(), r)
 					return nil
@@ -155,7 +219,7 @@ func TestServerMux_ChainedGroup(t *testing.T) {
 		}
 
 		srv.HandleFunc("/hello", func(ctx Context) error {
-			age := ctx.Request().Context().Value("age")
+			age := ctx.Request().Context().Value(testAgeKey)
 			return ctx.String(http.StatusOK, fmt.Sprint("Hello, ", age, " year old World!"))
 		})
 	})
@@ -431,7 +495,7 @@ func TestServer_GroupMiddleware(t *testing.T) {
 
 	srv.Group("/greet", "", func(srv *Server) {
 		srv.HandleFunc("/hello", func(ctx Context) error {
-			age := ctx.Request().Context().Value("age")
+			age := ctx.Request().Context().Value(testAgeKey)
 			return ctx.String(http.StatusOK, fmt.Sprint("Hello, ", age, " year old World!"))
 		}, WithMiddleware(testAgeMiddleware))
 	})
@@ -449,9 +513,11 @@ func TestServer_GroupMiddleware(t *testing.T) {
 
 }
 
+var testAgeKey = NewKey[int]("age")
+
 func testAgeMiddleware(next http.Handler) http.Handler {
 	return HandlerFunc(func(ctx Context) error {
-		ctx.ContextSet("age", 22)
+		ctx.ContextSet(testAgeKey, 22)
 
 		next.ServeHTTP(ctx.Response(), ctx.Request())
 		return nil
@@ -465,7 +531,7 @@ func TestServer_ContextGet(t *testing.T) {
 
 	srv.Group("/greet", "", func(srv *Server) {
 		srv.HandleFunc("/hello", func(ctx Context) error {
-			age := ctx.ContextGet("age")
+			age := ctx.ContextGet(testAgeKey)
 			return ctx.String(http.StatusOK, fmt.Sprint("Hello, ", age, " year old World!"))
 		}, WithMiddleware(testAgeMiddleware))
 	})
@@ -504,3 +570,2006 @@ func TestServer_ContextRouteName(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 	assert.Equal(t, "Hello, /hello", string(body))
 }
+
+func TestServer_RouteTimeout(t *testing.T) {
+	srv, err := Init(Options{Middleware: []Middleware{TimeoutMiddleware(50 * time.Millisecond)}})
+	require.NoError(t, err, "server init failed")
+
+	remaining := func(ctx Context) error {
+		deadline, ok := ctx.Context().Deadline()
+		if !ok {
+			return ctx.String(http.StatusOK, "none")
+		}
+
+		return ctx.String(http.StatusOK, fmt.Sprint(time.Until(deadline) > time.Second))
+	}
+	srv.HandleFunc("/upload", remaining, WithTimeout(time.Minute), WithMiddleware(testAgeMiddleware))
+	srv.HandleFunc("/strict", remaining)
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/upload")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "true", string(body))
+
+	resp, err = runTestServer(t, srv, "/strict")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "false", string(body))
+}
+
+func TestServer_ParamInt(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/items/{id}", func(ctx Context) error {
+		id, err := ctx.ParamInt("id")
+		if err != nil {
+			return err
+		}
+		return ctx.String(http.StatusOK, fmt.Sprint("item ", id))
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/items/42")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "item 42", string(body))
+
+	resp, err = runTestServer(t, srv, "/items/abc")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_MaxConcurrentRequests(t *testing.T) {
+	srv, err := Init(Options{MaxConcurrentRequests: 2})
+	require.NoError(t, err, "server init failed")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv.HandleFunc("/slow", func(ctx Context) error {
+		started <- struct{}{}
+		<-release
+		return ctx.String(http.StatusOK, "done")
+	})
+	srv.HandleFunc("/panic", func(ctx Context) error {
+		panic("released anyway")
+	})
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := tSrv.Client().Get(tSrv.URL + "/slow")
+			if err != nil {
+				done <- 0
+				return
+			}
+			done <- resp.StatusCode
+		}()
+		<-started
+	}
+
+	resp, err := tSrv.Client().Get(tSrv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// slots are freed after completion and after a panic
+	require.Eventually(t, func() bool { return len(srv.inFlight) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		resp, err = tSrv.Client().Get(tSrv.URL + "/panic")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func testAgeCtxMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx Context) error {
+		ctx.ContextSet(testAgeKey, 22)
+		return next(ctx)
+	}
+}
+
+func TestServer_CtxMiddleware(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	denyAll := func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			return NewHTTPError(http.StatusUnauthorized, nil)
+		}
+	}
+
+	srv.Group("/greet", "", func(srv *Server) {
+		srv.UseCtx(testAgeCtxMiddleware)
+		srv.HandleFunc("/hello", func(ctx Context) error {
+			return ctx.String(http.StatusOK, fmt.Sprint("Hello, ", ctx.ContextGet(testAgeKey), " year old World!"))
+		})
+	})
+	srv.HandleFunc("/private", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "secret")
+	}, WithCtxMiddleware(denyAll))
+	srv.HandleFunc("/req-id", func(ctx Context) error {
+		return ctx.String(http.StatusOK, ctx.RequestID())
+	}, WithCtxMiddleware(ToCtxMiddleware(RequestIDMiddleware)))
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/greet/hello")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Hello, 22 year old World!", string(body))
+
+	resp, err = runTestServer(t, srv, "/private")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = runTestServer(t, srv, "/req-id")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.NotEmpty(t, string(body))
+	assert.Equal(t, resp.Header.Get(RequestIDHeaderKey), string(body))
+}
+
+func TestCtxMiddlewareFunc(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+
+	calls := 0
+	requireToken := CtxMiddlewareFunc(func(ctx Context, next HandlerFunc) error {
+		if ctx.Request().Header.Get("Authorization") != "Bearer secret" {
+			return ctx.Error(http.StatusUnauthorized, nil)
+		}
+		ctx.ContextSet("user", "ann")
+		return next(ctx)
+	})
+	handler := func(ctx Context) error {
+		calls++
+		return ctx.String(http.StatusOK, fmt.Sprint("hello ", ctx.ContextGet("user")))
+	}
+	srv.HandleFunc("GET /ctx", handler, WithCtxMiddleware(requireToken.CtxMiddleware()))
+	srv.HandleFunc("GET /mw", handler, WithMiddleware(requireToken.Middleware()))
+	require.NoError(t, srv.Route())
+
+	for _, path := range []string{"/ctx", "/mw"} {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, path)
+		assert.Equal(t, "Unauthorized\n", rec.Body.String(), path)
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Equal(t, "hello ann", rec.Body.String(), path)
+	}
+	assert.Equal(t, 2, calls, "the handler only runs when next is called")
+}
+
+func TestServer_RouteMiddleware(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	greet := func(ctx Context) error {
+		age := ctx.Request().Context().Value(testAgeKey)
+		return ctx.String(http.StatusOK, fmt.Sprint("Hello, ", age, " year old World!"))
+	}
+
+	srv.HandleFunc("/hello", greet, WithMiddleware(testAgeMiddleware))
+	srv.HandleFunc("/sibling", greet)
+	srv.Group("/greet", "", func(srv *Server) {
+		srv.HandleFunc("/hello", greet, WithMiddleware(testAgeMiddleware))
+		srv.HandleFunc("/sibling", greet)
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		url          string
+		expectedBody string
+	}{
+		{url: "/hello", expectedBody: "Hello, 22 year old World!"},
+		{url: "/sibling", expectedBody: "Hello, <nil> year old World!"},
+		{url: "/greet/hello", expectedBody: "Hello, 22 year old World!"},
+		{url: "/greet/sibling", expectedBody: "Hello, <nil> year old World!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			resp, err := runTestServer(t, srv, tt.url)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.expectedBody, string(body))
+		})
+	}
+
+	t.Run("options routes", func(t *testing.T) {
+		options := defaultOptions
+		options.Routes = []Route{
+			{Match: "GET /hello", Handler: HandlerFunc(greet), Middleware: []Middleware{testAgeMiddleware}},
+		}
+
+		resp, err := runServerForTest(t, options, "/hello")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "Hello, 22 year old World!", string(body))
+	})
+}
+
+func TestServer_NamedMiddleware(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	srv, err := Init(Options{Middleware: []Middleware{record("plain")}})
+	require.NoError(t, err, "server init failed")
+
+	srv.UseNamed("logging", record("logging"))
+	srv.UseBefore("logging", "auth", record("auth"))
+	srv.UseBefore("auth", "recovery", record("recovery"))
+	srv.UseNamed("cors", record("cors"))
+	srv.UseAfter("logging", "metrics", record("metrics"))
+	srv.UseAfter("logging", "tracing", record("tracing"))
+	srv.Replace("cors", record("new-cors"))
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "hello")
+	}, WithName("hello"))
+	noop := func(ctx Context) error { return nil }
+	srv.Group("/api", "api", func(srv *Server) {
+		srv.HandleFunc("POST /items", noop, WithName("items"))
+	})
+	srv.HostGroup("admin.example.com", "admin", func(srv *Server) {
+		srv.HandleFunc("GET /users", noop)
+	})
+	require.NoError(t, srv.Route())
+
+	names, err := srv.MiddlewareOrder()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recovery", "auth", "logging", "metrics", "tracing", "cors", "<anonymous>"}, names)
+
+	_, err = runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recovery", "auth", "logging", "metrics", "tracing", "new-cors", "plain"}, order)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, srv.PrintRoutes(buf))
+	assert.Equal(t, "middleware: recovery -> auth -> logging -> metrics -> tracing -> cors -> <anonymous>\n"+
+		"GET admin.example.com/users\n"+
+		"/hello (hello)\n"+
+		"POST /api/items (api/items)\n", buf.String())
+
+	tests := []struct {
+		name  string
+		setup func(srv *Server)
+	}{
+		{name: "unknown reference", setup: func(srv *Server) {
+			srv.UseBefore("missing", "auth", record("auth"))
+		}},
+		{name: "unknown replacement", setup: func(srv *Server) {
+			srv.Replace("missing", record("auth"))
+		}},
+		{name: "cycle", setup: func(srv *Server) {
+			srv.UseBefore("b", "a", record("a"))
+			srv.UseBefore("a", "b", record("b"))
+		}},
+		{name: "duplicate", setup: func(srv *Server) {
+			srv.UseNamed("a", record("a"))
+			srv.UseNamed("a", record("a"))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := Init(Options{})
+			require.NoError(t, err, "server init failed")
+
+			tt.setup(srv)
+			assert.Error(t, srv.Route())
+		})
+	}
+}
+
+func TestServer_Handler(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "Hello, embedded World!")
+	})
+
+	handler, err := srv.Handler()
+	require.NoError(t, err)
+
+	parent := http.NewServeMux()
+	parent.Handle("/app/", http.StripPrefix("/app", handler))
+
+	tSrv := httptest.NewServer(parent)
+	defer tSrv.Close()
+
+	resp, err := tSrv.Client().Get(tSrv.URL + "/app/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Hello, embedded World!", string(body))
+}
+
+func TestServer_Maintenance(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{Root: "testData/templates"})
+	require.NoError(t, err)
+
+	var maintenance atomic.Bool
+	srv, err := Init(Options{
+		Templates:  tmpl,
+		Middleware: []Middleware{MaintenanceMiddleware(&maintenance, 90*time.Second)},
+	})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "Hello, World!")
+	})
+	srv.HandleFunc("/healthz", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "ok")
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	maintenance.Store(true)
+
+	resp, err = runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "90", resp.Header.Get("Retry-After"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Back soon!", string(body))
+
+	resp, err = runTestServer(t, srv, "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	maintenance.Store(false)
+
+	resp, err = runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+type upperJSONEncoder struct{ opts *JSONEncodeOptions }
+
+func (e upperJSONEncoder) EncodeJSON(w io.Writer, v any, opts JSONEncodeOptions) error {
+	*e.opts = opts
+	var buf bytes.Buffer
+	if err := (StdJSONEncoder{}).EncodeJSON(&buf, v, opts); err != nil {
+		return err
+	}
+	_, err := w.Write(bytes.ToUpper(buf.Bytes()))
+	return err
+}
+
+func TestServer_JSONEncoder(t *testing.T) {
+	data := JSONResponse{Status: http.StatusOK, Data: map[string]string{"html": "<b>&</b>"}}
+	get := func(t *testing.T, opts Options) string {
+		t.Helper()
+		srv, err := Init(opts)
+		require.NoError(t, err)
+		srv.HandleFunc("/data", func(ctx Context) error { return ctx.JSON(http.StatusOK, data) })
+		srv.HandleFunc("/stream", func(ctx Context) error {
+			return ctx.StreamArray(http.StatusOK, func(write func(v any) error) error {
+				return write(data.Data)
+			})
+		})
+		require.NoError(t, srv.Route())
+
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/data", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		body := rec.Body.String()
+
+		rec = httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+		return body + rec.Body.String()
+	}
+
+	assert.Equal(t, `{"Status":200,"Data":{"html":"\u003cb\u003e\u0026\u003c/b\u003e"},"ErrorType":"","Error":null}`+"\n"+
+		`[{"html":"\u003cb\u003e\u0026\u003c/b\u003e"}]`, get(t, Options{}), "escaped and compact by default")
+
+	assert.Equal(t, `{"Status":200,"Data":{"html":"<b>&</b>"},"ErrorType":"","Error":null}`+"\n"+`[{"html":"<b>&</b>"}]`,
+		get(t, Options{JSONDisableHTMLEscape: true}))
+
+	assert.Equal(t, "{\n  \"Status\": 200,\n  \"Data\": {\n    \"html\": \"<b>&</b>\"\n  },\n"+
+		"  \"ErrorType\": \"\",\n  \"Error\": null\n}\n"+`[{"html":"<b>&</b>"}]`,
+		get(t, Options{Env: ENVDev, JSONDisableHTMLEscape: true}), "indented in dev, stream elements stay compact")
+
+	var used JSONEncodeOptions
+	body := get(t, Options{JSONEncoder: upperJSONEncoder{&used}, JSONIndent: "\t"})
+	assert.True(t, strings.HasPrefix(body, "{\n\t\"STATUS\": 200,"), body)
+	assert.Equal(t, JSONEncodeOptions{EscapeHTML: true}, used, "the last call was a stream element")
+}
+
+func TestServer_StreamArray(t *testing.T) {
+	type record struct {
+		ID   int
+		Name string
+	}
+
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/records", func(ctx Context) error {
+		return ctx.StreamArray(http.StatusOK, func(write func(v any) error) error {
+			for i := 1; i <= 3; i++ {
+				if err := write(record{ID: i, Name: fmt.Sprint("record ", i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	srv.HandleFunc("/empty", func(ctx Context) error {
+		return ctx.StreamArray(http.StatusOK, func(write func(v any) error) error { return nil })
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/records")
+	require.NoError(t, err)
+	assert.Equal(t, ContentTypeJSON, resp.Header.Get(HeaderContentType))
+
+	var records []record
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+	assert.Equal(t, []record{{1, "record 1"}, {2, "record 2"}, {3, "record 3"}}, records)
+
+	resp, err = runTestServer(t, srv, "/empty")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "[]", string(body))
+}
+
+func TestServer_RouteNamesFromRoutes(t *testing.T) {
+	noop := HandlerFunc(func(ctx Context) error { return nil })
+
+	srv, err := Init(Options{
+		Routes: []Route{
+			{Match: "GET /users/{id}", Handler: noop, Name: "user"},
+		},
+	})
+	require.NoError(t, err, "server init failed")
+
+	srv.Group("/catalogs", "catalog", func(srv *Server) {
+		srv.AddRoutes(
+			Route{Match: "GET /items/{itemId}", Handler: noop, Name: "item"},
+			Route{Match: "/", Handler: noop, Name: "list"},
+		)
+
+		srv.Group("/admin", "admin", func(srv *Server) {
+			srv.AddRoutes(Route{Match: "POST /items/{itemId}", Handler: noop, Name: "edit"})
+		})
+	})
+	require.NoError(t, srv.Route())
+
+	assert.Equal(t, "/users/42", srv.RouteName("user", "id", "42"))
+	assert.Equal(t, "/catalogs/items/7", srv.RouteName("catalog/item", "itemId", "7"))
+	assert.Equal(t, "/catalogs", srv.RouteName("catalog/list"))
+	assert.Equal(t, "/catalogs/admin/items/7", srv.RouteName("catalog/admin/edit", "itemId", "7"))
+
+	resp, err := runTestServer(t, srv, "/catalogs/items/7")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_SetSessionManager(t *testing.T) {
+	oldStore, newStore := memstore.New(), memstore.New()
+	oldMgr, newMgr := scs.New(), scs.New()
+	oldMgr.Store, newMgr.Store = oldStore, newStore
+
+	srv, err := Init(Options{SessionMgr: oldMgr, HealthPath: "/healthz"})
+	require.NoError(t, err)
+	srv.SetSessionManager(newMgr)
+
+	srv.HandleFunc("PUT /name", func(ctx Context) error {
+		ctx.Session().Put("name", "ada")
+		return ctx.String(http.StatusOK, "ok")
+	})
+	require.NoError(t, srv.Route())
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/name", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	_, found, err := newStore.Find(cookies[0].Value)
+	require.NoError(t, err)
+	assert.True(t, found, "the session is saved in the new store")
+	_, found, err = oldStore.Find(cookies[0].Value)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the outer endpoints are kept")
+
+	srv.SetSessionManager(oldMgr)
+	assert.Same(t, newMgr, srv.sessionMgr, "ignored once the routes are mounted")
+}
+
+func TestServer_FlashRedirect(t *testing.T) {
+	sessionManager := scs.New()
+	srv, err := Init(Options{SessionMgr: sessionManager})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("POST /items", func(ctx Context) error {
+		return ctx.FlashRedirect("/items", "flash", "Item saved")
+	})
+	srv.HandleFunc("GET /items", func(ctx Context) error {
+		return ctx.String(http.StatusOK, fmt.Sprint(ctx.Session().Mgr().PopString(ctx.Context(), "flash")))
+	})
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := tSrv.Client()
+	client.Jar = jar
+
+	t.Run("redirect", func(t *testing.T) {
+		resp, err := client.Post(tSrv.URL+"/items", "", nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/items", resp.Request.URL.Path)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "Item saved", string(body))
+	})
+
+	t.Run("htmx", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, tSrv.URL+"/items", nil)
+		require.NoError(t, err)
+		req.Header.Set("HX-Request", "true")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/items", resp.Header.Get("HX-Redirect"))
+	})
+
+	t.Run("no session manager", func(t *testing.T) {
+		srv, err := Init(Options{})
+		require.NoError(t, err, "server init failed")
+
+		var flashErr error
+		srv.HandleFunc("POST /items", func(ctx Context) error {
+			flashErr = ctx.FlashRedirect("/items", "flash", "Item saved")
+			return flashErr
+		})
+		require.NoError(t, srv.Route())
+
+		tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+		defer tSrv.Close()
+		resp, err := tSrv.Client().Post(tSrv.URL+"/items", "", nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.ErrorIs(t, flashErr, ErrNoSessionManager)
+	})
+}
+
+func TestContext_RenderFlashes(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"items.tmpl": {Data: []byte(`{{with .Flashes}}<p class="flash">{{.flash}}</p>{{end}}<h1>{{.Title}}</h1>`)},
+	}})
+	require.NoError(t, err)
+
+	srv, err := Init(Options{SessionMgr: scs.New(), Templates: tmpl, RenderFlashes: true})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /items", func(ctx Context) error {
+		return ctx.FlashRedirect("/items", "flash", "Item saved")
+	})
+	srv.HandleFunc("GET /items", func(ctx Context) error {
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "items", Data: map[string]any{"Title": "Items"}})
+	})
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := tSrv.Client()
+	client.Jar = jar
+
+	resp, err := client.Post(tSrv.URL+"/items", "", nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, `<p class="flash">Item saved</p><h1>Items</h1>`, string(body))
+
+	resp, err = client.Get(tSrv.URL + "/items")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, `<h1>Items</h1>`, string(body), "flashes are consumed")
+}
+
+func TestServer_LogLevelEndpoint(t *testing.T) {
+	defer SetLogLevel(LogLevel())
+	SetLogLevel(slog.LevelInfo)
+
+	srv, err := Init(Options{EnableLogLevelEndpoint: true})
+	require.NoError(t, err, "server init failed")
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+
+	put := func(body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, tSrv.URL+LogLevelPath, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := tSrv.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp, err := tSrv.Client().Get(tSrv.URL + LogLevelPath)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "INFO", string(body))
+
+	resp = put("debug")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "DEBUG", string(body))
+	assert.Equal(t, slog.LevelDebug, LogLevel())
+
+	resp = put("loud")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, slog.LevelDebug, LogLevel())
+
+	t.Run("disabled", func(t *testing.T) {
+		resp, err := runServerForTest(t, Options{}, LogLevelPath)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_LoggerAfterInitLog(t *testing.T) {
+	defer func(l *slog.Logger, level slog.Level) {
+		appLog = l
+		SetLogLevel(level)
+	}(appLog, LogLevel())
+
+	srv, err := Init(Options{LogRequests: true, Middleware: []Middleware{RequestIDMiddleware}})
+	require.NoError(t, err)
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		ctx.Log().Info("in handler")
+		return ctx.String(http.StatusOK, "hello")
+	})
+	require.NoError(t, srv.Route())
+
+	out := new(bytes.Buffer)
+	require.NoError(t, InitLogWithOptions(LogOptions{Env: ENVTest, Level: slog.LevelInfo, Output: out}))
+
+	resp, err := runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Contains(t, out.String(), "INFO in handler reqID=")
+	assert.Contains(t, out.String(), "INFO /hello method=GET path=/hello status=200")
+
+	other := new(bytes.Buffer)
+	srv.SetLogger(slog.New(NewCustomLogHandler(other, nil)))
+	out.Reset()
+
+	resp, err = runTestServer(t, srv, "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Empty(t, out.String())
+	assert.Contains(t, other.String(), "INFO in handler reqID=")
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServer_AdminPort(t *testing.T) {
+	_, err := Init(Options{AdminPort: 9999})
+	assert.ErrorIs(t, err, ErrNoAdminHandler)
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("requests_total 1"))
+	})
+
+	port, adminPort := freePort(t), freePort(t)
+	srv, err := Init(Options{Host: "127.0.0.1", Port: port, AdminPort: adminPort, AdminHandler: admin})
+	require.NoError(t, err)
+	srv.HandleFunc("/hello", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "hello")
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Run() }()
+
+	get := func(port int, path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	require.Eventually(t, func() bool {
+		code, _ := get(adminPort, "/metrics")
+		return code == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+
+	code, body := get(adminPort, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "requests_total 1", body)
+
+	code, _ = get(port, "/metrics")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = get(port, "/hello")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", body)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-done, http.ErrServerClosed)
+
+	code, _ = get(adminPort, "/metrics")
+	assert.Zero(t, code, "admin listener still running")
+
+	t.Run("shutdown error", func(t *testing.T) {
+		defer func(timeout time.Duration) { listenerShutdownTimeout = timeout }(listenerShutdownTimeout)
+		listenerShutdownTimeout = 10 * time.Millisecond
+
+		port, adminPort := freePort(t), freePort(t)
+		srv, err := Init(Options{Host: "127.0.0.1", Port: port, AdminPort: adminPort, AdminHandler: admin})
+		require.NoError(t, err)
+		started, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		srv.HandleFunc("/slow", func(ctx Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+
+		done := make(chan error, 1)
+		go func() { done <- srv.Run() }()
+		go func() {
+			// retried until the listener is up, then held by the handler
+			for code, _ := get(port, "/slow"); code == 0; code, _ = get(port, "/slow") {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		<-started
+
+		// the admin listener stops while a request keeps the main one from shutting down
+		require.NoError(t, srv.AdminHTTPServer.Close())
+		err = <-done
+		assert.ErrorIs(t, err, http.ErrServerClosed)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestServer_Pprof(t *testing.T) {
+	resp, err := runServerForTest(t, Options{}, PprofPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = runServerForTest(t, Options{EnablePprof: true}, PprofPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "ignored without an explicit Env")
+
+	resp, err = runServerForTest(t, Options{EnablePprof: true, Env: ENVProduction}, PprofPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = runServerForTest(t, Options{EnablePprof: true, Env: ENVDev}, PprofPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	t.Run("basic auth", func(t *testing.T) {
+		srv, err := Init(Options{EnablePprof: true, Env: ENVDev, PprofAuth: &BasicAuthCredentials{User: "ops", Password: "s3cret"}})
+		require.NoError(t, err)
+		require.NoError(t, srv.Route())
+		tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+		defer tSrv.Close()
+
+		for _, tc := range []struct {
+			user, pass string
+			want       int
+		}{
+			{"", "", http.StatusUnauthorized},
+			{"ops", "wrong", http.StatusUnauthorized},
+			{"ops", "s3cret", http.StatusOK},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, tSrv.URL+PprofPath, nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.pass)
+			}
+			resp, err := tSrv.Client().Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.want, resp.StatusCode, "%s:%s", tc.user, tc.pass)
+		}
+	})
+
+	t.Run("admin listener", func(t *testing.T) {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+		srv, err := Init(Options{EnablePprof: true, Env: ENVDev, AdminPort: 9999, AdminHandler: admin})
+		require.NoError(t, err)
+		require.NoError(t, srv.Route())
+
+		resp, err := runTestServer(t, srv, PprofPath)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		tSrv := httptest.NewServer(srv.AdminHTTPServer.Handler)
+		defer tSrv.Close()
+		for _, path := range []string{PprofPath, "/health"} {
+			resp, err := tSrv.Client().Get(tSrv.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		}
+	})
+}
+
+func TestServer_ErrorLogContext(t *testing.T) {
+	out := new(bytes.Buffer)
+	srv, err := Init(Options{
+		Log:        slog.New(slog.NewJSONHandler(out, nil)),
+		Middleware: []Middleware{RequestIDMiddleware, RecoveryMiddleware},
+	})
+	require.NoError(t, err)
+	srv.Group("/api", "", func(srv *Server) {
+		srv.HandleFunc("GET /items/{id}", func(ctx Context) error {
+			return errors.New("db down")
+		})
+		srv.HandleFunc("/panic", func(ctx Context) error {
+			var m map[string]int
+			m["boom"]++
+			return nil
+		})
+	})
+	srv.Handle("/raw", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("raw handler")
+	}))
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		path    string
+		msg     string
+		pattern string
+	}{
+		{"/api/items/7", "internal server error", "GET /api/items/{id}"},
+		{"/api/panic", "panic recovered", "/api/panic"},
+		{"/raw", "Recovered from panic", "/raw"},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		resp, err := runTestServer(t, srv, tt.path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		assert.Equal(t, tt.msg, entry["msg"])
+		assert.Equal(t, http.MethodGet, entry["method"])
+		assert.Equal(t, tt.path, entry["path"])
+		assert.Equal(t, tt.pattern, entry["pattern"])
+		assert.Equal(t, "127.0.0.1", entry["ip"])
+		assert.Equal(t, resp.Header.Get(RequestIDHeaderKey), entry["reqID"])
+		assert.Contains(t, entry, "duration")
+	}
+}
+
+func TestServer_RequestLogSkip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		logged  []string
+	}{
+		{
+			name:   "defaults",
+			logged: []string{"/hello", "/missing"},
+		},
+		{
+			name:    "log everything",
+			options: Options{RequestLogSkip: []string{}},
+			logged:  []string{"/healthz", "/public/app.css", "/public/nope.css", "/hello", "/missing"},
+		},
+		{
+			name: "statuses",
+			options: Options{
+				RequestLogSkip:         []string{"/healthz"},
+				RequestLogSkipStatuses: map[string][]int{"/public/": {2}, "/missing": {http.StatusNotFound}},
+			},
+			logged: []string{"/public/nope.css", "/hello"},
+		},
+		{
+			name: "skipper",
+			options: Options{RequestLogSkipper: func(r *http.Request, status int) bool {
+				return r.URL.Path == "/hello"
+			}},
+			logged: []string{"/missing"},
+		},
+	}
+
+	paths := []string{"/healthz", "/public/app.css", "/public/nope.css", "/hello", "/missing"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			options := tt.options
+			options.Log = slog.New(slog.NewJSONHandler(out, nil))
+			options.LogRequests = true
+			options.Public = "./testData/public"
+
+			srv, err := Init(options)
+			require.NoError(t, err)
+			srv.HandleFunc("/healthz", func(ctx Context) error { return ctx.String(http.StatusOK, "ok") })
+			srv.HandleFunc("/hello", func(ctx Context) error { return ctx.String(http.StatusOK, "hello") })
+			require.NoError(t, srv.Route())
+
+			for _, p := range paths {
+				resp, err := runTestServer(t, srv, p)
+				require.NoError(t, err)
+				resp.Body.Close()
+			}
+
+			var logged []string
+			dec := json.NewDecoder(out)
+			for dec.More() {
+				var entry map[string]any
+				require.NoError(t, dec.Decode(&entry))
+				logged = append(logged, entry["path"].(string))
+			}
+			assert.Equal(t, tt.logged, logged)
+		})
+	}
+}
+
+func TestServer_SetHeaders(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err, "server init failed")
+
+	srv.HandleFunc("/report", func(ctx Context) error {
+		ctx.Header().Add("Vary", "Accept")
+		return ctx.
+			SetHeader("Cache-Control", "no-store").
+			WithHeaders(map[string]string{"X-Report": "weekly", "X-Rows": "3"}).
+			String(http.StatusOK, "report")
+	})
+	require.NoError(t, srv.Route())
+
+	resp, err := runTestServer(t, srv, "/report")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "weekly", resp.Header.Get("X-Report"))
+	assert.Equal(t, "3", resp.Header.Get("X-Rows"))
+}
+
+func TestServer_RequestLogFields(t *testing.T) {
+	newServer := func(t *testing.T, out *bytes.Buffer, fields []RequestLogField) *httptest.Server {
+		srv, err := Init(Options{
+			Log:              slog.New(slog.NewJSONHandler(out, nil)),
+			LogRequests:      true,
+			RequestLogFields: fields,
+			Middleware:       []Middleware{RealIPMiddleware([]string{"127.0.0.1"}), RequestIDMiddleware},
+		})
+		require.NoError(t, err)
+		srv.HandleFunc("/hello", func(ctx Context) error {
+			return ctx.String(http.StatusOK, "hello world")
+		})
+		require.NoError(t, srv.Route())
+		return httptest.NewServer(srv.HTTPServer.Handler)
+	}
+
+	get := func(t *testing.T, tSrv *httptest.Server) {
+		defer tSrv.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, tSrv.URL+"/hello?x=1", nil)
+		req.Header.Set("User-Agent", "probe/1.0")
+		req.Header.Set("Referer", "https://example.com/")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set(RequestIDHeaderKey, "req-42")
+		resp, err := tSrv.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		out := new(bytes.Buffer)
+		get(t, newServer(t, out, nil))
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		assert.Equal(t, "/hello?x=1", entry["msg"])
+		assert.Equal(t, "/hello", entry["path"])
+		assert.EqualValues(t, http.StatusOK, entry["status"])
+		assert.Equal(t, "req-42", entry["reqID"])
+		assert.Equal(t, "203.0.113.9", entry["ip"])
+		assert.EqualValues(t, len("hello world"), entry["bytes"])
+		assert.Equal(t, "HTTP/1.1", entry["proto"])
+		assert.Equal(t, "probe/1.0", entry["userAgent"])
+		assert.Equal(t, "https://example.com/", entry["referer"])
+	})
+
+	t.Run("selected", func(t *testing.T) {
+		out := new(bytes.Buffer)
+		get(t, newServer(t, out, []RequestLogField{RequestLogBytes}))
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		assert.EqualValues(t, len("hello world"), entry["bytes"])
+		for _, field := range []RequestLogField{RequestLogID, RequestLogIP, RequestLogProto, RequestLogUserAgent, RequestLogReferer} {
+			assert.NotContains(t, entry, string(field))
+		}
+		assert.Contains(t, entry, "duration")
+	})
+}
+
+func TestServer_BindJSON(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+	}
+
+	for _, strict := range []bool{false, true} {
+		srv, err := Init(Options{StrictJSON: strict})
+		require.NoError(t, err)
+		srv.HandleFunc("POST /items", func(ctx Context) error {
+			var it item
+			if err := ctx.BindJSON(&it); err != nil {
+				return err
+			}
+			return ctx.String(http.StatusCreated, it.Name)
+		})
+		srv.HandleFunc("POST /strict", func(ctx Context) error {
+			var it item
+			if err := ctx.BindJSONStrict(&it); err != nil {
+				assert.Equal(t, map[string][]string{"nmae": {"unknown field"}}, ctx.Errors())
+				return err
+			}
+			return ctx.String(http.StatusCreated, it.Name)
+		})
+		require.NoError(t, srv.Route())
+
+		tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+		post := func(path string) (int, string) {
+			resp, err := tSrv.Client().Post(tSrv.URL+path, "application/json", strings.NewReader(`{"name":"a","nmae":"b"}`))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, strings.TrimSpace(string(body))
+		}
+
+		code, body := post("/items")
+		if strict {
+			assert.Equal(t, http.StatusBadRequest, code)
+			assert.Equal(t, `unknown field "nmae"`, body)
+		} else {
+			assert.Equal(t, http.StatusCreated, code)
+			assert.Equal(t, "a", body)
+		}
+
+		code, body = post("/strict")
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `unknown field "nmae"`, body)
+		tSrv.Close()
+	}
+}
+
+func TestServer_DuplicateRouteName(t *testing.T) {
+	noop := func(ctx Context) error { return nil }
+
+	t.Run("routes", func(t *testing.T) {
+		srv, err := Init(Options{})
+		require.NoError(t, err)
+		srv.HandleFunc("/users", noop, WithName("users"))
+		srv.HandleFunc("/accounts", noop, WithName("Users"))
+
+		err = srv.Route()
+		assert.ErrorIs(t, err, ErrDuplicateRouteName)
+		assert.ErrorContains(t, err, `"users" is used by "/users" and "/accounts"`)
+	})
+
+	t.Run("same path", func(t *testing.T) {
+		srv, err := Init(Options{})
+		require.NoError(t, err)
+		srv.HandleFunc("GET /login", noop, WithName("login"))
+		srv.HandleFunc("POST /login", noop, WithName("login"))
+
+		require.NoError(t, srv.Route())
+		assert.Equal(t, "/login", srv.RouteName("login"))
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		srv, err := Init(Options{})
+		require.NoError(t, err)
+		srv.Group("/admin", "admin", func(srv *Server) {
+			srv.HandleFunc("/users", noop, WithName("users"))
+		})
+
+		assert.PanicsWithValue(t, `group("/staff"): duplicate route name: "admin/users" is used by "/admin/users" and "/staff/users"`, func() {
+			srv.Group("/staff", "admin", func(srv *Server) {
+				srv.HandleFunc("/users", noop, WithName("users"))
+			})
+		})
+	})
+}
+
+func TestServer_SlowRequests(t *testing.T) {
+	out := new(bytes.Buffer)
+	var mu sync.Mutex
+	var slow []AccessLogEntry
+
+	srv, err := Init(Options{
+		Log:                  slog.New(slog.NewJSONHandler(out, nil)),
+		LogRequests:          true,
+		RequestLogSkip:       []string{"/events"},
+		SlowRequestThreshold: 20 * time.Millisecond,
+		OnSlowRequest: func(e AccessLogEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			slow = append(slow, e)
+		},
+	})
+	require.NoError(t, err)
+
+	sleepy := func(ctx Context) error {
+		time.Sleep(40 * time.Millisecond)
+		return ctx.String(http.StatusOK, "done")
+	}
+	srv.HandleFunc("/fast", func(ctx Context) error { return ctx.String(http.StatusOK, "done") })
+	srv.HandleFunc("GET /reports/{id}", sleepy)
+	srv.HandleFunc("/events", sleepy)
+	require.NoError(t, srv.Route())
+
+	for _, p := range []string{"/fast", "/reports/7", "/events"} {
+		resp, err := runTestServer(t, srv, p)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	var levels []string
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var entry map[string]any
+		require.NoError(t, dec.Decode(&entry))
+		levels = append(levels, fmt.Sprint(entry["path"], " ", entry["level"], " ", entry["slow"]))
+	}
+	assert.Equal(t, []string{"/fast INFO <nil>", "/reports/7 WARN true"}, levels)
+
+	require.Len(t, slow, 1)
+	assert.Equal(t, http.MethodGet, slow[0].Method)
+	assert.Equal(t, "/reports/7", slow[0].Path)
+	assert.Equal(t, "GET /reports/{id}", slow[0].Pattern)
+	assert.True(t, slow[0].Slow)
+	assert.Greater(t, slow[0].Duration, 20*time.Millisecond)
+}
+
+func TestServer_CacheControlRoute(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	srv.HandleFunc("/logo", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "logo")
+	}, WithMiddleware(CacheControlMiddleware("public, max-age=3600")))
+	srv.HandleFunc("/account", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "account")
+	}, WithMiddleware(NoCacheMiddleware))
+	srv.HandleFunc("/plain", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "plain")
+	})
+	require.NoError(t, srv.Route())
+
+	for path, want := range map[string]string{"/logo": "public, max-age=3600", "/account": "no-store", "/plain": ""} {
+		resp, err := runTestServer(t, srv, path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, want, resp.Header.Get("Cache-Control"), path)
+	}
+}
+
+func TestServer_RequestLoggingOverride(t *testing.T) {
+	ok := func(ctx Context) error { return ctx.String(http.StatusOK, "ok") }
+
+	for _, logRequests := range []bool{false, true} {
+		out := new(bytes.Buffer)
+		srv, err := Init(Options{Log: slog.New(slog.NewJSONHandler(out, nil)), LogRequests: logRequests})
+		require.NoError(t, err)
+
+		srv.HandleFunc("/default", ok)
+		srv.HandleFunc("/loud", ok, WithRequestLogging(true))
+		srv.HandleFunc("/quiet", ok, WithRequestLogging(false))
+		srv.Group("/hooks", "", func(srv *Server) {
+			srv.HandleFunc("/push", ok)
+			srv.HandleFunc("/audit", ok, WithRequestLogging(true))
+		}, WithRequestLogging(false))
+		require.NoError(t, srv.Route())
+
+		for _, p := range []string{"/default", "/loud", "/quiet", "/hooks/push", "/hooks/audit"} {
+			resp, err := runTestServer(t, srv, p)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+
+		var logged []string
+		dec := json.NewDecoder(out)
+		for dec.More() {
+			var entry map[string]any
+			require.NoError(t, dec.Decode(&entry))
+			logged = append(logged, entry["path"].(string))
+		}
+
+		want := []string{"/loud", "/hooks/audit"}
+		if logRequests {
+			want = []string{"/default", "/loud", "/hooks/audit"}
+		}
+		assert.Equal(t, want, logged, "LogRequests: %v", logRequests)
+	}
+}
+
+func TestContext_Pattern(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+
+	var routeMW string
+	recordMatched := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, pattern := MatchedRoute(r)
+			routeMW = method + "|" + pattern
+			next.ServeHTTP(w, r)
+		})
+	}
+	pattern := func(ctx Context) error {
+		return ctx.String(http.StatusOK, ctx.Pattern())
+	}
+
+	srv.HandleFunc("GET /users/{id}", pattern, WithMiddleware(recordMatched))
+	srv.HandleFunc("/{path...}", pattern)
+	srv.Group("/api", "api", func(srv *Server) {
+		srv.HandleFunc("POST /items", pattern)
+		srv.HandleFunc("/files/", pattern, WithMiddleware(recordMatched))
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		method, path string
+		pattern      string
+		routeMW      string
+	}{
+		{http.MethodGet, "/users/42", "GET /users/{id}", "GET|/users/{id}"},
+		{http.MethodGet, "/anything/else", "/{path...}", ""},
+		{http.MethodPost, "/api/items", "POST /api/items", ""},
+		{http.MethodGet, "/api/files/a/b.txt", "/api/files/", "|/api/files/"},
+	}
+	for _, tt := range tests {
+		routeMW = ""
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		assert.Equal(t, tt.pattern, rec.Body.String(), tt.path)
+		assert.Equal(t, tt.routeMW, routeMW, tt.path)
+	}
+}
+
+func TestServer_HostGroup(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+
+	srv.HostGroup("admin.example.com", "admin", func(srv *Server) {
+		srv.HandleFunc("GET /dashboard", func(ctx Context) error {
+			return ctx.String(http.StatusOK, "admin "+ctx.Host()+" "+ctx.Subdomain())
+		})
+	})
+	srv.HostGroup("{tenant}.example.com", "tenant", func(srv *Server) {
+		srv.HandleFunc("GET /dashboard", func(ctx Context) error {
+			return ctx.String(http.StatusOK, fmt.Sprintf("tenant %s %s %s", ctx.UrlParam("tenant"), ctx.Subdomain(), ctx.Pattern()))
+		}, WithName("dashboard"))
+	})
+	srv.HandleFunc("/", func(ctx Context) error {
+		return ctx.String(http.StatusOK, "root "+ctx.Host())
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"acme.example.com:8080", "/dashboard", "tenant acme acme GET {tenant}.example.com/dashboard"},
+		{"Globex.Example.com.", "/dashboard", "tenant globex globex GET {tenant}.example.com/dashboard"},
+		{"admin.example.com", "/dashboard", "admin admin.example.com "},
+		{"example.com", "/dashboard", "root example.com"},
+		{"a.b.example.com", "/dashboard", "root a.b.example.com"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, tt.want, rec.Body.String(), tt.host)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/settings", nil)
+	req.Host = "acme.example.com"
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "host groups don't fall back to the other routes")
+
+	assert.Equal(t, "/dashboard", srv.RouteName("tenant/dashboard"))
+}
+
+func TestServer_LogRoutes(t *testing.T) {
+	logs := new(bytes.Buffer)
+	port := freePort(t)
+	srv, err := Init(Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Log:       slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		LogRoutes: true,
+	})
+	require.NoError(t, err)
+
+	noop := func(ctx Context) error { return nil }
+	srv.HandleFunc("GET /users/{id}", noop, WithName("user"), WithMiddleware(RecoveryMiddleware))
+	srv.Group("/api", "api", func(srv *Server) {
+		srv.Use(RequestIDMiddleware)
+		srv.HandleFunc("POST /items", noop, WithName("items"))
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Run() }()
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/users/1", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, srv.Shutdown(context.Background()))
+	<-done
+
+	var routes []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry["msg"] == "route" {
+			assert.Equal(t, "DEBUG", entry["level"])
+			delete(entry, "time")
+			delete(entry, "level")
+			delete(entry, "msg")
+			routes = append(routes, entry)
+		}
+	}
+	assert.Equal(t, []map[string]any{
+		{"method": "GET", "pattern": "/users/{id}", "name": "user", "middleware": 1.0},
+		{"method": "POST", "pattern": "/api/items", "name": "api/items", "middleware": 1.0},
+	}, routes)
+}
+
+func TestHandlerFunc_ContextErrors(t *testing.T) {
+	var records []slog.Record
+	srv, err := Init(Options{Log: slog.New(recordHandler{level: slog.LevelDebug, records: &records})})
+	require.NoError(t, err)
+
+	wait := func(ctx Context) error {
+		<-ctx.Context().Done()
+		return fmt.Errorf("loading report: %w", ctx.Context().Err())
+	}
+	srv.HandleFunc("/slow", wait, WithTimeout(10*time.Millisecond))
+	srv.HandleFunc("/wait", wait)
+	srv.HandleFunc("/upstream", func(ctx Context) error {
+		call, cancel := context.WithTimeout(ctx.Context(), time.Millisecond)
+		defer cancel()
+		<-call.Done()
+		return fmt.Errorf("calling upstream: %w", call.Err())
+	}, WithTimeout(time.Minute))
+	require.NoError(t, srv.Route())
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wait", nil).WithContext(reqCtx))
+	assert.Equal(t, StatusClientClosedRequest, rec.Code)
+
+	require.Len(t, records, 2)
+	for _, r := range records {
+		assert.Equal(t, slog.LevelDebug, r.Level, r.Message)
+		assert.Equal(t, "request cancelled", r.Message)
+	}
+
+	records = nil
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upstream", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "the request itself didn't end")
+	require.Len(t, records, 1)
+	assert.Equal(t, slog.LevelError, records[0].Level)
+}
+
+func TestServer_MountPprof(t *testing.T) {
+	tagged := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Server-Middleware", "1")
+			next.ServeHTTP(w, r)
+		})
+	}
+	guard := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Ops-Token") != "let-me-in" {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv, err := Init(Options{Middleware: []Middleware{tagged}})
+	require.NoError(t, err)
+	srv.MountPprof("/ops/pprof", guard)
+	require.NoError(t, srv.Route())
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("X-Ops-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, path := range []string{"/ops/pprof/", "/ops/pprof/heap?debug=1", "/ops/pprof/goroutine?debug=1", "/ops/pprof/cmdline"} {
+		rec := get(path, "let-me-in")
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Empty(t, rec.Header().Get("X-Server-Middleware"), "server middleware is bypassed")
+	}
+	assert.Contains(t, get("/ops/pprof/heap?debug=1", "let-me-in").Body.String(), "heap profile")
+	assert.Equal(t, http.StatusForbidden, get("/ops/pprof/heap", "").Code)
+
+	skip := srv.PprofSkipper()
+	assert.True(t, skip(httptest.NewRequest(http.MethodGet, "/ops/pprof/profile", nil)))
+	assert.False(t, skip(httptest.NewRequest(http.MethodGet, "/ops", nil)))
+
+	t.Run("EnablePprof in production", func(t *testing.T) {
+		resp, err := runServerForTest(t, Options{EnablePprof: true, Env: ENVProduction}, PprofPath)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_HealthPath(t *testing.T) {
+	logs := new(bytes.Buffer)
+	srv, err := Init(Options{
+		Log:         slog.New(slog.NewJSONHandler(logs, nil)),
+		LogRequests: true,
+		SessionMgr:  scs.New(),
+		HealthPath:  "/health",
+		BuildInfo:   &BuildInfo{Version: "v1.4.2", Commit: "abc123"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewServer(srv.HTTPServer.Handler)
+	defer tSrv.Close()
+
+	resp, err := tSrv.Client().Get(tSrv.URL + "/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentTypeJSON, resp.Header.Get(HeaderContentType))
+	assert.Empty(t, resp.Header.Get("Set-Cookie"), "no session")
+
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, map[string]any{"status": "ok", "uptime": 0.0, "version": "v1.4.2", "commit": "abc123"}, body)
+
+	resp, err = tSrv.Client().Head(tSrv.URL + "/health")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = tSrv.Client().Post(tSrv.URL+"/health", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	assert.Empty(t, logs.String(), "health checks aren't logged")
+
+	resp, err = runServerForTest(t, Options{}, "/health")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "off by default")
+}
+
+func TestServer_ReadyPath(t *testing.T) {
+	ready := func(t *testing.T, srv *Server) (int, readyResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body readyResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		return rec.Code, body
+	}
+
+	t.Run("checks", func(t *testing.T) {
+		srv, err := Init(Options{ReadyPath: "/ready", ReadyCheckTimeout: 20 * time.Millisecond, ReadyCacheTTL: -1})
+		require.NoError(t, err)
+		require.NoError(t, srv.Route())
+
+		code, body := ready(t, srv)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ok", body.Status)
+		assert.Empty(t, body.Checks)
+
+		srv.AddReadinessCheck("cache", func(ctx context.Context) error { return nil })
+		srv.AddReadinessCheck("db", func(ctx context.Context) error {
+			return errors.New("dial tcp 10.0.0.5:5432: connection refused")
+		})
+		srv.AddReadinessCheck("queue", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		code, body = ready(t, srv)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "unavailable", body.Status)
+		require.Len(t, body.Checks, 3)
+		assert.Equal(t, "cache", body.Checks[0].Name)
+		assert.Equal(t, "ok", body.Checks[0].Status)
+		assert.Empty(t, body.Checks[0].Error)
+		assert.Equal(t, "db", body.Checks[1].Name)
+		assert.Equal(t, "failed", body.Checks[1].Status)
+		assert.Equal(t, "check failed", body.Checks[1].Error, "redacted outside dev")
+		assert.Equal(t, "queue", body.Checks[2].Name)
+		assert.Equal(t, "failed", body.Checks[2].Status)
+		assert.GreaterOrEqual(t, body.Checks[2].Latency, 20.0)
+
+		srv.AddReadinessCheck("db", func(ctx context.Context) error { return nil })
+		srv.AddReadinessCheck("queue", func(ctx context.Context) error { return nil })
+		code, body = ready(t, srv)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Len(t, body.Checks, 3)
+	})
+
+	t.Run("dev errors and cache", func(t *testing.T) {
+		srv, err := Init(Options{ReadyPath: "/ready", Env: ENVDev, ReadyCacheTTL: time.Hour})
+		require.NoError(t, err)
+		require.NoError(t, srv.Route())
+
+		var calls atomic.Int32
+		srv.AddReadinessCheck("db", func(ctx context.Context) error {
+			calls.Add(1)
+			return errors.New("connection refused")
+		})
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code, body := ready(t, srv)
+				assert.Equal(t, http.StatusServiceUnavailable, code)
+				assert.Equal(t, "connection refused", body.Checks[0].Error)
+			}()
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, calls.Load(), "probes share the cached result")
+
+		srv.AddReadinessCheck("db", func(ctx context.Context) error { return nil })
+		code, _ := ready(t, srv)
+		assert.Equal(t, http.StatusOK, code, "adding a check invalidates the cache")
+	})
+}
+
+func TestServer_OverlappingRoutes(t *testing.T) {
+	var records []slog.Record
+	srv, err := Init(Options{Log: slog.New(recordHandler{level: slog.LevelWarn, records: &records})})
+	require.NoError(t, err)
+
+	ok := func(ctx Context) error { return ctx.String(http.StatusOK, ctx.Pattern()) }
+	srv.HandleFunc("/users/{id}", ok)
+	srv.HandleFunc("GET /users/new", ok)
+	srv.HandleFunc("POST /users/{id}", ok)
+	srv.HandleFunc("/users/{id}/edit", ok)
+	srv.HandleFunc("/files/{path...}", ok)
+	srv.HandleFunc("/files/readme", ok)
+	srv.Group("/api", "api", func(srv *Server) {
+		srv.HandleFunc("GET /items/export", ok)
+		srv.HandleFunc("GET /items/{id}", ok)
+		srv.HandleFunc("DELETE /items/{id}", ok)
+	})
+	require.NoError(t, srv.Route())
+
+	var overlaps [][2]string
+	for _, r := range records {
+		attrs := map[string]string{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		overlaps = append(overlaps, [2]string{attrs["wins"], attrs["over"]})
+	}
+	assert.Equal(t, [][2]string{
+		{"GET /api/items/export", "GET /api/items/{id}"},
+		{"GET /users/new", "/users/{id}"},
+	}, overlaps)
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/new", nil))
+	assert.Equal(t, "GET /users/new", rec.Body.String(), "the more specific pattern wins")
+}
+
+func TestServer_VersionPath(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+		"footer.tmpl": {Data: []byte(`<script src="/public/app.js?v={{buildVersion}}"></script>`)},
+	}})
+	require.NoError(t, err)
+
+	logs := new(bytes.Buffer)
+	build := &BuildInfo{Version: "v1.4.2", Commit: "abc123", BuildTime: "2026-10-01T12:00:00Z"}
+	srv, err := Init(Options{
+		Log:         slog.New(slog.NewJSONHandler(logs, nil)),
+		Templates:   tmpl,
+		VersionPath: "/version",
+		BuildInfo:   build,
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/footer", func(ctx Context) error {
+		ctx.Log().Info("rendering footer")
+		return ctx.Render(http.StatusOK, RenderOpt{Template: "footer"})
+	})
+	require.NoError(t, srv.Route())
+	logs.Reset() // the missing error templates are reported by Route
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, "v1.4.2", body["version"])
+	assert.Equal(t, "abc123", body["commit"])
+	assert.Equal(t, "2026-10-01T12:00:00Z", body["build_time"])
+	assert.Equal(t, runtime.Version(), body["go_version"])
+	started, err := time.Parse(time.RFC3339Nano, body["started"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), started, time.Minute)
+
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/footer", nil))
+	assert.Equal(t, `<script src="/public/app.js?v=v1.4.2"></script>`, rec.Body.String())
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "rendering footer", entry["msg"])
+	assert.Equal(t, "v1.4.2", entry["version"], "log lines carry the build version")
+
+	logs.Reset()
+	srv.SetLogger(slog.New(slog.NewJSONHandler(logs, nil)))
+	srv.HTTPServer.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/footer", nil))
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "v1.4.2", entry["version"])
+
+	for _, withRenderer := range []bool{false, true} {
+		tmpl, err := InitTemplates(TemplateOptions{FS: fstest.MapFS{
+			"footer.tmpl": {Data: []byte(`<script src="/public/app.js?v={{buildVersion}}"></script>`)},
+		}})
+		require.NoError(t, err)
+		opts := Options{Templates: tmpl}
+		if withRenderer {
+			opts.Renderer = TemplatesRenderer(tmpl)
+		}
+		srv, err := Init(opts)
+		require.NoError(t, err)
+		srv.HandleFunc("/footer", func(ctx Context) error {
+			return ctx.Render(http.StatusOK, RenderOpt{Template: "footer"})
+		})
+		require.NoError(t, srv.Route())
+
+		rec = httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/footer", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "buildVersion is defined without a version")
+		assert.Equal(t, `<script src="/public/app.js?v=`+srv.build.Version+`"></script>`, rec.Body.String())
+	}
+}
+
+func TestContext_HTMX(t *testing.T) {
+	srv, err := Init(Options{})
+	require.NoError(t, err)
+	srv.HandleFunc("/items", func(ctx Context) error {
+		return ctx.String(http.StatusOK, fmt.Sprintf("%t|%s|%s|%s", ctx.IsHTMX(), ctx.HXTarget(), ctx.HXTrigger(), ctx.HXCurrentURL()))
+	})
+	require.NoError(t, srv.Route())
+
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, "false|||", rec.Body.String())
+
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("HX-Target", "item-list")
+	req.Header.Set("HX-Trigger", "load-more")
+	req.Header.Set("HX-Current-URL", "https://example.com/items?page=2")
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, "true|item-list|load-more|https://example.com/items?page=2", rec.Body.String())
+}
+
+func TestContext_RenderHX(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{DefaultLayout: "layout", FS: fstest.MapFS{
+		"layout.tmpl": {Data: []byte(`<html>{{template "content" .}}</html>`)},
+		"form.tmpl":   {Data: []byte(`<form id="signup">{{.}}</form>`)},
+	}})
+	require.NoError(t, err)
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /signup", func(ctx Context) error {
+		return ctx.RenderHX(http.StatusUnprocessableEntity, RenderOpt{Template: "form", Data: "email is required"}, "#signup", "outerHTML")
+	})
+	require.NoError(t, srv.Route())
+
+	req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+	req.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, `<form id="signup">email is required</form>`, rec.Body.String())
+	assert.Equal(t, "#signup", rec.Header().Get("HX-Retarget"))
+	assert.Equal(t, "outerHTML", rec.Header().Get("HX-Reswap"))
+
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/signup", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, `<html><form id="signup">email is required</form></html>`, rec.Body.String())
+	assert.Empty(t, rec.Header().Get("HX-Retarget"))
+	assert.Empty(t, rec.Header().Get("HX-Reswap"))
+}
+
+func TestContext_SuperfluousWriteHeader(t *testing.T) {
+	var logs bytes.Buffer
+	srv, err := Init(Options{
+		Log:        slog.New(slog.NewJSONHandler(&logs, nil)),
+		Middleware: []Middleware{RequestIDMiddleware},
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/twice", func(ctx Context) error {
+		if err := ctx.String(http.StatusCreated, "created"); err != nil {
+			return err
+		}
+		ctx.Response().WriteHeader(http.StatusInternalServerError)
+		return nil
+	})
+	require.NoError(t, srv.Route())
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/twice", nil))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "created", rec.Body.String())
+
+	var warning map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["msg"] == "superfluous WriteHeader ignored" {
+			warning = entry
+		}
+	}
+	require.NotNil(t, warning, logs.String())
+	assert.Equal(t, "WARN", warning["level"])
+	assert.Equal(t, rec.Header().Get(RequestIDHeaderKey), warning["reqID"])
+	assert.EqualValues(t, http.StatusCreated, warning["status"])
+	assert.EqualValues(t, http.StatusInternalServerError, warning["ignored"])
+}
+
+func TestContext_Hijack(t *testing.T) {
+	var logs bytes.Buffer
+	srv, err := Init(Options{Log: slog.New(slog.NewJSONHandler(&logs, nil))})
+	require.NoError(t, err)
+	done := make(chan struct{})
+	srv.HandleFunc("/upgrade", func(ctx Context) error {
+		defer close(done)
+		hj, ok := ctx.Response().(http.Hijacker)
+		if !ok {
+			return errors.New("not a hijacker")
+		}
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		ctx.Response().WriteHeader(http.StatusInternalServerError)
+		return nil
+	})
+	require.NoError(t, srv.Route())
+	ts := httptest.NewServer(srv.HTTPServer.Handler)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/upgrade", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	<-done
+	assert.Contains(t, logs.String(), "superfluous WriteHeader ignored", "a hijacked response counts as written")
+	assert.Contains(t, logs.String(), `"status":101`)
+}
+
+func TestContext_Detach(t *testing.T) {
+	var logs bytes.Buffer
+	srv, err := Init(Options{
+		Log:        slog.New(slog.NewJSONHandler(&logs, nil)),
+		Middleware: []Middleware{RequestIDMiddleware},
+	})
+	require.NoError(t, err)
+
+	otherKey := NewKey[string]("other")
+	var reqCtx, detached context.Context
+	srv.HandleFunc("/detach", func(ctx Context) error {
+		ctx.ContextSet(testAgeKey, 42)
+		ctx.ContextSet(otherKey, "left out")
+		reqCtx, detached = ctx.Context(), ctx.Detach(testAgeKey)
+		return ctx.String(http.StatusAccepted, "queued")
+	})
+	require.NoError(t, srv.Route())
+
+	base, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/detach", nil).WithContext(base))
+	cancel()
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	require.Error(t, reqCtx.Err())
+	assert.NoError(t, detached.Err())
+	assert.Nil(t, detached.Done())
+
+	reqID := rec.Header().Get(RequestIDHeaderKey)
+	require.NotEmpty(t, reqID)
+	assert.Equal(t, reqID, RequestIDFromContext(detached))
+
+	age, ok := FromContext(detached, testAgeKey)
+	assert.True(t, ok)
+	assert.Equal(t, 42, age)
+	_, ok = FromContext(detached, otherKey)
+	assert.False(t, ok, "only the keys asked for are kept")
+	_, ok = FromContext(detached, requestInfoKey)
+	assert.False(t, ok)
+
+	LoggerFromContext(detached).Info("background work done")
+	var entry map[string]any
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry))
+	assert.Equal(t, "background work done", entry["msg"])
+	assert.Equal(t, reqID, entry["reqID"])
+
+	assert.Empty(t, RequestIDFromContext(context.Background()))
+	assert.NotNil(t, LoggerFromContext(context.Background()))
+}
+
+func TestContext_RenderAuto(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{DefaultLayout: "layout", FS: fstest.MapFS{
+		"layout.tmpl": {Data: []byte(`<html>{{template "content" .}}</html>`)},
+		"rows.tmpl":   {Data: []byte(`<tr>{{.}}</tr>`)},
+		"users.tmpl":  {Data: []byte(`<table><tr>{{.}}</tr></table>`)},
+	}})
+	require.NoError(t, err)
+	srv, err := Init(Options{Templates: tmpl})
+	require.NoError(t, err)
+	srv.HandleFunc("GET /users", func(ctx Context) error {
+		return ctx.RenderAuto(http.StatusOK, RenderOpt{Template: "rows", Data: "ann"}, RenderOpt{Template: "users", Data: "ann"})
+	})
+	require.NoError(t, srv.Route())
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"plain", nil, `<html><table><tr>ann</tr></table></html>`},
+		{"htmx", http.Header{"Hx-Request": {"true"}}, `<tr>ann</tr>`},
+		{"boosted", http.Header{"Hx-Request": {"true"}, "Hx-Boosted": {"true"}}, `<html><table><tr>ann</tr></table></html>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			srv.HTTPServer.Handler.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.want, rec.Body.String())
+			assert.Equal(t, "HX-Request", rec.Header().Get("Vary"))
+		})
+	}
+}
+
+func TestContext_RenderOOB(t *testing.T) {
+	tmpl, err := InitTemplates(TemplateOptions{DefaultLayout: "layout", FS: fstest.MapFS{
+		"layout.tmpl": {Data: []byte(`<html>{{template "content" .}}</html>`)},
+		"row.tmpl":    {Data: []byte(`<tr id="item-{{.}}"><td>{{.}}</td></tr>`)},
+		"flash.tmpl":  {Data: []byte(`<p>{{.}} added</p>`)},
+		"badge.tmpl":  {Data: []byte(`{{.}}`)},
+	}})
+	require.NoError(t, err)
+	providerCalls := 0
+	srv, err := Init(Options{Templates: tmpl, ViewDataProviders: []ViewDataProvider{func(Context) map[string]any {
+		providerCalls++
+		return map[string]any{"User": "ann"}
+	}}})
+	require.NoError(t, err)
+	srv.HandleFunc("POST /cart", func(ctx Context) error {
+		return ctx.RenderOOB(http.StatusOK, RenderOpt{Template: "row", Data: "book"},
+			OOBFragment{Template: "flash", Target: "flash", Data: "book"},
+			OOBFragment{Template: "badge", Target: "#cart-count", Data: 3, Swap: "outerHTML", Tag: "span"},
+		)
+	})
+	require.NoError(t, srv.Route())
+
+	req := httptest.NewRequest(http.MethodPost, "/cart", nil)
+	req.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeHTML, rec.Header().Get(HeaderContentType))
+	assert.Equal(t, `<tr id="item-book"><td>book</td></tr>`+
+		`<div hx-swap-oob="innerHTML:#flash"><p>book added</p></div>`+
+		`<span id="cart-count" hx-swap-oob="outerHTML">3</span>`, rec.Body.String())
+	assert.Equal(t, 1, providerCalls, "the fragments share the view data")
+	var renders []string
+	for _, st := range srv.Stats().Templates {
+		renders = append(renders, fmt.Sprintf("%s %q %d", st.Template, st.Layout, st.Renders))
+	}
+	assert.Equal(t, []string{`badge "" 1`, `flash "" 1`, `row "" 1`}, renders)
+
+	rec = httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cart", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `<html><tr id="item-book"><td>book</td></tr></html>`, rec.Body.String())
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// DefaultSingleflightVary are the request headers that keep requests apart by default, so
+// responses are never shared between clients with different credentials or content negotiation.
+var DefaultSingleflightVary = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// SingleflightConfig configures SingleflightMiddlewareWithConfig.
+type SingleflightConfig struct {
+	// Vary lists the request headers that are part of the request key, in addition to the
+	// method and URL. Defaults to DefaultSingleflightVary.
+	Vary []string
+	// Skipper bypasses the middleware for matching requests.
+	Skipper Skipper
+}
+
+// SingleflightMiddleware coalesces concurrent identical GET and HEAD requests: one of them
+// runs the handler and the others get a copy of its response.
+func SingleflightMiddleware(next http.Handler) http.Handler {
+	return SingleflightMiddlewareWithConfig(SingleflightConfig{})(next)
+}
+
+// SingleflightMiddlewareWithConfig returns a SingleflightMiddleware using the given config.
+// Responses are buffered before being sent, so coalesced handlers can't stream. The handler
+// runs once, with the first request on a context that isn't canceled with it, so the client
+// going away doesn't fail the others; each request waits for the response until its own
+// context ends. The handler keeps the deadline of the first request, and its context is
+// canceled once every request stopped waiting. If the handler panics, the panic is logged and
+// the requests get a 500.
+func SingleflightMiddlewareWithConfig(cfg SingleflightConfig) Middleware {
+	if cfg.Vary == nil {
+		cfg.Vary = DefaultSingleflightVary
+	}
+
+	return func(next http.Handler) http.Handler {
+		g := &flightGroup{calls: make(map[string]*flightCall)}
+		return Skip(g.middleware(cfg.Vary), cfg.Skipper)(next)
+	}
+}
+
+// flightGroup tracks the requests in flight for one handler. It is a minimal stand-in for
+// the DoChan of golang.org/x/sync/singleflight specialized for buffered responses.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	// done is closed once the handler returned
+	done chan struct{}
+	// res is nil when the handler panicked
+	res *bufferedResponse
+	// dups counts the requests that joined the call
+	dups int
+	// waiting counts the requests still waiting for the response
+	waiting int
+	// cancel cancels the context of the shared request
+	cancel context.CancelFunc
+}
+
+func (g *flightGroup) middleware(vary []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := flightKey(r, vary)
+			g.mu.Lock()
+			c, ok := g.calls[key]
+			if ok {
+				c.dups++
+			} else {
+				c = &flightCall{done: make(chan struct{})}
+				g.calls[key] = c
+				var shared *http.Request
+				shared, c.cancel = detachedRequest(r)
+				go g.run(c, key, next, shared)
+			}
+			c.waiting++
+			g.mu.Unlock()
+
+			select {
+			case <-c.done:
+			case <-r.Context().Done():
+				g.leave(c, key)
+				httpErr, _ := contextHTTPError(r.Context(), r.Context().Err())
+				http.Error(w, httpErr.Message, httpErr.Code)
+				return
+			}
+			if c.res == nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			c.res.replay(w)
+		})
+	}
+}
+
+// run serves r, the request shared by the call, into a buffered response.
+func (g *flightGroup) run(c *flightCall, key string, next http.Handler, r *http.Request) {
+	defer func() {
+		// the panic can't reach the recovery of a request from this goroutine
+		if v := recover(); v != nil && v != http.ErrAbortHandler {
+			requestLogger(r).Error("coalesced handler panicked", "panic", v, "stack", string(debug.Stack()))
+		}
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+
+	res := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(res, r)
+	c.res = res
+}
+
+// leave stops counting a request that gave up waiting for c. When it was the last one, the
+// shared request is canceled and later requests start a new call rather than getting its
+// response.
+func (g *flightGroup) leave(c *flightCall, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.waiting--
+	if c.waiting > 0 {
+		return
+	}
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	c.cancel()
+}
+
+// detachedRequest returns a copy of r whose context isn't canceled with r but keeps its
+// deadline, with its own copy of the request info, which the handler may update after r was
+// answered. The returned function cancels the copy.
+func detachedRequest(r *http.Request) (*http.Request, context.CancelFunc) {
+	base := context.WithoutCancel(r.Context())
+	ctx, cancel := context.WithCancel(base)
+	if deadline, ok := r.Context().Deadline(); ok {
+		cancel()
+		ctx, cancel = context.WithDeadline(base, deadline)
+	}
+	if info, ok := FromContext(ctx, requestInfoKey); ok {
+		copied := *info
+		ctx = ContextWithValue(ctx, requestInfoKey, &copied)
+	}
+	return r.WithContext(ctx), cancel
+}
+
+// flightKey identifies requests that can share a response.
+func flightKey(r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(" ")
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, h := range vary {
+		b.WriteString("\n")
+		b.WriteString(h)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(r.Header.Values(h), ", "))
+	}
+	return b.String()
+}
+
+// bufferedResponse records a response so it can be sent to several clients.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	b.status = statusCode
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// replay writes the recorded response to w. It only reads b, so it is safe to call
+// concurrently once the handler has returned.
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsWindow is the number of most recent requests the latency percentiles are computed over.
+const statsWindow = 1024
+
+// ServerStats is a snapshot of the counters returned by Server.Stats.
+type ServerStats struct {
+	// Requests is the number of requests served, including those rejected by
+	// MaxConcurrentRequests.
+	Requests uint64 `json:"requests"`
+	// StatusClasses counts the responses by status class: "1xx" to "5xx".
+	StatusClasses map[string]uint64 `json:"status_classes"`
+	InFlight      int64             `json:"in_flight"`
+	// Latency holds the percentiles of the last requests served.
+	Latency      LatencyStats `json:"latency"`
+	BytesWritten uint64       `json:"bytes_written"`
+	// Streams is the number of open server-sent event streams and WebSocket connections.
+	Streams int64 `json:"streams"`
+	// Panics is the number of panics recovered by HandlerFunc and RecoveryMiddleware.
+	Panics uint64 `json:"panics"`
+	// Templates holds the successful Context.Render calls by template and layout, sorted.
+	Templates []TemplateStats `json:"templates"`
+	// TemplateCache counts the template lookups of Context.Render served from the parsed
+	// template cache. It stays zero with TemplateOptions.Debug, which disables the cache.
+	TemplateCache TemplateCacheStats `json:"template_cache"`
+	// RenderCache counts the Context.Render calls with RenderOpt.Cache served from the render
+	// cache, and the ones rendered again.
+	RenderCache TemplateCacheStats `json:"render_cache"`
+	// Connections holds the connection counters when Options.TrackConnections is set.
+	Connections *ConnStats `json:"connections,omitempty"`
+}
+
+// TemplateStats are the render counters of a template in a layout. It is encoded in JSON with
+// the duration in milliseconds.
+type TemplateStats struct {
+	Template string
+	// Layout is the layout the template was rendered in, "" for none.
+	Layout  string
+	Renders uint64
+	// Duration is the total time spent executing the template.
+	Duration time.Duration
+	// Bytes is the total size of the output.
+	Bytes uint64
+}
+
+func (t TemplateStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Template string  `json:"template"`
+		Layout   string  `json:"layout"`
+		Renders  uint64  `json:"renders"`
+		Duration float64 `json:"duration_ms"`
+		Bytes    uint64  `json:"bytes"`
+	}{t.Template, t.Layout, t.Renders, float64(t.Duration.Microseconds()) / 1000, t.Bytes})
+}
+
+// TemplateCacheStats counts the lookups of the parsed template cache.
+type TemplateCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// LatencyStats are request latency percentiles over a window of recent requests. It is
+// encoded in JSON with the durations in milliseconds.
+type LatencyStats struct {
+	// Samples is the number of requests in the window.
+	Samples int
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+}
+
+func (l LatencyStats) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return json.Marshal(struct {
+		Samples int     `json:"samples"`
+		P50     float64 `json:"p50_ms"`
+		P95     float64 `json:"p95_ms"`
+		P99     float64 `json:"p99_ms"`
+	}{l.Samples, ms(l.P50), ms(l.P95), ms(l.P99)})
+}
+
+// serverStats holds the counters of a server. Every field is updated atomically.
+type serverStats struct {
+	requests atomic.Uint64
+	// classes is indexed by status/100, 0 counts invalid codes
+	classes  [6]atomic.Uint64
+	inFlight atomic.Int64
+	bytes    atomic.Uint64
+	streams  atomic.Int64
+	panics   atomic.Uint64
+
+	// templates maps renderKeys to their *templateCounters
+	templates   sync.Map
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	renderHits  atomic.Uint64
+	renderMiss  atomic.Uint64
+
+	// latencies is a ring of the last statsWindow durations; next counts the writes
+	latencies [statsWindow]atomic.Int64
+	next      atomic.Uint64
+}
+
+// Stats returns the request counters of the server. They are zero when Options.DisableStats
+// is set.
+func (s *Server) Stats() ServerStats {
+	var stats ServerStats
+	if s.stats != nil {
+		stats = s.stats.snapshot()
+	}
+	if s.conns != nil {
+		conns := s.conns.snapshot()
+		stats.Connections = &conns
+	}
+	return stats
+}
+
+func (st *serverStats) snapshot() ServerStats {
+	stats := ServerStats{
+		Requests:      st.requests.Load(),
+		StatusClasses: make(map[string]uint64, 5),
+		InFlight:      st.inFlight.Load(),
+		BytesWritten:  st.bytes.Load(),
+		Streams:       st.streams.Load(),
+		Panics:        st.panics.Load(),
+		TemplateCache: TemplateCacheStats{Hits: st.cacheHits.Load(), Misses: st.cacheMisses.Load()},
+		RenderCache:   TemplateCacheStats{Hits: st.renderHits.Load(), Misses: st.renderMiss.Load()},
+	}
+	for class := 1; class <= 5; class++ {
+		stats.StatusClasses[string(rune('0'+class))+"xx"] = st.classes[class].Load()
+	}
+
+	st.templates.Range(func(key, counters any) bool {
+		stats.Templates = append(stats.Templates, counters.(*templateCounters).snapshot(key.(renderKey)))
+		return true
+	})
+	slices.SortFunc(stats.Templates, func(a, b TemplateStats) int {
+		return cmp.Or(cmp.Compare(a.Template, b.Template), cmp.Compare(a.Layout, b.Layout))
+	})
+
+	n := min(st.next.Load(), statsWindow)
+	if n == 0 {
+		return stats
+	}
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = time.Duration(st.latencies[i].Load())
+	}
+	slices.Sort(samples)
+	percentile := func(p int) time.Duration {
+		return samples[(len(samples)*p+99)/100-1]
+	}
+	stats.Latency = LatencyStats{Samples: len(samples), P50: percentile(50), P95: percentile(95), P99: percentile(99)}
+	return stats
+}
+
+// begin counts a request in flight and returns w wrapped to record its response. done must be
+// called once the request is served.
+func (st *serverStats) begin(w http.ResponseWriter, r *http.Request) (*statsWriter, func()) {
+	start := time.Now()
+	st.inFlight.Add(1)
+	sw := &statsWriter{ResponseWriter: w, stats: st}
+	if isWebSocketUpgrade(r) {
+		sw.stream = true
+		st.streams.Add(1)
+	}
+
+	return sw, func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		class := status / 100
+		if class < 1 || class > 5 {
+			class = 0
+		}
+
+		st.requests.Add(1)
+		st.classes[class].Add(1)
+		st.latencies[(st.next.Add(1)-1)%statsWindow].Store(int64(time.Since(start)))
+		if sw.stream {
+			st.streams.Add(-1)
+		}
+		st.inFlight.Add(-1)
+	}
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// statsWriter records the status and size of a response, and whether it is an event stream.
+type statsWriter struct {
+	http.ResponseWriter
+	stats  *serverStats
+	status int
+	stream bool
+}
+
+func (w *statsWriter) WriteHeader(code int) {
+	if w.status == 0 && (code < 100 || code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		if !w.stream && strings.HasPrefix(w.Header().Get(HeaderContentType), "text/event-stream") {
+			w.stream = true
+			w.stats.streams.Add(1)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.stats.bytes.Add(uint64(n))
+	return n, err
+}
+
+// Flush and Hijack keep the writer an http.Flusher and an http.Hijacker for handlers asserting
+// them, e.g. for server-sent events and WebSocket upgrades.
+func (w *statsWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *statsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// renderKey labels the render counters of a template in a layout.
+type renderKey struct {
+	name, layout string
+}
+
+// templateCounters are the render counters of a template in a layout.
+type templateCounters struct {
+	renders atomic.Uint64
+	nanos   atomic.Int64
+	bytes   atomic.Uint64
+}
+
+func (tc *templateCounters) snapshot(key renderKey) TemplateStats {
+	return TemplateStats{
+		Template: key.name,
+		Layout:   key.layout,
+		Renders:  tc.renders.Load(),
+		Duration: time.Duration(tc.nanos.Load()),
+		Bytes:    tc.bytes.Load(),
+	}
+}
+
+// recordRender counts a successful render of opt, which took d and produced size bytes, and
+// warns about it when it is slower than Options.SlowRenderThreshold. Both are off with
+// Options.DisableStats.
+func (s *Server) recordRender(r *http.Request, opt RenderOpt, cached bool, d time.Duration, size int) {
+	st := s.stats
+	if st == nil {
+		return
+	}
+
+	key := renderKey{name: opt.Template, layout: s.renderLayout(opt)}
+	counters, ok := st.templates.Load(key)
+	if !ok {
+		counters, _ = st.templates.LoadOrStore(key, new(templateCounters))
+	}
+	tc := counters.(*templateCounters)
+	tc.renders.Add(1)
+	tc.nanos.Add(int64(d))
+	tc.bytes.Add(uint64(size))
+
+	// only *Templates reports its cache
+	if tr, ok := s.renderer.(templatesRenderer); ok && !tr.t.opts.Debug {
+		if cached {
+			st.cacheHits.Add(1)
+		} else {
+			st.cacheMisses.Add(1)
+		}
+	}
+
+	if s.slowRender > 0 && d > s.slowRender {
+		requestLogger(r).Warn("slow template render", "template", key.name, "layout", key.layout, "duration", d, "bytes", size)
+	}
+}
+
+// recordRenderCache counts a lookup of the render cache.
+func (s *Server) recordRenderCache(hit bool) {
+	if st := s.stats; st != nil {
+		if hit {
+			st.renderHits.Add(1)
+		} else {
+			st.renderMiss.Add(1)
+		}
+	}
+}
+
+// withStats serves the stats endpoint at path and passes every other request to next. Like the
+// health endpoint, it runs before the session and server middleware and isn't counted.
+func withStats(path string, s *Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, ContentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(s.Stats())
+	})
+}
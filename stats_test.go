@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Stats(t *testing.T) {
+	srv, err := Init(Options{StatsPath: "/stats"})
+	require.NoError(t, err)
+
+	streamOpen, streamDone := make(chan struct{}), make(chan struct{})
+	srv.HandleFunc("/status/{code}", func(ctx Context) error {
+		code, _ := strconv.Atoi(ctx.UrlParam("code"))
+		return ctx.String(code, "body")
+	})
+	srv.HandleFunc("/panic", func(ctx Context) error {
+		panic("boom")
+	})
+	srv.HandleFunc("/events", func(ctx Context) error {
+		ctx.SetHeader(HeaderContentType, "text/event-stream")
+		ctx.Response().WriteHeader(http.StatusOK)
+		close(streamOpen)
+		<-streamDone
+		return nil
+	})
+	require.NoError(t, srv.Route())
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	const workers, perWorker = 16, 80
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				switch (w + i) % 5 {
+				case 0:
+					serve("/panic")
+				case 1:
+					serve("/status/404")
+				default:
+					serve("/status/200")
+				}
+				// snapshots race with the writers
+				if i%10 == 0 {
+					srv.Stats()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := srv.Stats()
+	assert.EqualValues(t, workers*perWorker, stats.Requests)
+	assert.Equal(t, map[string]uint64{
+		"1xx": 0,
+		"2xx": workers * perWorker * 3 / 5,
+		"3xx": 0,
+		"4xx": workers * perWorker / 5,
+		"5xx": workers * perWorker / 5,
+	}, stats.StatusClasses)
+	assert.EqualValues(t, workers*perWorker/5, stats.Panics)
+	assert.Zero(t, stats.InFlight)
+	assert.Zero(t, stats.Streams)
+	panicBody := len(http.StatusText(http.StatusInternalServerError) + "\n")
+	assert.EqualValues(t, workers*perWorker*4/5*len("body")+workers*perWorker/5*panicBody, stats.BytesWritten)
+	assert.Equal(t, statsWindow, stats.Latency.Samples)
+	assert.LessOrEqual(t, stats.Latency.P50, stats.Latency.P95)
+	assert.LessOrEqual(t, stats.Latency.P95, stats.Latency.P99)
+
+	go serve("/events")
+	<-streamOpen
+	stats = srv.Stats()
+	assert.EqualValues(t, 1, stats.InFlight)
+	assert.EqualValues(t, 1, stats.Streams)
+	close(streamDone)
+	require.Eventually(t, func() bool { return srv.Stats().Streams == 0 }, time.Second, time.Millisecond)
+
+	rec := serve("/stats")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.EqualValues(t, workers*perWorker+1, body["requests"], "the stats endpoint isn't counted")
+	assert.Contains(t, body["latency"], "p99_ms")
+
+	srv, err = Init(Options{DisableStats: true})
+	require.NoError(t, err)
+	srv.HandleFunc("/", func(ctx Context) error { return ctx.String(http.StatusOK, "ok") })
+	require.NoError(t, srv.Route())
+	serve("/")
+	assert.Equal(t, ServerStats{}, srv.Stats())
+}
+
+func TestServer_StatsWriterInterfaces(t *testing.T) {
+	for _, opts := range []Options{{}, {LogRequests: true, Log: slog.New(slog.NewTextHandler(io.Discard, nil))}} {
+		srv, err := Init(opts)
+		require.NoError(t, err)
+		srv.Handle("/probe", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, flusher := w.(http.Flusher)
+			_, hijacker := w.(http.Hijacker)
+			fmt.Fprintf(w, "flusher=%t hijacker=%t", flusher, hijacker)
+		}))
+		srv.HandleFunc("/upgrade", func(ctx Context) error {
+			conn, buf, err := http.NewResponseController(ctx.Response()).Hijack()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			return buf.Flush()
+		})
+		require.NoError(t, srv.Route())
+		ts := httptest.NewServer(srv.HTTPServer.Handler)
+
+		res, err := http.Get(ts.URL + "/probe")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "flusher=true hijacker=true", string(body), "log requests: %t", opts.LogRequests)
+
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/upgrade", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "test")
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+		ts.Close()
+	}
+}
+
+func TestServerStats_Latency(t *testing.T) {
+	var st serverStats
+	for i := 1; i <= 100; i++ {
+		_, done := st.begin(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		done()
+		st.latencies[i-1].Store(int64(i) * int64(time.Millisecond))
+	}
+
+	assert.Equal(t, LatencyStats{Samples: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond},
+		st.snapshot().Latency)
+
+	out, err := json.Marshal(st.snapshot().Latency)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"samples":100,"p50_ms":50,"p95_ms":95,"p99_ms":99}`, string(out))
+}
+
+func TestServer_TrackConnections(t *testing.T) {
+	var userStates atomic.Int32
+	srv, err := Init(Options{
+		TrackConnections: true,
+		StatsPath:        "/stats",
+		ConnState:        func(net.Conn, http.ConnState) { userStates.Add(1) },
+	})
+	require.NoError(t, err)
+	srv.HandleFunc("/", func(ctx Context) error { return ctx.String(http.StatusOK, "ok") })
+	require.NoError(t, srv.Route())
+
+	tSrv := httptest.NewUnstartedServer(srv.HTTPServer.Handler)
+	tSrv.Config.ConnState = srv.HTTPServer.ConnState
+	tSrv.Start()
+	defer tSrv.Close()
+
+	client := tSrv.Client()
+	resp, err := client.Get(tSrv.URL + "/")
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	require.Eventually(t, func() bool {
+		return *srv.Stats().Connections == ConnStats{Idle: 1}
+	}, time.Second, time.Millisecond, "the keep-alive connection is idle")
+
+	client.CloseIdleConnections()
+	require.Eventually(t, func() bool {
+		return *srv.Stats().Connections == ConnStats{Closed: 1}
+	}, time.Second, time.Millisecond)
+	assert.EqualValues(t, 4, userStates.Load(), "new, active, idle and closed reach the user's callback")
+
+	rec := httptest.NewRecorder()
+	srv.HTTPServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Contains(t, rec.Body.String(), `"connections":{"new":0,"active":0,"idle":0,"hijacked":0,"closed":1}`)
+
+	srv, err = Init(Options{})
+	require.NoError(t, err)
+	assert.Nil(t, srv.Stats().Connections)
+	assert.Nil(t, srv.HTTPServer.ConnState)
+
+	userStates.Store(0)
+	srv, err = Init(Options{ConnState: func(net.Conn, http.ConnState) { userStates.Add(1) }})
+	require.NoError(t, err)
+	srv.HTTPServer.ConnState(nil, http.StateNew)
+	assert.EqualValues(t, 1, userStates.Load(), "set without the tracking too")
+}
+
+func TestConnTracker_Allocs(t *testing.T) {
+	ct := newConnTracker(nil, false)
+	c, other := net.Pipe()
+	defer c.Close()
+	defer other.Close()
+
+	ct.connState(c, http.StateNew)
+	allocs := testing.AllocsPerRun(100, func() {
+		ct.connState(c, http.StateActive)
+		ct.connState(c, http.StateIdle)
+	})
+	assert.Zero(t, allocs)
+	assert.Equal(t, ConnStats{Idle: 1}, ct.snapshot())
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// SVGSource is a directory of SVG files for the svg template function, read from FS when set,
+// otherwise from the Root directory.
+type SVGSource struct {
+	Root string
+	FS   fs.FS
+}
+
+// svgIcons inlines the SVG files of TemplateOptions.PathToSVG and SVGSources.
+type svgIcons struct {
+	roots []fs.FS
+	debug bool
+
+	mu sync.RWMutex
+	// cache holds the content of the files by name, "" for the names no source has
+	cache map[string]string
+	// missing holds the names already logged as not found
+	missing sync.Map
+}
+
+// initSVG adds the svg template function when SVG files are configured.
+func (t *Templates) initSVG() error {
+	var roots []fs.FS
+	if t.opts.PathToSVG != "" {
+		roots = append(roots, os.DirFS(t.opts.PathToSVG))
+	}
+	for _, src := range t.opts.SVGSources {
+		fsys, err := sourceFS(src.Root, src.FS)
+		if err != nil {
+			return fmt.Errorf("%w (svg source)", err)
+		}
+		roots = append(roots, fsys)
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+
+	icons := &svgIcons{roots: roots, debug: t.opts.Debug, cache: make(map[string]string)}
+	t.addFunc("svg", icons.render)
+	return nil
+}
+
+// render returns the SVG file name, ".svg" being optional, from the first source that has it,
+// with attrs merged into its root element. attrs are attribute name and value pairs; "size"
+// sets both width and height, and "class" adds to the classes of the file:
+//
+//	{{svg "icons/check" "class" "icon" "size" "16" "aria-label" "Done"}}
+//
+// An unknown name renders nothing, or an HTML comment in Debug, and is logged once.
+func (s *svgIcons) render(name string, attrs ...string) (template.HTML, error) {
+	if len(attrs)%2 != 0 {
+		return "", fmt.Errorf("svg %q: attributes must be name and value pairs", name)
+	}
+
+	src, ok, err := s.load(name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		if _, logged := s.missing.LoadOrStore(name, true); !logged {
+			appLog.Warn("svg not found", "name", name)
+		}
+		if s.debug {
+			return template.HTML("<!-- svg " + html.EscapeString(name) + " not found -->"), nil
+		}
+		return "", nil
+	}
+	if len(attrs) == 0 {
+		return template.HTML(src), nil
+	}
+	return template.HTML(mergeSVGAttrs(src, attrs)), nil
+}
+
+// load returns the normalized content of the SVG file name and whether a source has it, cached
+// unless in Debug. Errors reading the file other than it not existing are returned.
+func (s *svgIcons) load(name string) (string, bool, error) {
+	if !s.debug {
+		s.mu.RLock()
+		src, ok := s.cache[name]
+		s.mu.RUnlock()
+		if ok {
+			return src, src != "", nil
+		}
+	}
+
+	file := strings.TrimPrefix(name, "/")
+	if !strings.HasSuffix(file, ".svg") {
+		file += ".svg"
+	}
+	if !fs.ValidPath(file) {
+		return "", false, nil
+	}
+
+	var src string
+	for _, root := range s.roots {
+		data, err := fs.ReadFile(root, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("svg %q: %w", name, err)
+		}
+		if src, err = normalizeSVG(data); err != nil {
+			return "", false, fmt.Errorf("svg %q: %w", name, err)
+		}
+		break
+	}
+	if !s.debug {
+		s.mu.Lock()
+		s.cache[name] = src
+		s.mu.Unlock()
+	}
+	return src, src != "", nil
+}
+
+// normalizeSVG drops what precedes the root svg element, such as the XML declaration, comments
+// and doctype, and the surrounding whitespace.
+func normalizeSVG(data []byte) (string, error) {
+	src := string(data)
+	start := strings.Index(src, "<svg")
+	if start < 0 {
+		return "", errors.New("no svg element")
+	}
+	return strings.TrimSpace(src[start:]), nil
+}
+
+var (
+	svgAttrName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:.-]*$`)
+	svgAttr     = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+)
+
+// mergeSVGAttrs sets attrs on the root element of src, which starts with "<svg". Invalid
+// attribute names are skipped.
+func mergeSVGAttrs(src string, attrs []string) string {
+	end := svgTagEnd(src)
+	if end < 0 {
+		return src
+	}
+	tag := strings.TrimSpace(src[len("<svg"):end])
+	selfClosing := strings.HasSuffix(tag, "/")
+	tag = strings.TrimSuffix(tag, "/")
+
+	type attr struct{ name, value string }
+	var list []attr
+	for _, m := range svgAttr.FindAllStringSubmatch(tag, -1) {
+		list = append(list, attr{name: m[1], value: m[2]})
+	}
+	set := func(name, value string) {
+		quoted := `"` + html.EscapeString(value) + `"`
+		for i := range list {
+			if strings.EqualFold(list[i].name, name) {
+				if name == "class" {
+					quoted = `"` + strings.TrimSpace(strings.Trim(list[i].value, `"'`)+" "+html.EscapeString(value)) + `"`
+				}
+				list[i].value = quoted
+				return
+			}
+		}
+		list = append(list, attr{name: name, value: quoted})
+	}
+
+	for i := 0; i < len(attrs); i += 2 {
+		name, value := attrs[i], attrs[i+1]
+		switch {
+		case name == "size":
+			set("width", value)
+			set("height", value)
+		case svgAttrName.MatchString(name):
+			set(name, value)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("<svg")
+	for _, a := range list {
+		b.WriteString(" " + a.name)
+		if a.value != "" {
+			b.WriteString("=" + a.value)
+		}
+	}
+	if selfClosing {
+		b.WriteString("/")
+	}
+	b.WriteString(src[end:])
+	return b.String()
+}
+
+// svgTagEnd returns the index of the ">" closing the start tag src begins with, skipping
+// quoted attribute values.
+func svgTagEnd(src string) int {
+	var quote byte
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplates_SVG(t *testing.T) {
+	defer func(l *slog.Logger) { appLog = l }(appLog)
+	var logs bytes.Buffer
+	appLog = slog.New(slog.NewTextHandler(&logs, nil))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logo.svg"), []byte(`<?xml version="1.0"?>
+<!-- art -->
+<svg viewBox="0 0 10 10" class="logo"><path d="M0 0"/></svg>
+`), 0o644))
+	icons := fstest.MapFS{
+		"check.svg": {Data: []byte(`<svg viewBox="0 0 24 24" width='24'><path d="M1 1"/></svg>`)},
+		"logo.svg":  {Data: []byte(`<svg id="shadowed"/>`)},
+	}
+	pages := fstest.MapFS{
+		"plain.tmpl":   {Data: []byte(`{{svg "logo"}}`)},
+		"attrs.tmpl":   {Data: []byte(`{{svg "check.svg" "class" "icon" "size" "16" "aria-label" "Done & dusted" "on click" "x"}}`)},
+		"merge.tmpl":   {Data: []byte(`{{svg "logo" "class" "big"}}`)},
+		"missing.tmpl": {Data: []byte(`[{{svg "nope"}}{{svg "nope"}}]`)},
+	}
+
+	tmpl, err := InitTemplates(TemplateOptions{FS: pages, PathToSVG: dir, SVGSources: []SVGSource{{FS: icons}}})
+	require.NoError(t, err)
+	render := func(name string) string {
+		var buf bytes.Buffer
+		require.NoError(t, tmpl.Render(&buf, name, nil))
+		return buf.String()
+	}
+
+	assert.Equal(t, `<svg viewBox="0 0 10 10" class="logo"><path d="M0 0"/></svg>`, render("plain"), "PathToSVG comes first")
+	assert.Equal(t, `<svg viewBox="0 0 24 24" width="16" class="icon" height="16" aria-label="Done &amp; dusted"><path d="M1 1"/></svg>`, render("attrs"))
+	assert.Equal(t, `<svg viewBox="0 0 10 10" class="logo big"><path d="M0 0"/></svg>`, render("merge"))
+	assert.Equal(t, `[]`, render("missing"))
+	assert.Equal(t, 1, strings.Count(logs.String(), `msg="svg not found" name=nope`))
+
+	opens := &openCountFS{FS: icons}
+	tmpl, err = InitTemplates(TemplateOptions{FS: pages, SVGSources: []SVGSource{{FS: opens}}})
+	require.NoError(t, err)
+	render("missing")
+	render("missing")
+	assert.Equal(t, 1, opens.opens, "the missing name is cached")
+
+	opens = &openCountFS{FS: icons, err: fs.ErrPermission}
+	tmpl, err = InitTemplates(TemplateOptions{FS: pages, SVGSources: []SVGSource{{FS: opens}}})
+	require.NoError(t, err)
+	err = tmpl.Render(io.Discard, "plain", nil)
+	assert.ErrorIs(t, err, fs.ErrPermission, "only a file that doesn't exist is not found")
+
+	tmpl, err = InitTemplates(TemplateOptions{FS: pages, Debug: true, SVGSources: []SVGSource{{FS: icons}}})
+	require.NoError(t, err)
+	assert.Equal(t, `[<!-- svg nope not found --><!-- svg nope not found -->]`, render("missing"))
+	assert.Equal(t, `<svg id="shadowed"/>`, render("plain"))
+	assert.Equal(t, `<svg id="shadowed" class="big"/>`, render("merge"))
+}
+
+// openCountFS counts the files opened in FS, failing with err when set.
+type openCountFS struct {
+	fs.FS
+	opens int
+	err   error
+}
+
+func (f *openCountFS) Open(name string) (fs.File, error) {
+	f.opens++
+	if f.err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: f.err}
+	}
+	return f.FS.Open(name)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// TraceContext identifies the distributed trace a request is part of. TraceID is 32 and SpanID 16
+// lowercase hex characters.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// TraceFromContext returns the trace context of the request ctx belongs to. The server reads it
+// from the W3C traceparent header, or the B3 headers when there is none; invalid headers are
+// ignored.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	info, ok := FromContext(ctx, requestInfoKey)
+	if !ok || info.trace.TraceID == "" {
+		return TraceContext{}, false
+	}
+	return info.trace, true
+}
+
+// SetTrace replaces the trace context of r, e.g. by tracing middleware that starts a span for
+// it. Loggers scoped to the request before the call keep the previous IDs.
+func SetTrace(r *http.Request, tc TraceContext) {
+	if info, ok := FromContext(r.Context(), requestInfoKey); ok {
+		info.trace = tc
+	}
+}
+
+// traceLogAttrs returns the trace and span IDs of ctx as log attributes, if it has them.
+func traceLogAttrs(ctx context.Context) []any {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return []any{"trace_id", tc.TraceID, "span_id", tc.SpanID}
+}
+
+// traceFromHeaders reads the trace context propagated with h.
+func traceFromHeaders(h http.Header) (TraceContext, bool) {
+	if tp := h.Get("Traceparent"); tp != "" {
+		return parseTraceparent(tp)
+	}
+	if b3 := h.Get("B3"); b3 != "" {
+		traceID, rest, _ := strings.Cut(b3, "-")
+		spanID, _, _ := strings.Cut(rest, "-")
+		return newB3Trace(traceID, spanID)
+	}
+	return newB3Trace(h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId"))
+}
+
+// parseTraceparent parses a W3C traceparent header: version-traceid-parentid-flags. Versions
+// after 00 may append fields, which are ignored.
+func parseTraceparent(h string) (TraceContext, bool) {
+	if len(h) < 55 || len(h) > 55 && (h[:2] == "00" || h[55] != '-') {
+		return TraceContext{}, false
+	}
+	if h[2] != '-' || h[35] != '-' || h[52] != '-' || !isLowerHex(h[:2]) || h[:2] == "ff" || !isLowerHex(h[53:55]) {
+		return TraceContext{}, false
+	}
+
+	tc := TraceContext{TraceID: h[3:35], SpanID: h[36:52]}
+	if !validTraceID(tc.TraceID) || !validTraceID(tc.SpanID) {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// newB3Trace validates B3 IDs. 64-bit trace IDs are left-padded to 128 bits.
+func newB3Trace(traceID, spanID string) (TraceContext, bool) {
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || !validTraceID(traceID) || !validTraceID(spanID) {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: traceID, SpanID: spanID}, true
+}
+
+// validTraceID reports whether id is lowercase hex and not all zeros.
+func validTraceID(id string) bool {
+	return isLowerHex(id) && strings.Trim(id, "0") != ""
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
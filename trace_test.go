@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceFromHeaders(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    TraceContext
+		ok      bool
+	}{
+		{"traceparent", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"}, TraceContext{traceID, spanID}, true},
+		{"future version", map[string]string{"traceparent": "01-" + traceID + "-" + spanID + "-00-extra"}, TraceContext{traceID, spanID}, true},
+		{"version 00 with extra", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01-extra"}, TraceContext{}, false},
+		{"invalid version", map[string]string{"traceparent": "ff-" + traceID + "-" + spanID + "-01"}, TraceContext{}, false},
+		{"uppercase", map[string]string{"traceparent": "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01"}, TraceContext{}, false},
+		{"zero trace", map[string]string{"traceparent": "00-00000000000000000000000000000000-" + spanID + "-01"}, TraceContext{}, false},
+		{"zero span", map[string]string{"traceparent": "00-" + traceID + "-0000000000000000-01"}, TraceContext{}, false},
+		{"short", map[string]string{"traceparent": "00-" + traceID + "-" + spanID}, TraceContext{}, false},
+		{"invalid traceparent wins over b3", map[string]string{"traceparent": "garbage", "b3": traceID + "-" + spanID}, TraceContext{}, false},
+		{"b3 single", map[string]string{"b3": traceID + "-" + spanID + "-1"}, TraceContext{traceID, spanID}, true},
+		{"b3 64-bit", map[string]string{"b3": "a3ce929d0e0e4736-" + spanID}, TraceContext{"0000000000000000a3ce929d0e0e4736", spanID}, true},
+		{"b3 deny", map[string]string{"b3": "0"}, TraceContext{}, false},
+		{"b3 multi", map[string]string{"X-B3-TraceId": traceID, "X-B3-SpanId": spanID}, TraceContext{traceID, spanID}, true},
+		{"none", nil, TraceContext{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got, ok := traceFromHeaders(h)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestServer_TraceLogAttrs(t *testing.T) {
+	logs, accessLog := new(bytes.Buffer), new(bytes.Buffer)
+	srv, err := Init(Options{
+		Log:        slog.New(slog.NewJSONHandler(logs, nil)),
+		Middleware: []Middleware{RequestIDMiddleware},
+		AccessLog:  &AccessLogOptions{Format: AccessLogJSON, Output: accessLog},
+	})
+	require.NoError(t, err)
+	var trace TraceContext
+	srv.HandleFunc("/", func(ctx Context) error {
+		trace, _ = TraceFromContext(ctx.Context())
+		ctx.Log().Info("handled")
+		return ctx.String(http.StatusOK, "ok")
+	})
+	require.NoError(t, srv.Route())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.HTTPServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, TraceContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}, trace)
+
+	for _, out := range []*bytes.Buffer{logs, accessLog} {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entry["trace_id"])
+		assert.Equal(t, "00f067aa0ba902b7", entry["span_id"])
+	}
+
+	logs.Reset()
+	accessLog.Reset()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "not-a-trace")
+	srv.HTTPServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, trace)
+	assert.NotContains(t, logs.String(), "trace_id")
+	assert.NotContains(t, accessLog.String(), "trace_id")
+}
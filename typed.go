@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+)
+
+// Handle2 adapts a typed handler to a HandlerFunc, to register with Handle, HandleFunc or inside
+// a Group. The request is bound into an In: the query string of GET, HEAD and DELETE requests
+// with `query` tags, the url-encoded or multipart body with `form` tags, and any other body as
+// JSON. A struct{} In binds nothing. fn's result is written as the Data of a 200 JSONResponse.
+//
+// Binding failures are 400 HTTPErrors, and the errors fn returns go through the error handling
+// of HandlerFunc, so return an HTTPError for anything but a 500.
+func Handle2[In, Out any](fn func(ctx Context, in In) (Out, error)) HandlerFunc {
+	return func(ctx Context) error {
+		var in In
+		if err := bindRequest(ctx, &in); err != nil {
+			return err
+		}
+
+		out, err := fn(ctx, in)
+		if err != nil {
+			return err
+		}
+		return ctx.JSON(http.StatusOK, JSONResponse{Status: http.StatusOK, Data: out})
+	}
+}
+
+// bindRequest binds the request into the struct dst points to, as described for Handle2.
+func bindRequest(ctx Context, dst any) error {
+	if t := reflect.TypeOf(dst).Elem(); t.Kind() == reflect.Struct && t.NumField() == 0 {
+		return nil
+	}
+
+	r := ctx.Request()
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		err = ctx.BindQuery(dst)
+	default:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+		if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+			err = ctx.BindForm(dst)
+		} else {
+			err = ctx.BindJSON(dst)
+		}
+	}
+
+	// query and form binding leave the status to the caller
+	var httpErr *HTTPError
+	var bindErr *BindError
+	if !errors.As(err, &httpErr) && errors.As(err, &bindErr) {
+		return NewHTTPError(http.StatusBadRequest, err, fmt.Sprintf("invalid value for field %q", bindErr.Field))
+	}
+	return err
+}